@@ -1,13 +1,14 @@
 package accounter
 
 import (
+	"context"
 	"encoding/hex"
-	"fmt"
-	"log"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/btcsuite/btcutil"
+	"github.com/pkg/errors"
 	"github.com/square/beancounter/reporter"
 
 	"github.com/square/beancounter/backend"
@@ -30,20 +31,41 @@ type Accounter struct {
 
 	addresses    map[string]address     // map of address script => (Address, txHashes)
 	transactions map[string]transaction // map of txhash => transaction
+	unconfirmed  map[string]transaction // map of txhash => transaction, for transactions which haven't been mined
+	aboveHeight  map[string]transaction // map of txhash => transaction, for transactions mined after blockHeight
 
 	backend   backend.Backend
 	deriver   *deriver.AddressDeriver
 	lookahead uint32
 
-	countMu            sync.Mutex // protects lastAddresses, derivedAddrCount and processedAddrCount
+	countMu            sync.Mutex // protects lastAddresses, the counters and txQueue
 	lastAddresses      [2]uint32
 	derivedAddrCount   uint32
 	processedAddrCount uint32
 	seenTxCount        uint32
 	processedTxCount   uint32
+	txQueue            []string // transactions which recvWork found and sendWork needs to request
+
+	requestedTxs map[string]struct{} // transactions which have been queued. Only used by recvWork.
+	workReady    chan struct{}       // wakes up sendWork when there's more work
 
 	addrResponses <-chan *backend.AddrResponse
 	txResponses   <-chan *backend.TxResponse
+	deriveErrors  chan error // errors from sendWork
+
+	findings []Finding
+	immature uint64 // coinbase outputs which can't be spent yet
+
+	checkpointPath     string
+	checkpointInterval time.Duration
+	resumed            map[[2]uint32]struct{} // (change, index) of the addresses restored by Resume
+
+	snapshot          *Snapshot           // snapshot we are rolling forward from, if any
+	snapshotTxs       map[string]struct{} // transactions loaded from the snapshot
+	snapshotEnabled   bool
+	anchorEnabled     bool
+	anchorHash        string // hash the block at blockHeight must have, if set
+	blockHashAtHeight string // hash of the block at blockHeight, only fetched for snapshots and anchors
 }
 
 type address struct {
@@ -52,10 +74,12 @@ type address struct {
 }
 
 type transaction struct {
-	height int64
-	hex    string
-	vin    []vin
-	vout   []vout
+	height   int64
+	hex      string
+	vin      []vin
+	vout     []vout
+	coinbase bool
+	verified bool // inclusion was checked with a merkle proof
 }
 
 type vin struct {
@@ -70,8 +94,8 @@ type vout struct {
 	spentBy *string // txhash of spending transaction; nil for unspent transactions.
 }
 
-// New instantiates a new Accounter.
-// TODO: find a better way to pass options to the NewCounter. Maybe thru a config or functional option params?
+// New instantiates a new Accounter. Programs which embed beancounter should use package audit,
+// which wraps the Accounter with functional options.
 func New(b backend.Backend, addressDeriver *deriver.AddressDeriver, lookahead uint32, blockHeight uint32) *Accounter {
 	a := &Accounter{
 		blockHeight:   blockHeight,
@@ -82,45 +106,158 @@ func New(b backend.Backend, addressDeriver *deriver.AddressDeriver, lookahead ui
 	}
 	a.addresses = make(map[string]address)
 	a.transactions = make(map[string]transaction)
+	a.unconfirmed = make(map[string]transaction)
+	a.aboveHeight = make(map[string]transaction)
+	a.requestedTxs = make(map[string]struct{})
 	a.addrResponses = b.AddrResponses()
 	a.txResponses = b.TxResponses()
+	a.deriveErrors = make(chan error, 1)
+	a.workReady = make(chan struct{}, 1)
 	return a
 }
 
-func (a *Accounter) ComputeBalance() uint64 {
+// ComputeBalance fetches all the transactions and returns the wallet's spendable balance. See
+// errors.go for the errors it can return.
+//
+// Coinbase outputs which haven't matured at the audit height aren't spendable yet. They are
+// excluded from the balance and reported by Immature().
+//
+// If ctx is canceled (or times out), the backend is torn down and an IncompleteError is returned.
+func (a *Accounter) ComputeBalance(ctx context.Context) (uint64, error) {
+	// Check the blocks we need for snapshots
+	if err := a.fetchBlocks(ctx); err != nil {
+		a.backend.Finish()
+		return 0, err
+	}
+
 	// Fetch all the transactions
-	a.fetchTransactions()
+	if err := a.fetchTransactions(ctx); err != nil {
+		return 0, err
+	}
 
 	// Process the data
-	a.processTransactions()
+	if err := a.processTransactions(); err != nil {
+		return 0, err
+	}
 
 	// Compute the balance
-	return a.balance()
+	balance, err := a.balance()
+	if err != nil {
+		return 0, err
+	}
+	a.immature = a.immatureBalance()
+	balance -= a.immature
+
+	// Look for anything unusual
+	a.findings = a.detectAnomalies()
+
+	return balance, nil
+}
+
+// EnableAnchor anchors the audit to the block at the audit height: its hash is fetched before the
+// scan and again once all the transactions have been fetched. If the chain was reorganized in
+// between, ComputeBalance returns a ReorgError. If hash isn't empty, the block at the audit height
+// must also have this hash.
+func (a *Accounter) EnableAnchor(hash string) {
+	a.anchorEnabled = true
+	a.anchorHash = hash
+}
+
+// BlockHash returns the hash of the block at the audit height. It's only known after
+// ComputeBalance succeeded, with EnableAnchor or EnableSnapshot.
+func (a *Accounter) BlockHash() string {
+	return a.blockHashAtHeight
+}
+
+// fetchBlocks checks that the snapshot we are rolling forward from is still valid and fetches the
+// hash of the block at the audit height, so that we can write a new snapshot or detect a reorg.
+func (a *Accounter) fetchBlocks(ctx context.Context) error {
+	if a.snapshot != nil {
+		if err := a.checkReorg(ctx); err != nil {
+			return err
+		}
+	}
+	if a.snapshotEnabled || a.anchorEnabled {
+		hash, err := a.blockHash(ctx, a.blockHeight)
+		if err != nil {
+			return err
+		}
+		if a.anchorHash != "" && hash != a.anchorHash {
+			return &ReorgError{Height: a.blockHeight, Expected: a.anchorHash, Actual: hash}
+		}
+		a.blockHashAtHeight = hash
+	}
+	return nil
+}
+
+// checkAnchor fetches the block at the audit height again, after the scan.
+func (a *Accounter) checkAnchor(ctx context.Context) error {
+	hash, err := a.blockHash(ctx, a.blockHeight)
+	if err != nil {
+		return err
+	}
+	if hash != a.blockHashAtHeight {
+		return &ReorgError{Height: a.blockHeight, Expected: a.blockHashAtHeight, Actual: hash}
+	}
+	return nil
 }
 
 // Fetch all the transactions related to our wallet. We tally the balance after we have fetched
 // all the transactions so that we don't need to worry about receiving transactions out-of-order.
-func (a *Accounter) fetchTransactions() {
-	// send work runs forever
-	go a.sendWork()
-
-	a.recvWork()
+func (a *Accounter) fetchTransactions(ctx context.Context) error {
+	// sendWork runs until we are done receiving
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.sendWork(ctx)
+
+	err := a.recvWork(ctx)
+	if err != nil {
+		reporter.GetInstance().Logf("failed to fetch transactions: %s", err)
+		a.backend.Finish()
+		if a.checkpointPath != "" {
+			// save what we have, so that the next run can resume from here.
+			if err := a.saveCheckpoint(); err != nil {
+				reporter.GetInstance().Logf("failed to save checkpoint: %s", err)
+			}
+		}
+		return err
+	}
+	if a.anchorEnabled {
+		if err := a.checkAnchor(ctx); err != nil {
+			a.backend.Finish()
+			return err
+		}
+	}
+	if a.checkpointPath != "" {
+		// the checkpoint is useless now
+		if err := os.Remove(a.checkpointPath); err != nil && !os.IsNotExist(err) {
+			reporter.GetInstance().Logf("failed to remove checkpoint: %s", err)
+		}
+	}
 
 	reporter.GetInstance().Log("done fetching addresses; waiting to finish...")
 	a.backend.Finish()
 	reporter.GetInstance().Log("done fetching transactions")
+	return nil
 }
 
-func (a *Accounter) processTransactions() {
+func (a *Accounter) processTransactions() error {
 	for hash, tx := range a.transactions {
 		// remove transactions which are too recent
 		if tx.height > int64(a.blockHeight) {
 			reporter.GetInstance().Logf("transaction %s has height %d > BLOCK HEIGHT (%d)", hash, tx.height, a.blockHeight)
+			a.aboveHeight[hash] = tx
 			delete(a.transactions, hash)
 		}
-		// remove transactions which haven't been mined
+		// remove transactions which are already accounted for in the snapshot
+		if a.snapshot != nil && !a.isSnapshotTx(hash) && tx.height > 0 && tx.height <= int64(a.snapshot.BlockHeight) {
+			reporter.GetInstance().Logf("transaction %s has height %d <= SNAPSHOT HEIGHT (%d)", hash, tx.height, a.snapshot.BlockHeight)
+			delete(a.transactions, hash)
+		}
+		// set aside transactions which haven't been mined, they are reported separately
 		if tx.height <= 0 {
 			reporter.GetInstance().Logf("transaction %s has not been mined, yet (height=%d)", hash, tx.height)
+			a.unconfirmed[hash] = tx
 			delete(a.transactions, hash)
 		}
 	}
@@ -131,45 +268,61 @@ func (a *Accounter) processTransactions() {
 
 	// parse the transaction hex
 	for hash, tx := range a.transactions {
-		b, err := hex.DecodeString(tx.hex)
-		if err != nil {
-			fmt.Printf("failed to unhex transaction %s: %s", hash, tx.hex)
+		if a.isSnapshotTx(hash) {
+			// we only have the outputs
+			continue
 		}
-		parsedTx, err := btcutil.NewTxFromBytes(b)
+		tx, err := a.parseTransaction(hash, tx)
 		if err != nil {
-			fmt.Printf("failed to parse transaction %s: %s", hash, tx.hex)
-			continue
+			return err
 		}
-		for _, txin := range parsedTx.MsgTx().TxIn {
-			tx.vin = append(tx.vin, vin{
-				prevHash: txin.PreviousOutPoint.Hash.String(),
-				index:    txin.PreviousOutPoint.Index,
-			})
+		// ugly...
+		a.transactions[hash] = tx
+	}
+	for hash, tx := range a.unconfirmed {
+		tx, err := a.parseTransaction(hash, tx)
+		if err != nil {
+			return err
 		}
+		a.unconfirmed[hash] = tx
+	}
+	return nil
+}
 
-		for _, txout := range parsedTx.MsgTx().TxOut {
-			addr := hex.EncodeToString(txout.PkScript)
-			_, exists := a.addresses[addr]
-			tx.vout = append(tx.vout, vout{
-				value:   txout.Value,
-				address: addr,
-				ours:    exists,
-				spentBy: nil,
-			})
-		}
+// parseTransaction decodes the transaction's hex and fills vin and vout.
+func (a *Accounter) parseTransaction(hash string, tx transaction) (transaction, error) {
+	b, err := hex.DecodeString(tx.hex)
+	if err != nil {
+		return tx, &TxError{Hash: hash, Err: errors.Wrap(err, "failed to unhex transaction")}
+	}
+	parsedTx, err := btcutil.NewTxFromBytes(b)
+	if err != nil {
+		return tx, &TxError{Hash: hash, Err: errors.Wrap(err, "failed to parse transaction")}
+	}
+	tx.coinbase = isCoinbase(parsedTx.MsgTx())
+	for _, txin := range parsedTx.MsgTx().TxIn {
+		tx.vin = append(tx.vin, vin{
+			prevHash: txin.PreviousOutPoint.Hash.String(),
+			index:    txin.PreviousOutPoint.Index,
+		})
+	}
 
-		// ugly...
-		a.transactions[hash] = tx
+	for _, txout := range parsedTx.MsgTx().TxOut {
+		addr := hex.EncodeToString(txout.PkScript)
+		_, exists := a.addresses[addr]
+		tx.vout = append(tx.vout, vout{
+			value:   txout.Value,
+			address: addr,
+			ours:    exists,
+			spentBy: nil,
+		})
 	}
+	return tx, nil
 }
 
-func (a *Accounter) balance() uint64 {
+func (a *Accounter) balance() (uint64, error) {
 	balance := int64(0)
 
-	// TODO: we could check that every transaction either has an input which belongs to us or an
-	// output. Otherwise, it would not have appeared in the list. It's also a good check, given
-	// that we filter some transactions out.
-
 	// compute all credits
 	for _, tx := range a.transactions {
 		for _, txout := range tx.vout {
@@ -179,28 +332,33 @@ func (a *Accounter) balance() uint64 {
 		}
 	}
 
-	// TODO: log a warning if an address is being used multiple times. Ideally, a given address
-	// should only have one incoming and one outgoing transaction.
-
-	// TODO: log a warning if a receive address is getting change.
-
-	// TODO: log a warning if a change address is receiving funds from an address we don't own.
-
 	// compute all debits
 	for hash, tx := range a.transactions {
+		hash := hash // spentBy keeps a pointer to the hash
 		for _, txin := range tx.vin {
 			prev, exists := a.transactions[txin.prevHash]
 			if !exists {
 				continue
 			}
 			if int(txin.index) >= len(prev.vout) {
-				panic("prev index > vouts")
+				if a.isSnapshotTx(txin.prevHash) {
+					// we only know the snapshot's outputs up to the last one which is ours.
+					continue
+				}
+				return 0, &TxError{
+					Hash: hash,
+					Err:  errors.Errorf("spends %s:%d, which only has %d outputs", txin.prevHash, txin.index, len(prev.vout)),
+				}
 			}
 			if prev.vout[txin.index].ours {
 				balance -= prev.vout[txin.index].value
 				if prev.vout[txin.index].spentBy != nil {
 					// sanity check: an output can only be spent by one transaction.
-					log.Panicf("%s and %s, both spending %s", hash, *prev.vout[txin.index].spentBy, txin.prevHash)
+					return 0, &DoubleSpendError{
+						PrevHash: txin.prevHash,
+						Index:    txin.index,
+						Spenders: [2]string{hash, *prev.vout[txin.index].spentBy},
+					}
 				}
 				prev.vout[txin.index].spentBy = &hash
 			}
@@ -208,9 +366,9 @@ func (a *Accounter) balance() uint64 {
 	}
 
 	if balance < 0 {
-		panic("balance is negative")
+		return 0, ErrNegativeBalance
 	}
-	return uint64(balance)
+	return uint64(balance), nil
 }
 
 // sendWork starts the send loop that derives new addresses and sends them to a
@@ -219,31 +377,114 @@ func (a *Accounter) balance() uint64 {
 // be extended if a transaction for a given address is found. E.g.:
 // only addresses 0-99 are initially checked, but there was a transaction at
 // index 43, so now all addresses up to 142 are checked.
-func (a *Accounter) sendWork() {
+//
+// sendWork also requests the transactions which recvWork queues. Requests can block when the
+// backend is busy, which is why they happen here and not in recvWork: the backend might be
+// waiting for recvWork to consume its responses.
+func (a *Accounter) sendWork(ctx context.Context) {
 	indexes := []uint32{0, 0}
 	for {
 		for _, change := range []uint32{0, 1} {
 			lastAddr := a.getLastAddress(change)
 			for indexes[change] < lastAddr {
-				// increment the number of addresses which have been derived
-				addr := a.deriver.Derive(change, indexes[change])
+				if _, done := a.resumed[[2]uint32{change, indexes[change]}]; done {
+					// restored from a checkpoint, and already counted.
+					indexes[change]++
+					continue
+				}
+				addr, err := a.deriver.Derive(change, indexes[change])
+				if err != nil {
+					a.deriveErrors <- &DeriveError{Err: err}
+					return
+				}
+				// increment the number of addresses which have been derived. This needs to happen
+				// before the request is sent, otherwise recvWork could see the response first and
+				// miss the fact that we are done.
 				a.countMu.Lock()
 				a.derivedAddrCount++
 				a.countMu.Unlock()
-				a.backend.AddrRequest(addr)
+				if err := a.backend.AddrRequest(ctx, addr); err != nil {
+					// ctx is done
+					return
+				}
 				indexes[change]++
 			}
 		}
-		// apparently no more work for us, so we can sleep a bit
-		time.Sleep(time.Millisecond * 100)
+
+		for txHash, ok := a.popTx(); ok; txHash, ok = a.popTx() {
+			if err := a.backend.TxRequest(ctx, txHash); err != nil {
+				// ctx is done
+				return
+			}
+		}
+
+		// no more work for us, wait until recvWork finds some.
+		select {
+		case <-a.workReady:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (a *Accounter) recvWork() {
+// signalWork wakes up sendWork. Signals are coalesced: sendWork looks for all the available work
+// every time it wakes up.
+func (a *Accounter) signalWork() {
+	select {
+	case a.workReady <- struct{}{}:
+	default:
+	}
+}
+
+// pushTx queues a transaction for sendWork.
+func (a *Accounter) pushTx(txHash string) {
+	a.countMu.Lock()
+	defer a.countMu.Unlock()
+
+	a.txQueue = append(a.txQueue, txHash)
+	a.seenTxCount++
+}
+
+// popTx returns the next transaction sendWork needs to request.
+func (a *Accounter) popTx() (string, bool) {
+	a.countMu.Lock()
+	defer a.countMu.Unlock()
+
+	if len(a.txQueue) == 0 {
+		return "", false
+	}
+	txHash := a.txQueue[0]
+	a.txQueue = a.txQueue[1:]
+	return txHash, true
+}
+
+// recvWork processes the backend's responses. Every response can schedule additional work
+// (transactions to fetch or a larger range of addresses to derive), so we check for completion
+// right after processing each one.
+func (a *Accounter) recvWork(ctx context.Context) error {
 	addrResponses := a.addrResponses
 	txResponses := a.txResponses
-	for {
+
+	var checkpoints <-chan time.Time // nil (i.e. blocks forever) unless checkpoints are enabled
+	if a.checkpointPath != "" && a.checkpointInterval > 0 {
+		ticker := time.NewTicker(a.checkpointInterval)
+		defer ticker.Stop()
+		checkpoints = ticker.C
+	}
+
+	for !a.complete() {
 		select {
+		case <-ctx.Done():
+			return a.incomplete(ctx.Err())
+		case <-checkpoints:
+			if err := a.saveCheckpoint(); err != nil {
+				// not fatal, we might be able to save the next one.
+				reporter.GetInstance().Logf("failed to save checkpoint: %s", err)
+			}
+		case err := <-a.deriveErrors:
+			return err
+		case err := <-a.backend.Errors():
+			return err
 		case resp, ok := <-addrResponses:
 			// channel is closed now, so ignore this case by blocking forever
 			if !ok {
@@ -252,30 +493,37 @@ func (a *Accounter) recvWork() {
 			}
 			reporter.GetInstance().IncAddressesFetched()
 
-			a.countMu.Lock()
-			a.processedAddrCount++
-			a.countMu.Unlock()
-
-			a.addresses[resp.Address.Script()] = address{
+			script, err := resp.Address.Script()
+			if err != nil {
+				return &DeriveError{Err: err}
+			}
+			a.addresses[script] = address{
 				path:     resp.Address,
 				txHashes: resp.TxHashes,
 			}
 
-			a.countMu.Lock()
+			queued := false
 			for _, txHash := range resp.TxHashes {
-				if _, exists := a.transactions[txHash]; !exists {
-					a.backend.TxRequest(txHash)
-					a.seenTxCount++
+				if _, exists := a.requestedTxs[txHash]; !exists {
+					a.requestedTxs[txHash] = struct{}{}
+					if a.wantTx(txHash, resp.TxHeights) {
+						a.pushTx(txHash)
+						queued = true
+					}
 				}
 			}
-			a.countMu.Unlock()
 
 			reporter.GetInstance().Logf("address %s has %d transactions", resp.Address, len(resp.TxHashes))
 
+			a.countMu.Lock()
+			a.processedAddrCount++
 			if resp.HasTransactions() {
-				a.countMu.Lock()
 				a.lastAddresses[resp.Address.Change()] = Max(a.lastAddresses[resp.Address.Change()], resp.Address.Index()+a.lookahead)
-				a.countMu.Unlock()
+			}
+			a.countMu.Unlock()
+
+			if queued || resp.HasTransactions() {
+				a.signalWork()
 			}
 		case resp, ok := <-txResponses:
 			// channel is closed now, so ignore this case by blocking forever
@@ -291,18 +539,38 @@ func (a *Accounter) recvWork() {
 			a.countMu.Unlock()
 
 			tx := transaction{
-				height: resp.Height,
-				hex:    resp.Hex,
-				vin:    []vin{},
-				vout:   []vout{},
+				height:   resp.Height,
+				hex:      resp.Hex,
+				vin:      []vin{},
+				vout:     []vout{},
+				verified: resp.Verified,
 			}
 			a.transactions[resp.Hash] = tx
-		case <-time.Tick(1 * time.Second):
-			if a.complete() {
-				return
-			}
 		}
 	}
+	return nil
+}
+
+// incomplete returns an IncompleteError which captures the current progress.
+func (a *Accounter) incomplete(err error) error {
+	return &IncompleteError{
+		Progress: a.Progress(),
+		Err:      err,
+	}
+}
+
+// Progress returns the number of addresses and transactions which have been requested and
+// processed so far.
+func (a *Accounter) Progress() Progress {
+	a.countMu.Lock()
+	defer a.countMu.Unlock()
+
+	return Progress{
+		AddressesDerived:      a.derivedAddrCount,
+		AddressesProcessed:    a.processedAddrCount,
+		TransactionsSeen:      a.seenTxCount,
+		TransactionsProcessed: a.processedTxCount,
+	}
 }
 
 // getLastAddress synchronizes access to lastAddresses array
@@ -322,6 +590,8 @@ func (a *Accounter) complete() bool {
 
 	// We are done when the right number of addresses were scheduled, fetched and processed
 	// *and* all the transactions that were seen have been scheduled, fetched and processed.
+	// Both sides of each comparison are updated before the corresponding request is sent, so the
+	// last response we process always sees the final numbers.
 	indexes := a.lastAddresses[0] + a.lastAddresses[1]
 	addrsDone := a.derivedAddrCount == indexes && a.processedAddrCount == indexes
 	txsDone := a.seenTxCount == a.processedTxCount
@@ -1,8 +1,20 @@
 package accounter
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/square/beancounter/backend"
 	"github.com/square/beancounter/deriver"
 	. "github.com/square/beancounter/utils"
@@ -13,6 +25,8 @@ func TestProcessTransactions(t *testing.T) {
 	a := Accounter{
 		blockHeight:  100,
 		transactions: make(map[string]transaction),
+		unconfirmed:  make(map[string]transaction),
+		aboveHeight:  make(map[string]transaction),
 	}
 	// https://api.blockcypher.com/v1/btc/main/txs/38f6366700f12dc902718ab5222c8ae67a4514ed07ee8aea364feec22bf6424f?limit=50&includeHex=true
 	a.transactions["1"] = transaction{
@@ -46,9 +60,11 @@ func TestProcessTransactions(t *testing.T) {
 		vout:   []vout{},
 	}
 
-	a.processTransactions()
+	assert.NoError(t, a.processTransactions())
 
 	assert.Equal(t, len(a.transactions), 2)
+	assert.Equal(t, len(a.unconfirmed), 1)
+	assert.Equal(t, len(a.unconfirmed["4"].vin), 5)
 	assert.Equal(t, len(a.transactions["1"].vin), 1)
 	assert.Equal(t, a.transactions["1"].vin[0], vin{
 		prevHash: "a8ef8d06c00fc819cdf8a2045c2fd919e42f6a7451d0934a4d40a5e674b9fc2a",
@@ -91,10 +107,606 @@ func TestProcessTransactions(t *testing.T) {
 
 func TestComputeBalanceTestnet(t *testing.T) {
 	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
-	deriver := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	b, err := backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	a := New(b, deriver, 100, 1435169)
+
+	balance, err := a.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), balance)
+
+	// the fixture doesn't have merkle proofs
+	assert.Equal(t, 0, a.Verified())
+	assert.Len(t, a.Transactions(), 15)
+
+	// the fixture wallet reuses two receive addresses and sends change to one of them
+	findings := a.Findings()
+	assert.Len(t, findings, 3)
+	for _, f := range findings {
+		assert.Equal(t, SeverityWarning, f.Severity)
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	receive := deriver.NewAddress("m/.../0/0", "receive", Testnet, 0, 0)
+	reused := deriver.NewAddress("m/.../0/1", "reused", Testnet, 0, 1)
+	change := deriver.NewAddress("m/.../1/0", "change", Testnet, 1, 0)
+
+	a := Accounter{
+		addresses: map[string]address{
+			"r":  {path: receive, txHashes: []string{"fund", "spend"}},
+			"rr": {path: reused, txHashes: []string{"fund", "spend", "dust"}},
+			"c":  {path: change, txHashes: []string{"gift"}},
+		},
+		transactions: make(map[string]transaction),
+	}
+	spend := "spend"
+	a.transactions["fund"] = transaction{
+		vin: []vin{{prevHash: "external", index: 0}},
+		vout: []vout{
+			{value: 1000, address: "r", ours: true, spentBy: &spend},
+			{value: 2000, address: "rr", ours: true},
+		},
+	}
+	a.transactions["spend"] = transaction{
+		vin: []vin{{prevHash: "fund", index: 0}},
+		vout: []vout{
+			{value: 500, address: "x", ours: false},
+			{value: 400, address: "rr", ours: true},
+		},
+	}
+	a.transactions["dust"] = transaction{
+		vin:  []vin{{prevHash: "external", index: 1}},
+		vout: []vout{{value: 1, address: "rr", ours: true}},
+	}
+	a.transactions["gift"] = transaction{
+		vin:  []vin{{prevHash: "external", index: 2}},
+		vout: []vout{{value: 3000, address: "c", ours: true, spentBy: &spend}},
+	}
+	a.transactions["unrelated"] = transaction{
+		vin:  []vin{{prevHash: "external", index: 3}},
+		vout: []vout{{value: 3000, address: "x", ours: false}},
+	}
+
+	findings := a.detectAnomalies()
+
+	kinds := map[FindingKind]int{}
+	for _, f := range findings {
+		kinds[f.Kind]++
+	}
+	assert.Equal(t, map[FindingKind]int{
+		AddressReuse:                 1,
+		ChangeToReceiveAddress:       1,
+		ExternalFundsToChangeAddress: 1,
+		DustDeposit:                  1,
+		UnrelatedTransaction:         1,
+		UnexpectedSpend:              1,
+	}, kinds)
+
+	// critical findings come first
+	assert.Equal(t, SeverityCritical, findings[0].Severity)
+	assert.Equal(t, SeverityInfo, findings[len(findings)-1].Severity)
+	assert.Equal(t, DustDeposit, findings[len(findings)-1].Kind)
+}
+
+func TestUnconfirmed(t *testing.T) {
+	spend := "spend"
+	a := Accounter{
+		addresses: map[string]address{
+			"a": {path: deriver.NewAddress("m/.../0/0", "a", Testnet, 0, 0), txHashes: []string{"fund", "spend"}},
+			"b": {path: deriver.NewAddress("m/.../0/1", "b", Testnet, 0, 1), txHashes: []string{"fund"}},
+		},
+		transactions: map[string]transaction{
+			"fund": {vout: []vout{
+				{value: 1000, address: "a", ours: true, spentBy: &spend},
+				{value: 2000, address: "b", ours: true},
+			}},
+			"spend": {vin: []vin{{prevHash: "fund", index: 0}}},
+		},
+		unconfirmed: map[string]transaction{
+			// spends our confirmed output and sends change back to us
+			"pending": {
+				vin:  []vin{{prevHash: "fund", index: 1}},
+				vout: []vout{{value: 500, address: "x"}, {value: 1400, address: "c", ours: true}},
+			},
+			// receives funds
+			"deposit": {
+				vin:  []vin{{prevHash: "external", index: 0}},
+				vout: []vout{{value: 300, address: "d", ours: true}},
+			},
+			// spends an output which was already spent
+			"conflict": {
+				vin:  []vin{{prevHash: "fund", index: 0}},
+				vout: []vout{{value: 900, address: "e", ours: true}},
+			},
+		},
+	}
+
+	assert.Equal(t, Unconfirmed{Incoming: 1700, Outgoing: 2000, Transactions: 2}, a.Unconfirmed())
+
+	findings := a.detectAnomalies()
+	assert.Len(t, findings, 1)
+	assert.Equal(t, UnconfirmedConflict, findings[0].Kind)
+	assert.Equal(t, "conflict", findings[0].TxHash)
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	script := []byte{0x51} // OP_TRUE, good enough for the accounter
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{0x01, 0x02}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000, script))
+	var buf bytes.Buffer
+	assert.NoError(t, coinbase.Serialize(&buf))
+
+	for _, tt := range []struct {
+		blockHeight uint32
+		immature    uint64
+	}{
+		{blockHeight: 950, immature: 5000},
+		// the coinbase can be spent in block 1050, i.e. right after an audit at 1049
+		{blockHeight: 1048, immature: 5000},
+		{blockHeight: 1049, immature: 0},
+		{blockHeight: 1050, immature: 0},
+	} {
+		a := Accounter{
+			blockHeight:  tt.blockHeight,
+			addresses:    map[string]address{hex.EncodeToString(script): {}},
+			transactions: map[string]transaction{"coinbase": {height: 950, hex: hex.EncodeToString(buf.Bytes())}},
+			unconfirmed:  make(map[string]transaction),
+		}
+		assert.NoError(t, a.processTransactions())
+		assert.True(t, a.transactions["coinbase"].coinbase)
+		balance, err := a.balance()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(5000), balance)
+		assert.Equal(t, tt.immature, a.immatureBalance(), "at height %d", tt.blockHeight)
+	}
+}
+
+func TestProcessTransactionsBadHex(t *testing.T) {
+	a := Accounter{
+		blockHeight:  100,
+		transactions: make(map[string]transaction),
+	}
+	a.transactions["1"] = transaction{height: 10, hex: "not hex"}
+
+	err := a.processTransactions()
+	assert.IsType(t, &TxError{}, err)
+	assert.True(t, IsIntegrityError(err))
+}
+
+func TestBalanceErrors(t *testing.T) {
+	// an output spent by two transactions
+	a := Accounter{transactions: make(map[string]transaction)}
+	a.transactions["fund"] = transaction{vout: []vout{{value: 1000, address: "r", ours: true}}}
+	a.transactions["spend1"] = transaction{vin: []vin{{prevHash: "fund", index: 0}}}
+	a.transactions["spend2"] = transaction{vin: []vin{{prevHash: "fund", index: 0}}}
+
+	_, err := a.balance()
+	assert.IsType(t, &DoubleSpendError{}, err)
+	assert.True(t, IsIntegrityError(err))
+
+	// an input which refers to an output which doesn't exist
+	a = Accounter{transactions: make(map[string]transaction)}
+	a.transactions["fund"] = transaction{vout: []vout{{value: 1000, address: "r", ours: true}}}
+	a.transactions["spend"] = transaction{vin: []vin{{prevHash: "fund", index: 1}}}
+
+	_, err = a.balance()
+	assert.IsType(t, &TxError{}, err)
+}
+
+func TestComputeBalanceCanceled(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	b, err := backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	a := New(b, deriver, 100, 1435169)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = a.ComputeBalance(ctx)
+
+	assert.IsType(t, &IncompleteError{}, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestGroupComputeBalances(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	b, err := backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+
+	// the same wallet twice: transactions are fetched once and the outputs are only counted once
+	// in the total.
+	g := NewGroup(b, 1435169)
+	assert.NoError(t, g.Add(Wallet{Name: "a", Deriver: deriver, Lookahead: 100}))
+	assert.NoError(t, g.Add(Wallet{Name: "b", Deriver: deriver, Lookahead: 100}))
+	assert.Error(t, g.Add(Wallet{Name: "b", Deriver: deriver, Lookahead: 100}))
+
+	report, err := g.ComputeBalances(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, report.Wallets, 2)
+	for _, w := range report.Wallets {
+		assert.Equal(t, uint64(267893477), w.Balance)
+		assert.Len(t, w.Findings, 3)
+	}
+	assert.Equal(t, uint64(267893477), report.Total)
+	assert.Empty(t, report.Transfers)
+
+	// a single wallet requests as many transactions as the whole group
+	b, err = backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	single := New(b, deriver, 100, 1435169)
+	_, err = single.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int(single.seenTxCount), g.backend.TxFetches())
+
+	// the wallets are anchored to the same block
+	dir, err := ioutil.TempDir("", "group")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	b, err = backend.NewFixtureBackend(fixtureWithBlocks(t, dir, map[uint32]string{1435169: "hash-1435169"}))
+	assert.NoError(t, err)
+	g = NewGroup(b, 1435169)
+	g.EnableAnchor("")
+	assert.NoError(t, g.Add(Wallet{Name: "a", Deriver: deriver, Lookahead: 100}))
+	assert.NoError(t, g.Add(Wallet{Name: "b", Deriver: deriver, Lookahead: 100}))
+	report, err = g.ComputeBalances(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "hash-1435169", report.BlockHash)
+}
+
+// failingBackend fails the requests for a given address.
+type failingBackend struct {
+	*backend.FixtureBackend
+	failing string
+	errors  chan error
+}
+
+func (b *failingBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	if addr.String() == b.failing {
+		b.errors <- &backend.Error{Request: addr.String(), Err: errors.New("history too large")}
+		return nil
+	}
+	return b.FixtureBackend.AddrRequest(ctx, addr)
+}
+
+func (b *failingBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func TestSharedBackendWalletFailure(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	good, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	bad, err := deriver.NewAddressDeriver(Testnet, nil, 1, "mm8xEm6YS8B7ErLYYqcdF6URWkS1BWnqtY")
+	assert.NoError(t, err)
+	fixture, err := backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	sb := backend.NewSharedBackend(&failingBackend{FixtureBackend: fixture, failing: "mm8xEm6YS8B7ErLYYqcdF6URWkS1BWnqtY", errors: make(chan error, 1)})
+	defer sb.Finish()
+
+	// the failure is only reported to the wallet which requested the address, the other wallet
+	// finishes.
+	badErr := make(chan error, 1)
+	go func() {
+		_, err := New(sb.NewClient(), bad, 100, 1435169).ComputeBalance(context.Background())
+		badErr <- err
+	}()
+	balance, err := New(sb.NewClient(), good, 100, 1435169).ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), balance)
+	assert.Error(t, <-badErr)
+}
+
+func TestGroupTransfers(t *testing.T) {
+	pay := "pay"
+	from := &Accounter{transactions: map[string]transaction{
+		"fund": {vout: []vout{{value: 1000, address: "f", ours: true, spentBy: &pay}}},
+		"pay": {
+			vin:  []vin{{prevHash: "fund", index: 0}},
+			vout: []vout{{value: 600, address: "t", ours: false}, {value: 300, address: "c", ours: true}},
+		},
+	}}
+	to := &Accounter{transactions: map[string]transaction{
+		"pay": {
+			vin:  []vin{{prevHash: "fund", index: 0}},
+			vout: []vout{{value: 600, address: "t", ours: true}, {value: 300, address: "c", ours: false}},
+		},
+	}}
+	g := &Group{wallets: []Wallet{{Name: "from"}, {Name: "to"}}}
+
+	transfers := g.transfers([]*Accounter{from, to})
+	assert.Equal(t, []Transfer{{TxHash: "pay", From: "from", To: "to", Value: 600}}, transfers)
+	assert.Equal(t, uint64(900), consolidatedBalance([]*Accounter{from, to}))
+}
+
+func TestCheckpointResume(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
 	b, err := backend.NewFixtureBackend("testdata/tpub_data.json")
 	assert.NoError(t, err)
+
+	// fetch everything, then pretend we crashed before getting the last few transactions.
 	a := New(b, deriver, 100, 1435169)
+	assert.NoError(t, a.fetchTransactions(context.Background()))
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	a.EnableCheckpoints(filepath.Join(dir, "checkpoint.json"), time.Minute)
+	assert.NoError(t, a.saveCheckpoint())
+
+	cp, err := LoadCheckpoint(filepath.Join(dir, "checkpoint.json"))
+	assert.NoError(t, err)
+	missing := 3
+	cp.Transactions = cp.Transactions[:len(cp.Transactions)-missing]
+
+	b, err = backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	shared := backend.NewSharedBackend(b)
+	defer shared.Finish()
+	resumed := New(shared.NewClient(), deriver, 100, 1435169)
+	assert.NoError(t, resumed.Resume(cp))
+
+	balance, err := resumed.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), balance)
+	assert.Equal(t, missing, shared.TxFetches())
+
+	// the checkpoint is only valid for the same height
+	other := New(b, deriver, 100, 1435000)
+	assert.Error(t, other.Resume(cp))
+}
+
+// fixtureWithBlocks writes a copy of the testnet fixture which also contains the given blocks.
+func fixtureWithBlocks(t *testing.T, dir string, hashes map[uint32]string) string {
+	data, err := ioutil.ReadFile("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	fixture := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &fixture))
+	blocks := []map[string]interface{}{}
+	for height, hash := range hashes {
+		blocks = append(blocks, map[string]interface{}{"height": height, "hash": hash, "timestamp": time.Now()})
+	}
+	fixture["blocks"] = blocks
+	data, err = json.Marshal(fixture)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "fixture.json")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestSnapshotRollForward(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fixture := fixtureWithBlocks(t, dir, map[uint32]string{1414324: "hash-1414324", 1435169: "hash-1435169"})
+
+	// audit up to 1414324 and take a snapshot
+	b, err := backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	a := New(b, deriver, 100, 1414324)
+	a.EnableSnapshot()
+	balance, err := a.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	snapshot, err := a.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, balance, snapshot.Balance())
+	assert.Equal(t, "hash-1414324", snapshot.BlockHash)
+
+	// roll forward: only the two transactions above the snapshot are fetched
+	b, err = backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	shared := backend.NewSharedBackend(b)
+	defer shared.Finish()
+	a = New(shared.NewClient(), deriver, 100, 1435169)
+	assert.NoError(t, a.RollForward(snapshot))
+	balance, err = a.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), balance)
+	assert.Equal(t, 2, shared.TxFetches())
+
+	// the chain was reorganized below the snapshot
+	snapshot.BlockHash = "orphaned"
+	b, err = backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	a = New(b, deriver, 100, 1435169)
+	assert.NoError(t, a.RollForward(snapshot))
+	_, err = a.ComputeBalance(context.Background())
+	assert.IsType(t, &ReorgError{}, err)
+	assert.True(t, IsIntegrityError(err))
+}
+
+// reorgBackend replaces the hash of the blocks after the first block request, as if the chain
+// had been reorganized. With errs, it reports a HeaderMismatchError instead, like the Electrum
+// backend does when a server's block isn't the validated one.
+type reorgBackend struct {
+	backend.Backend
+	requests  int
+	responses chan *backend.BlockResponse
+	errs      chan error
+}
+
+func (b *reorgBackend) BlockRequest(ctx context.Context, height uint32) error {
+	if err := b.Backend.BlockRequest(ctx, height); err != nil {
+		return err
+	}
+	resp := *<-b.Backend.BlockResponses()
+	b.requests++
+	if b.requests > 1 {
+		if b.errs != nil {
+			b.errs <- &backend.Error{
+				Request: fmt.Sprintf("block %d", height),
+				Err:     &backend.HeaderMismatchError{Height: height, Expected: resp.Hash, Actual: "reorganized"},
+			}
+			return nil
+		}
+		resp.Hash = "reorganized"
+	}
+	b.responses <- &resp
+	return nil
+}
+
+func (b *reorgBackend) BlockResponses() <-chan *backend.BlockResponse {
+	return b.responses
+}
+
+func (b *reorgBackend) Errors() <-chan error {
+	if b.errs != nil {
+		return b.errs
+	}
+	return b.Backend.Errors()
+}
+
+func TestAnchor(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "anchor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fixture := fixtureWithBlocks(t, dir, map[uint32]string{1435169: "hash-1435169"})
+
+	b, err := backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	height, err := b.BlockHeight(context.Background(), "hash-1435169")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1435169), height)
+	a := New(b, deriver, 100, height)
+	a.EnableAnchor("hash-1435169")
+	balance, err := a.ComputeBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), balance)
+	assert.Equal(t, "hash-1435169", a.BlockHash())
+
+	// the block at the audit height isn't the one we asked for
+	b, err = backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	a = New(b, deriver, 100, 1435169)
+	a.EnableAnchor("other")
+	_, err = a.ComputeBalance(context.Background())
+	assert.Equal(t, &ReorgError{Height: 1435169, Expected: "other", Actual: "hash-1435169"}, err)
+
+	// the chain is reorganized during the scan
+	b, err = backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	a = New(&reorgBackend{Backend: b, responses: make(chan *backend.BlockResponse, 1)}, deriver, 100, 1435169)
+	a.EnableAnchor("")
+	_, err = a.ComputeBalance(context.Background())
+	assert.Equal(t, &ReorgError{Height: 1435169, Expected: "hash-1435169", Actual: "reorganized"}, err)
+	assert.True(t, IsIntegrityError(err))
+
+	// the backend noticed the reorg
+	b, err = backend.NewFixtureBackend(fixture)
+	assert.NoError(t, err)
+	a = New(&reorgBackend{Backend: b, responses: make(chan *backend.BlockResponse, 1), errs: make(chan error, 1)}, deriver, 100, 1435169)
+	a.EnableAnchor("")
+	_, err = a.ComputeBalance(context.Background())
+	assert.Equal(t, &ReorgError{Height: 1435169, Expected: "hash-1435169", Actual: "reorganized"}, err)
+}
+
+func TestReconcile(t *testing.T) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "reconcile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	withBlocks := fixtureWithBlocks(t, dir, map[uint32]string{1435169: "hash-1435169"})
 
-	assert.Equal(t, uint64(267893477), a.ComputeBalance())
+	left, err := backend.NewFixtureBackend(withBlocks)
+	assert.NoError(t, err)
+	right, err := backend.NewFixtureBackend(withBlocks)
+	assert.NoError(t, err)
+	r, err := Reconcile(context.Background(), left, right, deriver, 100, 1435169)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(267893477), r.LeftBalance)
+	assert.Equal(t, r.LeftBalance, r.RightBalance)
+	assert.Equal(t, 15, r.Transactions)
+	assert.Equal(t, "hash-1435169", r.BlockHash)
+	assert.Empty(t, r.Differences)
+
+	// the right backend reports a transaction at another height and hides another one, on
+	// another chain
+	data, err := ioutil.ReadFile(withBlocks)
+	assert.NoError(t, err)
+	fixture := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &fixture))
+	tx := fixture["transactions"].([]interface{})[0].(map[string]interface{})
+	height := tx["height"].(float64)
+	tx["height"] = height - 1
+	var hidden, hiddenFrom string
+	for _, addr := range fixture["addresses"].([]interface{}) {
+		addr := addr.(map[string]interface{})
+		hashes := addr["tx_hashes"].([]interface{})
+		if hidden == "" && len(hashes) > 0 && hashes[0] != tx["hash"] {
+			hidden, hiddenFrom = hashes[0].(string), addr["address"].(string)
+			addr["tx_hashes"] = hashes[1:]
+		}
+	}
+	fixture["blocks"].([]interface{})[0].(map[string]interface{})["hash"] = "other-1435169"
+	data, err = json.Marshal(fixture)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "right.json")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	left, err = backend.NewFixtureBackend(withBlocks)
+	assert.NoError(t, err)
+	right, err = backend.NewFixtureBackend(path)
+	assert.NoError(t, err)
+	r, err = Reconcile(context.Background(), left, right, deriver, 100, 1435169)
+	assert.NoError(t, err)
+	assert.Contains(t, r.Differences, Difference{Kind: DiffBlock, Subject: "1435169", Left: "hash-1435169", Right: "other-1435169"})
+	assert.Contains(t, r.Differences, Difference{
+		Kind:    DiffHeight,
+		Subject: tx["hash"].(string),
+		Left:    fmt.Sprintf("%d", int64(height)),
+		Right:   fmt.Sprintf("%d", int64(height)-1),
+	})
+	assert.Contains(t, r.Differences, Difference{
+		Kind:    DiffHistory,
+		Subject: hiddenFrom,
+		Left:    fmt.Sprintf("[%s]", hidden),
+		Right:   "[]",
+	})
+
+	// the right backend doesn't know the block at the audit height, so its audit can't be anchored
+	left, err = backend.NewFixtureBackend(withBlocks)
+	assert.NoError(t, err)
+	right, err = backend.NewFixtureBackend("testdata/tpub_data.json")
+	assert.NoError(t, err)
+	_, err = Reconcile(context.Background(), left, right, deriver, 100, 1435169)
+	var sideErr *SideError
+	if assert.True(t, errors.As(err, &sideErr)) {
+		assert.Equal(t, "right", sideErr.Side)
+	}
+	var walletErr *WalletError
+	assert.False(t, errors.As(err, &walletErr))
+}
+
+func BenchmarkComputeBalance(b *testing.B) {
+	pubs := []string{"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"}
+	deriver, err := deriver.NewAddressDeriver(Testnet, pubs, 1, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		fb, err := backend.NewFixtureBackend("testdata/tpub_data.json")
+		if err != nil {
+			b.Fatal(err)
+		}
+		a := New(fb, deriver, 100, 1435169)
+		if _, err := a.ComputeBalance(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
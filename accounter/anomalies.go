@@ -0,0 +1,256 @@
+package accounter
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Wallet hygiene checks. Once the balance has been computed (and every output we own knows which
+// transaction spent it), we walk the transactions a second time and flag anything that looks
+// unusual for a well-behaved HD wallet. None of these findings change the balance; they are meant
+// to be reviewed by a human after the audit.
+
+// Severity indicates how much attention a finding deserves.
+type Severity int
+
+const (
+	// SeverityInfo findings are worth knowing about but are usually benign.
+	SeverityInfo Severity = iota
+	// SeverityWarning findings indicate poor wallet hygiene.
+	SeverityWarning
+	// SeverityCritical findings indicate data we can't reconcile with how the wallet should behave.
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// FindingKind identifies the check which produced a Finding.
+type FindingKind string
+
+const (
+	// AddressReuse: an address received funds in more than one transaction.
+	AddressReuse FindingKind = "address-reuse"
+	// ChangeToReceiveAddress: a transaction which spends our funds sends change to a receive
+	// address.
+	ChangeToReceiveAddress FindingKind = "change-to-receive-address"
+	// ExternalFundsToChangeAddress: a change address received funds from a transaction which
+	// doesn't spend any of our outputs.
+	ExternalFundsToChangeAddress FindingKind = "external-funds-to-change-address"
+	// DustDeposit: a third party sent us an output below the dust threshold. This is commonly
+	// used to de-anonymize wallets.
+	DustDeposit FindingKind = "dust-deposit"
+	// UnrelatedTransaction: a transaction neither spends nor creates any of our outputs. The
+	// backend should never return such a transaction.
+	UnrelatedTransaction FindingKind = "unrelated-transaction"
+	// UnexpectedSpend: one of our outputs was spent by a transaction which the backend didn't
+	// list in the address' history.
+	UnexpectedSpend FindingKind = "unexpected-spend"
+	// UnconfirmedConflict: an unconfirmed transaction spends an output which a confirmed
+	// transaction already spent. It will never be mined.
+	UnconfirmedConflict FindingKind = "unconfirmed-conflict"
+)
+
+// Finding describes a single anomaly.
+type Finding struct {
+	Kind     FindingKind
+	Severity Severity
+	TxHash   string // transaction which triggered the finding, if any
+	Address  string // address which triggered the finding, if any
+	Path     string // derivation path of Address
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("[%s] %s: %s", f.Severity, f.Kind, f.Message)
+}
+
+const (
+	// outputs below this value (in Satoshi) are considered dust. 546 is Bitcoin Core's dust
+	// limit for P2PKH outputs.
+	dustThreshold = 546
+)
+
+// Findings returns the anomalies detected by the last call to ComputeBalance. The findings are
+// sorted by decreasing severity.
+func (a *Accounter) Findings() []Finding {
+	return a.findings
+}
+
+// detectAnomalies runs all the wallet hygiene checks. It must be called after balance(), since
+// some checks rely on spentBy being set.
+func (a *Accounter) detectAnomalies() []Finding {
+	findings := []Finding{}
+
+	// number of transactions which sent funds to a given address (keyed by script)
+	deposits := map[string]int{}
+
+	// single address wallets receive their change on the only address they have.
+	hasChange := a.deriver == nil || !a.deriver.IsSingleAddress()
+
+	for hash, tx := range a.transactions {
+		spendsOurs := a.spendsOurOutputs(tx)
+		createsOurs := false
+		seen := map[string]bool{} // a transaction can pay the same address multiple times
+
+		// the snapshot's transactions were checked by the audit which created the snapshot, only
+		// their spends are new.
+		fromSnapshot := a.isSnapshotTx(hash)
+
+		for _, txout := range tx.vout {
+			if !txout.ours {
+				continue
+			}
+			createsOurs = true
+			if fromSnapshot {
+				if finding, ok := a.unexpectedSpend(hash, txout); ok {
+					findings = append(findings, finding)
+				}
+				continue
+			}
+			addr := a.addresses[txout.address].path
+			firstOutput := !seen[txout.address]
+			seen[txout.address] = true
+			if firstOutput {
+				deposits[txout.address]++
+			}
+
+			if firstOutput && hasChange && spendsOurs && addr.Change() == 0 {
+				findings = append(findings, Finding{
+					Kind:     ChangeToReceiveAddress,
+					Severity: SeverityWarning,
+					TxHash:   hash,
+					Address:  addr.String(),
+					Path:     addr.Path(),
+					Message:  fmt.Sprintf("%s sends change to receive address %s (%s)", hash, addr, addr.Path()),
+				})
+			}
+			if firstOutput && !spendsOurs && addr.Change() == 1 {
+				findings = append(findings, Finding{
+					Kind:     ExternalFundsToChangeAddress,
+					Severity: SeverityWarning,
+					TxHash:   hash,
+					Address:  addr.String(),
+					Path:     addr.Path(),
+					Message:  fmt.Sprintf("%s sends external funds to change address %s (%s)", hash, addr, addr.Path()),
+				})
+			}
+			if !spendsOurs && txout.value < dustThreshold {
+				findings = append(findings, Finding{
+					Kind:     DustDeposit,
+					Severity: SeverityInfo,
+					TxHash:   hash,
+					Address:  addr.String(),
+					Path:     addr.Path(),
+					Message:  fmt.Sprintf("%s deposits %d satoshi to %s (%s)", hash, txout.value, addr, addr.Path()),
+				})
+			}
+			if finding, ok := a.unexpectedSpend(hash, txout); ok {
+				findings = append(findings, finding)
+			}
+		}
+
+		if !spendsOurs && !createsOurs {
+			findings = append(findings, Finding{
+				Kind:     UnrelatedTransaction,
+				Severity: SeverityCritical,
+				TxHash:   hash,
+				Message:  fmt.Sprintf("%s neither spends nor creates any of our outputs", hash),
+			})
+		}
+	}
+
+	for hash, confirmed := range a.conflicts() {
+		findings = append(findings, Finding{
+			Kind:     UnconfirmedConflict,
+			Severity: SeverityWarning,
+			TxHash:   hash,
+			Message:  fmt.Sprintf("unconfirmed %s conflicts with %s, which has been mined", hash, confirmed),
+		})
+	}
+
+	for script, count := range deposits {
+		if count <= 1 {
+			continue
+		}
+		addr := a.addresses[script].path
+		findings = append(findings, Finding{
+			Kind:     AddressReuse,
+			Severity: SeverityWarning,
+			Address:  addr.String(),
+			Path:     addr.Path(),
+			Message:  fmt.Sprintf("%s (%s) received funds in %d transactions", addr, addr.Path(), count),
+		})
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// unexpectedSpend checks that the transaction which spends txout is in the address' history.
+func (a *Accounter) unexpectedSpend(hash string, txout vout) (Finding, bool) {
+	if txout.spentBy == nil || a.addresses[txout.address].hasTransaction(*txout.spentBy) {
+		return Finding{}, false
+	}
+	addr := a.addresses[txout.address].path
+	return Finding{
+		Kind:     UnexpectedSpend,
+		Severity: SeverityCritical,
+		TxHash:   *txout.spentBy,
+		Address:  addr.String(),
+		Path:     addr.Path(),
+		Message: fmt.Sprintf("output of %s to %s (%s) is spent by %s, which isn't in the address' history",
+			hash, addr, addr.Path(), *txout.spentBy),
+	}, true
+}
+
+// spendsOurOutputs returns true if any of the transaction's inputs spends one of our outputs.
+func (a *Accounter) spendsOurOutputs(tx transaction) bool {
+	for _, txin := range tx.vin {
+		prev, exists := a.transactions[txin.prevHash]
+		if !exists || int(txin.index) >= len(prev.vout) {
+			continue
+		}
+		if prev.vout[txin.index].ours {
+			return true
+		}
+	}
+	return false
+}
+
+func (addr address) hasTransaction(txHash string) bool {
+	for _, h := range addr.txHashes {
+		if h == txHash {
+			return true
+		}
+	}
+	return false
+}
+
+// sortFindings orders findings by decreasing severity. Ties are broken by kind, transaction and
+// address so that the output is stable across runs.
+func sortFindings(findings []Finding) {
+	sort.Slice(findings, func(i, j int) bool {
+		fi, fj := findings[i], findings[j]
+		if fi.Severity != fj.Severity {
+			return fi.Severity > fj.Severity
+		}
+		if fi.Kind != fj.Kind {
+			return fi.Kind < fj.Kind
+		}
+		if fi.TxHash != fj.TxHash {
+			return fi.TxHash < fj.TxHash
+		}
+		return fi.Address < fj.Address
+	})
+}
@@ -0,0 +1,201 @@
+package accounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/square/beancounter/reporter"
+)
+
+// Long scans can fail halfway through (e.g. when all the Electrum peers drop out). To avoid
+// starting over, the accounter can periodically save its progress to a checkpoint file. A later
+// run can then resume from the checkpoint and only request the addresses and transactions which
+// are missing.
+//
+// The checkpoint is written by recvWork, which owns the addresses and transactions maps.
+
+const checkpointVersion = 1
+
+// Checkpoint is the accounter's progress, as saved on disk.
+type Checkpoint struct {
+	Version       int                     `json:"version"`
+	BlockHeight   uint32                  `json:"block_height"`
+	LastAddresses [2]uint32               `json:"last_addresses"`
+	Addresses     []checkpointAddress     `json:"addresses"`
+	Transactions  []checkpointTransaction `json:"transactions"`
+}
+
+type checkpointAddress struct {
+	Address  string   `json:"address"`
+	Change   uint32   `json:"change"`
+	Index    uint32   `json:"index"`
+	TxHashes []string `json:"tx_hashes"`
+}
+
+type checkpointTransaction struct {
+	Hash   string `json:"hash"`
+	Height int64  `json:"height"`
+	Hex    string `json:"hex"`
+
+	Verified bool `json:"verified,omitempty"`
+}
+
+// LoadCheckpoint reads a checkpoint file written by an earlier run.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %s", path, err)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has version %d, expecting %d", path, cp.Version, checkpointVersion)
+	}
+	return cp, nil
+}
+
+// EnableCheckpoints makes ComputeBalance save its progress to path every interval. The file is
+// removed once all the transactions have been fetched.
+func (a *Accounter) EnableCheckpoints(path string, interval time.Duration) {
+	a.checkpointPath = path
+	a.checkpointInterval = interval
+}
+
+// Resume restores the progress saved in cp. It must be called before ComputeBalance (and after
+// RollForward, when rolling forward from a snapshot). The
+// checkpoint must have been written for the same wallet and block height.
+func (a *Accounter) Resume(cp *Checkpoint) error {
+	if cp.BlockHeight != a.blockHeight {
+		return fmt.Errorf("checkpoint is for block height %d, not %d", cp.BlockHeight, a.blockHeight)
+	}
+
+	a.resumed = make(map[[2]uint32]struct{})
+	for _, addr := range cp.Addresses {
+		derived, err := a.deriver.Derive(addr.Change, addr.Index)
+		if err != nil {
+			return &DeriveError{Err: err}
+		}
+		if derived.String() != addr.Address {
+			return fmt.Errorf("checkpoint doesn't match the wallet: %s is %s, not %s", derived.Path(), derived, addr.Address)
+		}
+		script, err := derived.Script()
+		if err != nil {
+			return &DeriveError{Err: err}
+		}
+		a.addresses[script] = address{
+			path:     derived,
+			txHashes: addr.TxHashes,
+		}
+		a.resumed[[2]uint32{addr.Change, addr.Index}] = struct{}{}
+	}
+
+	for _, tx := range cp.Transactions {
+		a.transactions[tx.Hash] = transaction{
+			height:   tx.Height,
+			hex:      tx.Hex,
+			vin:      []vin{},
+			vout:     []vout{},
+			verified: tx.Verified,
+		}
+	}
+
+	// re-request the transactions which were seen but not fetched.
+	a.countMu.Lock()
+	a.lastAddresses = cp.LastAddresses
+	a.derivedAddrCount = uint32(len(a.resumed))
+	a.processedAddrCount = uint32(len(a.resumed))
+	a.countMu.Unlock()
+	for _, addr := range a.addresses {
+		for _, txHash := range addr.txHashes {
+			if _, exists := a.requestedTxs[txHash]; exists {
+				continue
+			}
+			a.requestedTxs[txHash] = struct{}{}
+			if _, exists := a.transactions[txHash]; exists {
+				a.countMu.Lock()
+				a.seenTxCount++
+				a.processedTxCount++
+				a.countMu.Unlock()
+				continue
+			}
+			if a.wantTx(txHash, nil) {
+				a.pushTx(txHash)
+			}
+		}
+	}
+
+	reporter.GetInstance().Logf("resuming with %d addresses and %d transactions (%d missing)",
+		len(a.resumed), len(a.transactions), len(a.txQueue))
+	return nil
+}
+
+// checkpoint builds a Checkpoint with the current progress. Only called from recvWork.
+func (a *Accounter) checkpoint() *Checkpoint {
+	cp := &Checkpoint{
+		Version:      checkpointVersion,
+		BlockHeight:  a.blockHeight,
+		Addresses:    []checkpointAddress{},
+		Transactions: []checkpointTransaction{},
+	}
+	a.countMu.Lock()
+	cp.LastAddresses = a.lastAddresses
+	a.countMu.Unlock()
+
+	for _, addr := range a.addresses {
+		cp.Addresses = append(cp.Addresses, checkpointAddress{
+			Address:  addr.path.String(),
+			Change:   addr.path.Change(),
+			Index:    addr.path.Index(),
+			TxHashes: addr.txHashes,
+		})
+	}
+	for hash, tx := range a.transactions {
+		// unconfirmed transactions are fetched again, their height has probably changed. The
+		// snapshot's transactions are loaded from the snapshot.
+		if tx.height <= 0 || a.isSnapshotTx(hash) {
+			continue
+		}
+		cp.Transactions = append(cp.Transactions, checkpointTransaction{
+			Hash:     hash,
+			Height:   tx.height,
+			Hex:      tx.hex,
+			Verified: tx.verified,
+		})
+	}
+
+	// keep the file stable, it makes it easier to diff checkpoints.
+	sort.Slice(cp.Addresses, func(i, j int) bool {
+		if cp.Addresses[i].Change != cp.Addresses[j].Change {
+			return cp.Addresses[i].Change < cp.Addresses[j].Change
+		}
+		return cp.Addresses[i].Index < cp.Addresses[j].Index
+	})
+	sort.Slice(cp.Transactions, func(i, j int) bool {
+		return cp.Transactions[i].Hash < cp.Transactions[j].Hash
+	})
+	return cp
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file and then renames it, so that a crash
+// while writing doesn't clobber the previous checkpoint.
+func (a *Accounter) saveCheckpoint() error {
+	data, err := json.MarshalIndent(a.checkpoint(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.checkpointPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.checkpointPath); err != nil {
+		return err
+	}
+	reporter.GetInstance().Logf("saved checkpoint to %s", a.checkpointPath)
+	return nil
+}
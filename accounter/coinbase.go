@@ -0,0 +1,55 @@
+package accounter
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Coinbase outputs (e.g. mining pool payouts sent directly from the coinbase transaction) can only
+// be spent once the block which created them is buried under enough blocks. Until then, they are
+// reported as immature instead of being part of the spendable balance.
+
+// coinbaseMaturity is the number of blocks a coinbase output has to wait before it can be spent.
+const coinbaseMaturity = 100
+
+// isCoinbase returns true if the transaction is a coinbase transaction, i.e. it has a single
+// input which spends the null outpoint.
+func isCoinbase(msgTx *wire.MsgTx) bool {
+	if len(msgTx.TxIn) != 1 {
+		return false
+	}
+	prev := msgTx.TxIn[0].PreviousOutPoint
+	return prev.Index == wire.MaxPrevOutIndex && prev.Hash == (chainhash.Hash{})
+}
+
+// Immature returns the value of the coinbase outputs which aren't spendable at the audit height.
+// It can only be called after ComputeBalance.
+func (a *Accounter) Immature() uint64 {
+	return a.immature
+}
+
+// isImmature returns true if tx is a coinbase transaction whose outputs can't be spent in the block
+// following the audit height. The audit height is the last block included in the audit, and
+// consensus lets a coinbase from height h be spent in a block at h+coinbaseMaturity. E.g. a
+// coinbase from 950 is immature at audit height 1048 and mature at 1049, since it can be spent in
+// block 1050.
+func (a *Accounter) isImmature(tx transaction) bool {
+	return tx.coinbase && int64(a.blockHeight)+1-tx.height < coinbaseMaturity
+}
+
+// immatureBalance sums our unspent outputs from immature coinbase transactions. It must be called
+// after balance(), since it relies on spentBy being set.
+func (a *Accounter) immatureBalance() uint64 {
+	immature := uint64(0)
+	for _, tx := range a.transactions {
+		if !a.isImmature(tx) {
+			continue
+		}
+		for _, txout := range tx.vout {
+			if txout.ours && txout.spentBy == nil {
+				immature += uint64(txout.value)
+			}
+		}
+	}
+	return immature
+}
@@ -0,0 +1,94 @@
+package accounter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/square/beancounter/backend"
+)
+
+// Errors returned by ComputeBalance. Errors reported by the backend are returned as is (usually
+// as a *backend.Error), errors from the deriver are wrapped in a DeriveError and a canceled
+// context results in an IncompleteError. The other errors (including a backend.ProofError, when a
+// transaction's merkle proof doesn't match) mean the data we fetched doesn't add up.
+
+// ErrNegativeBalance is returned when the wallet spends more than it received.
+var ErrNegativeBalance = errors.New("balance is negative")
+
+// DoubleSpendError is returned when two transactions spend the same output.
+type DoubleSpendError struct {
+	PrevHash string // transaction which created the output
+	Index    uint32 // index of the output in PrevHash
+	Spenders [2]string
+}
+
+func (e *DoubleSpendError) Error() string {
+	return fmt.Sprintf("%s and %s, both spending %s:%d", e.Spenders[0], e.Spenders[1], e.PrevHash, e.Index)
+}
+
+// TxError is returned when a transaction can't be decoded or refers to outputs which don't
+// exist.
+type TxError struct {
+	Hash string
+	Err  error
+}
+
+func (e *TxError) Error() string {
+	return fmt.Sprintf("transaction %s: %s", e.Hash, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// DeriveError is returned when the deriver fails to derive an address.
+type DeriveError struct {
+	Err error
+}
+
+func (e *DeriveError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *DeriveError) Unwrap() error {
+	return e.Err
+}
+
+// Progress reports how far the accounter got.
+type Progress struct {
+	AddressesDerived      uint32
+	AddressesProcessed    uint32
+	TransactionsSeen      uint32
+	TransactionsProcessed uint32
+}
+
+// IncompleteError is returned when the context is canceled (or its deadline expires) before the
+// balance could be computed.
+type IncompleteError struct {
+	Progress Progress
+	Err      error // the context's error
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("%s after processing %d/%d addresses and %d/%d transactions", e.Err,
+		e.Progress.AddressesProcessed, e.Progress.AddressesDerived,
+		e.Progress.TransactionsProcessed, e.Progress.TransactionsSeen)
+}
+
+// Unwrap returns the context's error, so errors.Is(err, context.DeadlineExceeded) works.
+func (e *IncompleteError) Unwrap() error {
+	return e.Err
+}
+
+// IsIntegrityError returns true if err indicates that the fetched data is inconsistent, as
+// opposed to a failure to fetch the data.
+func IsIntegrityError(err error) bool {
+	var doubleSpend *DoubleSpendError
+	var txErr *TxError
+	var reorg *ReorgError
+	var proof *backend.ProofError
+	return errors.Is(err, ErrNegativeBalance) || errors.As(err, &doubleSpend) || errors.As(err, &txErr) ||
+		errors.As(err, &reorg) || errors.As(err, &proof)
+}
@@ -0,0 +1,274 @@
+package accounter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/square/beancounter/backend"
+	"github.com/square/beancounter/deriver"
+)
+
+// Group audits several wallets at the same height over a single backend. Each wallet gets its own
+// Accounter; the backend is wrapped in a SharedBackend so that transactions which show up in
+// several wallets are only fetched once.
+//
+// Once all the balances are known, the Group looks for transfers between its wallets. These
+// transfers move funds within the group and should be eliminated in a consolidated view.
+type Group struct {
+	backend     *backend.SharedBackend
+	blockHeight uint32
+	wallets     []Wallet
+
+	anchorEnabled bool
+	anchorHash    string
+}
+
+// Wallet describes one of the wallets audited by a Group.
+type Wallet struct {
+	Name      string
+	Deriver   *deriver.AddressDeriver
+	Lookahead uint32
+}
+
+// WalletBalance is the result of auditing one wallet.
+type WalletBalance struct {
+	Name        string
+	Balance     uint64 // spendable balance
+	Immature    uint64 // coinbase outputs which can't be spent yet
+	Unconfirmed Unconfirmed
+	Findings    []Finding
+
+	Transactions int // number of transactions applied to compute the balance
+	Verified     int // number of transactions which were SPV verified
+}
+
+// Transfer is a transaction which spends funds from one wallet of the group and sends (some of)
+// them to another wallet of the group.
+type Transfer struct {
+	TxHash string
+	From   string // name of the wallet which spends its outputs
+	To     string // name of the wallet which receives the outputs
+	Value  uint64 // in Satoshi, sum of the outputs received by To
+}
+
+func (t Transfer) String() string {
+	return fmt.Sprintf("%s: %s -> %s, %d", t.TxHash, t.From, t.To, t.Value)
+}
+
+// GroupReport contains the per-wallet and aggregate balances.
+type GroupReport struct {
+	Wallets []WalletBalance // in the order the wallets were added
+
+	// Total is the group's consolidated spendable balance. Outputs which belong to several
+	// wallets (e.g. when two wallet definitions overlap) are only counted once, so Total can be
+	// smaller than the sum of the wallets' balances.
+	Total uint64
+
+	Transfers []Transfer
+
+	// BlockHash is the hash of the block at the audit height, with EnableAnchor.
+	BlockHash string
+}
+
+// WalletError is returned when one of the group's wallets can't be audited.
+type WalletError struct {
+	Name string
+	Err  error
+}
+
+func (e *WalletError) Error() string {
+	return fmt.Sprintf("wallet %s: %s", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *WalletError) Unwrap() error {
+	return e.Err
+}
+
+// NewGroup instantiates a new Group. The Group takes ownership of b: ComputeBalances calls
+// b.Finish() when it's done.
+func NewGroup(b backend.Backend, blockHeight uint32) *Group {
+	return &Group{
+		backend:     backend.NewSharedBackend(b),
+		blockHeight: blockHeight,
+	}
+}
+
+// Add registers a wallet. Wallet names must be unique.
+func (g *Group) Add(w Wallet) error {
+	for _, existing := range g.wallets {
+		if existing.Name == w.Name {
+			return fmt.Errorf("duplicate wallet name: %s", w.Name)
+		}
+	}
+	g.wallets = append(g.wallets, w)
+	return nil
+}
+
+// EnableAnchor anchors each wallet's audit to the block at the audit height (see
+// Accounter.EnableAnchor). The wallets must all see the same block.
+func (g *Group) EnableAnchor(hash string) {
+	g.anchorEnabled = true
+	g.anchorHash = hash
+}
+
+// ComputeBalances audits all the wallets concurrently. If any wallet fails, the other audits are
+// canceled and the first error is returned as a WalletError.
+func (g *Group) ComputeBalances(ctx context.Context) (*GroupReport, error) {
+	defer g.backend.Finish()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	accounters := make([]*Accounter, len(g.wallets))
+	balances := make([]uint64, len(g.wallets))
+	errs := make([]error, len(g.wallets))
+	var wg sync.WaitGroup
+	for i, w := range g.wallets {
+		accounters[i] = New(g.backend.NewClient(), w.Deriver, w.Lookahead, g.blockHeight)
+		if g.anchorEnabled {
+			accounters[i].EnableAnchor(g.anchorHash)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			balances[i], errs[i] = accounters[i].ComputeBalance(ctx)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the first wallet to fail is the one which didn't return an IncompleteError caused by our
+	// own cancellation. Fall back to the first error otherwise.
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		werr := &WalletError{Name: g.wallets[i].Name, Err: err}
+		if _, incomplete := err.(*IncompleteError); !incomplete {
+			return nil, werr
+		}
+		if first == nil {
+			first = werr
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+
+	report := &GroupReport{}
+	if g.anchorEnabled {
+		// the block could have changed between two wallets' audits
+		report.BlockHash = accounters[0].BlockHash()
+		for i, a := range accounters {
+			if a.BlockHash() != report.BlockHash {
+				return nil, &WalletError{Name: g.wallets[i].Name, Err: &ReorgError{Height: g.blockHeight, Expected: report.BlockHash, Actual: a.BlockHash()}}
+			}
+		}
+	}
+	for i, w := range g.wallets {
+		report.Wallets = append(report.Wallets, WalletBalance{
+			Name:        w.Name,
+			Balance:     balances[i],
+			Immature:    accounters[i].Immature(),
+			Unconfirmed: accounters[i].Unconfirmed(),
+			Findings:    accounters[i].Findings(),
+
+			Transactions: len(accounters[i].Transactions()),
+			Verified:     accounters[i].Verified(),
+		})
+	}
+	report.Total = consolidatedBalance(accounters)
+	report.Transfers = g.transfers(accounters)
+	return report, nil
+}
+
+// outpoint identifies a transaction output.
+type outpoint struct {
+	hash  string
+	index int
+}
+
+// consolidatedBalance sums the spendable unspent outputs of all the wallets, counting each output
+// once.
+func consolidatedBalance(accounters []*Accounter) uint64 {
+	unspent := map[outpoint]int64{}
+	for _, a := range accounters {
+		for hash, tx := range a.transactions {
+			if a.isImmature(tx) {
+				continue
+			}
+			for i, txout := range tx.vout {
+				if txout.ours && txout.spentBy == nil {
+					unspent[outpoint{hash: hash, index: i}] = txout.value
+				}
+			}
+		}
+	}
+	total := uint64(0)
+	for _, value := range unspent {
+		total += uint64(value)
+	}
+	return total
+}
+
+// transfers finds the transactions which spend outputs from one wallet and pay another wallet.
+// Outputs which also belong to the spending wallet are its change, not a transfer.
+func (g *Group) transfers(accounters []*Accounter) []Transfer {
+	transfers := []Transfer{}
+
+	// wallets which spend their outputs in a given transaction
+	spenders := map[string][]int{}
+	for i, a := range accounters {
+		for hash, tx := range a.transactions {
+			if a.spendsOurOutputs(tx) {
+				spenders[hash] = append(spenders[hash], i)
+			}
+		}
+	}
+
+	for hash, from := range spenders {
+		for _, i := range from {
+			for j, a := range accounters {
+				if i == j {
+					continue
+				}
+				tx, exists := a.transactions[hash]
+				if !exists {
+					continue
+				}
+				value := int64(0)
+				for k, txout := range tx.vout {
+					if txout.ours && !accounters[i].transactions[hash].vout[k].ours {
+						value += txout.value
+					}
+				}
+				if value > 0 {
+					transfers = append(transfers, Transfer{
+						TxHash: hash,
+						From:   g.wallets[i].Name,
+						To:     g.wallets[j].Name,
+						Value:  uint64(value),
+					})
+				}
+			}
+		}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		ti, tj := transfers[i], transfers[j]
+		if ti.TxHash != tj.TxHash {
+			return ti.TxHash < tj.TxHash
+		}
+		if ti.From != tj.From {
+			return ti.From < tj.From
+		}
+		return ti.To < tj.To
+	})
+	return transfers
+}
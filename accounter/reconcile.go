@@ -0,0 +1,227 @@
+package accounter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/square/beancounter/backend"
+	"github.com/square/beancounter/deriver"
+)
+
+// Reconcile audits the same wallet at the same height against two backends (e.g. btcd and
+// Electrum, or a live backend and a fixture) and compares what they returned: the transactions of
+// each address, and the height and bytes of each transaction.
+
+// DifferenceKind says what the backends disagree on.
+type DifferenceKind string
+
+const (
+	DiffBalance DifferenceKind = "balance"
+	DiffHistory DifferenceKind = "history" // an address has different transactions
+	DiffHeight  DifferenceKind = "height"  // a transaction was mined at different heights
+	DiffHex     DifferenceKind = "hex"     // a transaction has different bytes
+	DiffBlock   DifferenceKind = "block"   // the block at the audit height has different hashes
+)
+
+// Difference is something the two backends disagree on.
+type Difference struct {
+	Kind    DifferenceKind
+	Subject string // address or transaction hash, empty for the balance
+	Left    string // what the left backend returned
+	Right   string // what the right backend returned
+}
+
+func (d Difference) String() string {
+	if d.Subject == "" {
+		return fmt.Sprintf("%s: %s != %s", d.Kind, d.Left, d.Right)
+	}
+	return fmt.Sprintf("%s %s: %s != %s", d.Kind, d.Subject, d.Left, d.Right)
+}
+
+// Reconciliation is the result of Reconcile.
+type Reconciliation struct {
+	LeftBalance  uint64
+	RightBalance uint64
+	Addresses    int    // number of addresses scanned by either backend
+	Transactions int    // number of transactions fetched by either backend
+	BlockHash    string // hash of the block at the audit height, according to the left backend
+	Differences  []Difference
+}
+
+// SideError is returned by Reconcile when the audit against one of the backends fails.
+type SideError struct {
+	Side string // "left" or "right"
+	Err  error
+}
+
+func (e *SideError) Error() string {
+	return fmt.Sprintf("%s backend: %s", e.Side, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SideError) Unwrap() error {
+	return e.Err
+}
+
+// Reconcile computes the balance with each backend and returns the differences. It takes ownership
+// of both backends. An error (a *SideError) is only returned if one of the audits fails. Both
+// audits are anchored to the block at the audit height (see Accounter.EnableAnchor).
+func Reconcile(ctx context.Context, left, right backend.Backend, addressDeriver *deriver.AddressDeriver, lookahead uint32, blockHeight uint32) (*Reconciliation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	accounters := []*Accounter{
+		New(left, addressDeriver, lookahead, blockHeight),
+		New(right, addressDeriver, lookahead, blockHeight),
+	}
+	for _, a := range accounters {
+		a.EnableAnchor("")
+	}
+	balances := make([]uint64, 2)
+	// the first failure cancels the other audit, it's the one reported
+	var mu sync.Mutex
+	var sideErr *SideError
+	var wg sync.WaitGroup
+	for i, side := range []string{"left", "right"} {
+		wg.Add(1)
+		go func(i int, side string) {
+			defer wg.Done()
+			var err error
+			balances[i], err = accounters[i].ComputeBalance(ctx)
+			if err != nil {
+				mu.Lock()
+				if sideErr == nil {
+					sideErr = &SideError{Side: side, Err: err}
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(i, side)
+	}
+	wg.Wait()
+	if sideErr != nil {
+		return nil, sideErr
+	}
+
+	r := &Reconciliation{LeftBalance: balances[0], RightBalance: balances[1], BlockHash: accounters[0].BlockHash()}
+	if right := accounters[1].BlockHash(); right != r.BlockHash {
+		r.Differences = append(r.Differences, Difference{Kind: DiffBlock, Subject: fmt.Sprintf("%d", blockHeight), Left: r.BlockHash, Right: right})
+	}
+	if r.LeftBalance != r.RightBalance {
+		r.Differences = append(r.Differences, Difference{
+			Kind:  DiffBalance,
+			Left:  fmt.Sprintf("%d", r.LeftBalance),
+			Right: fmt.Sprintf("%d", r.RightBalance),
+		})
+	}
+	r.Differences = append(r.Differences, diffHistories(r, accounters[0], accounters[1])...)
+	r.Differences = append(r.Differences, diffTransactions(r, accounters[0], accounters[1])...)
+	return r, nil
+}
+
+// histories returns the transaction hashes of each address, keyed by address.
+func (a *Accounter) histories() map[string]map[string]struct{} {
+	histories := map[string]map[string]struct{}{}
+	for _, addr := range a.addresses {
+		txs := map[string]struct{}{}
+		for _, txHash := range addr.txHashes {
+			txs[txHash] = struct{}{}
+		}
+		histories[addr.path.String()] = txs
+	}
+	return histories
+}
+
+// fetchedTx returns a transaction fetched from the backend, whether it was used to compute the
+// balance or not.
+func (a *Accounter) fetchedTx(hash string) (transaction, bool) {
+	for _, txs := range []map[string]transaction{a.transactions, a.unconfirmed, a.aboveHeight} {
+		if tx, exists := txs[hash]; exists {
+			return tx, true
+		}
+	}
+	return transaction{}, false
+}
+
+// diffHistories compares the transactions of each address. An address which was only scanned by
+// one backend (the lookahead can stop at different indexes) is compared with an empty history.
+func diffHistories(r *Reconciliation, left, right *Accounter) []Difference {
+	l, rr := left.histories(), right.histories()
+	addresses := map[string]struct{}{}
+	for addr := range l {
+		addresses[addr] = struct{}{}
+	}
+	for addr := range rr {
+		addresses[addr] = struct{}{}
+	}
+	r.Addresses = len(addresses)
+
+	diffs := []Difference{}
+	for addr := range addresses {
+		onlyLeft, onlyRight := setDifference(l[addr], rr[addr]), setDifference(rr[addr], l[addr])
+		if len(onlyLeft) == 0 && len(onlyRight) == 0 {
+			continue
+		}
+		diffs = append(diffs, Difference{
+			Kind:    DiffHistory,
+			Subject: addr,
+			Left:    fmt.Sprintf("[%s]", strings.Join(onlyLeft, ", ")),
+			Right:   fmt.Sprintf("[%s]", strings.Join(onlyRight, ", ")),
+		})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Subject < diffs[j].Subject })
+	return diffs
+}
+
+// diffTransactions compares the transactions fetched by both backends. The transactions which
+// were only fetched by one backend show up in the histories.
+func diffTransactions(r *Reconciliation, left, right *Accounter) []Difference {
+	hashes := map[string]struct{}{}
+	for _, a := range []*Accounter{left, right} {
+		for _, txs := range []map[string]transaction{a.transactions, a.unconfirmed, a.aboveHeight} {
+			for hash := range txs {
+				hashes[hash] = struct{}{}
+			}
+		}
+	}
+	r.Transactions = len(hashes)
+
+	diffs := []Difference{}
+	for hash := range hashes {
+		l, lok := left.fetchedTx(hash)
+		rt, rok := right.fetchedTx(hash)
+		if !lok || !rok {
+			continue
+		}
+		if l.height != rt.height {
+			diffs = append(diffs, Difference{Kind: DiffHeight, Subject: hash,
+				Left: fmt.Sprintf("%d", l.height), Right: fmt.Sprintf("%d", rt.height)})
+		}
+		if l.hex != rt.hex {
+			diffs = append(diffs, Difference{Kind: DiffHex, Subject: hash,
+				Left: fmt.Sprintf("%d bytes", len(l.hex)/2), Right: fmt.Sprintf("%d bytes", len(rt.hex)/2)})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Subject != diffs[j].Subject {
+			return diffs[i].Subject < diffs[j].Subject
+		}
+		return diffs[i].Kind < diffs[j].Kind
+	})
+	return diffs
+}
+
+// setDifference returns the sorted elements of a which aren't in b.
+func setDifference(a, b map[string]struct{}) []string {
+	diff := []string{}
+	for k := range a {
+		if _, exists := b[k]; !exists {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
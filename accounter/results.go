@@ -0,0 +1,110 @@
+package accounter
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Accessors for the data behind the balance. They can only be called after ComputeBalance
+// succeeded.
+
+// Output is one of the wallet's unspent outputs.
+type Output struct {
+	TxHash       string
+	Index        uint32
+	Value        uint64 // in Satoshi
+	Address      string
+	Path         string
+	Change       uint32
+	AddressIndex uint32
+	Height       int64
+	Coinbase     bool
+	Immature     bool // coinbase output which can't be spent yet
+}
+
+// TxSummary describes how a transaction affected the wallet.
+type TxSummary struct {
+	Hash     string
+	Height   int64
+	Received uint64 // in Satoshi, sum of the outputs sent to our addresses
+	Sent     uint64 // in Satoshi, sum of our outputs spent by the transaction
+	Verified bool   // inclusion was checked with a merkle proof
+}
+
+// Outputs returns the wallet's unspent outputs at the audit height, sorted by transaction hash and
+// index.
+func (a *Accounter) Outputs() ([]Output, error) {
+	outputs := []Output{}
+	for hash, tx := range a.transactions {
+		for i, txout := range tx.vout {
+			if !txout.ours || txout.spentBy != nil {
+				continue
+			}
+			addr := a.addresses[txout.address].path
+			if addr == nil {
+				return nil, fmt.Errorf("output %s:%d belongs to an address which wasn't fetched", hash, i)
+			}
+			outputs = append(outputs, Output{
+				TxHash:       hash,
+				Index:        uint32(i),
+				Value:        uint64(txout.value),
+				Address:      addr.String(),
+				Path:         addr.Path(),
+				Change:       addr.Change(),
+				AddressIndex: addr.Index(),
+				Height:       tx.height,
+				Coinbase:     tx.coinbase,
+				Immature:     a.isImmature(tx),
+			})
+		}
+	}
+	sort.Slice(outputs, func(i, j int) bool {
+		if outputs[i].TxHash != outputs[j].TxHash {
+			return outputs[i].TxHash < outputs[j].TxHash
+		}
+		return outputs[i].Index < outputs[j].Index
+	})
+	return outputs, nil
+}
+
+// Verified returns the number of transactions applied to compute the balance whose inclusion in
+// the blockchain was checked with a merkle proof (SPV). Some backends can't provide proofs.
+func (a *Accounter) Verified() int {
+	verified := 0
+	for hash, tx := range a.transactions {
+		if tx.verified && !a.isSnapshotTx(hash) {
+			verified++
+		}
+	}
+	return verified
+}
+
+// Transactions returns the transactions which were applied to compute the balance, sorted by
+// height. When rolling forward from a snapshot, the snapshot's transactions aren't included.
+func (a *Accounter) Transactions() []TxSummary {
+	summaries := []TxSummary{}
+	for hash, tx := range a.transactions {
+		if a.isSnapshotTx(hash) {
+			continue
+		}
+		s := TxSummary{Hash: hash, Height: tx.height, Verified: tx.verified}
+		for _, txout := range tx.vout {
+			if txout.ours {
+				s.Received += uint64(txout.value)
+			}
+		}
+		for _, txin := range tx.vin {
+			if txout, ok := a.prevOutput(txin); ok && txout.ours {
+				s.Sent += uint64(txout.value)
+			}
+		}
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Height != summaries[j].Height {
+			return summaries[i].Height < summaries[j].Height
+		}
+		return summaries[i].Hash < summaries[j].Hash
+	})
+	return summaries
+}
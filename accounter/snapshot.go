@@ -0,0 +1,251 @@
+package accounter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/square/beancounter/backend"
+	"github.com/square/beancounter/reporter"
+	. "github.com/square/beancounter/utils"
+)
+
+// Re-auditing a wallet from scratch every month is wasteful: only the last few thousand blocks
+// changed. A snapshot captures the result of an audit (the unspent outputs, the last used indexes
+// and the hash of the block at the audit height). A later audit can roll forward from the
+// snapshot: the snapshot's outputs are loaded as if they came from the blockchain and only the
+// transactions above the snapshot's height are applied.
+//
+// If the block at the snapshot's height changed, the chain was reorganized under the snapshot and
+// the snapshot can't be trusted anymore.
+
+const snapshotVersion = 1
+
+// Snapshot is the state of a wallet at a given block.
+type Snapshot struct {
+	Version     int              `json:"version"`
+	BlockHeight uint32           `json:"block_height"`
+	BlockHash   string           `json:"block_hash"`
+	NextIndexes [2]uint32        `json:"next_indexes"` // 1 + the last used index, for each chain
+	Outputs     []snapshotOutput `json:"outputs"`      // unspent outputs
+}
+
+type snapshotOutput struct {
+	TxHash       string `json:"tx_hash"`
+	Index        uint32 `json:"index"`
+	Value        int64  `json:"value"`
+	Address      string `json:"address"`
+	Change       uint32 `json:"change"`
+	AddressIndex uint32 `json:"addr_index"`
+
+	// coinbase outputs need the height of their transaction, so we can tell when they mature.
+	Coinbase bool  `json:"coinbase,omitempty"`
+	Height   int64 `json:"height,omitempty"`
+}
+
+// ReorgError is returned when the block at the snapshot's height isn't the one recorded in the
+// snapshot, or when the block at the audit height changed (see EnableAnchor).
+type ReorgError struct {
+	Height   uint32
+	Expected string // block hash in the snapshot, or the anchor
+	Actual   string // block hash returned by the backend
+}
+
+func (e *ReorgError) Error() string {
+	return fmt.Sprintf("chain was reorganized: block %d is %s, expected %s", e.Height, e.Actual, e.Expected)
+}
+
+// LoadSnapshot reads a snapshot file.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %s", path, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s has version %d, expecting %d", path, s.Version, snapshotVersion)
+	}
+	return s, nil
+}
+
+// Save writes the snapshot to path.
+func (s *Snapshot) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Balance returns the sum of the snapshot's outputs.
+func (s *Snapshot) Balance() uint64 {
+	balance := uint64(0)
+	for _, out := range s.Outputs {
+		balance += uint64(out.Value)
+	}
+	return balance
+}
+
+// EnableSnapshot makes ComputeBalance fetch the hash of the block at the audit height, which is
+// required to call Snapshot() afterwards.
+func (a *Accounter) EnableSnapshot() {
+	a.snapshotEnabled = true
+}
+
+// RollForward starts the audit from s instead of from the genesis block. It must be called before
+// Resume and ComputeBalance. ComputeBalance returns a ReorgError if the block at the snapshot's
+// height changed.
+func (a *Accounter) RollForward(s *Snapshot) error {
+	if s.BlockHeight > a.blockHeight {
+		return fmt.Errorf("snapshot is at block height %d, which is above %d", s.BlockHeight, a.blockHeight)
+	}
+
+	a.snapshot = s
+	a.snapshotTxs = make(map[string]struct{})
+	for _, out := range s.Outputs {
+		derived, err := a.deriver.Derive(out.Change, out.AddressIndex)
+		if err != nil {
+			return &DeriveError{Err: err}
+		}
+		if derived.String() != out.Address {
+			return fmt.Errorf("snapshot doesn't match the wallet: %s is %s, not %s", derived.Path(), derived, out.Address)
+		}
+		script, err := derived.Script()
+		if err != nil {
+			return &DeriveError{Err: err}
+		}
+
+		// We only know about the outputs which are ours and unspent. The other outputs are
+		// placeholders, so that the indexes line up.
+		tx, exists := a.transactions[out.TxHash]
+		if !exists {
+			tx = transaction{height: int64(s.BlockHeight), vin: []vin{}, vout: []vout{}, coinbase: out.Coinbase}
+			if out.Coinbase {
+				tx.height = out.Height
+			}
+		}
+		for uint32(len(tx.vout)) <= out.Index {
+			tx.vout = append(tx.vout, vout{})
+		}
+		tx.vout[out.Index] = vout{value: out.Value, address: script, ours: true}
+		a.transactions[out.TxHash] = tx
+		a.snapshotTxs[out.TxHash] = struct{}{}
+	}
+
+	a.countMu.Lock()
+	for change := range a.lastAddresses {
+		a.lastAddresses[change] = Max(a.lastAddresses[change], s.NextIndexes[change]+a.lookahead)
+	}
+	a.countMu.Unlock()
+
+	reporter.GetInstance().Logf("rolling forward from block %d with %d outputs", s.BlockHeight, len(s.Outputs))
+	return nil
+}
+
+// checkReorg compares the block at the snapshot's height with the one recorded in the snapshot.
+func (a *Accounter) checkReorg(ctx context.Context) error {
+	hash, err := a.blockHash(ctx, a.snapshot.BlockHeight)
+	if err != nil {
+		return err
+	}
+	if hash != a.snapshot.BlockHash {
+		return &ReorgError{Height: a.snapshot.BlockHeight, Expected: a.snapshot.BlockHash, Actual: hash}
+	}
+	return nil
+}
+
+// blockHash requests the hash of the block at a given height from the backend.
+func (a *Accounter) blockHash(ctx context.Context, height uint32) (string, error) {
+	if err := a.backend.BlockRequest(ctx, height); err != nil {
+		return "", a.incomplete(err)
+	}
+	for {
+		select {
+		case resp := <-a.backend.BlockResponses():
+			if resp.Height != height {
+				continue
+			}
+			if resp.Hash == "" {
+				return "", fmt.Errorf("backend didn't return the hash of block %d", height)
+			}
+			return resp.Hash, nil
+		case err := <-a.backend.Errors():
+			var mismatch *backend.HeaderMismatchError
+			if errors.As(err, &mismatch) {
+				return "", &ReorgError{Height: mismatch.Height, Expected: mismatch.Expected, Actual: mismatch.Actual}
+			}
+			return "", err
+		case <-ctx.Done():
+			return "", a.incomplete(ctx.Err())
+		}
+	}
+}
+
+// wantTx returns true if the transaction needs to be fetched. When rolling forward, the
+// transactions at or below the snapshot's height are already accounted for.
+func (a *Accounter) wantTx(txHash string, heights map[string]int64) bool {
+	if a.snapshot == nil {
+		return true
+	}
+	if _, exists := a.snapshotTxs[txHash]; exists {
+		return false
+	}
+	height, known := heights[txHash]
+	return !known || height <= 0 || height > int64(a.snapshot.BlockHeight)
+}
+
+// isSnapshotTx returns true if the transaction was loaded from the snapshot.
+func (a *Accounter) isSnapshotTx(txHash string) bool {
+	_, exists := a.snapshotTxs[txHash]
+	return exists
+}
+
+// Snapshot returns the state of the wallet at the audit height. It can only be called after
+// ComputeBalance succeeded, with EnableSnapshot.
+func (a *Accounter) Snapshot() (*Snapshot, error) {
+	if a.blockHashAtHeight == "" {
+		return nil, fmt.Errorf("snapshots must be enabled before computing the balance")
+	}
+
+	s := &Snapshot{
+		Version:     snapshotVersion,
+		BlockHeight: a.blockHeight,
+		BlockHash:   a.blockHashAtHeight,
+		Outputs:     []snapshotOutput{},
+	}
+	if a.snapshot != nil {
+		s.NextIndexes = a.snapshot.NextIndexes
+	}
+	for _, addr := range a.addresses {
+		if len(addr.txHashes) > 0 {
+			change := addr.path.Change()
+			s.NextIndexes[change] = Max(s.NextIndexes[change], addr.path.Index()+1)
+		}
+	}
+
+	outputs, err := a.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range outputs {
+		out := snapshotOutput{
+			TxHash:       o.TxHash,
+			Index:        o.Index,
+			Value:        int64(o.Value),
+			Address:      o.Address,
+			Change:       o.Change,
+			AddressIndex: o.AddressIndex,
+		}
+		if o.Coinbase {
+			out.Coinbase = true
+			out.Height = o.Height
+		}
+		s.Outputs = append(s.Outputs, out)
+	}
+	return s, nil
+}
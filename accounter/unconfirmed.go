@@ -0,0 +1,79 @@
+package accounter
+
+import (
+	"fmt"
+)
+
+// The balance only includes transactions which have been mined at or below the audit height.
+// Transactions which haven't been mined yet (Electrum reports them with a height of 0 or -1, btcd
+// finds them in its mempool) are reported separately, as pending incoming and outgoing amounts.
+//
+// An unconfirmed transaction which spends the same output as a confirmed transaction will never
+// be mined. Such transactions are flagged and left out of the pending amounts.
+
+// Unconfirmed is the sum of the wallet's transactions which haven't been mined.
+type Unconfirmed struct {
+	Incoming     uint64 // in Satoshi, sent to our addresses
+	Outgoing     uint64 // in Satoshi, spent from our addresses
+	Transactions int    // number of unconfirmed transactions, excluding the conflicting ones
+}
+
+// Unconfirmed returns the wallet's pending amounts. It can only be called after ComputeBalance.
+func (a *Accounter) Unconfirmed() Unconfirmed {
+	u := Unconfirmed{}
+	conflicts := a.conflicts()
+	for hash, tx := range a.unconfirmed {
+		if _, conflicting := conflicts[hash]; conflicting {
+			continue
+		}
+		u.Transactions++
+		for _, txout := range tx.vout {
+			if txout.ours {
+				u.Incoming += uint64(txout.value)
+			}
+		}
+		for _, txin := range tx.vin {
+			if txout, ok := a.prevOutput(txin); ok && txout.ours {
+				u.Outgoing += uint64(txout.value)
+			}
+		}
+	}
+	return u
+}
+
+// prevOutput returns the output spent by txin, if we have the transaction which created it.
+func (a *Accounter) prevOutput(txin vin) (vout, bool) {
+	prev, exists := a.transactions[txin.prevHash]
+	if !exists {
+		prev, exists = a.unconfirmed[txin.prevHash]
+	}
+	if !exists || int(txin.index) >= len(prev.vout) {
+		return vout{}, false
+	}
+	return prev.vout[txin.index], true
+}
+
+// conflicts returns the unconfirmed transactions which spend an output already spent by a
+// confirmed transaction, along with the confirmed transaction.
+func (a *Accounter) conflicts() map[string]string {
+	conflicts := map[string]string{}
+	if len(a.unconfirmed) == 0 {
+		return conflicts
+	}
+
+	spent := map[string]string{} // "prevHash:index" => confirmed transaction
+	for hash, tx := range a.transactions {
+		for _, txin := range tx.vin {
+			spent[fmt.Sprintf("%s:%d", txin.prevHash, txin.index)] = hash
+		}
+	}
+	for hash, tx := range a.unconfirmed {
+		for _, txin := range tx.vin {
+			if confirmed, exists := spent[fmt.Sprintf("%s:%d", txin.prevHash, txin.index)]; exists {
+				conflicts[hash] = confirmed
+				break
+			}
+		}
+	}
+	return conflicts
+}
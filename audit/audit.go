@@ -0,0 +1,222 @@
+// Package audit lets Go programs embed beancounter. It wires a backend and an address deriver into
+// an Accounter and returns everything the audit found, not just the balance:
+//
+//	b, err := backend.NewElectrumBackend(addr, port, network, nil)
+//	...
+//	err = b.ValidateTip()
+//	...
+//	d, err := deriver.NewAddressDeriver(network, xpubs, m, "")
+//	...
+//	result, err := audit.Run(ctx, audit.WithBackend(b), audit.WithDeriver(d))
+//
+// Run takes ownership of the backend and finishes it before returning.
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/square/beancounter/accounter"
+	"github.com/square/beancounter/backend"
+	"github.com/square/beancounter/deriver"
+)
+
+const (
+	// DefaultLookahead is the number of unused addresses scanned after the last used one.
+	DefaultLookahead = 100
+
+	// DefaultConfirmations is the number of blocks between the audit height and the chain's tip,
+	// when the height isn't set.
+	DefaultConfirmations = 6
+)
+
+// ErrBlockHeightTooHigh is returned when the requested height doesn't have enough confirmations.
+var ErrBlockHeightTooHigh = errors.New("block height is too high")
+
+// Option configures an audit.
+type Option func(*config) error
+
+type config struct {
+	backend       backend.Backend
+	deriver       *deriver.AddressDeriver
+	lookahead     uint32
+	blockHeight   uint32
+	blockHash     string
+	anchor        bool
+	confirmations uint32
+}
+
+// WithBackend sets the backend used to fetch addresses, transactions and blocks. Required.
+func WithBackend(b backend.Backend) Option {
+	return func(c *config) error {
+		if b == nil {
+			return errors.New("backend can't be nil")
+		}
+		c.backend = b
+		return nil
+	}
+}
+
+// WithDeriver sets the wallet's address deriver. Required.
+func WithDeriver(d *deriver.AddressDeriver) Option {
+	return func(c *config) error {
+		if d == nil {
+			return errors.New("deriver can't be nil")
+		}
+		c.deriver = d
+		return nil
+	}
+}
+
+// WithLookahead sets the number of unused addresses to scan after the last used one. Defaults to
+// DefaultLookahead.
+func WithLookahead(lookahead uint32) Option {
+	return func(c *config) error {
+		if lookahead == 0 {
+			return errors.New("lookahead must be positive")
+		}
+		c.lookahead = lookahead
+		return nil
+	}
+}
+
+// WithBlockHeight sets the height at which the balance is computed. Defaults to the chain's
+// height minus the number of confirmations.
+func WithBlockHeight(height uint32) Option {
+	return func(c *config) error {
+		c.blockHeight = height
+		return nil
+	}
+}
+
+// WithBlockHash sets the block at which the balance is computed, as an alternative to
+// WithBlockHeight. The backend must implement backend.BlockFinder. The audit is anchored to the
+// block, see WithAnchor.
+func WithBlockHash(hash string) Option {
+	return func(c *config) error {
+		if hash == "" {
+			return errors.New("block hash can't be empty")
+		}
+		c.blockHash = hash
+		c.anchor = true
+		return nil
+	}
+}
+
+// WithAnchor records the hash of the block at the audit height and checks that the chain wasn't
+// reorganized during the audit. The hash is returned in Result.BlockHash.
+func WithAnchor() Option {
+	return func(c *config) error {
+		c.anchor = true
+		return nil
+	}
+}
+
+// WithConfirmations sets the number of blocks which must have been mined on top of the audit
+// height. Defaults to DefaultConfirmations.
+func WithConfirmations(confirmations uint32) Option {
+	return func(c *config) error {
+		c.confirmations = confirmations
+		return nil
+	}
+}
+
+// Result is everything the audit found.
+type Result struct {
+	BlockHeight  uint32
+	BlockHash    string // only set with WithAnchor or WithBlockHash
+	Balance      uint64 // in Satoshi, spendable
+	Immature     uint64 // in Satoshi, coinbase outputs which can't be spent yet
+	Unconfirmed  accounter.Unconfirmed
+	UTXOs        []accounter.Output
+	Transactions []accounter.TxSummary
+	Verified     int // number of Transactions which were SPV verified
+	Stats        accounter.Progress
+	Warnings     []accounter.Finding
+}
+
+// Run audits the wallet. Errors from the accounter (e.g. *accounter.IncompleteError or
+// accounter.ErrNegativeBalance) are returned as is, so they can be inspected with errors.As and
+// accounter.IsIntegrityError.
+func Run(ctx context.Context, opts ...Option) (*Result, error) {
+	c := &config{
+		lookahead:     DefaultLookahead,
+		confirmations: DefaultConfirmations,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			if c.backend != nil {
+				c.backend.Finish()
+			}
+			return nil, err
+		}
+	}
+	if c.backend == nil {
+		return nil, errors.New("a backend is required")
+	}
+	if err := c.resolveBlockHeight(ctx); err != nil {
+		c.backend.Finish()
+		return nil, err
+	}
+
+	a := accounter.New(c.backend, c.deriver, c.lookahead, c.blockHeight)
+	if c.anchor {
+		a.EnableAnchor(c.blockHash)
+	}
+	balance, err := a.ComputeBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := a.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		BlockHeight:  c.blockHeight,
+		BlockHash:    a.BlockHash(),
+		Balance:      balance,
+		Immature:     a.Immature(),
+		Unconfirmed:  a.Unconfirmed(),
+		UTXOs:        utxos,
+		Transactions: a.Transactions(),
+		Verified:     a.Verified(),
+		Stats:        a.Progress(),
+		Warnings:     a.Findings(),
+	}, nil
+}
+
+// resolveBlockHeight validates the configuration, looks up the block hash and defaults the block
+// height.
+func (c *config) resolveBlockHeight(ctx context.Context) error {
+	if c.deriver == nil {
+		return errors.New("a deriver is required")
+	}
+	if c.blockHash != "" {
+		if c.blockHeight != 0 {
+			return errors.New("WithBlockHeight and WithBlockHash can't be used together")
+		}
+		finder, ok := c.backend.(backend.BlockFinder)
+		if !ok {
+			return errors.New("the backend can't look up blocks by hash")
+		}
+		height, err := finder.BlockHeight(ctx, c.blockHash)
+		if err != nil {
+			return err
+		}
+		c.blockHeight = height
+	}
+	tip := c.backend.ChainHeight()
+	if c.blockHeight == 0 {
+		if tip < c.confirmations {
+			return fmt.Errorf("chain height %d is below %d confirmations, set the block height", tip, c.confirmations)
+		}
+		c.blockHeight = tip - c.confirmations
+		return nil
+	}
+	// backends without a chain height (e.g. the fixture backend) report 0.
+	if tip != 0 && (tip < c.confirmations || c.blockHeight > tip-c.confirmations) {
+		return fmt.Errorf("%w: %d > %d - %d", ErrBlockHeightTooHigh, c.blockHeight, tip, c.confirmations)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/square/beancounter/backend"
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const tpub = "tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"
+
+func TestRun(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{tpub}, 1, "")
+	assert.NoError(t, err)
+	b, err := backend.NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+
+	result, err := Run(context.Background(), WithBackend(b), WithDeriver(d), WithBlockHeight(1435169))
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint32(1435169), result.BlockHeight)
+	assert.Equal(t, uint64(267893477), result.Balance)
+	assert.Len(t, result.Transactions, 15)
+	assert.Len(t, result.Warnings, 3)
+	assert.Equal(t, uint32(15), result.Stats.TransactionsProcessed)
+
+	sum := uint64(0)
+	for _, utxo := range result.UTXOs {
+		sum += utxo.Value
+	}
+	assert.Equal(t, result.Balance, sum)
+}
+
+func TestRunOptions(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{tpub}, 1, "")
+	assert.NoError(t, err)
+
+	_, err = Run(context.Background(), WithDeriver(d))
+	assert.EqualError(t, err, "a backend is required")
+
+	b, err := backend.NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+	_, err = Run(context.Background(), WithBackend(b), WithDeriver(d), WithLookahead(0))
+	assert.EqualError(t, err, "lookahead must be positive")
+
+	// the fixture backend doesn't know the chain's height
+	b, err = backend.NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+	_, err = Run(context.Background(), WithBackend(b), WithDeriver(d))
+	assert.Error(t, err)
+
+	c := &config{deriver: d, backend: &tipBackend{b, 1000}, confirmations: 6}
+	assert.NoError(t, c.resolveBlockHeight(context.Background()))
+	assert.Equal(t, uint32(994), c.blockHeight)
+
+	c = &config{deriver: d, backend: &tipBackend{b, 1000}, confirmations: 6, blockHeight: 995}
+	assert.True(t, errors.Is(c.resolveBlockHeight(context.Background()), ErrBlockHeightTooHigh))
+
+	// the fixture backend looks up blocks by hash, but doesn't have this one
+	c = &config{deriver: d, backend: b, blockHash: "unknown"}
+	assert.EqualError(t, c.resolveBlockHeight(context.Background()), "fixture doesn't contain block unknown")
+
+	c = &config{deriver: d, backend: &tipBackend{b, 1000}, blockHash: "unknown"}
+	assert.EqualError(t, c.resolveBlockHeight(context.Background()), "the backend can't look up blocks by hash")
+
+	c = &config{deriver: d, backend: b, blockHash: "unknown", blockHeight: 1000}
+	assert.Error(t, c.resolveBlockHeight(context.Background()))
+}
+
+// tipBackend overrides the chain height.
+type tipBackend struct {
+	backend.Backend
+	tip uint32
+}
+
+func (b *tipBackend) ChainHeight() uint32 {
+	return b.tip
+}
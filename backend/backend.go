@@ -1,8 +1,15 @@
 package backend
 
 import (
-	"github.com/square/beancounter/deriver"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
 	time "time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/square/beancounter/deriver"
 )
 
 // Backend is an interface which abstracts different types of backends.
@@ -27,23 +34,67 @@ import (
 // Accounter to wait until the Backend is done with any additional requests. In theory, we could
 // forgo the Finish() method and have the Accounter read from the TxResponses channel until it has
 // all the data it needs. This would require the Accounter to maintain its own set of transactions.
+//
+// Requests which can't be completed (and won't be retried) are reported on the Errors() channel.
+// The caller should treat any error as fatal: the corresponding response will never be sent.
+//
+// Scheduling a request blocks until the backend has room for it. If the context is done first,
+// the request is dropped and the context's error is returned. Finish() must be called once the
+// caller is done with the backend, including after a cancellation: it stops all the backend's
+// goroutines, even the ones blocked on sending responses nobody is going to read.
 type Backend interface {
 	ChainHeight() uint32
 
-	AddrRequest(addr *deriver.Address)
+	AddrRequest(ctx context.Context, addr *deriver.Address) error
 	AddrResponses() <-chan *AddrResponse
-	TxRequest(txHash string)
+	TxRequest(ctx context.Context, txHash string) error
 	TxResponses() <-chan *TxResponse
-	BlockRequest(height uint32)
+	BlockRequest(ctx context.Context, height uint32) error
 	BlockResponses() <-chan *BlockResponse
+	Errors() <-chan error
 
 	Finish()
 }
 
+// BlockFinder is implemented by the backends which can look up a block by its hash. It must be
+// called before the backend is handed to an Accounter.
+type BlockFinder interface {
+	// BlockHeight returns the height of a block in the main chain.
+	BlockHeight(ctx context.Context, hash string) (uint32, error)
+}
+
+// ServerReporter is implemented by the backends which spread the requests over several servers. It
+// reports the transactions the servers didn't agree on, in quorum mode (see quorum.go), and what
+// each server saw, in privacy mode (see privacy.go).
+type ServerReporter interface {
+	Disagreements() []Disagreement
+	PrivacyExposure() []Exposure
+}
+
+// Error is reported on the Errors() channel when a backend fails to process a request.
+type Error struct {
+	Request string // the address, transaction hash or block height which was requested
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("backend failed to process %s: %s", e.Request, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // AddrResponse lists transaction hashes for a given address
 type AddrResponse struct {
 	Address  *deriver.Address
 	TxHashes []string
+
+	// TxHeights maps transaction hashes to heights, for the backends which get the heights along
+	// with the address' history (nil otherwise). It lets the accounter skip transactions it
+	// doesn't need.
+	TxHeights map[string]int64
 }
 
 // TxResponse contains raw transaction, transaction hash and a block height in which
@@ -52,10 +103,15 @@ type TxResponse struct {
 	Hash   string
 	Height int64
 	Hex    string
+
+	// Verified is true if the backend checked that the transaction was mined at Height, with a
+	// merkle proof (see spv.go).
+	Verified bool
 }
 
 type BlockResponse struct {
 	Height    uint32
+	Hash      string
 	Timestamp time.Time
 }
 
@@ -63,3 +119,52 @@ type BlockResponse struct {
 func (r *AddrResponse) HasTransactions() bool {
 	return len(r.TxHashes) > 0
 }
+
+// reportError sends err on the errors channel without blocking. Since any error is fatal, it's
+// fine to drop errors once the channel's buffer is full.
+func reportError(errors chan error, request string, err error) {
+	select {
+	case errors <- &Error{Request: request, Err: err}:
+	default:
+	}
+}
+
+// TxHashError is returned when a transaction's bytes don't hash to the transaction hash they were
+// returned for.
+type TxHashError struct {
+	Requested string
+	Actual    string
+}
+
+func (e *TxHashError) Error() string {
+	return fmt.Sprintf("transaction %s was returned for %s", e.Actual, e.Requested)
+}
+
+// HeaderMismatchError is reported when a server's block at a height isn't the one in the validated
+// header chain, e.g. because the chain was reorganized since the header was validated.
+type HeaderMismatchError struct {
+	Height   uint32
+	Expected string
+	Actual   string
+}
+
+func (e *HeaderMismatchError) Error() string {
+	return fmt.Sprintf("block %d is %s, expected %s", e.Height, e.Actual, e.Expected)
+}
+
+// checkTxHash decodes a raw transaction and checks that it hashes to txHash. The hash is the
+// double SHA-256 of the transaction without its witness data.
+func checkTxHash(txHash, txHex string) error {
+	b, err := hex.DecodeString(txHex)
+	if err != nil {
+		return fmt.Errorf("failed to unhex transaction %s: %s", txHash, err)
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("failed to parse transaction %s: %s", txHash, err)
+	}
+	if actual := tx.TxHash().String(); actual != txHash {
+		return &TxHashError{Requested: txHash, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,630 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/square/beancounter/deriver"
+	"github.com/square/beancounter/reporter"
+	. "github.com/square/beancounter/utils"
+)
+
+// BitcoindBackend fetches the wallet's transactions from Bitcoin Core. Core doesn't have an
+// address index, so the backend creates a temporary watch-only descriptor wallet, imports the
+// wallet's descriptors (see deriver.Descriptors) and lets the node rescan the chain from the
+// wallet's birthday. Addresses and transactions are then answered from the wallet's history
+// (listtransactions and gettransaction).
+//
+// The descriptors are imported for the first descriptorRange addresses of each chain. When the
+// Accounter asks for an address beyond the imported range, the range is doubled, which triggers
+// another rescan.
+//
+// The temporary wallet is unloaded by Finish(). Core can't delete wallets over RPC, so it's left
+// in the node's wallet directory.
+type BitcoindBackend struct {
+	chainHeight uint32
+
+	client      *rpcclient.Client // node RPCs
+	wallet      *rpcclient.Client // RPCs of the temporary wallet
+	walletName  string
+	network     Network
+	descriptors []string
+	birthday    int64 // rescans start from blocks with this timestamp
+
+	walletMu sync.RWMutex           // guards rangeEnd, history and txs
+	rangeEnd uint32                 // addresses below this index have been imported
+	history  map[string][]string    // address => transaction hashes
+	txs      map[string]*bitcoindTx // transactions of the temporary wallet
+
+	blockHeightMu     sync.Mutex // mutex to guard read/writes to blockHeightLookup map
+	blockHeightLookup map[string]int64
+
+	// channels used to communicate with the Accounter
+	addrRequests  chan *deriver.Address
+	addrResponses chan *AddrResponse
+	txRequests    chan string
+	txResponses   chan *TxResponse
+
+	// channels used to communicate with the Blockfinder
+	blockRequests  chan uint32
+	blockResponses chan *BlockResponse
+
+	errors chan error
+	doneCh chan bool
+}
+
+type bitcoindTx struct {
+	resp      TxResponse
+	blockHash string
+	msg       *wire.MsgTx
+}
+
+const (
+	// number of addresses of each chain imported at first.
+	descriptorRange = 1000
+
+	// number of transactions per listtransactions call.
+	listTransactionsPage = 1000
+)
+
+// NewBitcoindBackend connects to a Bitcoin Core node and imports the derivers' descriptors into a
+// new watch-only wallet. The node rescans the blocks starting at birthday (a block height), which
+// can take a while. Testnet wallets can be audited against a regtest node.
+//
+// Like the Btcd backend, the RPC connection doesn't use TLS.
+func NewBitcoindBackend(host, port, user, pass string, network Network, derivers []*deriver.AddressDeriver, birthday uint32) (*BitcoindBackend, error) {
+	client, err := newBitcoindClient(fmt.Sprintf("%s:%s", host, port), user, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that we are talking to the right chain. Testnet addresses are also valid on regtest.
+	genesis, err := client.GetBlockHash(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetBlockHash(0) failed")
+	}
+	if genesis.String() != GenesisBlock(network) &&
+		!(network == Testnet && genesis.IsEqual(chaincfg.RegressionNetParams.GenesisHash)) {
+		return nil, errors.Errorf("Unexpected genesis block %s != %s", genesis.String(), GenesisBlock(network))
+	}
+
+	height, err := client.GetBlockCount()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the Bitcoin Core node")
+	}
+
+	b := &BitcoindBackend{
+		client:         client,
+		network:        network,
+		chainHeight:    uint32(height),
+		walletName:     fmt.Sprintf("beancounter-%d", time.Now().UnixNano()),
+		history:        make(map[string][]string),
+		txs:            make(map[string]*bitcoindTx),
+		addrRequests:   make(chan *deriver.Address, addrRequestsChanSize),
+		addrResponses:  make(chan *AddrResponse, addrRequestsChanSize),
+		txRequests:     make(chan string, 2*maxTxsPerAddr),
+		txResponses:    make(chan *TxResponse, 2*maxTxsPerAddr),
+		blockRequests:  make(chan uint32, 2*blockRequestChanSize),
+		blockResponses: make(chan *BlockResponse, 2*blockRequestChanSize),
+		errors:         make(chan error, concurrency),
+
+		blockHeightLookup: make(map[string]int64),
+		doneCh:            make(chan bool),
+	}
+	for _, d := range derivers {
+		b.descriptors = append(b.descriptors, d.Descriptors()...)
+	}
+
+	if birthday > 0 {
+		hash, err := client.GetBlockHash(int64(birthday))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch block %d", birthday)
+		}
+		header, err := client.GetBlockHeaderVerbose(hash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not fetch block %d", birthday)
+		}
+		b.birthday = header.Time
+	}
+
+	if len(b.descriptors) > 0 {
+		if err := b.createWallet(host, port, user, pass); err != nil {
+			return nil, err
+		}
+		b.walletMu.Lock()
+		err := b.importDescriptors(descriptorRange)
+		b.walletMu.Unlock()
+		if err != nil {
+			b.unloadWallet()
+			return nil, err
+		}
+	}
+
+	// launch
+	for i := 0; i < concurrency; i++ {
+		go b.processRequests()
+	}
+	return b, nil
+}
+
+func newBitcoindClient(host, user, pass string) (*rpcclient.Client, error) {
+	connCfg := &rpcclient.ConnConfig{
+		Host:         host,
+		User:         user,
+		Pass:         pass,
+		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
+		DisableTLS:   true, // Since we're assuming a personal bitcoin node for now, skip TLS
+	}
+	client, err := rpcclient.New(connCfg, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create a Bitcoin Core RPC client")
+	}
+	return client, nil
+}
+
+// rawRequest marshals the parameters and sends a request.
+func rawRequest(client *rpcclient.Client, method string, params ...interface{}) (json.RawMessage, error) {
+	raw := make([]json.RawMessage, 0, len(params))
+	for _, p := range params {
+		r, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, r)
+	}
+	result, err := client.RawRequest(method, raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s failed", method)
+	}
+	return result, nil
+}
+
+// createWallet creates the temporary watch-only descriptor wallet.
+func (b *BitcoindBackend) createWallet(host, port, user, pass string) error {
+	// name, disable_private_keys, blank, passphrase, avoid_reuse, descriptors, load_on_startup
+	_, err := rawRequest(b.client, "createwallet", b.walletName, true, true, "", false, true, false)
+	if err != nil {
+		return err
+	}
+	b.wallet, err = newBitcoindClient(fmt.Sprintf("%s:%s/wallet/%s", host, port, b.walletName), user, pass)
+	if err != nil {
+		b.unloadWallet()
+		return err
+	}
+	reporter.GetInstance().Logf("created watch-only wallet %s", b.walletName)
+	return nil
+}
+
+func (b *BitcoindBackend) unloadWallet() {
+	if _, err := rawRequest(b.client, "unloadwallet", b.walletName); err != nil {
+		log.Printf("failed to unload wallet %s: %+v", b.walletName, err)
+	}
+}
+
+// importDescriptors imports the descriptors up to index end (excluded), waits for the node to
+// rescan and reloads the wallet's history. The caller must hold walletMu.
+func (b *BitcoindBackend) importDescriptors(end uint32) error {
+	requests := []map[string]interface{}{}
+	for _, desc := range b.descriptors {
+		r := map[string]interface{}{"desc": desc, "timestamp": b.birthday}
+		if strings.Contains(desc, "*") {
+			// a new range must include the range which was already imported.
+			r["range"] = []uint32{0, end - 1}
+		}
+		requests = append(requests, r)
+	}
+	reporter.GetInstance().Logf("importing %d addresses per chain, rescanning from %d", end, b.birthday)
+	result, err := rawRequest(b.wallet, "importdescriptors", requests)
+	if err != nil {
+		return err
+	}
+	var statuses []struct {
+		Success bool `json:"success"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(result, &statuses); err != nil {
+		return errors.Wrap(err, "invalid importdescriptors result")
+	}
+	for i, status := range statuses {
+		if !status.Success {
+			msg := "unknown error"
+			if status.Error != nil {
+				msg = status.Error.Message
+			}
+			return errors.Errorf("failed to import %s: %s", b.descriptors[i], msg)
+		}
+	}
+	b.rangeEnd = end
+	return b.loadHistory()
+}
+
+// loadHistory fetches the wallet's transactions and indexes them by address. The caller must hold
+// walletMu.
+func (b *BitcoindBackend) loadHistory() error {
+	txids := []string{}
+	seen := map[string]struct{}{}
+	for skip := 0; ; skip += listTransactionsPage {
+		result, err := rawRequest(b.wallet, "listtransactions", "*", listTransactionsPage, skip, true)
+		if err != nil {
+			return err
+		}
+		var entries []struct {
+			TxID string `json:"txid"`
+		}
+		if err := json.Unmarshal(result, &entries); err != nil {
+			return errors.Wrap(err, "invalid listtransactions result")
+		}
+		for _, e := range entries {
+			if _, exists := seen[e.TxID]; !exists {
+				seen[e.TxID] = struct{}{}
+				txids = append(txids, e.TxID)
+			}
+		}
+		if len(entries) < listTransactionsPage {
+			break
+		}
+	}
+
+	for _, txid := range txids {
+		if _, exists := b.txs[txid]; exists {
+			continue
+		}
+		tx, err := b.getTransaction(txid)
+		if err != nil {
+			return err
+		}
+		if tx != nil {
+			b.txs[txid] = tx
+		}
+	}
+
+	msgs := make(map[string]*wire.MsgTx, len(b.txs))
+	for hash, tx := range b.txs {
+		msgs[hash] = tx.msg
+	}
+	b.history = indexHistory(msgs, b.network.ChainConfig())
+	reporter.GetInstance().Logf("wallet %s has %d transactions", b.walletName, len(b.txs))
+	return nil
+}
+
+// getTransaction fetches a transaction of the wallet. Transactions which conflict with the main
+// chain are skipped (nil is returned).
+func (b *BitcoindBackend) getTransaction(txid string) (*bitcoindTx, error) {
+	result, err := rawRequest(b.wallet, "gettransaction", txid, true)
+	if err != nil {
+		return nil, err
+	}
+	var tx struct {
+		Hex           string `json:"hex"`
+		BlockHash     string `json:"blockhash"`
+		Confirmations int64  `json:"confirmations"`
+	}
+	if err := json.Unmarshal(result, &tx); err != nil {
+		return nil, errors.Wrapf(err, "invalid transaction %s", txid)
+	}
+	if tx.Confirmations < 0 {
+		reporter.GetInstance().Logf("skipping transaction %s, it conflicts with the main chain", txid)
+		return nil, nil
+	}
+	if err := checkTxHash(txid, tx.Hex); err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(tx.Hex)
+	if err != nil {
+		return nil, err
+	}
+	msg := &wire.MsgTx{}
+	if err := msg.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+
+	var height int64
+	if tx.Confirmations > 0 {
+		height, err = b.getBlockHeight(tx.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &bitcoindTx{
+		resp:      TxResponse{Hash: txid, Height: height, Hex: tx.Hex},
+		blockHash: tx.BlockHash,
+		msg:       msg,
+	}, nil
+}
+
+// indexHistory returns the transactions which pay to or spend from each address. The transactions'
+// inputs are only matched with the outputs of the other transactions, which is enough since the
+// wallet has every transaction which pays it.
+func indexHistory(txs map[string]*wire.MsgTx, params *chaincfg.Params) map[string][]string {
+	hashes := make([]string, 0, len(txs))
+	for hash := range txs {
+		hashes = append(hashes, hash)
+	}
+	// keep the histories stable
+	sort.Strings(hashes)
+
+	history := map[string][]string{}
+	outputs := map[wire.OutPoint]string{}
+	add := func(addr, hash string) {
+		h := history[addr]
+		if len(h) == 0 || h[len(h)-1] != hash {
+			history[addr] = append(h, hash)
+		}
+	}
+	for _, hash := range hashes {
+		txHash := txs[hash].TxHash()
+		for i, out := range txs[hash].TxOut {
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(out.PkScript, params)
+			if err != nil || len(addrs) != 1 {
+				continue
+			}
+			outputs[wire.OutPoint{Hash: txHash, Index: uint32(i)}] = addrs[0].EncodeAddress()
+			add(addrs[0].EncodeAddress(), hash)
+		}
+	}
+	for _, hash := range hashes {
+		for _, in := range txs[hash].TxIn {
+			if addr, exists := outputs[in.PreviousOutPoint]; exists {
+				add(addr, hash)
+			}
+		}
+	}
+	return history
+}
+
+// AddrRequest schedules a request to the backend to lookup information related
+// to the given address.
+func (b *BitcoindBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	select {
+	case b.addrRequests <- addr:
+		reporter.GetInstance().IncAddressesScheduled()
+		reporter.GetInstance().Logf("scheduling address: %s", addr)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddrResponses exposes a channel that allows to consume backend's responses to
+// address requests created with AddrRequest()
+func (b *BitcoindBackend) AddrResponses() <-chan *AddrResponse {
+	return b.addrResponses
+}
+
+// TxRequest schedules a request to the backend to lookup information related
+// to the given transaction hash.
+func (b *BitcoindBackend) TxRequest(ctx context.Context, txHash string) error {
+	select {
+	case b.txRequests <- txHash:
+		reporter.GetInstance().IncTxScheduled()
+		reporter.GetInstance().Logf("scheduling tx: %s", txHash)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TxResponses exposes a channel that allows to consume backend's responses to
+// transaction requests created with TxRequest().
+func (b *BitcoindBackend) TxResponses() <-chan *TxResponse {
+	return b.txResponses
+}
+
+func (b *BitcoindBackend) BlockRequest(ctx context.Context, height uint32) error {
+	select {
+	case b.blockRequests <- height:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *BitcoindBackend) BlockResponses() <-chan *BlockResponse {
+	return b.blockResponses
+}
+
+// BlockHeight returns the height of a block in the main chain.
+func (b *BitcoindBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	height, err := b.getBlockHeight(hash)
+	if err != nil {
+		return 0, err
+	}
+	mainChain, err := b.client.GetBlockHash(height)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not fetch block %d", height)
+	}
+	if mainChain.String() != hash {
+		return 0, errors.Errorf("block %s isn't in the main chain", hash)
+	}
+	return uint32(height), nil
+}
+
+// Errors exposes a channel on which the backend reports requests it failed to process.
+func (b *BitcoindBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Finish informs the backend to stop doing its work and unloads the temporary wallet.
+func (b *BitcoindBackend) Finish() {
+	close(b.doneCh)
+	if b.wallet != nil {
+		b.unloadWallet()
+		b.wallet.Shutdown()
+	}
+	b.client.Shutdown()
+}
+
+func (b *BitcoindBackend) ChainHeight() uint32 {
+	return b.chainHeight
+}
+
+func (b *BitcoindBackend) processRequests() {
+	for {
+		select {
+		case addr := <-b.addrRequests:
+			err := b.processAddrRequest(addr)
+			if err != nil {
+				log.Printf("processAddrRequest failed: %+v", err)
+				reportError(b.errors, addr.String(), err)
+			}
+		case tx := <-b.txRequests:
+			err := b.processTxRequest(tx)
+			if err != nil {
+				log.Printf("processTxRequest failed: %+v", err)
+				reportError(b.errors, tx, err)
+			}
+		case block := <-b.blockRequests:
+			err := b.processBlockRequest(block)
+			if err != nil {
+				log.Printf("processBlockRequest failed: %+v", err)
+				reportError(b.errors, fmt.Sprintf("block %d", block), err)
+			}
+		case <-b.doneCh:
+			return
+		}
+	}
+}
+
+func (b *BitcoindBackend) processAddrRequest(addr *deriver.Address) error {
+	if b.wallet == nil {
+		return errors.New("no descriptors were imported")
+	}
+	if err := b.extendRange(addr.Index()); err != nil {
+		return err
+	}
+
+	b.walletMu.RLock()
+	txHashes := append([]string{}, b.history[addr.String()]...)
+	txHeights := make(map[string]int64, len(txHashes))
+	for _, hash := range txHashes {
+		txHeights[hash] = b.txs[hash].resp.Height
+	}
+	b.walletMu.RUnlock()
+
+	select {
+	case b.addrResponses <- &AddrResponse{Address: addr, TxHashes: txHashes, TxHeights: txHeights}:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+// extendRange imports more addresses if index is beyond the imported range.
+func (b *BitcoindBackend) extendRange(index uint32) error {
+	b.walletMu.RLock()
+	imported := index < b.rangeEnd
+	b.walletMu.RUnlock()
+	if imported {
+		return nil
+	}
+
+	b.walletMu.Lock()
+	defer b.walletMu.Unlock()
+	if index < b.rangeEnd {
+		return nil
+	}
+	return b.importDescriptors(Max(2*b.rangeEnd, index+1))
+}
+
+func (b *BitcoindBackend) processTxRequest(txHash string) error {
+	b.walletMu.RLock()
+	tx, exists := b.txs[txHash]
+	b.walletMu.RUnlock()
+	if !exists {
+		return errors.Errorf("transaction %s isn't in the wallet", txHash)
+	}
+
+	resp := tx.resp
+	if resp.Height > 0 {
+		if err := b.verifyTx(&resp, tx.blockHash); err != nil {
+			return err
+		}
+	}
+	select {
+	case b.txResponses <- &resp:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+// verifyTx checks a mined transaction with gettxoutproof and sets resp.Verified. Passing the block
+// hash lets Core find the transaction without a transaction index.
+func (b *BitcoindBackend) verifyTx(resp *TxResponse, blockHash string) error {
+	result, err := rawRequest(b.client, "gettxoutproof", []string{resp.Hash}, blockHash)
+	if err != nil {
+		return err
+	}
+	mb, err := decodeTxOutProof(result, resp.Hash, resp.Height)
+	if err != nil {
+		return err
+	}
+	// the proof's block must be the one at the height the node claims.
+	mainChain, err := b.client.GetBlockHash(resp.Height)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch block %d", resp.Height)
+	}
+	if err := verifyMerkleBlock(resp.Hash, resp.Height, mb, mainChain.String()); err != nil {
+		return err
+	}
+	resp.Verified = true
+	return nil
+}
+
+func (b *BitcoindBackend) processBlockRequest(height uint32) error {
+	hash, err := b.client.GetBlockHash(int64(height))
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch block %d", height)
+	}
+	header, err := b.client.GetBlockHeader(hash)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch block %d", height)
+	}
+	select {
+	case b.blockResponses <- &BlockResponse{Height: height, Hash: hash.String(), Timestamp: header.Timestamp}:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+// getBlockHeight returns the height of a block, given its hash.
+func (b *BitcoindBackend) getBlockHeight(hash string) (int64, error) {
+	b.blockHeightMu.Lock()
+	height, exists := b.blockHeightLookup[hash]
+	b.blockHeightMu.Unlock()
+	if exists {
+		return height, nil
+	}
+
+	h, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return -1, err
+	}
+	header, err := b.client.GetBlockHeaderVerbose(h)
+	if err != nil {
+		if jerr, ok := err.(*btcjson.RPCError); ok && jerr.Code == btcjson.ErrRPCInvalidAddressOrKey {
+			return -1, errors.Wrap(err, "blockchain doesn't have block "+hash)
+		}
+		return -1, errors.Wrap(err, "could not fetch block "+hash)
+	}
+
+	b.blockHeightMu.Lock()
+	b.blockHeightLookup[hash] = int64(header.Height)
+	b.blockHeightMu.Unlock()
+	return int64(header.Height), nil
+}
@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTpub = "tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"
+
+func TestIndexHistory(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	ours, err := d.Derive(0, 0)
+	assert.NoError(t, err)
+	theirs, err := d.Derive(0, 1)
+	assert.NoError(t, err)
+	script := func(addr *deriver.Address) []byte {
+		a, err := addr.Address()
+		assert.NoError(t, err)
+		s, err := txscript.PayToAddrScript(a)
+		assert.NoError(t, err)
+		return s
+	}
+
+	// funding pays us, spending sends the output elsewhere without change
+	funding := wire.NewMsgTx(1)
+	funding.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{1}}, nil, nil))
+	funding.AddTxOut(wire.NewTxOut(1000, script(theirs)))
+	funding.AddTxOut(wire.NewTxOut(5000, script(ours)))
+	spending := wire.NewMsgTx(1)
+	spending.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: funding.TxHash(), Index: 1}, nil, nil))
+	spending.AddTxOut(wire.NewTxOut(4000, []byte{0x6a}))
+
+	history := indexHistory(map[string]*wire.MsgTx{
+		funding.TxHash().String():  funding,
+		spending.TxHash().String(): spending,
+	}, Testnet.ChainConfig())
+	assert.Equal(t, []string{funding.TxHash().String(), spending.TxHash().String()}, history[ours.String()])
+	assert.Equal(t, []string{funding.TxHash().String()}, history[theirs.String()])
+}
+
+// TestBitcoindRegtest runs against a local regtest node, e.g.
+//
+//	bitcoind -regtest -fallbackfee=0.0001 -rpcuser=u -rpcpassword=p
+//	BEANCOUNTER_BITCOIND=u:p@localhost:18443 go test ./backend -run Bitcoind
+//
+// The node funds the test's addresses from its own wallet, using mined coins.
+func TestBitcoindRegtest(t *testing.T) {
+	config := os.Getenv("BEANCOUNTER_BITCOIND")
+	if config == "" {
+		t.Skip("BEANCOUNTER_BITCOIND isn't set")
+	}
+	parts := strings.SplitN(config, "@", 2)
+	credentials := strings.SplitN(parts[0], ":", 2)
+	host, port, err := net.SplitHostPort(parts[1])
+	assert.NoError(t, err)
+
+	node, err := newBitcoindClient(parts[1], credentials[0], credentials[1])
+	assert.NoError(t, err)
+	defer node.Shutdown()
+	// the wallet may already exist (and be loaded) from a previous run
+	rawRequest(node, "createwallet", "beancounter-funds")
+	rawRequest(node, "loadwallet", "beancounter-funds")
+	funds, err := newBitcoindClient(parts[1]+"/wallet/beancounter-funds", credentials[0], credentials[1])
+	assert.NoError(t, err)
+	defer funds.Shutdown()
+	call := func(client *rpcclient.Client, method string, params ...interface{}) json.RawMessage {
+		result, err := rawRequest(client, method, params...)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return result
+	}
+
+	var miner string
+	assert.NoError(t, json.Unmarshal(call(funds, "getnewaddress"), &miner))
+	call(funds, "generatetoaddress", 101, miner)
+	birthday, err := node.GetBlockCount()
+	assert.NoError(t, err)
+
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	receive, err := d.Derive(0, 2)
+	assert.NoError(t, err)
+	// beyond the imported range, the backend has to import more addresses
+	far, err := d.Derive(1, descriptorRange+5)
+	assert.NoError(t, err)
+	var txid string
+	assert.NoError(t, json.Unmarshal(call(funds, "sendtoaddress", receive.String(), 1.5), &txid))
+	call(funds, "sendtoaddress", far.String(), 0.5)
+	call(funds, "generatetoaddress", 1, miner)
+
+	b, err := NewBitcoindBackend(host, port, credentials[0], credentials[1], Testnet, []*deriver.AddressDeriver{d}, uint32(birthday))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer b.Finish()
+	ctx := context.Background()
+
+	assert.NoError(t, b.AddrRequest(ctx, receive))
+	resp := <-b.AddrResponses()
+	assert.Equal(t, []string{txid}, resp.TxHashes)
+	assert.Equal(t, birthday+1, resp.TxHeights[txid])
+
+	assert.NoError(t, b.AddrRequest(ctx, far))
+	resp = <-b.AddrResponses()
+	assert.Len(t, resp.TxHashes, 1)
+
+	assert.NoError(t, b.TxRequest(ctx, txid))
+	select {
+	case tx := <-b.TxResponses():
+		assert.Equal(t, birthday+1, tx.Height)
+		assert.True(t, tx.Verified)
+	case err := <-b.Errors():
+		assert.NoError(t, err)
+	}
+
+	hash, err := node.GetBlockHash(birthday + 1)
+	assert.NoError(t, err)
+	height, err := b.BlockHeight(ctx, hash.String())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(birthday+1), height)
+}
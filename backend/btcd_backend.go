@@ -1,9 +1,12 @@
 package backend
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -35,10 +38,15 @@ type BtcdBackend struct {
 	blockRequests  chan uint32
 	blockResponses chan *BlockResponse
 
+	errors chan error
+
 	// internal channels
 	transactionsMu     sync.Mutex // mutex to guard read/writes to transactions map
 	cachedTransactions map[string]*TxResponse
 	doneCh             chan bool
+
+	// set once we find out the node doesn't implement gettxoutproof (btcd doesn't, bitcoind does).
+	noProofs int32
 }
 
 const (
@@ -95,6 +103,7 @@ func NewBtcdBackend(host, port, user, pass string, network Network) (*BtcdBacken
 		txResponses:    make(chan *TxResponse, 2*maxTxsPerAddr),
 		blockRequests:  make(chan uint32, 2*blockRequestChanSize),
 		blockResponses: make(chan *BlockResponse, 2*blockRequestChanSize),
+		errors:         make(chan error, concurrency),
 
 		blockHeightLookup:  make(map[string]int64),
 		cachedTransactions: make(map[string]*TxResponse),
@@ -110,10 +119,15 @@ func NewBtcdBackend(host, port, user, pass string, network Network) (*BtcdBacken
 
 // AddrRequest schedules a request to the backend to lookup information related
 // to the given address.
-func (b *BtcdBackend) AddrRequest(addr *deriver.Address) {
-	reporter.GetInstance().IncAddressesScheduled()
-	reporter.GetInstance().Logf("scheduling address: %s", addr)
-	b.addrRequests <- addr
+func (b *BtcdBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	select {
+	case b.addrRequests <- addr:
+		reporter.GetInstance().IncAddressesScheduled()
+		reporter.GetInstance().Logf("scheduling address: %s", addr)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // AddrResponses exposes a channel that allows to consume backend's responses to
@@ -124,10 +138,15 @@ func (b *BtcdBackend) AddrResponses() <-chan *AddrResponse {
 
 // TxRequest schedules a request to the backend to lookup information related
 // to the given transaction hash.
-func (b *BtcdBackend) TxRequest(txHash string) {
-	reporter.GetInstance().IncTxScheduled()
-	reporter.GetInstance().Logf("scheduling tx: %s", txHash)
-	b.txRequests <- txHash
+func (b *BtcdBackend) TxRequest(ctx context.Context, txHash string) error {
+	select {
+	case b.txRequests <- txHash:
+		reporter.GetInstance().IncTxScheduled()
+		reporter.GetInstance().Logf("scheduling tx: %s", txHash)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // TxResponses exposes a channel that allows to consume backend's responses to
@@ -138,18 +157,28 @@ func (b *BtcdBackend) TxResponses() <-chan *TxResponse {
 	return b.txResponses
 }
 
-func (b *BtcdBackend) BlockRequest(height uint32) {
-	b.blockRequests <- height
+func (b *BtcdBackend) BlockRequest(ctx context.Context, height uint32) error {
+	select {
+	case b.blockRequests <- height:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (b *BtcdBackend) BlockResponses() <-chan *BlockResponse {
 	return b.blockResponses
 }
 
-// Finish informs the backend to stop doing its work.
+// Errors exposes a channel on which the backend reports requests it failed to process.
+func (b *BtcdBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Finish informs the backend to stop doing its work. Pending RPC calls are aborted.
 func (b *BtcdBackend) Finish() {
 	close(b.doneCh)
-	b.client.Disconnect()
+	b.client.Shutdown()
 }
 
 func (b *BtcdBackend) ChainHeight() uint32 {
@@ -162,37 +191,47 @@ func (b *BtcdBackend) processRequests() {
 		case addr := <-b.addrRequests:
 			err := b.processAddrRequest(addr)
 			if err != nil {
-				log.Panicf("processAddrRequest failed: %+v", err)
+				log.Printf("processAddrRequest failed: %+v", err)
+				reportError(b.errors, addr.String(), err)
 			}
 		case tx := <-b.txRequests:
 			err := b.processTxRequest(tx)
 			if err != nil {
-				log.Panicf("processTxRequest failed: %+v", err)
+				log.Printf("processTxRequest failed: %+v", err)
+				reportError(b.errors, tx, err)
 			}
 		case block := <-b.blockRequests:
 			err := b.processBlockRequest(block)
 			if err != nil {
-				log.Panicf("processBlockRequest failed: %+v", err)
+				log.Printf("processBlockRequest failed: %+v", err)
+				reportError(b.errors, fmt.Sprintf("block %d", block), err)
 			}
 		case <-b.doneCh:
-			break
+			return
 		}
 	}
 }
 
 func (b *BtcdBackend) processAddrRequest(address *deriver.Address) error {
-	addr := address.Script()
-	txs, err := b.client.SearchRawTransactionsVerbose(address.Address(), 0, maxTxsPerAddr+1, true, false, nil)
+	addr, err := address.Script()
+	if err != nil {
+		return err
+	}
+	a, err := address.Address()
+	if err != nil {
+		return err
+	}
+	txs, err := b.client.SearchRawTransactionsVerbose(a, 0, maxTxsPerAddr+1, true, false, nil)
 	if err != nil {
 		if jerr, ok := err.(*btcjson.RPCError); ok {
 			switch jerr.Code {
 			case btcjson.ErrRPCInvalidAddressOrKey:
 				// the address doesn't exist in the blockchain - either because it was not used
 				// or given backend doesn't have a complete blockchain
-				b.addrResponses <- &AddrResponse{
+				b.sendAddrResponse(&AddrResponse{
 					Address:  address,
 					TxHashes: []string{},
-				}
+				})
 				return nil
 			}
 		}
@@ -208,12 +247,14 @@ func (b *BtcdBackend) processAddrRequest(address *deriver.Address) error {
 		txHashes = append(txHashes, tx.Txid)
 	}
 
-	b.cacheTxs(txs)
+	if err := b.cacheTxs(txs); err != nil {
+		return err
+	}
 
-	b.addrResponses <- &AddrResponse{
+	b.sendAddrResponse(&AddrResponse{
 		Address:  address,
 		TxHashes: txHashes,
-	}
+	})
 
 	return nil
 }
@@ -224,7 +265,11 @@ func (b *BtcdBackend) processTxRequest(txHash string) error {
 	b.transactionsMu.Unlock()
 
 	if exists {
-		b.txResponses <- tx
+		resp := *tx
+		if err := b.verifyTx(&resp); err != nil {
+			return err
+		}
+		b.sendTxResponse(&resp)
 
 		return nil
 	}
@@ -248,11 +293,56 @@ func (b *BtcdBackend) processTxRequest(txHash string) error {
 		return err
 	}
 
-	b.txResponses <- &TxResponse{
+	resp := &TxResponse{
 		Hash:   txHash,
 		Height: height,
 		Hex:    txResp.Hex,
 	}
+	if err := b.verifyTx(resp); err != nil {
+		return err
+	}
+	b.sendTxResponse(resp)
+	return nil
+}
+
+// verifyTx checks a mined transaction with gettxoutproof and sets resp.Verified. Nodes which don't
+// implement gettxoutproof leave the transaction unverified.
+func (b *BtcdBackend) verifyTx(resp *TxResponse) error {
+	if resp.Height <= 0 || atomic.LoadInt32(&b.noProofs) != 0 {
+		return nil
+	}
+
+	txids, err := json.Marshal([]string{resp.Hash})
+	if err != nil {
+		return err
+	}
+	result, err := b.client.RawRequest("gettxoutproof", []json.RawMessage{txids})
+	if err != nil {
+		if jerr, ok := err.(*btcjson.RPCError); ok {
+			switch jerr.Code {
+			case btcjson.ErrRPCUnimplemented, btcjson.ErrRPCMethodNotFound.Code:
+				if atomic.CompareAndSwapInt32(&b.noProofs, 0, 1) {
+					log.Printf("node doesn't support gettxoutproof, transactions won't be SPV verified")
+				}
+				return nil
+			}
+		}
+		return errors.Wrap(err, "could not fetch merkle proof for "+resp.Hash)
+	}
+	mb, err := decodeTxOutProof(result, resp.Hash, resp.Height)
+	if err != nil {
+		return err
+	}
+
+	// the proof's block must be the one at the height the node claims.
+	blockHash, err := b.client.GetBlockHash(resp.Height)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch block %d", resp.Height)
+	}
+	if err := verifyMerkleBlock(resp.Hash, resp.Height, mb, blockHash.String()); err != nil {
+		return err
+	}
+	resp.Verified = true
 	return nil
 }
 
@@ -279,26 +369,51 @@ func (b *BtcdBackend) processBlockRequest(height uint32) error {
 		return errors.Wrapf(err, "could not fetch block %d", height)
 	}
 
-	b.blockResponses <- &BlockResponse{
+	b.sendBlockResponse(&BlockResponse{
 		Height:    height,
+		Hash:      hash.String(),
 		Timestamp: header.Timestamp,
-	}
+	})
 	return nil
 }
 
-func (b *BtcdBackend) cacheTxs(txs []*btcjson.SearchRawTransactionsResult) {
+// The send*Response methods give up once Finish() has been called, since the responses won't be
+// read.
+
+func (b *BtcdBackend) sendAddrResponse(resp *AddrResponse) {
+	select {
+	case b.addrResponses <- resp:
+	case <-b.doneCh:
+	}
+}
+
+func (b *BtcdBackend) sendTxResponse(resp *TxResponse) {
+	select {
+	case b.txResponses <- resp:
+	case <-b.doneCh:
+	}
+}
+
+func (b *BtcdBackend) sendBlockResponse(resp *BlockResponse) {
+	select {
+	case b.blockResponses <- resp:
+	case <-b.doneCh:
+	}
+}
+
+func (b *BtcdBackend) cacheTxs(txs []*btcjson.SearchRawTransactionsResult) error {
 	for _, tx := range txs {
 		b.transactionsMu.Lock()
 		_, exists := b.cachedTransactions[tx.Txid]
 		b.transactionsMu.Unlock()
 
 		if exists {
-			return
+			return nil
 		}
 
 		height, err := b.getBlockHeight(tx.BlockHash)
 		if err != nil {
-			log.Panicf("error getting block height for hash %s: %s", tx.BlockHash, err.Error())
+			return errors.Wrapf(err, "error getting block height for hash %s", tx.BlockHash)
 		}
 
 		b.transactionsMu.Lock()
@@ -309,10 +424,32 @@ func (b *BtcdBackend) cacheTxs(txs []*btcjson.SearchRawTransactionsResult) {
 		}
 		b.transactionsMu.Unlock()
 	}
+	return nil
 }
 
-// getBlockHeight returns a block height for a given block hash or returns an error
+// BlockHeight returns the height of a block in the main chain.
+func (b *BtcdBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	height, err := b.getBlockHeight(hash)
+	if err != nil {
+		return 0, err
+	}
+	// blocks which were orphaned still have a height
+	mainChain, err := b.client.GetBlockHash(height)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not fetch block %d", height)
+	}
+	if mainChain.String() != hash {
+		return 0, errors.Errorf("block %s isn't in the main chain", hash)
+	}
+	return uint32(height), nil
+}
+
+// getBlockHeight returns a block height for a given block hash or returns an error. Transactions
+// which are still in the mempool don't have a block hash, their height is 0.
 func (b *BtcdBackend) getBlockHeight(hash string) (int64, error) {
+	if hash == "" {
+		return 0, nil
+	}
 	b.blockHeightMu.Lock()
 	height, exists := b.blockHeightLookup[hash]
 	b.blockHeightMu.Unlock()
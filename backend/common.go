@@ -48,5 +48,6 @@ func (a byTransactionID) Less(i, j int) bool { return a[i].Hash < a[j].Hash }
 
 type block struct {
 	Height    uint32    `json:"height"`
+	Hash      string    `json:"hash,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
@@ -1,36 +1,45 @@
 package electrum
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync/atomic"
-	"time"
 
 	"github.com/bcext/cashutil"
 	. "github.com/square/beancounter/utils"
 )
 
-const (
-	sleep = 200 * time.Millisecond // Be nice to the Electrum nodes
-)
-
 type Node struct {
 	// Ident is a an identifier of the form 127.0.0.1|s1234 or ::1|t5432.
 	Ident   string
 	Network Network
 
+	// Protocol is the protocol version negotiated with ServerVersion.
+	Protocol string
+
 	transport Transport
 
+	// limiter keeps us from overloading the server, see SetRateLimit.
+	limiter *TokenBucket
+
 	// Next ID for request. Store/load this via sync/atomic.
 	nextId uint64
+
+	// set to 1 once the server rejected a batch, batches are then sent one request at a time.
+	// Store/load this via sync/atomic.
+	noBatch int32
 }
 
 type Feature struct {
-	Prunning string `json:"prunning"`
-	Protocol string `json:"protocol_max"`
-	Genesis  string `json:"genesis_hash"`
+	Prunning    string `json:"prunning"`
+	Protocol    string `json:"protocol_max"`
+	ProtocolMin string `json:"protocol_min"`
+	Genesis     string `json:"genesis_hash"`
 }
 
 type BlockchainHeader struct {
@@ -55,7 +64,7 @@ type Balance struct {
 
 type Transaction struct {
 	Hash   string `json:"tx_hash"`
-	Height uint32 `json:"height"`
+	Height int32  `json:"height"` // 0 for unconfirmed transactions, -1 if they have unconfirmed parents
 	Value  int64  `json:"value"`
 	Pos    uint32 `json:"tx_pos"`
 }
@@ -119,19 +128,43 @@ type Header struct {
 	Hex    string `json:"hex"`
 }
 
+// Merkle is the proof that a transaction was included in a block.
+type Merkle struct {
+	BlockHeight uint32   `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         int      `json:"pos"`
+}
+
 type Block struct {
 	Count uint   `json:"count"`
 	Hex   string `json:"hex"`
 	Max   uint   `json:"max"`
 }
 
-func NewNode(addr, port string, network Network) (*Node, error) {
+// ConnectionConfig is how NewNode connects to servers. The zero value connects directly, only to
+// TLS ports, and only accepts certificates signed by a CA.
+type ConnectionConfig struct {
+	// TLS decides which certificates are accepted over TLS.
+	TLS *TLSPolicy
+	// Proxy is used for all the connections, if set.
+	Proxy *Proxy
+	// Plaintext allows connecting to TCP (t) ports. Anyone on the path can then tamper with the
+	// responses.
+	Plaintext bool
+}
+
+// NewNode connects to a server. port is the port number prefixed with t (TCP) or s (TLS), the
+// number can be omitted to use the network's default port. config can be nil.
+func NewNode(addr, port string, network Network, config *ConnectionConfig) (*Node, error) {
 	n := &Node{}
 	var a string
 	var t Transport
 	var err error
 
 	defaultTCP, defaultSSL := defaultPorts(network)
+	if config == nil {
+		config = &ConnectionConfig{}
+	}
 
 	if strings.Contains(addr, ":") {
 		a = fmt.Sprintf("[%s]", addr)
@@ -139,15 +172,22 @@ func NewNode(addr, port string, network Network) (*Node, error) {
 		a = addr
 	}
 
+	if port == "" {
+		return nil, fmt.Errorf("port must start with t or s")
+	}
+
 	if port[0] == 't' {
 		// TCP
+		if !config.Plaintext {
+			return nil, fmt.Errorf("%s:%s is a plain TCP port, which isn't allowed", addr, port)
+		}
 		var p string
 		if len(port) == 1 {
 			p = defaultTCP
 		} else {
 			p = port[1:]
 		}
-		t, err = NewTCPTransport(fmt.Sprintf("%s:%s", a, p))
+		t, err = NewTCPTransport(fmt.Sprintf("%s:%s", a, p), config.Proxy)
 	} else if port[0] == 's' {
 		// TLS
 		var p string
@@ -156,9 +196,9 @@ func NewNode(addr, port string, network Network) (*Node, error) {
 		} else {
 			p = port[1:]
 		}
-		t, err = NewSSLTransport(fmt.Sprintf("%s:%s", a, p))
+		t, err = NewSSLTransport(fmt.Sprintf("%s:%s", a, p), config.TLS, config.Proxy)
 	} else {
-		log.Panicf("port (%s) must start with t or s", port)
+		return nil, fmt.Errorf("port (%s) must start with t or s", port)
 	}
 
 	if err != nil {
@@ -166,11 +206,18 @@ func NewNode(addr, port string, network Network) (*Node, error) {
 	}
 
 	n.transport = t
+	n.limiter = NewTokenBucket(DefaultRate, DefaultBurst)
 	n.Network = network
 	n.Ident = NodeIdent(addr, port)
 	return n, nil
 }
 
+// SetRateLimit limits the number of requests sent to the server, to rate requests per second with
+// bursts of up to burst requests. Be nice to the Electrum nodes.
+func (n *Node) SetRateLimit(rate float64, burst int) {
+	n.limiter.SetRate(rate, burst)
+}
+
 func (n *Node) Disconnect() error {
 	return n.transport.Shutdown()
 }
@@ -198,20 +245,68 @@ func (n *Node) ServerFeatures() (*Feature, error) {
 	return &result, nil
 }
 
-// ServerVersion allows negotiating a min protocol version. This is required, as various methods
-// appeared (or were removed) in various versions.
+// ServerVersion negotiates a protocol version within [min, max]. This is required, as various
+// methods appeared (or were removed) in various versions. Since version 1.4, it must be the first
+// message sent to the server.
 //
 // version 1.1
 // https://electrumx.readthedocs.io/en/latest/protocol-methods.html#server-version
-func (n *Node) ServerVersion(ver string) error {
-	var ignored []string
-	return n.request("server.version", []interface{}{"beancounter", ver}, &ignored)
+func (n *Node) ServerVersion(min, max string) error {
+	var result []string
+	err := n.request("server.version", []interface{}{"beancounter", []string{min, max}}, &result)
+	if err != nil {
+		return err
+	}
+	if len(result) != 2 {
+		return fmt.Errorf("unexpected server.version response: %v", result)
+	}
+	n.Protocol = result[1]
+	return nil
+}
+
+// ScriptHash returns the script hash of an output script, as used by the blockchain.scripthash.*
+// methods: the sha256 of the script, in reverse byte order.
+//
+// https://electrumx.readthedocs.io/en/latest/protocol-basics.html#script-hashes
+func ScriptHash(script []byte) string {
+	hash := sha256.Sum256(script)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// BlockchainScripthashGetHistory returns the history of a script hash (see ScriptHash).
+//
+// version 1.1
+// https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-scripthash-get-history
+func (n *Node) BlockchainScripthashGetHistory(scriptHash string) ([]*Transaction, error) {
+	var result []*Transaction
+	err := n.request("blockchain.scripthash.get_history", []interface{}{scriptHash}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BlockchainScripthashGetHistoryBatch returns the history of several script hashes, using a
+// single batch. errs[i] is set if the server failed to return the i-th history.
+func (n *Node) BlockchainScripthashGetHistoryBatch(scriptHashes []string) (histories [][]*Transaction, errs []error, err error) {
+	params := make([][]interface{}, 0, len(scriptHashes))
+	results := make([]interface{}, 0, len(scriptHashes))
+	histories = make([][]*Transaction, len(scriptHashes))
+	for i, scriptHash := range scriptHashes {
+		params = append(params, []interface{}{scriptHash})
+		results = append(results, &histories[i])
+	}
+	errs, err = n.batch("blockchain.scripthash.get_history", params, results)
+	return histories, errs, err
 }
 
 // BlockchainAddressGetHistory returns the history of an address.
 //
-// version 1.1 and version 1.2 only
-// https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-scripthash-get_history
+// version 1.1 and version 1.2 only, use BlockchainScripthashGetHistory with newer servers.
+// https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-address-get-history
 func (n *Node) BlockchainAddressGetHistory(address string) ([]*Transaction, error) {
 	var result []*Transaction
 	err := n.request("blockchain.address.get_history", []interface{}{address}, &result)
@@ -230,19 +325,122 @@ func (n *Node) BlockchainTransactionGet(txid string) (string, error) {
 	return hex, err
 }
 
-// Subscribe to receive block headers when a new block is found.
+// BlockchainTransactionGetBatch returns several raw transactions, using a single batch. errs[i] is
+// set if the server failed to return the i-th transaction.
+func (n *Node) BlockchainTransactionGetBatch(txids []string) (hexes []string, errs []error, err error) {
+	params := make([][]interface{}, 0, len(txids))
+	results := make([]interface{}, 0, len(txids))
+	hexes = make([]string, len(txids))
+	for i, txid := range txids {
+		params = append(params, []interface{}{txid, false})
+		results = append(results, &hexes[i])
+	}
+	errs, err = n.batch("blockchain.transaction.get", params, results)
+	return hexes, errs, err
+}
+
+// BlockchainTransactionGetMerkle returns the merkle branch of a transaction, which was mined at
+// the given height.
 //
-// Note: there's no way to unsubscribe, and the rest of this code doesn't know how to deal with
-// notifications. It is advisable to only call this method once and disconnect/reconnect after
-// getting the block height.
+// https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-transaction-get-merkle
+func (n *Node) BlockchainTransactionGetMerkle(txid string, height uint32) (*Merkle, error) {
+	var merkle Merkle
+	err := n.request("blockchain.transaction.get_merkle", []interface{}{txid, height}, &merkle)
+	return &merkle, err
+}
+
+// Subscribe to receive block headers when a new block is found. Returns the current tip, the
+// following ones are sent to HeaderNotifications.
+//
+// Note: there's no way to unsubscribe.
+//
+// Version 1.2 needs the raw parameter to return the header's hex, later versions removed it.
 //
 // https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-headers-subscribe
 func (n *Node) BlockchainHeadersSubscribe() (*Header, error) {
+	params := []interface{}{}
+	if n.Protocol == "1.2" {
+		params = append(params, true)
+	}
 	var header Header
-	err := n.request("blockchain.headers.subscribe", []interface{}{true}, &header)
+	err := n.request("blockchain.headers.subscribe", params, &header)
 	return &header, err
 }
 
+// HeaderNotifications returns a channel on which the new block headers are sent, once subscribed
+// with BlockchainHeadersSubscribe. Call it before subscribing, so that no header is missed. The
+// channel is closed when the node disconnects.
+func (n *Node) HeaderNotifications() <-chan *Header {
+	out := make(chan *Header, notificationBufferSize)
+	in := n.transport.Notifications("blockchain.headers.subscribe")
+	go func() {
+		defer close(out)
+		for notification := range in {
+			var params []Header
+			if err := json.Unmarshal(notification.Params, &params); err != nil || len(params) != 1 {
+				log.Printf("invalid header notification from %s: %s", n.Ident, notification.Params)
+				continue
+			}
+			select {
+			case out <- &params[0]:
+			case <-n.transport.Done():
+				// nobody is reading anymore
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// ScripthashStatus is the status of a script hash, a hash of its history. It changes when the
+// history does.
+type ScripthashStatus struct {
+	ScriptHash string
+	Status     string // empty if the history is empty
+}
+
+// BlockchainScripthashSubscribe subscribes to a script hash's status, and returns the current
+// status. The changes are sent to ScripthashNotifications.
+//
+// version 1.1
+// https://electrumx.readthedocs.io/en/latest/protocol-methods.html#blockchain-scripthash-subscribe
+func (n *Node) BlockchainScripthashSubscribe(scriptHash string) (string, error) {
+	var status *string
+	err := n.request("blockchain.scripthash.subscribe", []interface{}{scriptHash}, &status)
+	if err != nil || status == nil {
+		return "", err
+	}
+	return *status, nil
+}
+
+// ScripthashNotifications returns a channel on which the status changes of the script hashes
+// subscribed with BlockchainScripthashSubscribe are sent. Call it before subscribing, so that no
+// change is missed. The channel is closed when the node disconnects.
+func (n *Node) ScripthashNotifications() <-chan *ScripthashStatus {
+	out := make(chan *ScripthashStatus, notificationBufferSize)
+	in := n.transport.Notifications("blockchain.scripthash.subscribe")
+	go func() {
+		defer close(out)
+		for notification := range in {
+			var params []*string
+			if err := json.Unmarshal(notification.Params, &params); err != nil || len(params) != 2 || params[0] == nil {
+				log.Printf("invalid scripthash notification from %s: %s", n.Ident, notification.Params)
+				continue
+			}
+			status := &ScripthashStatus{ScriptHash: *params[0]}
+			if params[1] != nil {
+				status.Status = *params[1]
+			}
+			select {
+			case out <- status:
+			case <-n.transport.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
 // ServerPeersSubscribe requests peers from a server.
 //
 // https://electrumx.readthedocs.io/en/latest/protocol-methods.html#server-peers-subscribe
@@ -255,16 +453,10 @@ func (n *Node) ServerPeersSubscribe() ([]Peer, error) {
 
 	out := []Peer{}
 	for _, peer := range peers {
-		features := make([]string, 0, len(peer[2].([]interface{})))
-		for _, feature := range peer[2].([]interface{}) {
-			features = append(features, feature.(string))
-		}
-
-		p := Peer{
-			IP:       peer[0].(string),
-			Host:     peer[1].(string),
-			Version:  features[0],
-			Features: features[1:],
+		p, ok := parsePeer(peer)
+		if !ok {
+			log.Printf("invalid peer from %s: %v", n.Ident, peer)
+			continue
 		}
 		out = append(out, p)
 	}
@@ -272,6 +464,34 @@ func (n *Node) ServerPeersSubscribe() ([]Peer, error) {
 	return out, nil
 }
 
+// parsePeer decodes a [ip, host, [version, features...]] entry of server.peers.subscribe. ok is
+// false if the entry doesn't have this shape.
+func parsePeer(peer []interface{}) (p Peer, ok bool) {
+	if len(peer) < 3 {
+		return Peer{}, false
+	}
+	if p.IP, ok = peer[0].(string); !ok {
+		return Peer{}, false
+	}
+	if p.Host, ok = peer[1].(string); !ok {
+		return Peer{}, false
+	}
+	list, ok := peer[2].([]interface{})
+	if !ok || len(list) == 0 {
+		return Peer{}, false
+	}
+	features := make([]string, 0, len(list))
+	for _, feature := range list {
+		f, ok := feature.(string)
+		if !ok {
+			return Peer{}, false
+		}
+		features = append(features, f)
+	}
+	p.Version, p.Features = features[0], features[1:]
+	return p, true
+}
+
 // BlockchainBlockHeaders returns a block header (160 hex).
 func (n *Node) BlockchainBlockHeaders(height uint32, count uint) (Block, error) {
 	var block Block
@@ -280,6 +500,8 @@ func (n *Node) BlockchainBlockHeaders(height uint32, count uint) (Block, error)
 }
 
 func (n *Node) request(method string, params []interface{}, result interface{}) error {
+	n.limiter.Wait()
+
 	msg := RequestMessage{
 		Id:     atomic.AddUint64(&n.nextId, 1),
 		Method: method,
@@ -295,11 +517,79 @@ func (n *Node) request(method string, params []interface{}, result interface{})
 	if err != nil {
 		return err
 	}
-	json.Unmarshal(r, result)
-	time.Sleep(sleep)
+	if err := json.Unmarshal(r, result); err != nil {
+		return fmt.Errorf("%w for %s from %s: %s", ErrInvalidResult, method, n.Ident, err)
+	}
 	return nil
 }
 
+// batch calls method once per element of params, in a single JSON-RPC batch, and unmarshals the
+// i-th result in results[i]. errs[i] is ErrAPI if the server returned an error for the i-th call,
+// or wraps ErrInvalidResult if the i-th result doesn't have the expected shape.
+// The returned error means the whole batch failed. If the server doesn't support batches, the
+// calls are sent one at a time.
+func (n *Node) batch(method string, params [][]interface{}, results []interface{}) ([]error, error) {
+	if atomic.LoadInt32(&n.noBatch) == 1 {
+		return n.unbatched(method, params, results)
+	}
+	n.limiter.WaitN(len(params))
+
+	msgs := make([]RequestMessage, 0, len(params))
+	for _, p := range params {
+		msgs = append(msgs, RequestMessage{
+			Id:     atomic.AddUint64(&n.nextId, 1),
+			Method: method,
+			Params: p,
+		})
+	}
+
+	responses, err := n.transport.SendBatch(msgs)
+	if err == ErrBatchRejected {
+		log.Printf("%s doesn't support batches", n.Ident)
+		atomic.StoreInt32(&n.noBatch, 1)
+		return n.unbatched(method, params, results)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(responses))
+	for i, resp := range responses {
+		if resp.Error != nil {
+			if DebugMode {
+				log.Printf("error on recv from %s: server error (%d: %s)", n.Ident, resp.Error.Code, resp.Error.Message)
+			}
+			errs[i] = ErrAPI
+			continue
+		}
+		r, err := json.Marshal(resp.Result)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(r, results[i]); err != nil {
+			errs[i] = fmt.Errorf("%w for %s from %s: %s", ErrInvalidResult, method, n.Ident, err)
+		}
+	}
+	return errs, nil
+}
+
+// unbatched calls method once per element of params, one request at a time. It returns the same
+// errors as batch.
+func (n *Node) unbatched(method string, params [][]interface{}, results []interface{}) ([]error, error) {
+	errs := make([]error, len(params))
+	for i, p := range params {
+		err := n.request(method, p, results[i])
+		if err == ErrAPI || errors.Is(err, ErrInvalidResult) {
+			errs[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
 func defaultPorts(network Network) (string, string) {
 	switch network {
 	case Mainnet:
@@ -0,0 +1,116 @@
+package electrum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cannedServer answers each request (batched or not) with the result registered for its method.
+// The returned function shuts the node and the server down.
+func cannedServer(t *testing.T, results map[string]string) (*Node, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadBytes(messageDelim)
+			if err != nil {
+				return
+			}
+			respond := func(req RequestMessage) json.RawMessage {
+				var result bytes.Buffer
+				assert.NoError(t, json.Compact(&result, []byte(results[req.Method])))
+				return json.RawMessage(fmt.Sprintf(`{"id": %d, "result": %s}`, req.Id, result.String()))
+			}
+			var b []byte
+			if line[0] == '[' {
+				var reqs []RequestMessage
+				assert.NoError(t, json.Unmarshal(line, &reqs))
+				resps := []json.RawMessage{}
+				for _, req := range reqs {
+					resps = append(resps, respond(req))
+				}
+				b, _ = json.Marshal(resps)
+			} else {
+				var req RequestMessage
+				assert.NoError(t, json.Unmarshal(line, &req))
+				b = respond(req)
+			}
+			conn.Write(append(b, messageDelim))
+		}
+	}()
+
+	transport, err := NewTCPTransport(l.Addr().String(), nil)
+	assert.NoError(t, err)
+	node := &Node{Ident: "canned", transport: transport, limiter: NewTokenBucket(DefaultRate, DefaultBurst)}
+	return node, func() {
+		transport.Shutdown()
+		l.Close()
+	}
+}
+
+func TestInvalidResult(t *testing.T) {
+	node, shutdown := cannedServer(t, map[string]string{"blockchain.block.headers": `"not a block"`})
+	defer shutdown()
+	_, err := node.BlockchainBlockHeaders(0, 1)
+	assert.True(t, errors.Is(err, ErrInvalidResult), "%v", err)
+}
+
+func TestServerPeersSubscribe(t *testing.T) {
+	node, shutdown := cannedServer(t, map[string]string{"server.peers.subscribe": `[
+		["1.2.3.4", "good.example", ["v1.4", "s50002", "t50001"]],
+		["1.2.3.5", "short.example"],
+		[1, "ip.example", ["v1.4"]],
+		["1.2.3.6", "features.example", "v1.4"],
+		["1.2.3.7", "empty.example", []],
+		["1.2.3.8", "feature.example", ["v1.4", 50002]]
+	]`})
+	defer shutdown()
+	peers, err := node.ServerPeersSubscribe()
+	assert.NoError(t, err)
+	assert.Equal(t, []Peer{{IP: "1.2.3.4", Host: "good.example", Version: "v1.4", Features: []string{"s50002", "t50001"}}}, peers)
+
+	// a reply which isn't a list of lists
+	node, shutdown = cannedServer(t, map[string]string{"server.peers.subscribe": `{"peers": []}`})
+	defer shutdown()
+	_, err = node.ServerPeersSubscribe()
+	assert.True(t, errors.Is(err, ErrInvalidResult), "%v", err)
+}
+
+func TestBatchInvalidResult(t *testing.T) {
+	node, shutdown := cannedServer(t, map[string]string{
+		"blockchain.scripthash.get_history": `[{"tx_hash": "aaaa", "height": "not a height"}]`,
+		"blockchain.transaction.get":        `{"hex": "00"}`,
+	})
+	defer shutdown()
+
+	// a history with the wrong shape mustn't look like an empty history
+	_, errs, err := node.BlockchainScripthashGetHistoryBatch([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.True(t, errors.Is(err, ErrInvalidResult), "%v", err)
+	}
+
+	// same when the batch is sent one request at a time
+	atomic.StoreInt32(&node.noBatch, 1)
+	_, errs, err = node.BlockchainTransactionGetBatch([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.True(t, errors.Is(err, ErrInvalidResult), "%v", err)
+	}
+}
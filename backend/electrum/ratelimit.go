@@ -0,0 +1,75 @@
+package electrum
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRate is the default number of requests per second sent to a server.
+	DefaultRate = 20
+	// DefaultBurst is the default number of requests which can be sent at once, after the
+	// connection has been idle.
+	DefaultBurst = 10
+)
+
+// TokenBucket limits the rate of requests sent to a server. The bucket holds up to burst tokens
+// and is refilled at rate tokens per second. Each request takes a token, waiting for one if the
+// bucket is empty.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the bucket's rate and size.
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Wait blocks until a token is available and takes it.
+func (b *TokenBucket) Wait() {
+	b.WaitN(1)
+}
+
+// WaitN blocks until n tokens are available and takes them, e.g. for a batch of n requests.
+func (b *TokenBucket) WaitN(n int) {
+	time.Sleep(b.reserve(time.Now(), n))
+}
+
+// reserve takes n tokens and returns how long to wait until they are available. The bucket can go
+// negative: the callers which are waiting take the tokens in order.
+func (b *TokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,73 @@
+package electrum
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/btcsuite/go-socks/socks"
+)
+
+// proxyConnTimeout is the time allowed to connect through a proxy. Building a Tor circuit is slow.
+const proxyConnTimeout = 30 * time.Second
+
+// Proxy is a SOCKS5 proxy, e.g. Tor. Host names are resolved by the proxy, so that DNS requests
+// don't leak and .onion servers can be reached.
+type Proxy struct {
+	Addr     string // host:port
+	Username string
+	Password string
+
+	// isolation is a random password for stream isolation, see credentials.
+	isolation string
+}
+
+// ParseProxy parses a socks5://[user:password@]host:port URL. Without credentials, each server is
+// reached with its own credentials: Tor then uses a separate circuit for each server (stream
+// isolation), so the servers can't be correlated by exit node.
+func ParseProxy(rawURL string) (*Proxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy %s, expecting socks5://host:port", rawURL)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %s", rawURL, err)
+	}
+	p := &Proxy{Addr: u.Host}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+		return p, nil
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	p.isolation = hex.EncodeToString(nonce)
+	return p, nil
+}
+
+// credentials returns the username and password used to reach addr, empty if none.
+func (p *Proxy) credentials(addr string) (string, string) {
+	if p.isolation != "" {
+		return addr, p.isolation
+	}
+	return p.Username, p.Password
+}
+
+// Dial connects to addr (host:port) through the proxy.
+func (p *Proxy) Dial(addr string) (net.Conn, error) {
+	username, password := p.credentials(addr)
+	proxy := &socks.Proxy{Addr: p.Addr, Username: username, Password: password}
+	conn, err := proxy.DialTimeout("tcp", addr, proxyConnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s failed to connect to %s: %s", p.Addr, addr, err)
+	}
+	return conn, nil
+}
@@ -2,11 +2,13 @@ package electrum
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -27,6 +29,11 @@ var (
 	ErrUnknown        = errors.New("unknown error")
 	ErrNetwork        = errors.New("network error")
 	ErrAPI            = errors.New("received API error")
+	// ErrInvalidResult is returned when a result doesn't have the expected shape.
+	ErrInvalidResult = errors.New("invalid result")
+	// ErrBatchRejected is returned when the server answers a batch with a single error, i.e.
+	// it doesn't support batches.
+	ErrBatchRejected = errors.New("batch rejected")
 )
 
 type ErrorResponse struct {
@@ -45,71 +52,199 @@ type ResponseMessage struct {
 	JsonRpc string         `json:"jsonrpc"`
 	Result  interface{}    `json:"result"`
 	Error   *ErrorResponse `json:"error"`
+
+	// set for notifications, which don't have an id
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Notification is a message the server sends without being asked, e.g. a new block header after
+// blockchain.headers.subscribe. Method is the subscription's method.
+type Notification struct {
+	Method string
+	Params json.RawMessage
 }
 
+// number of notifications buffered for each subscriber. Notifications are dropped when a
+// subscriber falls behind, so that responses are never held up.
+const notificationBufferSize = 100
+
 type Transport interface {
 	SendMessage(RequestMessage) (*ResponseMessage, error)
+	// SendBatch sends the requests as a single JSON-RPC batch. The responses are in the same order
+	// as the requests. A response can carry an error, which only concerns its request.
+	SendBatch([]RequestMessage) ([]*ResponseMessage, error)
+	// Notifications returns a channel on which the notifications for method are sent. The channel
+	// is closed when the connection is shut down.
+	Notifications(method string) <-chan *Notification
+	// Done returns a channel which is closed when the connection is shut down.
+	Done() <-chan struct{}
 	Shutdown() error
 }
 
+// TCPTransport multiplexes requests on a single connection: many requests can be in flight, and
+// a goroutine reads the responses and matches them to their request by id. Notifications (which
+// don't have an id) are sent to the subscribers of their method, or dropped if there are none.
 type TCPTransport struct {
 	conn net.Conn
+
+	writeMu sync.Mutex // serializes writes, so that messages don't interleave
+
+	mu          sync.Mutex // guards pending, batches, subscribers and err
+	pending     map[uint64]chan *ResponseMessage
+	batches     map[chan struct{}]struct{} // closed if the server rejects batches
+	subscribers map[string][]chan *Notification
+	err         error // set once the connection is unusable
+
+	shutdown sync.Once
+	done     chan struct{}
 }
 
-func NewTCPTransport(addr string) (Transport, error) {
-	conn, err := net.DialTimeout("tcp", addr, connTimeout)
+// NewTCPTransport connects to addr, through proxy if it isn't nil.
+func NewTCPTransport(addr string, proxy *Proxy) (Transport, error) {
+	conn, err := dial(addr, proxy)
 	if err != nil {
 		return nil, err
 	}
 
-	t := &TCPTransport{conn: conn}
-
-	return t, nil
+	return newTransport(conn), nil
 }
 
-func NewSSLTransport(addr string) (Transport, error) {
-	d := &net.Dialer{
-		Timeout: connTimeout,
+// NewSSLTransport connects to addr over TLS, through proxy if it isn't nil. The server's
+// certificate is checked according to policy.
+func NewSSLTransport(addr string, policy *TLSPolicy, proxy *Proxy) (Transport, error) {
+	config, err := policy.config(addr)
+	if err != nil {
+		return nil, err
 	}
-
-	conn, err := tls.DialWithDialer(d, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	conn, err := dial(addr, proxy)
 	if err != nil {
 		return nil, err
 	}
+	timeout := connTimeout
+	if proxy != nil {
+		timeout = proxyConnTimeout
+	}
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
 
-	t := &TCPTransport{conn: conn}
+	return newTransport(tlsConn), nil
+}
 
-	return t, nil
+func dial(addr string, proxy *Proxy) (net.Conn, error) {
+	if proxy != nil {
+		return proxy.Dial(addr)
+	}
+	return net.DialTimeout("tcp", addr, connTimeout)
 }
 
-func (t *TCPTransport) SendMessage(request RequestMessage) (*ResponseMessage, error) {
-	if t.conn == nil {
-		return nil, ErrNodeShutdown
+func newTransport(conn net.Conn) *TCPTransport {
+	t := &TCPTransport{
+		conn:        conn,
+		pending:     make(map[uint64]chan *ResponseMessage),
+		batches:     make(map[chan struct{}]struct{}),
+		subscribers: make(map[string][]chan *Notification),
+		done:        make(chan struct{}),
 	}
+	go t.readResponses()
+	return t
+}
 
+func (t *TCPTransport) SendMessage(request RequestMessage) (*ResponseMessage, error) {
 	body, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
+	responses, err := t.send([]uint64{request.Id}, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := responses[0]
+
+	if resp.Error != nil {
+		if DebugMode {
+			log.Printf("error on recv from %s: server error (%d: %s)", t.conn.RemoteAddr(), resp.Error.Code, resp.Error.Message)
+		}
+		return nil, ErrAPI
+	}
+
+	return resp, nil
+}
+
+func (t *TCPTransport) SendBatch(requests []RequestMessage) ([]*ResponseMessage, error) {
+	if len(requests) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(requests))
+	for _, request := range requests {
+		ids = append(ids, request.Id)
+	}
+	return t.send(ids, body, make(chan struct{}))
+}
+
+// send writes a message (a request or a batch) and waits for the responses to the given ids. A
+// batch has a rejected channel, which is closed if the server rejects batches.
+func (t *TCPTransport) send(ids []uint64, body []byte, rejected chan struct{}) ([]*ResponseMessage, error) {
 	body = append(body, messageDelim)
 
-	// Set write deadline
-	_ = t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	// Register the requests before sending them, the responses can arrive before Write returns.
+	channels := make([]chan *ResponseMessage, 0, len(ids))
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	for _, id := range ids {
+		if _, exists := t.pending[id]; exists {
+			for _, id := range ids[:len(channels)] {
+				delete(t.pending, id)
+			}
+			t.mu.Unlock()
+			return nil, ErrIdMismatch
+		}
+		ch := make(chan *ResponseMessage, 1)
+		t.pending[id] = ch
+		channels = append(channels, ch)
+	}
+	if rejected != nil {
+		t.batches[rejected] = struct{}{}
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		for _, id := range ids {
+			delete(t.pending, id)
+		}
+		delete(t.batches, rejected)
+		t.mu.Unlock()
+	}()
 
 	// Send message
+	t.writeMu.Lock()
+	_ = t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	n, err := t.conn.Write(body)
+	t.writeMu.Unlock()
 	if err != nil {
-		_ = t.Shutdown()
 		if DebugMode {
 			log.Printf("error on send to %s: %s", t.conn.RemoteAddr(), err)
 		}
+		t.fail(ErrNetwork)
 		return nil, ErrNetwork
 	}
 	if n != len(body) {
-		_ = t.Shutdown()
 		if DebugMode {
 			log.Printf("error on send to %s: short write (%d < %d)", t.conn.RemoteAddr(), n, len(body))
 		}
+		t.fail(ErrNetwork)
 		return nil, ErrNetwork
 	}
 
@@ -117,58 +252,167 @@ func (t *TCPTransport) SendMessage(request RequestMessage) (*ResponseMessage, er
 		log.Printf("%s <- %s", t.conn.RemoteAddr(), body)
 	}
 
-	// Clear write deadline, set read deadline
-	_ = t.conn.SetWriteDeadline(time.Time{})
-	_ = t.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	// Wait for the responses
+	timer := time.NewTimer(readTimeout)
+	defer timer.Stop()
+	responses := make([]*ResponseMessage, 0, len(ids))
+	for i, ch := range channels {
+		select {
+		case resp := <-ch:
+			responses = append(responses, resp)
+		case <-timer.C:
+			if DebugMode {
+				log.Printf("error on recv from %s: no response to %d", t.conn.RemoteAddr(), ids[i])
+			}
+			t.fail(ErrNetwork)
+			return nil, ErrNetwork
+		case <-rejected:
+			return nil, ErrBatchRejected
+		case <-t.done:
+			t.mu.Lock()
+			err := t.err
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	return responses, nil
+}
 
-	// Wait for response
+// readResponses reads messages until the connection fails, and hands each response to the
+// request waiting for it.
+func (t *TCPTransport) readResponses() {
 	reader := bufio.NewReader(t.conn)
+	for {
+		line, err := reader.ReadBytes(messageDelim)
+		if err != nil {
+			if DebugMode {
+				log.Printf("error on recv from %s: %s", t.conn.RemoteAddr(), err)
+			}
+			t.fail(ErrNetwork)
+			return
+		}
 
-	line, err := reader.ReadBytes(messageDelim)
-	if err != nil {
-		_ = t.Shutdown()
 		if DebugMode {
-			log.Printf("error on recv from %s: %s", t.conn.RemoteAddr(), err)
+			log.Printf("%s -> %s", t.conn.RemoteAddr(), line)
 		}
-		return nil, ErrNetwork
-	}
 
-	// Clear deadline
-	_ = t.conn.SetReadDeadline(time.Time{})
+		// Parse & process message. The response to a batch is an array.
+		responses := []*ResponseMessage{}
+		if trimmed := bytes.TrimLeft(line, " \t\r"); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(line, &responses)
+		} else {
+			resp := &ResponseMessage{}
+			err = json.Unmarshal(line, resp)
+			responses = append(responses, resp)
+		}
+		if err != nil {
+			if DebugMode {
+				log.Printf("error on recv from %s: %s", t.conn.RemoteAddr(), err)
+			}
+			t.fail(ErrUnknown)
+			return
+		}
 
-	if DebugMode {
-		log.Printf("%s -> %s", t.conn.RemoteAddr(), line)
-	}
+		for _, resp := range responses {
+			if resp.Id == 0 && resp.Method == "" && resp.Error != nil {
+				// an error without an id, for a message the server couldn't handle: a batch.
+				t.rejectBatches()
+				continue
+			}
+			if resp.Id == 0 {
+				// a notification, request ids start at 1
+				t.notify(&Notification{Method: resp.Method, Params: resp.Params})
+				continue
+			}
 
-	// Parse & process message
-	resp := ResponseMessage{}
-	err = json.Unmarshal(line, &resp)
-	if err != nil {
-		_ = t.Shutdown()
-		if DebugMode {
-			log.Printf("error on recv from %s: %s", t.conn.RemoteAddr(), err)
+			t.mu.Lock()
+			ch, exists := t.pending[resp.Id]
+			t.mu.Unlock()
+			if !exists {
+				if DebugMode {
+					log.Printf("error on recv from %s: unexpected id %d", t.conn.RemoteAddr(), resp.Id)
+				}
+				t.fail(ErrIdMismatch)
+				return
+			}
+			select {
+			case ch <- resp:
+			default:
+				// the server answered the same id twice
+				t.fail(ErrIdMismatch)
+				return
+			}
 		}
-		return nil, ErrUnknown
 	}
+}
 
-	if resp.Id != request.Id {
-		_ = t.Shutdown()
-		if DebugMode {
-			log.Printf("error on recv from %s: id mismatch (%d != %d)", t.conn.RemoteAddr(), request.Id, resp.Id)
-		}
-		return nil, ErrIdMismatch
+func (t *TCPTransport) Notifications(method string) <-chan *Notification {
+	ch := make(chan *Notification, notificationBufferSize)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		close(ch)
+		return ch
 	}
+	t.subscribers[method] = append(t.subscribers[method], ch)
+	return ch
+}
 
-	if resp.Error != nil {
-		if DebugMode {
-			log.Printf("error on recv from %s: server error (%d: %s)", t.conn.RemoteAddr(), resp.Error.Code, resp.Error.Message)
+func (t *TCPTransport) Done() <-chan struct{} {
+	return t.done
+}
+
+// rejectBatches fails the batches waiting for their responses.
+func (t *TCPTransport) rejectBatches() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for rejected := range t.batches {
+		close(rejected)
+		delete(t.batches, rejected)
+	}
+}
+
+// notify hands a notification to its method's subscribers, without blocking.
+func (t *TCPTransport) notify(n *Notification) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.subscribers[n.Method] {
+		select {
+		case ch <- n:
+		default:
+			if DebugMode {
+				log.Printf("dropping %s notification from %s", n.Method, t.conn.RemoteAddr())
+			}
 		}
-		return nil, ErrAPI
 	}
+}
 
-	return &resp, nil
+// fail shuts the connection down. Requests in flight, and later ones, return err.
+func (t *TCPTransport) fail(err error) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+	t.Shutdown()
 }
 
 func (t *TCPTransport) Shutdown() error {
-	return t.conn.Close()
+	var err error
+	t.shutdown.Do(func() {
+		t.mu.Lock()
+		if t.err == nil {
+			t.err = ErrNodeShutdown
+		}
+		for _, channels := range t.subscribers {
+			for _, ch := range channels {
+				close(ch)
+			}
+		}
+		t.subscribers = nil
+		t.mu.Unlock()
+		close(t.done)
+		err = t.conn.Close()
+	})
+	return err
 }
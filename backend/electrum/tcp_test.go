@@ -0,0 +1,213 @@
+package electrum
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reversingServer reads n requests, then answers them in reverse order with their method name.
+func reversingServer(t *testing.T, n int) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		requests := []RequestMessage{}
+		for len(requests) < n {
+			line, err := reader.ReadBytes(messageDelim)
+			if err != nil {
+				return
+			}
+			var req RequestMessage
+			assert.NoError(t, json.Unmarshal(line, &req))
+			requests = append(requests, req)
+		}
+		// a notification is dropped
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "blockchain.headers.subscribe", "params": []}` + "\n"))
+		for i := len(requests) - 1; i >= 0; i-- {
+			b, _ := json.Marshal(ResponseMessage{Id: requests[i].Id, Result: requests[i].Method})
+			conn.Write(append(b, messageDelim))
+		}
+		// wait for the client to hang up
+		reader.ReadBytes(messageDelim)
+	}()
+	return l
+}
+
+func TestTransportMultiplexes(t *testing.T) {
+	l := reversingServer(t, 3)
+	defer l.Close()
+	transport, err := NewTCPTransport(l.Addr().String(), nil)
+	assert.NoError(t, err)
+	defer transport.Shutdown()
+
+	// the server only answers once all the requests are in flight
+	var wg sync.WaitGroup
+	for i, method := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(id uint64, method string) {
+			defer wg.Done()
+			resp, err := transport.SendMessage(RequestMessage{Id: id, Method: method})
+			if assert.NoError(t, err) {
+				assert.Equal(t, method, resp.Result)
+			}
+		}(uint64(i+1), method)
+	}
+	wg.Wait()
+
+	transport.Shutdown()
+	_, err = transport.SendMessage(RequestMessage{Id: 4, Method: "d"})
+	assert.Equal(t, ErrNodeShutdown, err)
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	now := b.last
+
+	// the burst is free, then requests are spaced by 1/rate
+	assert.Equal(t, time.Duration(0), b.reserve(now, 1))
+	assert.Equal(t, time.Duration(0), b.reserve(now, 1))
+	assert.Equal(t, 100*time.Millisecond, b.reserve(now, 1))
+	assert.Equal(t, 200*time.Millisecond, b.reserve(now, 1))
+
+	// the bucket refills, up to the burst
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), b.reserve(now, 1))
+	assert.Equal(t, time.Duration(0), b.reserve(now, 1))
+	assert.Equal(t, 100*time.Millisecond, b.reserve(now, 1))
+}
+
+func TestTransportBatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadBytes(messageDelim)
+		if err != nil {
+			return
+		}
+		var requests []RequestMessage
+		assert.NoError(t, json.Unmarshal(line, &requests))
+		// the responses come in any order, and the second request fails
+		conn.Write([]byte(`[{"id": 3, "result": "c"}, {"id": 2, "error": {"code": 1, "message": "nope"}}, {"id": 1, "result": "a"}]` + "\n"))
+		reader.ReadBytes(messageDelim)
+	}()
+
+	transport, err := NewTCPTransport(l.Addr().String(), nil)
+	assert.NoError(t, err)
+	defer transport.Shutdown()
+	responses, err := transport.SendBatch([]RequestMessage{{Id: 1, Method: "a"}, {Id: 2, Method: "b"}, {Id: 3, Method: "c"}})
+	assert.NoError(t, err)
+	assert.Len(t, responses, 3)
+	assert.Equal(t, "a", responses[0].Result)
+	assert.NotNil(t, responses[1].Error)
+	assert.Equal(t, "c", responses[2].Result)
+}
+
+func TestBatchFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		// the batch gets a single error without an id, then each request is answered on its own
+		if _, err := reader.ReadBytes(messageDelim); err != nil {
+			return
+		}
+		conn.Write([]byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32600, "message": "invalid request"}}` + "\n"))
+		for {
+			line, err := reader.ReadBytes(messageDelim)
+			if err != nil {
+				return
+			}
+			var req RequestMessage
+			assert.NoError(t, json.Unmarshal(line, &req))
+			b, _ := json.Marshal(ResponseMessage{Id: req.Id, Result: req.Params[0]})
+			conn.Write(append(b, messageDelim))
+		}
+	}()
+
+	transport, err := NewTCPTransport(l.Addr().String(), nil)
+	assert.NoError(t, err)
+	defer transport.Shutdown()
+	node := &Node{transport: transport, limiter: NewTokenBucket(DefaultRate, DefaultBurst)}
+
+	for i := 0; i < 2; i++ {
+		var a, b string
+		errs, err := node.batch("echo", [][]interface{}{{"a"}, {"b"}}, []interface{}{&a, &b})
+		assert.NoError(t, err)
+		assert.Equal(t, []error{nil, nil}, errs)
+		assert.Equal(t, "a", a)
+		assert.Equal(t, "b", b)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadBytes(messageDelim)
+		if err != nil {
+			return
+		}
+		var req RequestMessage
+		assert.NoError(t, json.Unmarshal(line, &req))
+		// notifications can arrive before the response
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "blockchain.scripthash.subscribe", "params": ["abcd", null]}` + "\n"))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "blockchain.headers.subscribe", "params": [{"height": 101, "hex": "00"}]}` + "\n"))
+		b, _ := json.Marshal(ResponseMessage{Id: req.Id, Result: map[string]interface{}{"height": 100, "hex": "00"}})
+		conn.Write(append(b, messageDelim))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "blockchain.headers.subscribe", "params": [{"height": 102, "hex": "00"}]}` + "\n"))
+		conn.Write([]byte(`{"jsonrpc": "2.0", "method": "blockchain.scripthash.subscribe", "params": ["abcd", "ef01"]}` + "\n"))
+		reader.ReadBytes(messageDelim)
+	}()
+
+	transport, err := NewTCPTransport(l.Addr().String(), nil)
+	assert.NoError(t, err)
+	node := &Node{Protocol: "1.4", transport: transport, limiter: NewTokenBucket(DefaultRate, DefaultBurst)}
+	headers := node.HeaderNotifications()
+	statuses := node.ScripthashNotifications()
+
+	tip, err := node.BlockchainHeadersSubscribe()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(100), tip.Height)
+	assert.Equal(t, uint32(101), (<-headers).Height)
+	assert.Equal(t, uint32(102), (<-headers).Height)
+	assert.Equal(t, &ScripthashStatus{ScriptHash: "abcd"}, <-statuses)
+	assert.Equal(t, &ScripthashStatus{ScriptHash: "abcd", Status: "ef01"}, <-statuses)
+
+	// the channels are closed with the connection
+	node.Disconnect()
+	_, ok := <-headers
+	assert.False(t, ok)
+	_, ok = <-statuses
+	assert.False(t, ok)
+}
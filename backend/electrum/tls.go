@@ -0,0 +1,213 @@
+package electrum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TLSPolicy decides which certificates the SSL transport accepts. A server's certificate is
+// accepted if:
+//   - the server's host has a pin: the certificate's fingerprint matches the pin. CAs are ignored.
+//   - otherwise, the certificate is signed by a CA trusted by the system, for the server's host.
+//   - otherwise, KnownServers is set and the certificate is the one the server presented the first
+//     time we connected to it (trust on first use). A server which once presented a certificate
+//     signed by a CA is recorded as such, and must keep doing so.
+//
+// A nil policy only accepts certificates signed by a CA.
+type TLSPolicy struct {
+	// Pins maps a host to the SHA-256 fingerprint of its certificate (see Fingerprint).
+	Pins map[string]string
+	// KnownServers stores the fingerprints of the servers we trust on first use.
+	KnownServers *KnownServers
+}
+
+// CertificateError is returned when a server's certificate doesn't match its pin, or the
+// certificate it presented earlier.
+type CertificateError struct {
+	Server   string
+	Expected string
+	Actual   string
+}
+
+func (e *CertificateError) Error() string {
+	if e.Expected == signedByCA {
+		return fmt.Sprintf("certificate of %s isn't signed by a CA anymore: fingerprint is %s", e.Server, e.Actual)
+	}
+	return fmt.Sprintf("certificate of %s changed: fingerprint is %s, expected %s", e.Server, e.Actual, e.Expected)
+}
+
+// Fingerprint returns the hex encoded SHA-256 of a DER encoded certificate, e.g. the output of
+// `openssl x509 -noout -fingerprint -sha256` without the colons, in lower case.
+func Fingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
+// NormalizeFingerprint lower cases a fingerprint and removes the colons.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+// config returns the tls.Config used to connect to addr (host:port).
+func (p *TLSPolicy) config(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ServerName: host,
+		// The certificate is verified by verify instead, which falls back to pins and known servers.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return p.verify(addr, host, rawCerts)
+		},
+	}, nil
+}
+
+func (p *TLSPolicy) verify(addr, host string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%s didn't present a certificate", addr)
+	}
+	fingerprint := Fingerprint(rawCerts[0])
+
+	if p != nil {
+		if pin, exists := p.Pins[host]; exists {
+			if NormalizeFingerprint(pin) != fingerprint {
+				return &CertificateError{Server: addr, Expected: NormalizeFingerprint(pin), Actual: fingerprint}
+			}
+			return nil
+		}
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, caErr := certs[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	if caErr == nil {
+		if p != nil && p.KnownServers != nil {
+			p.KnownServers.trustCA(addr)
+		}
+		return nil
+	}
+
+	if p == nil || p.KnownServers == nil {
+		return caErr
+	}
+	return p.KnownServers.check(addr, fingerprint)
+}
+
+// signedByCA replaces the fingerprint of the known servers which presented a certificate signed
+// by a CA. Their certificates can be renewed, but can't be replaced with self-signed ones.
+const signedByCA = "ca"
+
+// KnownServers remembers the certificate fingerprints of the servers we connected to, in a file
+// similar to ssh's known_hosts: one "host:port fingerprint" per line ("host:port ca" for the
+// servers with a certificate signed by a CA).
+type KnownServers struct {
+	mu      sync.Mutex
+	path    string
+	servers map[string]string
+}
+
+// LoadKnownServers reads the known servers file. A missing file isn't an error, the file is
+// created when the first server is added. An empty path keeps the servers in memory only.
+func LoadKnownServers(path string) (*KnownServers, error) {
+	k := &KnownServers{path: path, servers: make(map[string]string)}
+	if path == "" {
+		return k, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid known servers file %s, line %d", path, line)
+		}
+		k.servers[fields[0]] = NormalizeFingerprint(fields[1])
+	}
+	return k, scanner.Err()
+}
+
+// check accepts the fingerprint if it is the one recorded for addr. An unknown server is added.
+func (k *KnownServers) check(addr, fingerprint string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if known, exists := k.servers[addr]; exists {
+		if known != fingerprint {
+			return &CertificateError{Server: addr, Expected: known, Actual: fingerprint}
+		}
+		return nil
+	}
+	k.servers[addr] = fingerprint
+	if err := k.save(); err != nil {
+		// not fatal, the server will be trusted again on its next first use.
+		log.Printf("failed to save known servers: %+v", err)
+	}
+	return nil
+}
+
+// trustCA records that addr presented a certificate signed by a CA.
+func (k *KnownServers) trustCA(addr string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.servers[addr] == signedByCA {
+		return
+	}
+	k.servers[addr] = signedByCA
+	if err := k.save(); err != nil {
+		log.Printf("failed to save known servers: %+v", err)
+	}
+}
+
+func (k *KnownServers) save() error {
+	if k.path == "" {
+		return nil
+	}
+	addrs := make([]string, 0, len(k.servers))
+	for addr := range k.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var buf bytes.Buffer
+	for _, addr := range addrs {
+		fmt.Fprintf(&buf, "%s %s\n", addr, k.servers[addr])
+	}
+	tmp := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,150 @@
+package electrum
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// selfSignedServer accepts TLS connections with a new self-signed certificate, and returns the
+// certificate's fingerprint.
+func selfSignedServer(t *testing.T) (net.Listener, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "electrum.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l, Fingerprint(der)
+}
+
+func connect(l net.Listener, policy *TLSPolicy) error {
+	transport, err := NewSSLTransport(l.Addr().String(), policy, nil)
+	if err != nil {
+		return err
+	}
+	return transport.Shutdown()
+}
+
+func TestTLSPolicy(t *testing.T) {
+	l, fingerprint := selfSignedServer(t)
+	defer l.Close()
+
+	// the certificate isn't signed by a CA
+	assert.Error(t, connect(l, nil))
+	assert.Error(t, connect(l, &TLSPolicy{}))
+
+	// pins
+	colons := strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:])
+	assert.NoError(t, connect(l, &TLSPolicy{Pins: map[string]string{"127.0.0.1": colons}}))
+	var certErr *CertificateError
+	err := connect(l, &TLSPolicy{Pins: map[string]string{"127.0.0.1": strings.Repeat("00", 32)}})
+	assert.True(t, errors.As(err, &certErr), "%+v", err)
+}
+
+func TestKnownServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beancounter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_servers")
+
+	l, fingerprint := selfSignedServer(t)
+	defer l.Close()
+	known, err := LoadKnownServers(path)
+	assert.NoError(t, err)
+	policy := &TLSPolicy{KnownServers: known}
+
+	// the server is trusted on first use, and remembered
+	assert.NoError(t, connect(l, policy))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, l.Addr().String()+" "+fingerprint+"\n", string(data))
+	assert.NoError(t, connect(l, policy))
+
+	// another run, the server's certificate changed
+	assert.NoError(t, ioutil.WriteFile(path, []byte(l.Addr().String()+" "+strings.Repeat("ab", 32)+"\n"), 0600))
+	known, err = LoadKnownServers(path)
+	assert.NoError(t, err)
+	var certErr *CertificateError
+	err = connect(l, &TLSPolicy{KnownServers: known})
+	assert.True(t, errors.As(err, &certErr), "%+v", err)
+}
+
+func TestKnownServersDowngrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beancounter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_servers")
+
+	l, fingerprint := selfSignedServer(t)
+	defer l.Close()
+	known, err := LoadKnownServers(path)
+	assert.NoError(t, err)
+	policy := &TLSPolicy{KnownServers: known}
+	assert.NoError(t, connect(l, policy))
+
+	// once the server presented a certificate signed by a CA, its self-signed one is refused
+	known.trustCA(l.Addr().String())
+	var certErr *CertificateError
+	err = connect(l, policy)
+	assert.True(t, errors.As(err, &certErr), "%+v", err)
+	assert.Equal(t, fingerprint, certErr.Actual)
+
+	// and in the next runs
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, l.Addr().String()+" ca\n", string(data))
+	known, err = LoadKnownServers(path)
+	assert.NoError(t, err)
+	err = connect(l, &TLSPolicy{KnownServers: known})
+	assert.True(t, errors.As(err, &certErr), "%+v", err)
+}
+
+func TestPlaintextPorts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.NoError(t, err)
+
+	_, err = NewNode("127.0.0.1", "t"+port, Testnet, nil)
+	assert.Error(t, err)
+	node, err := NewNode("127.0.0.1", "t"+port, Testnet, &ConnectionConfig{Plaintext: true})
+	assert.NoError(t, err)
+	node.Disconnect()
+}
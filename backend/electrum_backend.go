@@ -2,6 +2,7 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 
 	"github.com/Masterminds/semver"
@@ -23,10 +25,15 @@ import (
 // Electrum protocol docs: https://electrumx.readthedocs.io/en/latest/protocol.html
 //
 // When we connect to an Electrum server, we:
-// - ensure the server talks v1.2
-// - has the right genesis block
+// - negotiate a protocol version between v1.2 and v1.4
+// - ensure the server has the right genesis block
 // - has crossed the height we are interested in.
-// - we then negotiate protocol v1.2
+//
+// Addresses are looked up by script hash. Servers which only speak v1.2 fall back to the
+// blockchain.address.* methods, which were removed in v1.3.
+//
+// Block headers are downloaded in batches and validated before they are used (see
+// header_chain.go): block hashes and merkle proofs are checked against validated headers only.
 //
 // A background goroutine continuously connects to peers.
 
@@ -34,7 +41,10 @@ import (
 // balance and transaction history information for a given address.
 // ElectrumBackend implements Backend interface.
 type ElectrumBackend struct {
+	// the tip claimed by the initial server. chainHeight is only taken from the validated header
+	// chain once ValidateTip succeeds.
 	chainHeight uint32
+	tipHash     chainhash.Hash
 
 	// peer management
 	nodeMu sync.RWMutex // mutex to guard reads/writes to nodes map
@@ -43,6 +53,7 @@ type ElectrumBackend struct {
 	// time has elapsed.
 	blacklistedNodes map[string]struct{}
 	network          Network
+	connConfig       *electrum.ConnectionConfig
 
 	// channels used to communicate with the Accounter
 	addrRequests  chan *deriver.Address
@@ -54,16 +65,58 @@ type ElectrumBackend struct {
 	blockRequests  chan uint32
 	blockResponses chan *BlockResponse
 
+	// BlockHeight's requests to sync the header chain, each with its own reply channel
+	syncRequests chan *syncRequest
+
+	errors chan error
+
 	// internal channels
 	peersRequests  chan struct{}
 	transactionsMu sync.Mutex // mutex to guard read/writes to transactions map
 	transactions   map[string]int64
 	doneCh         chan bool
+
+	// block headers are validated before we use them (see header_chain.go). syncMu ensures a
+	// single node downloads headers at a time.
+	chain  *HeaderChain
+	syncMu sync.Mutex
+
+	// quorum mode (see quorum.go)
+	quorum          int
+	quorumPolicy    QuorumPolicy
+	quorumSlots     chan struct{}         // limits the number of addresses being processed
+	nodeQueues      map[string]*nodeQueue // guarded by nodeMu
+	disagreementsMu sync.Mutex
+	disagreements   []Disagreement
+
+	// privacy mode (see privacy.go), nil when disabled
+	privacy *privacyState
+
+	// number of times each request failed, see retry.
+	retriesMu sync.Mutex
+	retries   map[string]int
+
+	// rate limit of each server, see SetRateLimit. Guarded by nodeMu.
+	rate  float64
+	burst int
 }
 
 const (
 	maxPeers          = 100
 	peerFetchInterval = 30 * time.Second // How often to fetch additional peers?
+
+	// number of requests in flight on each connection. The servers' rate limit still applies.
+	requestsPerNode = 8
+
+	// max number of addresses or transactions sent in a single batch.
+	maxBatchSize = 50
+
+	// number of times a request is retried when a server fails to process it.
+	maxRetries = 3
+
+	// range of protocol versions negotiated with the servers
+	minProtocol = "1.2"
+	maxProtocol = "1.4"
 )
 
 var (
@@ -73,12 +126,19 @@ var (
 	ErrIncompatibleVersion = errors.New("Incompatible version")
 	// ErrFailedNegotiateVersion means electrum server doesn't support version(s) used by the electrum client lib
 	ErrFailedNegotiateVersion = errors.New("Failed negotiate version")
+	// ErrBackendFinished means the backend is shutting down
+	ErrBackendFinished = errors.New("Backend finished")
 )
 
 // NewElectrumBackend returns a new ElectrumBackend structs or errors.
 // Initially connects to 1 node. A background job handles connecting to
 // additional peers. The background job fails if there are no peers left.
-func NewElectrumBackend(addr, port string, network Network) (*ElectrumBackend, error) {
+// connConfig sets the proxy and which certificates are accepted from the servers, nil connects
+// directly and only accepts certificates signed by a CA.
+func NewElectrumBackend(addr, port string, network Network, connConfig *electrum.ConnectionConfig) (*ElectrumBackend, error) {
+	if connConfig == nil {
+		connConfig = &electrum.ConnectionConfig{}
+	}
 
 	// TODO: should the channels have k * maxPeers buffers? Each node needs to enqueue a
 	// potentially large number of transactions. If all nodes are doing that at the same time,
@@ -87,37 +147,53 @@ func NewElectrumBackend(addr, port string, network Network) (*ElectrumBackend, e
 		nodes:            make(map[string]*electrum.Node),
 		blacklistedNodes: make(map[string]struct{}),
 		network:          network,
+		connConfig:       connConfig,
 		addrRequests:     make(chan *deriver.Address, 2*maxPeers),
 		addrResponses:    make(chan *AddrResponse, 2*maxPeers),
 		txRequests:       make(chan string, 2*maxPeers),
 		txResponses:      make(chan *TxResponse, 2*maxPeers),
 		blockRequests:    make(chan uint32, 2*maxPeers),
 		blockResponses:   make(chan *BlockResponse, 2*maxPeers),
+		syncRequests:     make(chan *syncRequest),
+		errors:           make(chan error, maxPeers),
 
 		peersRequests: make(chan struct{}),
 		transactions:  make(map[string]int64),
 		doneCh:        make(chan bool),
+		chain:         NewHeaderChain(network),
+
+		quorum:       1,
+		quorumPolicy: QuorumUnion,
+		quorumSlots:  make(chan struct{}, 2*maxPeers),
+		nodeQueues:   make(map[string]*nodeQueue),
+
+		retries: make(map[string]int),
+
+		rate:  electrum.DefaultRate,
+		burst: electrum.DefaultBurst,
 	}
 
 	// Connect to a node to fetch the height
-	height, err := eb.getHeight(addr, port, network)
+	height, hash, err := eb.getHeight(addr, port, network)
 	if err != nil {
 		return nil, err
 	}
-	eb.chainHeight = height
+	eb.chainHeight, eb.tipHash = height, hash
 
 	// Connect to a node and handle requests
 	if err := eb.addNode(addr, port, network); err != nil {
-		fmt.Printf("failed to connect to initial node: %+v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to connect to initial node: %w", err)
 	}
 
 	// goroutine to continuously fetch additional peers
 	go func() {
+		ticker := time.NewTicker(peerFetchInterval)
+		defer ticker.Stop()
+
 		eb.findPeers()
 		for {
 			select {
-			case <-time.Tick(peerFetchInterval):
+			case <-ticker.C:
 				eb.findPeers()
 			case <-eb.doneCh:
 				return
@@ -130,10 +206,33 @@ func NewElectrumBackend(addr, port string, network Network) (*ElectrumBackend, e
 
 // AddrRequest schedules a request to the backend to lookup information related
 // to the given address.
-func (eb *ElectrumBackend) AddrRequest(addr *deriver.Address) {
-	reporter.GetInstance().IncAddressesScheduled()
-	reporter.GetInstance().Logf("scheduling address: %s", addr)
-	eb.addrRequests <- addr
+func (eb *ElectrumBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	if eb.privacy != nil {
+		return eb.privateAddrRequest(ctx, addr)
+	}
+	if eb.quorum > 1 {
+		select {
+		case eb.quorumSlots <- struct{}{}:
+			reporter.GetInstance().IncAddressesScheduled()
+			reporter.GetInstance().Logf("scheduling address: %s (quorum of %d)", addr, eb.quorum)
+			go func() {
+				defer func() { <-eb.quorumSlots }()
+				eb.processQuorumRequest(addr, quorumTimeout)
+			}()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case eb.addrRequests <- addr:
+		reporter.GetInstance().IncAddressesScheduled()
+		reporter.GetInstance().Logf("scheduling address: %s", addr)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // AddrResponses exposes a channel that allows to consume backend's responses to
@@ -144,10 +243,31 @@ func (eb *ElectrumBackend) AddrResponses() <-chan *AddrResponse {
 
 // TxRequest schedules a request to the backend to lookup information related
 // to the given transaction hash.
-func (eb *ElectrumBackend) TxRequest(txHash string) {
-	reporter.GetInstance().IncTxScheduled()
-	reporter.GetInstance().Logf("scheduling tx: %s", txHash)
-	eb.txRequests <- txHash
+func (eb *ElectrumBackend) TxRequest(ctx context.Context, txHash string) error {
+	// In privacy mode, the transaction is fetched from the host which saw its address.
+	if shard, exists := eb.txShard(txHash); exists {
+		select {
+		case eb.quorumSlots <- struct{}{}:
+			reporter.GetInstance().IncTxScheduled()
+			reporter.GetInstance().Logf("scheduling tx: %s (shard %d)", txHash, shard)
+			go func() {
+				defer func() { <-eb.quorumSlots }()
+				eb.processPrivateTx(txHash, shard)
+			}()
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case eb.txRequests <- txHash:
+		reporter.GetInstance().IncTxScheduled()
+		reporter.GetInstance().Logf("scheduling tx: %s", txHash)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // TxResponses exposes a channel that allows to consume backend's responses to
@@ -158,26 +278,160 @@ func (eb *ElectrumBackend) TxResponses() <-chan *TxResponse {
 	return eb.txResponses
 }
 
-func (eb *ElectrumBackend) BlockRequest(height uint32) {
-	eb.blockRequests <- height
+func (eb *ElectrumBackend) BlockRequest(ctx context.Context, height uint32) error {
+	select {
+	case eb.blockRequests <- height:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (eb *ElectrumBackend) BlockResponses() <-chan *BlockResponse {
 	return eb.blockResponses
 }
 
-// Finish informs the backend to stop doing its work.
+// syncRequest asks a node to extend the header chain up to height. The outcome is sent on result,
+// which is buffered so the node never blocks.
+type syncRequest struct {
+	height   uint32
+	attempts int
+	result   chan error
+}
+
+// BlockHeight returns the height of a block, by looking it up in the validated header chain. The
+// chain is first extended to the tip, which can take a while without a header store. Blocks below
+// the chain's anchor (the latest checkpoint) can't be found.
+func (eb *ElectrumBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	h, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	// the request doesn't go through blockRequests, so the responses meant for the Blockfinder
+	// (and the errors meant for the Accounter) aren't consumed here.
+	req := &syncRequest{height: eb.chainHeight, result: make(chan error, 1)}
+	select {
+	case eb.syncRequests <- req:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-eb.doneCh:
+		return 0, ErrBackendFinished
+	}
+	select {
+	case err := <-req.result:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-eb.doneCh:
+		return 0, ErrBackendFinished
+	}
+
+	// a node could be extending the chain for another request
+	eb.syncMu.Lock()
+	height, ok := eb.chain.Find(*h)
+	eb.syncMu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("block %s isn't in the header chain", hash)
+	}
+	return height, nil
+}
+
+// Errors exposes a channel on which the backend reports requests it failed to process.
+func (eb *ElectrumBackend) Errors() <-chan error {
+	return eb.errors
+}
+
+// Finish informs the backend to stop doing its work. All the goroutines exit and we disconnect
+// from all the nodes.
 func (eb *ElectrumBackend) Finish() {
 	close(eb.doneCh)
 	eb.removeAllNodes()
-	// TODO: we could gracefully disconnect from all the nodes. We currently don't, because the
-	// program is going to terminate soon anyways.
 }
 
+// ChainHeight returns the height of the tip. It's the initial server's claim until ValidateTip
+// succeeds.
 func (eb *ElectrumBackend) ChainHeight() uint32 {
 	return eb.chainHeight
 }
 
+// UseHeaderStore loads the validated headers stored in path by an earlier run, and stores the
+// headers downloaded by this run. It should be called right after creating the backend.
+func (eb *ElectrumBackend) UseHeaderStore(path string) error {
+	return eb.chain.Load(path)
+}
+
+// ValidateTip extends the header chain to the tip claimed by the initial server, and checks that
+// the tip is the validated header at that height. A server can't make up a tip without doing the
+// work of the whole chain since the latest checkpoint. It should be called after UseHeaderStore,
+// so the stored headers aren't downloaded again.
+func (eb *ElectrumBackend) ValidateTip() error {
+	err := errors.New("no node to fetch the headers from")
+	for _, node := range eb.connectedNodes() {
+		var header *wire.BlockHeader
+		header, err = eb.header(node, eb.chainHeight)
+		if err != nil {
+			log.Printf("ValidateTip failed with: %s, %+v", node.Ident, err)
+			continue
+		}
+		if header.BlockHash() != eb.tipHash {
+			return fmt.Errorf("tip %s at height %d isn't in the validated header chain", eb.tipHash, eb.chainHeight)
+		}
+		return nil
+	}
+	return err
+}
+
+// connectedNodes returns the nodes we are connected to.
+func (eb *ElectrumBackend) connectedNodes() []*electrum.Node {
+	eb.nodeMu.RLock()
+	defer eb.nodeMu.RUnlock()
+	nodes := make([]*electrum.Node, 0, len(eb.nodes))
+	for _, node := range eb.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// SetRateLimit limits the requests sent to each server to rate requests per second, with bursts
+// of up to burst requests.
+func (eb *ElectrumBackend) SetRateLimit(rate float64, burst int) error {
+	if rate <= 0 || burst < 1 {
+		return fmt.Errorf("rate limit must be positive")
+	}
+	eb.nodeMu.Lock()
+	defer eb.nodeMu.Unlock()
+	eb.rate, eb.burst = rate, burst
+	for _, node := range eb.nodes {
+		node.SetRateLimit(rate, burst)
+	}
+	return nil
+}
+
+// AddServer connects to another server, besides the initial one, and looks up its peers. This way,
+// the initial server doesn't pick all the peers, e.g. in quorum mode.
+func (eb *ElectrumBackend) AddServer(addr, port string) error {
+	ident := electrum.NodeIdent(addr, port)
+	eb.nodeMu.RLock()
+	node, exists := eb.nodes[ident]
+	eb.nodeMu.RUnlock()
+	if !exists {
+		// the server isn't already a peer
+		if err := eb.addNode(addr, port, eb.network); err != nil {
+			return err
+		}
+		eb.nodeMu.RLock()
+		node, exists = eb.nodes[ident]
+		eb.nodeMu.RUnlock()
+		if !exists {
+			return fmt.Errorf("%s was disconnected", addr)
+		}
+	}
+	return eb.processPeersRequest(node)
+}
+
 // Connect to a node and add it to the map of nodes
 func (eb *ElectrumBackend) addNode(addr, port string, network Network) error {
 	ident := electrum.NodeIdent(addr, port)
@@ -195,118 +449,196 @@ func (eb *ElectrumBackend) addNode(addr, port string, network Network) error {
 	}
 
 	log.Printf("connecting to %s", addr)
-	node, err := electrum.NewNode(addr, port, network)
+	node, err := electrum.NewNode(addr, port, network, eb.connConfig)
 	if err != nil {
-		eb.nodeMu.Lock()
-		eb.blacklistedNodes[ident] = struct{}{}
-		eb.nodeMu.Unlock()
+		eb.blacklistNode(ident)
 		return err
 	}
 
-	// Get the server's features
-	feature, err := node.ServerFeatures()
-	if err != nil {
-		eb.nodeMu.Lock()
-		eb.blacklistedNodes[ident] = struct{}{}
-		eb.nodeMu.Unlock()
-		return err
-	}
-	// Check genesis block
-	if feature.Genesis != GenesisBlock(network) {
-		eb.nodeMu.Lock()
-		eb.blacklistedNodes[ident] = struct{}{}
-		eb.nodeMu.Unlock()
-		return ErrIncorrectGenesisBlock
-	}
-	// TODO: check pruning. Currently, servers currently don't prune, so it's fine to skip for now.
-
-	// Check version
-	err = checkVersion(feature.Protocol)
-	if err != nil {
-		eb.nodeMu.Lock()
-		eb.blacklistedNodes[ident] = struct{}{}
-		eb.nodeMu.Unlock()
+	if err := handshake(node, network); err != nil {
+		node.Disconnect()
+		eb.blacklistNode(ident)
 		return err
 	}
 
-	// Negotiate version
-	err = node.ServerVersion("1.2")
-	if err != nil {
-		eb.nodeMu.Lock()
-		eb.blacklistedNodes[ident] = struct{}{}
-		eb.nodeMu.Unlock()
-		return ErrFailedNegotiateVersion
-	}
-
 	// TODO: ask the server for info on the block height we care about. If the server doesn't have
 	// that block, we'll automatically disconnect.
 
 	eb.nodeMu.Lock()
+	select {
+	case <-eb.doneCh:
+		// Finish() was called while we were connecting.
+		eb.nodeMu.Unlock()
+		node.Disconnect()
+		return ErrBackendFinished
+	default:
+	}
+	node.SetRateLimit(eb.rate, eb.burst)
 	eb.nodes[ident] = node
+	queue := &nodeQueue{requests: make(chan *historyRequest), txs: make(chan string), gone: make(chan struct{})}
+	eb.nodeQueues[ident] = queue
 	eb.nodeMu.Unlock()
 
-	// We can process requests
-	go eb.processRequests(node)
+	// We can process requests. The transport multiplexes the connection, so each node has several
+	// workers.
+	for i := 0; i < requestsPerNode; i++ {
+		go eb.processRequests(node, queue)
+	}
 
 	return nil
 }
 
-// Connect to a node without registering it, fetch height and disconnect.
-func (eb *ElectrumBackend) getHeight(addr, port string, network Network) (uint32, error) {
-	log.Printf("connecting to %s", addr)
-	node, err := electrum.NewNode(addr, port, network)
+// handshake negotiates the protocol version and checks the server's features. Since v1.4,
+// server.version must be the first message.
+func handshake(node *electrum.Node, network Network) error {
+	// Negotiate version
+	err := node.ServerVersion(minProtocol, maxProtocol)
 	if err != nil {
-		return 0, err
+		return ErrFailedNegotiateVersion
+	}
+	// The server picks the highest version we have in common. Check it didn't pick something else.
+	err = checkNegotiatedVersion(node.Protocol)
+	if err != nil {
+		return err
 	}
-	defer node.Disconnect()
 
 	// Get the server's features
 	feature, err := node.ServerFeatures()
 	if err != nil {
-		return 0, err
+		return err
 	}
 	// Check genesis block
 	if feature.Genesis != GenesisBlock(network) {
-		return 0, ErrIncorrectGenesisBlock
+		return ErrIncorrectGenesisBlock
 	}
 	// TODO: check pruning. Currently, servers currently don't prune, so it's fine to skip for now.
+	return nil
+}
 
-	// Check version
-	err = checkVersion(feature.Protocol)
+// getHistory fetches an address' history, using the address' script hash. Servers which
+// negotiated v1.2 might not implement the scripthash methods, the address is then looked up
+// directly.
+func getHistory(node *electrum.Node, addr *deriver.Address) ([]*electrum.Transaction, error) {
+	scriptHash, err := addrScriptHash(addr)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	txs, err := node.BlockchainScripthashGetHistory(scriptHash)
+	if err == electrum.ErrAPI && node.Protocol == minProtocol {
+		log.Printf("%s doesn't support blockchain.scripthash.get_history, falling back to the address", node.Ident)
+		return node.BlockchainAddressGetHistory(addr.String())
 	}
+	return txs, err
+}
 
-	// Negotiate version
-	err = node.ServerVersion("1.2")
+// getHistories fetches the histories of several addresses in a single batch, using their script
+// hashes. errs[i] is set if the server failed to return the i-th history. Like getHistory, servers
+// which negotiated v1.2 fall back to the addresses.
+func getHistories(node *electrum.Node, addrs []*deriver.Address) ([][]*electrum.Transaction, []error, error) {
+	scriptHashes := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		scriptHash, err := addrScriptHash(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		scriptHashes = append(scriptHashes, scriptHash)
+	}
+	histories, errs, err := node.BlockchainScripthashGetHistoryBatch(scriptHashes)
 	if err != nil {
-		return 0, ErrFailedNegotiateVersion
+		return nil, nil, err
+	}
+	if node.Protocol == minProtocol {
+		for i, addr := range addrs {
+			if errs[i] == electrum.ErrAPI {
+				histories[i], errs[i] = node.BlockchainAddressGetHistory(addr.String())
+			}
+		}
+	}
+	return histories, errs, nil
+}
+
+// addrScriptHash returns the script hash Electrum servers index the address' history by.
+func addrScriptHash(addr *deriver.Address) (string, error) {
+	script, err := addr.Script()
+	if err != nil {
+		return "", err
+	}
+	b, err := hex.DecodeString(script)
+	if err != nil {
+		return "", err
+	}
+	return electrum.ScriptHash(b), nil
+}
+
+// Connect to a node without registering it, fetch the tip and disconnect.
+func (eb *ElectrumBackend) getHeight(addr, port string, network Network) (uint32, chainhash.Hash, error) {
+	log.Printf("connecting to %s", addr)
+	node, err := electrum.NewNode(addr, port, network, eb.connConfig)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	defer node.Disconnect()
+
+	if err := handshake(node, network); err != nil {
+		return 0, chainhash.Hash{}, err
 	}
 
 	header, err := node.BlockchainHeadersSubscribe()
 	if err != nil {
 		log.Printf("BlockchainHeadersSubscribe failed: %+v", err)
-		return 0, err
+		return 0, chainhash.Hash{}, err
+	}
+
+	// The tip is only attested once ValidateTip linked it to the validated header chain. Until
+	// then, make sure the server at least sent a header with a valid proof of work, at a difficulty
+	// the network allows.
+	tip, err := parseBlockHeader(header.Hex)
+	if err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	if err := checkPowLimit(tip, network.ChainConfig()); err != nil {
+		return 0, chainhash.Hash{}, err
+	}
+	if err := checkProofOfWork(tip); err != nil {
+		return 0, chainhash.Hash{}, err
 	}
 
-	return header.Height, nil
+	return header.Height, tip.BlockHash(), nil
 }
 
-func (eb *ElectrumBackend) processRequests(node *electrum.Node) {
+func (eb *ElectrumBackend) processRequests(node *electrum.Node, queue *nodeQueue) {
 	for {
 		select {
+		case <-eb.doneCh:
+			return
+		case <-queue.gone:
+			// another worker removed the node
+			return
+		case req := <-queue.requests:
+			txs, err := getHistory(node, req.addr)
+			req.result <- historyResult{txs: txs, err: err}
+			if err != nil {
+				log.Printf("processRequests failed with: %s, %+v", node.Ident, err)
+				eb.removeNode(node.Ident)
+				return
+			}
+		case txHash := <-queue.txs:
+			err := eb.processTxRequests(node, []string{txHash})
+			if err != nil {
+				return
+			}
 		case _ = <-eb.peersRequests:
 			err := eb.processPeersRequest(node)
 			if err != nil {
 				return
 			}
 		case addr := <-eb.addrRequests:
-			err := eb.processAddrRequest(node, addr)
+			err := eb.processAddrRequests(node, eb.nextAddrs(addr))
 			if err != nil {
 				return
 			}
 		case tx := <-eb.txRequests:
-			err := eb.processTxRequest(node, tx)
+			err := eb.processTxRequests(node, eb.nextTxs(tx))
 			if err != nil {
 				return
 			}
@@ -315,6 +647,11 @@ func (eb *ElectrumBackend) processRequests(node *electrum.Node) {
 			if err != nil {
 				return
 			}
+		case req := <-eb.syncRequests:
+			err := eb.processSyncRequest(node, req)
+			if err != nil {
+				return
+			}
 		}
 	}
 }
@@ -338,120 +675,420 @@ func (eb *ElectrumBackend) processPeersRequest(node *electrum.Node) error {
 	return nil
 }
 
-func (eb *ElectrumBackend) processTxRequest(node *electrum.Node, txHash string) error {
-	hex, err := node.BlockchainTransactionGet(txHash)
+// nextAddrs returns addr and the address requests which are already queued, up to maxBatchSize.
+func (eb *ElectrumBackend) nextAddrs(addr *deriver.Address) []*deriver.Address {
+	addrs := []*deriver.Address{addr}
+	for len(addrs) < maxBatchSize {
+		select {
+		case addr := <-eb.addrRequests:
+			addrs = append(addrs, addr)
+		default:
+			return addrs
+		}
+	}
+	return addrs
+}
+
+// nextTxs returns txHash and the transaction requests which are already queued, up to
+// maxBatchSize.
+func (eb *ElectrumBackend) nextTxs(txHash string) []string {
+	txHashes := []string{txHash}
+	for len(txHashes) < maxBatchSize {
+		select {
+		case txHash := <-eb.txRequests:
+			txHashes = append(txHashes, txHash)
+		default:
+			return txHashes
+		}
+	}
+	return txHashes
+}
+
+// processTxRequests fetches the transactions in a single batch. A transaction the server failed
+// to return is requeued on its own, the node is only dropped if the whole batch failed.
+func (eb *ElectrumBackend) processTxRequests(node *electrum.Node, txHashes []string) error {
+	hexes, errs, err := node.BlockchainTransactionGetBatch(txHashes)
 	if err != nil {
-		log.Printf("processTxRequest failed with: %s, %+v", node.Ident, err)
+		log.Printf("processTxRequests failed with: %s, %+v", node.Ident, err)
 		eb.removeNode(node.Ident)
+		for _, txHash := range txHashes {
+			eb.requeueTx(txHash)
+		}
+		return err
+	}
+	for i, txHash := range txHashes {
+		if errs[i] != nil {
+			log.Printf("processTxRequests failed for %s with: %s, %+v", txHash, node.Ident, errs[i])
+			if eb.retry(txHash, errs[i]) {
+				eb.requeueTx(txHash)
+			}
+			continue
+		}
+		if err := eb.processTx(node, txHash, hexes[i]); err != nil {
+			// The node is gone, the remaining transactions go to other nodes.
+			for _, txHash := range txHashes[i+1:] {
+				eb.requeueTx(txHash)
+			}
+			return err
+		}
+	}
+	return nil
+}
 
-		// requeue request
-		// TODO: we should have a retry counter and fail gracefully if a transaction fails
-		//       too many times.
-		eb.txRequests <- txHash
+// processTx checks a transaction returned by node and sends it to the Accounter.
+func (eb *ElectrumBackend) processTx(node *electrum.Node, txHash, hex string) error {
+	if err := checkTxHash(txHash, hex); err != nil {
+		// The node sent us another transaction (or garbage). Don't talk to it again.
+		log.Printf("processTxRequest got a bad transaction from %s: %+v", node.Ident, err)
+		eb.blacklistNode(node.Ident)
+		eb.removeNode(node.Ident)
+		if eb.retry(txHash, err) {
+			eb.requeueTx(txHash)
+		}
 		return err
 	}
-	height := eb.getTxHeight(txHash)
+	height, err := eb.getTxHeight(txHash)
+	if err != nil {
+		// Not the node's fault, so we keep processing requests.
+		reportError(eb.errors, txHash, err)
+		return nil
+	}
+
+	// Mined transactions must come with a merkle proof. Transactions in the mempool can't be
+	// verified.
+	verified := false
+	if height > 0 {
+		if err := eb.verifyTx(node, txHash, height); err != nil {
+			if _, ok := err.(*ProofError); ok {
+				// The node lied about the transaction's block. Don't talk to it again, and let
+				// another node prove the transaction.
+				log.Printf("verifyTx got a bad proof from %s: %+v", node.Ident, err)
+				eb.blacklistNode(node.Ident)
+				eb.removeNode(node.Ident)
+				if eb.retry(txHash, err) {
+					eb.requeueTx(txHash)
+				}
+				return err
+			}
+			log.Printf("verifyTx failed with: %s, %+v", node.Ident, err)
+			eb.removeNode(node.Ident)
+			eb.requeueTx(txHash)
+			return err
+		}
+		verified = true
+	}
 
-	eb.txResponses <- &TxResponse{
-		Hash:   txHash,
-		Height: height,
-		Hex:    hex,
+	select {
+	case eb.txResponses <- &TxResponse{Hash: txHash, Height: height, Hex: hex, Verified: verified}:
+	case <-eb.doneCh:
 	}
 
 	return nil
 }
 
-func (eb *ElectrumBackend) getTxHeight(txHash string) int64 {
+func (eb *ElectrumBackend) getTxHeight(txHash string) (int64, error) {
 	eb.transactionsMu.Lock()
 	defer eb.transactionsMu.Unlock()
 
 	height, exists := eb.transactions[txHash]
 	if !exists {
-		log.Panicf("transactions cache miss for %s", txHash)
+		return 0, fmt.Errorf("transactions cache miss for %s", txHash)
 	}
-	return height
+	return height, nil
 }
 
-// note: we could be more efficient and batch things up.
+// verifyTx checks the transaction's merkle proof against the header at its height. Returns a
+// ProofError if the proof doesn't match, any other error means the node failed to respond.
+func (eb *ElectrumBackend) verifyTx(node *electrum.Node, txHash string, height int64) error {
+	merkle, err := node.BlockchainTransactionGetMerkle(txHash, uint32(height))
+	if err != nil {
+		return err
+	}
+	if int64(merkle.BlockHeight) != height {
+		return &ProofError{TxHash: txHash, Height: height,
+			Reason: fmt.Sprintf("proof is for height %d", merkle.BlockHeight)}
+	}
+	header, err := eb.header(node, uint32(height))
+	if err != nil {
+		return err
+	}
+	return verifyMerkleBranch(txHash, height, merkle.Pos, merkle.Merkle, header)
+}
+
+// header returns the validated block header at a given height. If the chain doesn't reach the
+// height yet, the missing headers are downloaded from node.
+func (eb *ElectrumBackend) header(node *electrum.Node, height uint32) (*wire.BlockHeader, error) {
+	if header, ok := eb.chain.Header(height); ok {
+		return header, nil
+	}
+
+	eb.syncMu.Lock()
+	defer eb.syncMu.Unlock()
+	for {
+		start, count := eb.chain.NextBatch(height)
+		if count == 0 {
+			break
+		}
+		block, err := node.BlockchainBlockHeaders(start, uint(count))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := hex.DecodeString(block.Hex)
+		if err != nil {
+			return nil, err
+		}
+		headers, err := parseHeaders(raw)
+		if err != nil {
+			return nil, err
+		}
+		if len(headers) == 0 {
+			return nil, fmt.Errorf("%s doesn't have block %d", node.Ident, start)
+		}
+		if err := eb.chain.Extend(start, headers); err != nil {
+			return nil, err
+		}
+		reporter.GetInstance().Logf("validated headers %d to %d", start, start+uint32(len(headers))-1)
+	}
+	if err := eb.chain.Save(); err != nil {
+		// not fatal, we'll download the headers again next time.
+		log.Printf("failed to save headers: %+v", err)
+	}
+
+	header, ok := eb.chain.Header(height)
+	if !ok {
+		return nil, fmt.Errorf("header chain doesn't reach %d", height)
+	}
+	return header, nil
+}
+
+// processBlockRequest returns the header at height from the validated header chain, so the block
+// hash is attested by the proof of work of the headers. A header validated earlier (e.g. loaded
+// from the header store) is compared with the node's current header at that height, so a reorg
+// isn't hidden by the chain.
 func (eb *ElectrumBackend) processBlockRequest(node *electrum.Node, height uint32) error {
-	block, err := node.BlockchainBlockHeaders(height, 1)
+	_, cached := eb.chain.Header(height)
+	blockHeader, err := eb.header(node, height)
+	if err == nil && cached {
+		err = eb.checkHeader(node, height, blockHeader)
+	}
+	var mismatch *HeaderMismatchError
+	if errors.As(err, &mismatch) {
+		reportError(eb.errors, fmt.Sprintf("block %d", height), err)
+		return err
+	}
 	if err != nil {
+		// The node failed to respond or sent us headers which don't validate. Drop it and let
+		// another node handle the request.
 		log.Printf("processBlockRequest failed with: %s, %+v", node.Ident, err)
 		eb.removeNode(node.Ident)
 
 		// requeue request
 		// TODO: we should have a retry counter and fail gracefully if an address fails too
 		// many times.
-		eb.blockRequests <- height
+		eb.requeueBlock(height)
 		return err
 	}
 
-	// Decode hex to get Timestamp
-	b, err := hex.DecodeString(block.Hex)
+	select {
+	case eb.blockResponses <- &BlockResponse{Height: height, Hash: blockHeader.BlockHash().String(), Timestamp: blockHeader.Timestamp}:
+	case <-eb.doneCh:
+	}
+
+	return nil
+}
+
+// processSyncRequest extends the header chain up to the request's height. If the node fails, it's
+// dropped and the request is handed to another node, until it failed maxRetries times.
+func (eb *ElectrumBackend) processSyncRequest(node *electrum.Node, req *syncRequest) error {
+	_, err := eb.header(node, req.height)
+	if err == nil {
+		req.result <- nil
+		return nil
+	}
+	log.Printf("processSyncRequest failed with: %s, %+v", node.Ident, err)
+	eb.removeNode(node.Ident)
+
+	req.attempts++
+	if req.attempts > maxRetries {
+		req.result <- fmt.Errorf("syncing the headers up to %d failed %d times, last error: %w", req.height, req.attempts, err)
+		return err
+	}
+	select {
+	case eb.syncRequests <- req:
+	case <-eb.doneCh:
+	}
+	return err
+}
+
+// checkHeader fetches the node's header at height, bypassing the header chain, and returns a
+// HeaderMismatchError if it isn't the validated header. The node's header must have a valid proof
+// of work, so a node can't claim a reorg for free.
+func (eb *ElectrumBackend) checkHeader(node *electrum.Node, height uint32, validated *wire.BlockHeader) error {
+	block, err := node.BlockchainBlockHeaders(height, 1)
+	if err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(block.Hex)
+	if err != nil {
+		return err
+	}
+	headers, err := parseHeaders(raw)
+	if err != nil {
+		return err
+	}
+	if len(headers) != 1 {
+		return fmt.Errorf("%s doesn't have block %d", node.Ident, height)
+	}
+	header := &headers[0]
+	if err := checkPowLimit(header, eb.chain.params); err != nil {
+		return err
+	}
+	if err := checkProofOfWork(header); err != nil {
+		return err
+	}
+	if header.BlockHash() != validated.BlockHash() {
+		return &HeaderMismatchError{Height: height, Expected: validated.BlockHash().String(), Actual: header.BlockHash().String()}
+	}
+	return nil
+}
+
+// parseBlockHeader decodes a hex encoded block header.
+func parseBlockHeader(h string) (*wire.BlockHeader, error) {
+	b, err := hex.DecodeString(h)
 	if err != nil {
-		fmt.Printf("failed to unhex block %d: %s\n", height, block.Hex)
-		panic(err)
+		return nil, err
 	}
 
 	var blockHeader wire.BlockHeader
 	err = blockHeader.Deserialize(bytes.NewReader(b))
 	if err != nil {
-		fmt.Printf("failed to parse block %d: %s\n", height, block.Hex)
-		panic(err)
+		return nil, err
 	}
+	return &blockHeader, nil
+}
 
-	eb.blockResponses <- &BlockResponse{
-		Height:    height,
-		Timestamp: blockHeader.Timestamp,
+// processAddrRequests fetches the addresses' histories in a single batch. An address the server
+// failed to return is requeued on its own, the node is only dropped if the whole batch failed.
+func (eb *ElectrumBackend) processAddrRequests(node *electrum.Node, addrs []*deriver.Address) error {
+	histories, errs, err := getHistories(node, addrs)
+	if err != nil {
+		log.Printf("processAddrRequests failed with: %s, %+v", node.Ident, err)
+		eb.removeNode(node.Ident)
+		for _, addr := range addrs {
+			eb.requeueAddr(addr)
+		}
+		return err
 	}
 
+	for i, addr := range addrs {
+		if errs[i] != nil {
+			log.Printf("processAddrRequests failed for %s with: %s, %+v", addr, node.Ident, errs[i])
+			if eb.retry(addr.String(), errs[i]) {
+				eb.requeueAddr(addr)
+			}
+			continue
+		}
+		// TODO: we assume there are no more transactions. We should check what the API returns
+		// for addresses with very large number of transactions.
+		eb.sendHistory(addr, histories[i])
+	}
 	return nil
 }
 
-func (eb *ElectrumBackend) processAddrRequest(node *electrum.Node, addr *deriver.Address) error {
-	txs, err := node.BlockchainAddressGetHistory(addr.String())
-	if err != nil {
-		log.Printf("processAddrRequest failed with: %s, %+v", node.Ident, err)
-		eb.removeNode(node.Ident)
-
-		// requeue request
-		// TODO: we should have a retry counter and fail gracefully if an address fails too
-		// many times.
-		eb.addrRequests <- addr
-		return err
+// retry records that a server failed to process a request, and returns whether the request
+// should be retried. After maxRetries failures, the error is reported instead, wrapping the last
+// error so that e.g. a ProofError can still be told apart.
+func (eb *ElectrumBackend) retry(request string, err error) bool {
+	eb.retriesMu.Lock()
+	eb.retries[request]++
+	retries := eb.retries[request]
+	eb.retriesMu.Unlock()
+	if retries > maxRetries {
+		reportError(eb.errors, request, fmt.Errorf("failed %d times, last error: %w", retries, err))
+		return false
 	}
+	return true
+}
 
+// sendHistory caches the heights of the address' transactions and sends the history to the
+// Accounter.
+func (eb *ElectrumBackend) sendHistory(addr *deriver.Address, txs []*electrum.Transaction) {
 	txHashes := make([]string, 0, len(txs))
+	txHeights := make(map[string]int64, len(txs))
 	for _, tx := range txs {
 		txHashes = append(txHashes, tx.Hash)
+		txHeights[tx.Hash] = int64(tx.Height)
 		// fetch additional data if needed
 	}
-	eb.cacheTxs(txs)
+	if err := eb.cacheTxs(txs); err != nil {
+		// Nodes disagree on the height of a transaction. Retrying won't help.
+		reportError(eb.errors, addr.String(), err)
+		return
+	}
 
-	// TODO: we assume there are no more transactions. We should check what the API returns for
-	// addresses with very large number of transactions.
-	eb.addrResponses <- &AddrResponse{
-		Address:  addr,
-		TxHashes: txHashes,
+	select {
+	case eb.addrResponses <- &AddrResponse{Address: addr, TxHashes: txHashes, TxHeights: txHeights}:
+	case <-eb.doneCh:
 	}
-	return nil
 }
 
-func (eb *ElectrumBackend) cacheTxs(txs []*electrum.Transaction) {
+// The requeue* methods put a request back in the queue so another node can process it. The
+// request is dropped if the backend is shutting down.
+
+func (eb *ElectrumBackend) requeueAddr(addr *deriver.Address) {
+	select {
+	case eb.addrRequests <- addr:
+	case <-eb.doneCh:
+	}
+}
+
+func (eb *ElectrumBackend) requeueTx(txHash string) {
+	if shard, exists := eb.txShard(txHash); exists {
+		go eb.processPrivateTx(txHash, shard)
+		return
+	}
+	select {
+	case eb.txRequests <- txHash:
+	case <-eb.doneCh:
+	}
+}
+
+func (eb *ElectrumBackend) requeueBlock(height uint32) {
+	select {
+	case eb.blockRequests <- height:
+	case <-eb.doneCh:
+	}
+}
+
+func (eb *ElectrumBackend) cacheTxs(txs []*electrum.Transaction) error {
 	eb.transactionsMu.Lock()
 	defer eb.transactionsMu.Unlock()
 
 	for _, tx := range txs {
 		height, exists := eb.transactions[tx.Hash]
 		if exists && (height != int64(tx.Height)) {
-			log.Panicf("inconsistent cache: %s %d != %d", tx.Hash, height, tx.Height)
+			return fmt.Errorf("inconsistent cache: %s %d != %d", tx.Hash, height, tx.Height)
 		}
 		eb.transactions[tx.Hash] = int64(tx.Height)
 	}
+	return nil
 }
 
-// Checks that Electrum server's version is 1.2 or higher
+// Checks that Electrum server's max version is 1.2 or higher. Newer servers are fine: they
+// negotiate down to maxProtocol.
 func checkVersion(ver string) error {
+	return checkVersionConstraint(ver, ">= "+minProtocol)
+}
+
+// Checks that the negotiated version is between minProtocol and maxProtocol.
+func checkNegotiatedVersion(ver string) error {
+	return checkVersionConstraint(ver, fmt.Sprintf(">= %s, <= %s", minProtocol, maxProtocol))
+}
+
+func checkVersionConstraint(ver, constraint string) error {
+	if ver == "" {
+		return ErrIncompatibleVersion
+	}
 	if ver[0] == 'v' {
 		ver = ver[1:]
 	}
@@ -460,7 +1097,7 @@ func checkVersion(ver string) error {
 		return err
 	}
 
-	c, err := semver.NewConstraint(">= 1.2")
+	c, err := semver.NewConstraint(constraint)
 	if err != nil {
 		return err
 	}
@@ -471,6 +1108,13 @@ func checkVersion(ver string) error {
 	return nil
 }
 
+// blacklistNode prevents the backend from connecting to a node again.
+func (eb *ElectrumBackend) blacklistNode(ident string) {
+	eb.nodeMu.Lock()
+	defer eb.nodeMu.Unlock()
+	eb.blacklistedNodes[ident] = struct{}{}
+}
+
 // remove a node from the map of nodes.
 func (eb *ElectrumBackend) removeNode(ident string) {
 	eb.nodeMu.Lock()
@@ -480,6 +1124,10 @@ func (eb *ElectrumBackend) removeNode(ident string) {
 		node.Disconnect()
 		delete(eb.nodes, ident)
 	}
+	if queue, exists := eb.nodeQueues[ident]; exists {
+		close(queue.gone)
+		delete(eb.nodeQueues, ident)
+	}
 }
 
 func (eb *ElectrumBackend) removeAllNodes() {
@@ -489,44 +1137,59 @@ func (eb *ElectrumBackend) removeAllNodes() {
 	for _, node := range eb.nodes {
 		node.Disconnect()
 	}
+	for _, queue := range eb.nodeQueues {
+		close(queue.gone)
+	}
 
 	eb.nodes = map[string]*electrum.Node{}
+	eb.nodeQueues = map[string]*nodeQueue{}
 }
 
 func (eb *ElectrumBackend) findPeers() {
-	eb.peersRequests <- struct{}{}
+	select {
+	case eb.peersRequests <- struct{}{}:
+	case <-eb.doneCh:
+		return
+	}
 	eb.nodeMu.Lock()
 	reporter.GetInstance().SetPeers(int32(len(eb.nodes)))
 	eb.nodeMu.Unlock()
 }
 
 func (eb *ElectrumBackend) addPeer(peer electrum.Peer) {
+	// Onion servers can only be reached through a proxy (e.g. Tor). The IP of an onion peer is
+	// its host.
+	addr := peer.IP
 	if strings.HasSuffix(peer.Host, ".onion") {
-		log.Printf("skipping %s because of .onion\n", peer.Host)
-		return
+		if eb.connConfig.Proxy == nil {
+			log.Printf("skipping %s because of .onion\n", peer.Host)
+			return
+		}
+		addr = peer.Host
 	}
 	err := checkVersion(peer.Version)
 	if err != nil {
 		log.Printf("skipping %s because of protocol version %s\n", peer.Host, peer.Version)
 		return
 	}
+	// Prefer TLS, so that the connection can't be tampered with.
 	for _, feature := range peer.Features {
-		if strings.HasPrefix(feature, "t") {
+		if strings.HasPrefix(feature, "s") {
 			go func(addr, feature string, network Network) {
 				if err := eb.addNode(addr, feature, network); err != nil {
 					log.Printf("error on addNode: %+v\n", err)
 				}
-			}(peer.IP, feature, eb.network)
+			}(addr, feature, eb.network)
 			return
 		}
 	}
 	for _, feature := range peer.Features {
-		if strings.HasPrefix(feature, "s") {
+		if strings.HasPrefix(feature, "t") && eb.connConfig.Plaintext {
 			go func(addr, feature string, network Network) {
 				if err := eb.addNode(addr, feature, network); err != nil {
 					log.Printf("error on addNode: %+v\n", err)
 				}
-			}(peer.IP, feature, eb.network)
+			}(addr, feature, eb.network)
 			return
 		}
 	}
@@ -1,11 +1,25 @@
 package backend
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/square/beancounter/backend/electrum"
 	"github.com/square/beancounter/deriver"
 	. "github.com/square/beancounter/utils"
 	"github.com/stretchr/testify/assert"
-	"testing"
 )
 
 func TestTransactionCache(t *testing.T) {
@@ -30,17 +44,434 @@ func TestTransactionCache(t *testing.T) {
 	tx3 := electrum.Transaction{Hash: "cccccc", Height: 101}
 	badTx := electrum.Transaction{Hash: "aaaaaa", Height: 102}
 
-	eb.cacheTxs([]*electrum.Transaction{&tx1, &tx2})
+	assert.NoError(t, eb.cacheTxs([]*electrum.Transaction{&tx1, &tx2}))
+
+	assertTxHeight(t, eb, tx1)
+	assertTxHeight(t, eb, tx2)
+	_, err := eb.getTxHeight(tx3.Hash)
+	assert.Error(t, err)
+
+	assert.NoError(t, eb.cacheTxs([]*electrum.Transaction{&tx2, &tx3}))
+
+	assertTxHeight(t, eb, tx1)
+	assertTxHeight(t, eb, tx2)
+	assertTxHeight(t, eb, tx3)
+
+	assert.Error(t, eb.cacheTxs([]*electrum.Transaction{&badTx}))
+}
+
+func assertTxHeight(t *testing.T, eb *ElectrumBackend, tx electrum.Transaction) {
+	height, err := eb.getTxHeight(tx.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(tx.Height), height)
+}
+
+func TestScriptHash(t *testing.T) {
+	// genesis block's address, from the Electrum protocol docs
+	script, err := hex.DecodeString("76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac")
+	assert.NoError(t, err)
+	assert.Equal(t, "8b01df4e368ea28f8dc0423bcf7a4923e3a12d307c875e47a0cfbf90b5c39161", electrum.ScriptHash(script))
+}
+
+func TestCheckVersion(t *testing.T) {
+	assert.NoError(t, checkVersion("v1.2"))
+	assert.NoError(t, checkVersion("1.4.2"))
+	assert.NoError(t, checkVersion("1.5"))
+	assert.Equal(t, ErrIncompatibleVersion, checkVersion("1.1"))
+
+	assert.NoError(t, checkNegotiatedVersion("1.2"))
+	assert.NoError(t, checkNegotiatedVersion("1.4"))
+	assert.Equal(t, ErrIncompatibleVersion, checkNegotiatedVersion("1.5"))
+	assert.Equal(t, ErrIncompatibleVersion, checkNegotiatedVersion(""))
+}
+
+// fakeElectrumServer answers the handshake with the given protocol version, and address histories.
+// Servers which don't support scripthashes return an error for blockchain.scripthash.* methods.
+// The methods called are recorded. Batches are supported.
+type fakeElectrumServer struct {
+	listener   net.Listener
+	protocol   string
+	scripthash bool
+
+	mu      sync.Mutex
+	methods []string
+	failing map[string]bool    // script hashes the server fails to return
+	headers []wire.BlockHeader // the server's chain, from genesis
+}
+
+func newFakeElectrumServer(t *testing.T, protocol string, scripthash bool) *fakeElectrumServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeElectrumServer{listener: l, protocol: protocol, scripthash: scripthash, failing: map[string]bool{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeElectrumServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var b []byte
+		if line[0] == '[' {
+			var reqs []electrum.RequestMessage
+			if err := json.Unmarshal(line, &reqs); err != nil {
+				return
+			}
+			resps := []electrum.ResponseMessage{}
+			for _, req := range reqs {
+				resps = append(resps, s.respond(req))
+			}
+			b, _ = json.Marshal(resps)
+		} else {
+			var req electrum.RequestMessage
+			if err := json.Unmarshal(line, &req); err != nil {
+				return
+			}
+			b, _ = json.Marshal(s.respond(req))
+		}
+		conn.Write(append(b, '\n'))
+	}
+}
+
+func (s *fakeElectrumServer) respond(req electrum.RequestMessage) electrum.ResponseMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods = append(s.methods, req.Method)
+
+	resp := electrum.ResponseMessage{Id: req.Id}
+	switch {
+	case req.Method == "server.version":
+		resp.Result = []string{"fake", s.protocol}
+	case req.Method == "server.features":
+		resp.Result = map[string]string{"genesis_hash": GenesisBlock(Testnet), "protocol_max": s.protocol}
+	case req.Method == "blockchain.scripthash.get_history" && s.scripthash && s.failing[req.Params[0].(string)]:
+		resp.Error = &electrum.ErrorResponse{Code: 1, Message: "history too large"}
+	case req.Method == "blockchain.scripthash.get_history" && s.scripthash,
+		req.Method == "blockchain.address.get_history":
+		resp.Result = []map[string]interface{}{{"tx_hash": "aaaaaa", "height": 100}}
+	case req.Method == "blockchain.block.headers":
+		start, count := int(req.Params[0].(float64)), int(req.Params[1].(float64))
+		var buf bytes.Buffer
+		for i := start; i < start+count && i < len(s.headers); i++ {
+			s.headers[i].Serialize(&buf)
+		}
+		resp.Result = electrum.Block{Count: uint(buf.Len() / 80), Hex: hex.EncodeToString(buf.Bytes()), Max: 2016}
+	case req.Method == "blockchain.transaction.get_merkle":
+		// the proof is always for the wrong block
+		resp.Result = map[string]interface{}{"block_height": 99, "merkle": []string{}, "pos": 0}
+	default:
+		resp.Error = &electrum.ErrorResponse{Code: -32601, Message: "unknown method"}
+	}
+	return resp
+}
+
+func (s *fakeElectrumServer) connect(t *testing.T) *electrum.Node {
+	host, port, err := net.SplitHostPort(s.listener.Addr().String())
+	assert.NoError(t, err)
+	node, err := electrum.NewNode(host, "t"+port, Testnet, &electrum.ConnectionConfig{Plaintext: true})
+	assert.NoError(t, err)
+	return node
+}
+
+func (s *fakeElectrumServer) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.methods...)
+}
+
+func TestElectrumProtocolNegotiation(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	addr, err := d.Derive(0, 0)
+	assert.NoError(t, err)
 
-	assert.Equal(t, int64(tx1.Height), eb.getTxHeight(tx1.Hash))
-	assert.Equal(t, int64(tx2.Height), eb.getTxHeight(tx2.Hash))
-	assert.Panics(t, func() { eb.getTxHeight(tx3.Hash) })
+	// a modern server only speaks scripthash
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+	node := server.connect(t)
+	defer node.Disconnect()
+	assert.NoError(t, handshake(node, Testnet))
+	assert.Equal(t, "1.4", node.Protocol)
+	txs, err := getHistory(node, addr)
+	assert.NoError(t, err)
+	assert.Len(t, txs, 1)
+	assert.Equal(t, []string{"server.version", "server.features", "blockchain.scripthash.get_history"}, server.calls())
+
+	// an older server falls back to the address
+	server = newFakeElectrumServer(t, "1.2", false)
+	defer server.listener.Close()
+	node = server.connect(t)
+	defer node.Disconnect()
+	assert.NoError(t, handshake(node, Testnet))
+	txs, err = getHistory(node, addr)
+	assert.NoError(t, err)
+	assert.Len(t, txs, 1)
+	assert.True(t, strings.HasSuffix(strings.Join(server.calls(), ","), "blockchain.scripthash.get_history,blockchain.address.get_history"))
+
+	// a server which doesn't respect the range is rejected
+	server = newFakeElectrumServer(t, "1.5", true)
+	defer server.listener.Close()
+	node = server.connect(t)
+	defer node.Disconnect()
+	assert.Equal(t, ErrIncompatibleVersion, handshake(node, Testnet))
+}
 
-	eb.cacheTxs([]*electrum.Transaction{&tx2, &tx3})
+func TestBatchedAddrRequests(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	addrs := []*deriver.Address{}
+	for i := uint32(0); i < 3; i++ {
+		addr, err := d.Derive(0, i)
+		assert.NoError(t, err)
+		addrs = append(addrs, addr)
+	}
+
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+	failing, err := addrScriptHash(addrs[1])
+	assert.NoError(t, err)
+	server.failing[failing] = true
+	node := server.connect(t)
+	defer node.Disconnect()
+	assert.NoError(t, handshake(node, Testnet))
+
+	eb := &ElectrumBackend{
+		nodes:         map[string]*electrum.Node{node.Ident: node},
+		nodeQueues:    make(map[string]*nodeQueue),
+		addrRequests:  make(chan *deriver.Address, 2*maxPeers),
+		addrResponses: make(chan *AddrResponse, 2*maxPeers),
+		errors:        make(chan error, maxPeers),
+		transactions:  make(map[string]int64),
+		retries:       make(map[string]int),
+		doneCh:        make(chan bool),
+	}
+
+	// a single batch, the failed address is requeued without dropping the node
+	assert.NoError(t, eb.processAddrRequests(node, addrs))
+	assert.Equal(t, []string{"server.version", "server.features", "blockchain.scripthash.get_history",
+		"blockchain.scripthash.get_history", "blockchain.scripthash.get_history"}, server.calls())
+	assert.Len(t, eb.addrResponses, 2)
+	assert.Equal(t, addrs[1], <-eb.addrRequests)
+	assert.Contains(t, eb.nodes, node.Ident)
+
+	// the address is given up on after maxRetries failures: the first retries are requeued, the
+	// last one is reported
+	for i := 0; i < maxRetries; i++ {
+		assert.NoError(t, eb.processAddrRequests(node, addrs[1:2]))
+	}
+	assert.Len(t, eb.addrRequests, maxRetries-1)
+	assert.Error(t, <-eb.errors)
+}
 
-	assert.Equal(t, int64(tx1.Height), eb.getTxHeight(tx1.Hash))
-	assert.Equal(t, int64(tx2.Height), eb.getTxHeight(tx2.Hash))
-	assert.Equal(t, int64(tx3.Height), eb.getTxHeight(tx3.Hash))
+func TestBadProofBlacklistsNode(t *testing.T) {
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+	node := server.connect(t)
+	defer node.Disconnect()
+	assert.NoError(t, handshake(node, Testnet))
 
-	assert.Panics(t, func() { eb.cacheTxs([]*electrum.Transaction{&badTx}) })
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	var buf bytes.Buffer
+	assert.NoError(t, tx.Serialize(&buf))
+	txHash := tx.TxHash().String()
+
+	eb := &ElectrumBackend{
+		nodes:            map[string]*electrum.Node{node.Ident: node},
+		blacklistedNodes: make(map[string]struct{}),
+		nodeQueues:       map[string]*nodeQueue{node.Ident: {gone: make(chan struct{})}},
+		txRequests:       make(chan string, 2*maxPeers),
+		errors:           make(chan error, maxPeers),
+		transactions:     map[string]int64{txHash: 100},
+		retries:          make(map[string]int),
+		doneCh:           make(chan bool),
+	}
+
+	// the node is dropped, and another node gets to prove the transaction
+	err := eb.processTx(node, txHash, hex.EncodeToString(buf.Bytes()))
+	assert.IsType(t, &ProofError{}, err)
+	assert.Contains(t, eb.blacklistedNodes, node.Ident)
+	assert.NotContains(t, eb.nodes, node.Ident)
+	assert.Equal(t, txHash, <-eb.txRequests)
+
+	// once the retries are exhausted, the ProofError is reported
+	node = server.connect(t)
+	defer node.Disconnect()
+	assert.NoError(t, handshake(node, Testnet))
+	eb.retries[txHash] = maxRetries
+	assert.IsType(t, &ProofError{}, eb.processTx(node, txHash, hex.EncodeToString(buf.Bytes())))
+	var proof *ProofError
+	assert.True(t, errors.As(<-eb.errors, &proof))
+	assert.Len(t, eb.txRequests, 0)
+}
+
+func TestBadTxBlacklistsNode(t *testing.T) {
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1}, nil, nil))
+	var buf bytes.Buffer
+	assert.NoError(t, tx.Serialize(&buf))
+	txHex := hex.EncodeToString(buf.Bytes())
+	// the node answers with another transaction's bytes
+	txHash := strings.Repeat("00", 32)
+
+	eb := &ElectrumBackend{
+		nodes:            make(map[string]*electrum.Node),
+		blacklistedNodes: make(map[string]struct{}),
+		nodeQueues:       make(map[string]*nodeQueue),
+		txRequests:       make(chan string, 2*maxPeers),
+		errors:           make(chan error, maxPeers),
+		transactions:     map[string]int64{txHash: 100},
+		retries:          make(map[string]int),
+		doneCh:           make(chan bool),
+	}
+
+	// each node is dropped and the transaction is requeued, until the retries are exhausted
+	for i := 0; i <= maxRetries; i++ {
+		node := server.connect(t)
+		eb.nodes[node.Ident] = node
+		eb.nodeQueues[node.Ident] = &nodeQueue{gone: make(chan struct{})}
+		assert.IsType(t, &TxHashError{}, eb.processTx(node, txHash, txHex))
+		assert.Contains(t, eb.blacklistedNodes, node.Ident)
+		assert.NotContains(t, eb.nodes, node.Ident)
+		node.Disconnect()
+	}
+	assert.Len(t, eb.txRequests, maxRetries)
+	var hashErr *TxHashError
+	assert.True(t, errors.As(<-eb.errors, &hashErr))
+}
+
+func TestValidateTip(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 10)...)
+	eb := &ElectrumBackend{
+		nodes: map[string]*electrum.Node{"fake": {Ident: "fake"}},
+		chain: newHeaderChain(&params),
+	}
+	assert.NoError(t, eb.chain.Extend(0, headers))
+
+	eb.chainHeight, eb.tipHash = 10, headers[10].BlockHash()
+	assert.NoError(t, eb.ValidateTip())
+
+	// the claimed tip isn't in the chain
+	eb.chainHeight = 9
+	assert.Error(t, eb.ValidateTip())
+
+	// no node to extend the chain with
+	eb.nodes = map[string]*electrum.Node{}
+	eb.chainHeight = 20
+	assert.Error(t, eb.ValidateTip())
+}
+
+func TestBlockRequestDetectsReorg(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 10)...)
+	// a fork at height 6, with a different timestamp
+	forked := mineHeaders(headers[5], 5, 1)[0]
+	forked.Timestamp = forked.Timestamp.Add(time.Second)
+	for checkProofOfWork(&forked) != nil {
+		forked.Nonce++
+	}
+	fork := append(append([]wire.BlockHeader{}, headers[:6]...), forked)
+	fork = append(fork, mineHeaders(forked, 6, 4)...)
+
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+	server.headers = headers
+	node := server.connect(t)
+	defer node.Disconnect()
+
+	eb := &ElectrumBackend{
+		nodes:          map[string]*electrum.Node{node.Ident: node},
+		chain:          newHeaderChain(&params),
+		blockRequests:  make(chan uint32, 1),
+		blockResponses: make(chan *BlockResponse, 1),
+		errors:         make(chan error, 1),
+		doneCh:         make(chan bool),
+	}
+	assert.NoError(t, eb.chain.Extend(0, headers))
+
+	// the node agrees with the validated chain
+	assert.NoError(t, eb.processBlockRequest(node, 8))
+	resp := <-eb.blockResponses
+	assert.Equal(t, headers[8].BlockHash().String(), resp.Hash)
+
+	// the chain was reorganized since the headers were validated
+	server.mu.Lock()
+	server.headers = fork
+	server.mu.Unlock()
+	err := eb.processBlockRequest(node, 8)
+	assert.Equal(t, &HeaderMismatchError{Height: 8, Expected: headers[8].BlockHash().String(), Actual: fork[8].BlockHash().String()}, err)
+	assert.Equal(t, &Error{Request: "block 8", Err: err}, <-eb.errors)
+}
+
+func TestBlockHeight(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 10)...)
+
+	server := newFakeElectrumServer(t, "1.4", true)
+	defer server.listener.Close()
+	server.headers = headers
+
+	eb := &ElectrumBackend{
+		nodes:          make(map[string]*electrum.Node),
+		nodeQueues:     make(map[string]*nodeQueue),
+		chain:          newHeaderChain(&params),
+		chainHeight:    10,
+		blockResponses: make(chan *BlockResponse, 1),
+		syncRequests:   make(chan *syncRequest),
+		doneCh:         make(chan bool),
+	}
+	defer close(eb.doneCh)
+	connect := func(server *fakeElectrumServer) {
+		node := server.connect(t)
+		queue := &nodeQueue{gone: make(chan struct{})}
+		eb.nodeMu.Lock()
+		eb.nodes[node.Ident] = node
+		eb.nodeQueues[node.Ident] = queue
+		eb.nodeMu.Unlock()
+		go eb.processRequests(node, queue)
+	}
+	connect(server)
+
+	// a response meant for the Blockfinder is left alone
+	eb.blockResponses <- &BlockResponse{Height: 3}
+	height, err := eb.BlockHeight(context.Background(), headers[7].BlockHash().String())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), height)
+	assert.Equal(t, uint32(3), (<-eb.blockResponses).Height)
+
+	_, err = eb.BlockHeight(context.Background(), chainhash.Hash{}.String())
+	assert.Error(t, err)
+
+	// the servers don't have the tip: each node is dropped, then the error is returned instead of
+	// waiting forever
+	for i := 0; i < maxRetries; i++ {
+		other := newFakeElectrumServer(t, "1.4", true)
+		defer other.listener.Close()
+		other.headers = headers
+		connect(other)
+	}
+	eb.chainHeight = 20
+	_, err = eb.BlockHeight(context.Background(), headers[7].BlockHash().String())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "syncing the headers up to 20 failed")
+	assert.Empty(t, eb.nodes)
 }
@@ -0,0 +1,390 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/square/beancounter/deriver"
+	"github.com/square/beancounter/reporter"
+	. "github.com/square/beancounter/utils"
+)
+
+// EsploraBackend fetches transactions from a server implementing the Esplora HTTP API
+// (https://github.com/Blockstream/esplora/blob/master/API.md), e.g. a self-hosted Esplora or
+// mempool.space instance.
+//
+// An address' history is paginated: the first page has the mempool transactions and the first
+// esploraPageSize confirmed transactions, the next pages are fetched from
+// /address/:addr/txs/chain/:last_seen_txid. The heights come along with the history, the
+// transactions' bytes are then fetched from /tx/:txid/hex and checked with the merkle proof
+// returned by /tx/:txid/merkleblock-proof.
+type EsploraBackend struct {
+	chainHeight uint32
+
+	baseURL string
+	client  *http.Client
+	network Network
+
+	transactionsMu sync.Mutex       // mutex to guard read/writes to txHeights map
+	txHeights      map[string]int64 // heights of the transactions seen in the histories
+
+	// channels used to communicate with the Accounter
+	addrRequests  chan *deriver.Address
+	addrResponses chan *AddrResponse
+	txRequests    chan string
+	txResponses   chan *TxResponse
+
+	// channels used to communicate with the Blockfinder
+	blockRequests  chan uint32
+	blockResponses chan *BlockResponse
+
+	errors chan error
+	doneCh chan bool
+}
+
+const (
+	// number of confirmed transactions per page of an address' history.
+	esploraPageSize = 25
+
+	esploraTimeout = 30 * time.Second
+)
+
+// esploraTx is a transaction, as returned in an address' history.
+type esploraTx struct {
+	TxID   string        `json:"txid"`
+	Status esploraStatus `json:"status"`
+}
+
+type esploraStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight int64  `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+}
+
+// NewEsploraBackend returns a new EsploraBackend. baseURL is the API's root, e.g.
+// https://blockstream.info/testnet/api. concurrency is the number of requests sent in parallel.
+func NewEsploraBackend(baseURL string, network Network, concurrency int) (*EsploraBackend, error) {
+	if concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	b := &EsploraBackend{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		client:         &http.Client{Timeout: esploraTimeout},
+		network:        network,
+		txHeights:      make(map[string]int64),
+		addrRequests:   make(chan *deriver.Address, addrRequestsChanSize),
+		addrResponses:  make(chan *AddrResponse, addrRequestsChanSize),
+		txRequests:     make(chan string, 2*maxTxsPerAddr),
+		txResponses:    make(chan *TxResponse, 2*maxTxsPerAddr),
+		blockRequests:  make(chan uint32, 2*blockRequestChanSize),
+		blockResponses: make(chan *BlockResponse, 2*blockRequestChanSize),
+		errors:         make(chan error, concurrency),
+		doneCh:         make(chan bool),
+	}
+
+	// Check that we are talking to the right chain
+	genesis, err := b.getText("/block-height/0")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch the genesis block")
+	}
+	if genesis != GenesisBlock(network) {
+		return nil, errors.Errorf("Unexpected genesis block %s != %s", genesis, GenesisBlock(network))
+	}
+
+	tip, err := b.getText("/blocks/tip/height")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch the chain height")
+	}
+	height, err := strconv.ParseUint(tip, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid chain height %q", tip)
+	}
+	b.chainHeight = uint32(height)
+
+	// launch
+	for i := 0; i < concurrency; i++ {
+		go b.processRequests()
+	}
+	return b, nil
+}
+
+// AddrRequest schedules a request to the backend to lookup information related
+// to the given address.
+func (b *EsploraBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	select {
+	case b.addrRequests <- addr:
+		reporter.GetInstance().IncAddressesScheduled()
+		reporter.GetInstance().Logf("scheduling address: %s", addr)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AddrResponses exposes a channel that allows to consume backend's responses to
+// address requests created with AddrRequest()
+func (b *EsploraBackend) AddrResponses() <-chan *AddrResponse {
+	return b.addrResponses
+}
+
+// TxRequest schedules a request to the backend to lookup information related
+// to the given transaction hash.
+func (b *EsploraBackend) TxRequest(ctx context.Context, txHash string) error {
+	select {
+	case b.txRequests <- txHash:
+		reporter.GetInstance().IncTxScheduled()
+		reporter.GetInstance().Logf("scheduling tx: %s", txHash)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TxResponses exposes a channel that allows to consume backend's responses to
+// transaction requests created with TxRequest().
+func (b *EsploraBackend) TxResponses() <-chan *TxResponse {
+	return b.txResponses
+}
+
+func (b *EsploraBackend) BlockRequest(ctx context.Context, height uint32) error {
+	select {
+	case b.blockRequests <- height:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *EsploraBackend) BlockResponses() <-chan *BlockResponse {
+	return b.blockResponses
+}
+
+// BlockHeight returns the height of a block in the main chain.
+func (b *EsploraBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	var status struct {
+		InBestChain bool   `json:"in_best_chain"`
+		Height      uint32 `json:"height"`
+	}
+	if err := b.getJSON("/block/"+hash+"/status", &status); err != nil {
+		return 0, err
+	}
+	if !status.InBestChain {
+		return 0, errors.Errorf("block %s isn't in the main chain", hash)
+	}
+	return status.Height, nil
+}
+
+// Errors exposes a channel on which the backend reports requests it failed to process.
+func (b *EsploraBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Finish informs the backend to stop doing its work.
+func (b *EsploraBackend) Finish() {
+	close(b.doneCh)
+}
+
+func (b *EsploraBackend) ChainHeight() uint32 {
+	return b.chainHeight
+}
+
+func (b *EsploraBackend) processRequests() {
+	for {
+		select {
+		case addr := <-b.addrRequests:
+			err := b.processAddrRequest(addr)
+			if err != nil {
+				log.Printf("processAddrRequest failed: %+v", err)
+				reportError(b.errors, addr.String(), err)
+			}
+		case tx := <-b.txRequests:
+			err := b.processTxRequest(tx)
+			if err != nil {
+				log.Printf("processTxRequest failed: %+v", err)
+				reportError(b.errors, tx, err)
+			}
+		case block := <-b.blockRequests:
+			err := b.processBlockRequest(block)
+			if err != nil {
+				log.Printf("processBlockRequest failed: %+v", err)
+				reportError(b.errors, fmt.Sprintf("block %d", block), err)
+			}
+		case <-b.doneCh:
+			return
+		}
+	}
+}
+
+func (b *EsploraBackend) processAddrRequest(addr *deriver.Address) error {
+	txs := []esploraTx{}
+	if err := b.getJSON("/address/"+addr.String()+"/txs", &txs); err != nil {
+		return err
+	}
+	// the first page also has the mempool transactions
+	confirmed := 0
+	for _, tx := range txs {
+		if tx.Status.Confirmed {
+			confirmed++
+		}
+	}
+	for confirmed == esploraPageSize {
+		if len(txs) > maxTxsPerAddr {
+			return fmt.Errorf("address %s has more than max allowed transactions of %d", addr, maxTxsPerAddr)
+		}
+		page := []esploraTx{}
+		if err := b.getJSON("/address/"+addr.String()+"/txs/chain/"+txs[len(txs)-1].TxID, &page); err != nil {
+			return err
+		}
+		txs = append(txs, page...)
+		confirmed = len(page)
+	}
+
+	txHashes := make([]string, 0, len(txs))
+	txHeights := make(map[string]int64, len(txs))
+	b.transactionsMu.Lock()
+	for _, tx := range txs {
+		var height int64
+		if tx.Status.Confirmed {
+			height = tx.Status.BlockHeight
+		}
+		txHashes = append(txHashes, tx.TxID)
+		txHeights[tx.TxID] = height
+		b.txHeights[tx.TxID] = height
+	}
+	b.transactionsMu.Unlock()
+
+	select {
+	case b.addrResponses <- &AddrResponse{Address: addr, TxHashes: txHashes, TxHeights: txHeights}:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+func (b *EsploraBackend) processTxRequest(txHash string) error {
+	b.transactionsMu.Lock()
+	height, exists := b.txHeights[txHash]
+	b.transactionsMu.Unlock()
+	if !exists {
+		var status esploraStatus
+		if err := b.getJSON("/tx/"+txHash+"/status", &status); err != nil {
+			return err
+		}
+		if status.Confirmed {
+			height = status.BlockHeight
+		}
+	}
+
+	hex, err := b.getText("/tx/" + txHash + "/hex")
+	if err != nil {
+		return err
+	}
+	if err := checkTxHash(txHash, hex); err != nil {
+		return err
+	}
+	resp := &TxResponse{Hash: txHash, Height: height, Hex: hex}
+	if height > 0 {
+		if err := b.verifyTx(resp); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case b.txResponses <- resp:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+// verifyTx checks a mined transaction's merkle proof (in gettxoutproof's format) against the block
+// at the transaction's height.
+func (b *EsploraBackend) verifyTx(resp *TxResponse) error {
+	proof, err := b.getText("/tx/" + resp.Hash + "/merkleblock-proof")
+	if err != nil {
+		return err
+	}
+	result, err := json.Marshal(proof)
+	if err != nil {
+		return err
+	}
+	mb, err := decodeTxOutProof(result, resp.Hash, resp.Height)
+	if err != nil {
+		return err
+	}
+	blockHash, err := b.getText(fmt.Sprintf("/block-height/%d", resp.Height))
+	if err != nil {
+		return err
+	}
+	if err := verifyMerkleBlock(resp.Hash, resp.Height, mb, blockHash); err != nil {
+		return err
+	}
+	resp.Verified = true
+	return nil
+}
+
+func (b *EsploraBackend) processBlockRequest(height uint32) error {
+	hash, err := b.getText(fmt.Sprintf("/block-height/%d", height))
+	if err != nil {
+		return err
+	}
+	var block struct {
+		Height    uint32 `json:"height"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if err := b.getJSON("/block/"+hash, &block); err != nil {
+		return err
+	}
+	if block.Height != height {
+		return errors.Errorf("block %s is at height %d, expecting %d", hash, block.Height, height)
+	}
+
+	select {
+	case b.blockResponses <- &BlockResponse{Height: height, Hash: hash, Timestamp: time.Unix(block.Timestamp, 0)}:
+	case <-b.doneCh:
+	}
+	return nil
+}
+
+// get fetches a path relative to the base URL.
+func (b *EsploraBackend) get(path string) ([]byte, error) {
+	resp, err := b.client.Get(b.baseURL + path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s failed", path)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s failed", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("GET %s failed: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (b *EsploraBackend) getText(path string) (string, error) {
+	body, err := b.get(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (b *EsploraBackend) getJSON(path string, v interface{}) error {
+	body, err := b.get(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errors.Wrapf(err, "GET %s returned invalid JSON", path)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// esploraServer serves an address whose history has 30 transactions mined in a block at height
+// 100, and one transaction in the mempool.
+func esploraServer(t *testing.T, addr string) (*httptest.Server, *btcutil.Block, *btcutil.Tx) {
+	block := testBlock(30)
+	blockHash := block.Hash().String()
+	mempool := btcutil.NewTx(wire.NewMsgTx(2))
+	mempool.MsgTx().AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 1000}, nil, nil))
+	mempool.MsgTx().AddTxOut(wire.NewTxOut(1, nil))
+
+	txs := map[string]*btcutil.Tx{mempool.Hash().String(): mempool}
+	history := []map[string]interface{}{}
+	for _, tx := range block.Transactions() {
+		txs[tx.Hash().String()] = tx
+		history = append(history, map[string]interface{}{
+			"txid":   tx.Hash().String(),
+			"status": map[string]interface{}{"confirmed": true, "block_height": 100, "block_hash": blockHash},
+		})
+	}
+	serialize := func(tx *btcutil.Tx) string {
+		var buf bytes.Buffer
+		assert.NoError(t, tx.MsgTx().Serialize(&buf))
+		return hex.EncodeToString(buf.Bytes())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/block-height/0", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, GenesisBlock(Testnet))
+	})
+	mux.HandleFunc("/api/block-height/100", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, blockHash)
+	})
+	mux.HandleFunc("/api/blocks/tip/height", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "110")
+	})
+	mux.HandleFunc("/api/block/"+blockHash, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"height": 100, "timestamp": 1500000000})
+	})
+	mux.HandleFunc("/api/block/"+blockHash+"/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"in_best_chain": true, "height": 100})
+	})
+	mux.HandleFunc("/api/address/"+addr+"/txs", func(w http.ResponseWriter, r *http.Request) {
+		unconfirmed := map[string]interface{}{"txid": mempool.Hash().String(), "status": map[string]interface{}{"confirmed": false}}
+		page := append([]map[string]interface{}{unconfirmed}, history[:esploraPageSize]...)
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/api/address/"+addr+"/txs/chain/", func(w http.ResponseWriter, r *http.Request) {
+		lastSeen := strings.TrimPrefix(r.URL.Path, "/api/address/"+addr+"/txs/chain/")
+		for i, tx := range history {
+			if tx["txid"] == lastSeen {
+				end := i + 1 + esploraPageSize
+				if end > len(history) {
+					end = len(history)
+				}
+				json.NewEncoder(w).Encode(history[i+1 : end])
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/api/tx/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/tx/"), "/")
+		tx, exists := txs[parts[0]]
+		if parts[0] == "tampered" {
+			tx, exists = mempool, true
+		}
+		if !exists || len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[1] {
+		case "hex":
+			fmt.Fprint(w, serialize(tx))
+		case "status":
+			json.NewEncoder(w).Encode(map[string]interface{}{"confirmed": false})
+		case "merkleblock-proof":
+			filter := bloom.NewFilter(1, 0, 0.0001, wire.BloomUpdateNone)
+			filter.AddHash(tx.Hash())
+			mb, _ := bloom.NewMerkleBlock(block, filter)
+			var buf bytes.Buffer
+			assert.NoError(t, mb.BtcEncode(&buf, wire.ProtocolVersion, wire.BaseEncoding))
+			fmt.Fprint(w, hex.EncodeToString(buf.Bytes()))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return httptest.NewServer(mux), block, mempool
+}
+
+func TestEsploraBackend(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	addr, err := d.Derive(0, 0)
+	assert.NoError(t, err)
+	server, block, mempool := esploraServer(t, addr.String())
+	defer server.Close()
+
+	_, err = NewEsploraBackend(server.URL+"/api/", Mainnet, 4)
+	assert.Error(t, err)
+
+	b, err := NewEsploraBackend(server.URL+"/api/", Testnet, 4)
+	assert.NoError(t, err)
+	defer b.Finish()
+	assert.Equal(t, uint32(110), b.ChainHeight())
+	ctx := context.Background()
+
+	// the history spans two pages
+	assert.NoError(t, b.AddrRequest(ctx, addr))
+	resp := <-b.AddrResponses()
+	assert.Len(t, resp.TxHashes, 31)
+	assert.Equal(t, int64(0), resp.TxHeights[mempool.Hash().String()])
+	last := block.Transactions()[29].Hash().String()
+	assert.Equal(t, int64(100), resp.TxHeights[last])
+
+	assert.NoError(t, b.TxRequest(ctx, last))
+	tx := <-b.TxResponses()
+	assert.Equal(t, last, tx.Hash)
+	assert.Equal(t, int64(100), tx.Height)
+	assert.True(t, tx.Verified)
+
+	assert.NoError(t, b.TxRequest(ctx, mempool.Hash().String()))
+	tx = <-b.TxResponses()
+	assert.Equal(t, int64(0), tx.Height)
+	assert.False(t, tx.Verified)
+
+	// the server returns another transaction's bytes
+	assert.NoError(t, b.TxRequest(ctx, "tampered"))
+	var hashErr *TxHashError
+	assert.True(t, errors.As(<-b.Errors(), &hashErr))
+
+	assert.NoError(t, b.BlockRequest(ctx, 100))
+	blockResp := <-b.BlockResponses()
+	assert.Equal(t, block.Hash().String(), blockResp.Hash)
+	assert.Equal(t, time.Unix(1500000000, 0), blockResp.Timestamp)
+
+	height, err := b.BlockHeight(ctx, block.Hash().String())
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(100), height)
+
+	// unknown block
+	assert.NoError(t, b.BlockRequest(ctx, 101))
+	assert.Error(t, <-b.Errors())
+}
@@ -1,9 +1,10 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"sync"
 
@@ -32,6 +33,8 @@ type FixtureBackend struct {
 	blockRequests  chan uint32
 	blockResponses chan *BlockResponse
 
+	errors chan error
+
 	transactionsMu sync.Mutex // mutex to guard read/writes to transactions map
 	transactions   map[string]int64
 
@@ -52,6 +55,7 @@ func NewFixtureBackend(filepath string) (*FixtureBackend, error) {
 		txResponses:    make(chan *TxResponse, 1000),
 		blockRequests:  make(chan uint32, 10),
 		blockResponses: make(chan *BlockResponse, 10),
+		errors:         make(chan error, 10),
 		addrIndex:      make(map[string]AddrResponse),
 		txIndex:        make(map[string]TxResponse),
 		blockIndex:     make(map[uint32]BlockResponse),
@@ -75,22 +79,50 @@ func NewFixtureBackend(filepath string) (*FixtureBackend, error) {
 
 // AddrRequest schedules a request to the backend to lookup information related
 // to the given address.
-func (fb *FixtureBackend) AddrRequest(addr *deriver.Address) {
-	reporter.GetInstance().IncAddressesScheduled()
-	reporter.GetInstance().Logf("[fixture] scheduling address: %s", addr)
-	fb.addrRequests <- addr
+func (fb *FixtureBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	select {
+	case fb.addrRequests <- addr:
+		reporter.GetInstance().IncAddressesScheduled()
+		reporter.GetInstance().Logf("[fixture] scheduling address: %s", addr)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // TxRequest schedules a request to the backend to lookup information related
 // to the given transaction hash.
-func (fb *FixtureBackend) TxRequest(txHash string) {
-	reporter.GetInstance().IncTxScheduled()
-	reporter.GetInstance().Logf("[fixture] scheduling tx: %s", txHash)
-	fb.txRequests <- txHash
+func (fb *FixtureBackend) TxRequest(ctx context.Context, txHash string) error {
+	select {
+	case fb.txRequests <- txHash:
+		reporter.GetInstance().IncTxScheduled()
+		reporter.GetInstance().Logf("[fixture] scheduling tx: %s", txHash)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (fb *FixtureBackend) BlockRequest(height uint32) {
-	fb.blockRequests <- height
+func (fb *FixtureBackend) BlockRequest(ctx context.Context, height uint32) error {
+	select {
+	case fb.blockRequests <- height:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BlockHeight returns the height of a block in the fixture.
+func (fb *FixtureBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	fb.blockIndexMu.Lock()
+	defer fb.blockIndexMu.Unlock()
+
+	for height, b := range fb.blockIndex {
+		if b.Hash == hash {
+			return height, nil
+		}
+	}
+	return 0, fmt.Errorf("fixture doesn't contain block %s", hash)
 }
 
 // AddrResponses exposes a channel that allows to consume backend's responses to
@@ -111,6 +143,11 @@ func (fb *FixtureBackend) BlockResponses() <-chan *BlockResponse {
 	return fb.blockResponses
 }
 
+// Errors exposes a channel on which the backend reports requests it failed to process.
+func (fb *FixtureBackend) Errors() <-chan error {
+	return fb.errors
+}
+
 // Finish informs the backend to stop doing its work.
 func (fb *FixtureBackend) Finish() {
 	close(fb.doneCh)
@@ -152,14 +189,25 @@ func (fb *FixtureBackend) processAddrRequest(addr *deriver.Address) {
 	resp, exists := fb.addrIndex[addr.String()]
 	fb.addrIndexMu.Unlock()
 
-	if exists {
-		fb.addrResponses <- &resp
-		return
+	if !exists {
+		// assuming that address has not been used
+		resp = AddrResponse{
+			Address: addr,
+		}
 	}
 
-	// assuming that address has not been used
-	fb.addrResponses <- &AddrResponse{
-		Address: addr,
+	fb.transactionsMu.Lock()
+	resp.TxHeights = make(map[string]int64, len(resp.TxHashes))
+	for _, txHash := range resp.TxHashes {
+		if height, exists := fb.transactions[txHash]; exists {
+			resp.TxHeights[txHash] = height
+		}
+	}
+	fb.transactionsMu.Unlock()
+
+	select {
+	case fb.addrResponses <- &resp:
+	case <-fb.doneCh:
 	}
 }
 
@@ -169,11 +217,13 @@ func (fb *FixtureBackend) processTxRequest(txHash string) {
 	fb.txIndexMu.Unlock()
 
 	if exists {
-		fb.txResponses <- &resp
+		select {
+		case fb.txResponses <- &resp:
+		case <-fb.doneCh:
+		}
 		return
 	}
-
-	// assuming that transaction does not exist in the fixture file
+	reportError(fb.errors, txHash, fmt.Errorf("fixture doesn't contain transaction %s", txHash))
 }
 
 func (fb *FixtureBackend) processBlockRequest(height uint32) {
@@ -182,10 +232,13 @@ func (fb *FixtureBackend) processBlockRequest(height uint32) {
 	fb.blockIndexMu.Unlock()
 
 	if exists {
-		fb.blockResponses <- &resp
+		select {
+		case fb.blockResponses <- &resp:
+		case <-fb.doneCh:
+		}
 		return
 	}
-	log.Panicf("fixture doesn't contain block %d", height)
+	reportError(fb.errors, fmt.Sprintf("block %d", height), fmt.Errorf("fixture doesn't contain block %d", height))
 }
 
 func (fb *FixtureBackend) loadFromFile(f *os.File) error {
@@ -212,6 +265,10 @@ func (fb *FixtureBackend) loadFromFile(f *os.File) error {
 	}
 
 	for _, tx := range cachedData.Transactions {
+		// recorded data isn't any more trustworthy than data coming from a server.
+		if err := checkTxHash(tx.Hash, tx.Hex); err != nil {
+			return err
+		}
 		fb.txIndex[tx.Hash] = TxResponse{
 			Hash:   tx.Hash,
 			Height: tx.Height,
@@ -224,6 +281,7 @@ func (fb *FixtureBackend) loadFromFile(f *os.File) error {
 	for _, b := range cachedData.Blocks {
 		fb.blockIndex[b.Height] = BlockResponse{
 			Height:    b.Height,
+			Hash:      b.Hash,
 			Timestamp: b.Timestamp,
 		}
 	}
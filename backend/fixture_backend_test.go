@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -22,6 +24,14 @@ func TestBadFixtureFile(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestTamperedFixtureFile(t *testing.T) {
+	// the transaction's bytes belong to another transaction
+	b, err := NewFixtureBackend("testdata/tampered_fixture.json")
+	assert.Nil(t, b)
+	var hashErr *TxHashError
+	assert.True(t, errors.As(err, &hashErr))
+}
+
 func TestFinish(t *testing.T) {
 	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
 	assert.NoError(t, err)
@@ -47,7 +57,7 @@ func TestNoAddress(t *testing.T) {
 	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
 	assert.NoError(t, err)
 
-	b.AddrRequest(deriver.NewAddress("m/1'/1/0/1", "BAD_ADDRESS", Testnet, 0, 1))
+	b.AddrRequest(context.Background(), deriver.NewAddress("m/1'/1/0/1", "BAD_ADDRESS", Testnet, 0, 1))
 
 	var addrs []*AddrResponse
 	var txs []*TxResponse
@@ -66,7 +76,7 @@ func TestAddressNoTransactions(t *testing.T) {
 	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
 	assert.NoError(t, err)
 
-	b.AddrRequest(deriver.NewAddress("m/1'/1234/0/61", "mfsNoNz57ANkYrCzHaLZDLoMGujBW8u3zv", Testnet, 0, 61))
+	b.AddrRequest(context.Background(), deriver.NewAddress("m/1'/1234/0/61", "mfsNoNz57ANkYrCzHaLZDLoMGujBW8u3zv", Testnet, 0, 61))
 
 	var addrs []*AddrResponse
 	var txs []*TxResponse
@@ -83,7 +93,7 @@ func TestAddressWithTransactions(t *testing.T) {
 	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
 	assert.NoError(t, err)
 
-	b.AddrRequest(deriver.NewAddress("m/1'/1234/0/7", "mi2udMvJHeeJJNp5wWKToa86L2cJUKzrby", Testnet, 0, 7))
+	b.AddrRequest(context.Background(), deriver.NewAddress("m/1'/1234/0/7", "mi2udMvJHeeJJNp5wWKToa86L2cJUKzrby", Testnet, 0, 7))
 
 	var addrs []*AddrResponse
 	var txs []*TxResponse
@@ -98,7 +108,7 @@ func TestAddressWithTransactions(t *testing.T) {
 	assert.Len(t, txs, 0)
 
 	for _, tx := range addrs[0].TxHashes {
-		b.TxRequest(tx)
+		b.TxRequest(context.Background(), tx)
 	}
 
 	fetchResults(b, &addrs, &txs, 100*time.Millisecond)
@@ -141,3 +151,37 @@ func fetchResults(b Backend, addrs *[]*AddrResponse, txs *[]*TxResponse, timeout
 
 	wg.Wait()
 }
+
+func TestMissingBlock(t *testing.T) {
+	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+
+	b.BlockRequest(context.Background(), 1234)
+
+	select {
+	case err := <-b.Errors():
+		assert.IsType(t, &Error{}, err)
+		assert.Contains(t, err.Error(), "block 1234")
+	case <-b.BlockResponses():
+		t.Errorf("expected an error for a block which isn't in the fixture")
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("expected an error for a block which isn't in the fixture")
+	}
+}
+
+func TestMissingTransaction(t *testing.T) {
+	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+
+	b.TxRequest(context.Background(), "0000")
+
+	select {
+	case err := <-b.Errors():
+		assert.IsType(t, &Error{}, err)
+		assert.Contains(t, err.Error(), "transaction 0000")
+	case <-b.TxResponses():
+		t.Errorf("expected an error for a transaction which isn't in the fixture")
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("expected an error for a transaction which isn't in the fixture")
+	}
+}
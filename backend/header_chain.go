@@ -0,0 +1,396 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	. "github.com/square/beancounter/utils"
+)
+
+// HeaderChain is a chain of block headers which has been validated the way a full node validates
+// headers: each header must link to the previous one, satisfy its proof of work and have the
+// difficulty dictated by the retargeting rules.
+//
+// Downloading all the headers since the genesis block is slow, so the chain is anchored at the
+// latest hardcoded checkpoint (see chaincfg) below the heights we need. The chain starts at the
+// beginning of the checkpoint's retarget period, the headers between the period's start and the
+// checkpoint are attested by the checkpoint's hash. If a lower height is needed later, the chain is
+// extended downwards: a segment anchored at the checkpoint below that height is validated up to the
+// chain's base, and the two are joined. The headers which were already validated are kept.
+//
+// The chain can be stored in a file, so later runs only download the new headers. The file starts
+// with the height of the first header (4 bytes, little endian), followed by the 80 byte headers.
+type HeaderChain struct {
+	mu      sync.Mutex
+	params  *chaincfg.Params
+	base    uint32             // height of headers[0]
+	headers []wire.BlockHeader // validated headers, headers[i] is at height base+i
+	path    string             // where the chain is stored, if set
+
+	// segment below base, while the chain is extended downwards. It's joined to the chain once it
+	// reaches base.
+	lower *HeaderChain
+}
+
+const (
+	// maxHeadersBatch is the number of headers Electrum servers return per request.
+	maxHeadersBatch = 2016
+
+	// the last headers of a stored chain are dropped when it's loaded, in case they were
+	// reorganized since.
+	maxReorgDepth = 100
+
+	medianTimeBlocks = 11
+)
+
+// HeaderError is returned when a header doesn't pass validation.
+type HeaderError struct {
+	Height uint32
+	Reason string
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("invalid header at height %d: %s", e.Height, e.Reason)
+}
+
+// NewHeaderChain returns an empty chain.
+func NewHeaderChain(network Network) *HeaderChain {
+	return newHeaderChain(network.ChainConfig())
+}
+
+func newHeaderChain(params *chaincfg.Params) *HeaderChain {
+	return &HeaderChain{params: params}
+}
+
+// Header returns the validated header at a given height, if the chain has it.
+func (c *HeaderChain) Header(height uint32) (*wire.BlockHeader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.headers) == 0 || height < c.base || height >= c.next() {
+		return nil, false
+	}
+	header := c.headers[height-c.base]
+	return &header, true
+}
+
+// Find returns the height of the header with a given hash, if the chain has it.
+func (c *HeaderChain) Find(hash chainhash.Hash) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := len(c.headers) - 1; i >= 0; i-- {
+		if c.headers[i].BlockHash() == hash {
+			return c.base + uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// next returns the height of the next header.
+func (c *HeaderChain) next() uint32 {
+	return c.base + uint32(len(c.headers))
+}
+
+// interval is the number of blocks between difficulty retargets (2016).
+func (c *HeaderChain) interval() uint32 {
+	return uint32(c.params.TargetTimespan / c.params.TargetTimePerBlock)
+}
+
+// anchor returns the height and hash of the latest checkpoint at or below height, or the genesis
+// block.
+func (c *HeaderChain) anchor(height uint32) (uint32, string) {
+	h, hash := uint32(0), c.params.GenesisHash.String()
+	for _, cp := range c.params.Checkpoints {
+		if uint32(cp.Height) <= height && uint32(cp.Height) > h {
+			h, hash = uint32(cp.Height), cp.Hash.String()
+		}
+	}
+	return h, hash
+}
+
+// NextBatch returns the headers which have to be downloaded next, in order to reach height.
+// count is 0 if the chain already has the header at height. If the chain starts above height, the
+// batches fill the gap between the checkpoint below height and the chain's base.
+func (c *HeaderChain) NextBatch(height uint32) (start uint32, count uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.headers) > 0 && height < c.base {
+		if c.lower != nil && (len(c.lower.headers) == 0 || height < c.lower.base) {
+			// the segment was started for a higher height
+			c.lower = nil
+		}
+		if c.lower == nil {
+			anchor, _ := c.anchor(height)
+			start = anchor - anchor%c.interval()
+		} else {
+			start = c.lower.next()
+		}
+		count = c.base - start
+		if count > maxHeadersBatch {
+			count = maxHeadersBatch
+		}
+		return start, count
+	}
+	if len(c.headers) == 0 {
+		anchor, _ := c.anchor(height)
+		start = anchor - anchor%c.interval()
+	} else {
+		start = c.next()
+	}
+	if height < start {
+		return start, 0
+	}
+	count = height - start + 1
+	if count > maxHeadersBatch {
+		count = maxHeadersBatch
+	}
+	return start, count
+}
+
+// Extend validates headers, starting at height start, and appends them to the chain.
+func (c *HeaderChain) Extend(start uint32, headers []wire.BlockHeader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.extend(start, headers)
+}
+
+func (c *HeaderChain) extend(start uint32, headers []wire.BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	if len(c.headers) == 0 {
+		return c.anchorAt(start, headers)
+	}
+	if start < c.base {
+		return c.extendLower(start, headers)
+	}
+	if start != c.next() {
+		return fmt.Errorf("headers start at %d, the chain's next height is %d", start, c.next())
+	}
+	for i := range headers {
+		if err := c.validate(start+uint32(i), &headers[i]); err != nil {
+			return err
+		}
+		c.headers = append(c.headers, headers[i])
+	}
+	return nil
+}
+
+// extendLower validates headers below the chain's base and adds them to the lower segment. Once
+// the segment reaches the base, the chain's first header must be valid on top of it and the
+// segment becomes the bottom of the chain.
+func (c *HeaderChain) extendLower(start uint32, headers []wire.BlockHeader) error {
+	if c.lower == nil {
+		c.lower = newHeaderChain(c.params)
+	}
+	if end := start + uint32(len(headers)); end > c.base {
+		headers = headers[:c.base-start]
+	}
+	if err := c.lower.extend(start, headers); err != nil {
+		return err
+	}
+	if len(c.lower.headers) == 0 || c.lower.next() != c.base {
+		return nil
+	}
+	if err := c.lower.validate(c.base, &c.headers[0]); err != nil {
+		c.lower = nil
+		return err
+	}
+	c.headers = append(c.lower.headers, c.headers...)
+	c.base = c.lower.base
+	c.lower = nil
+	return nil
+}
+
+// periodAnchor returns the latest checkpoint (or the genesis block) at or below end, in the
+// retarget period which starts at start. A stored chain can cross later checkpoints, it's anchored
+// at the checkpoint it started from.
+func (c *HeaderChain) periodAnchor(start, end uint32) (uint32, string, bool) {
+	h, hash, found := uint32(0), c.params.GenesisHash.String(), start == 0
+	for _, cp := range c.params.Checkpoints {
+		height := uint32(cp.Height)
+		if height <= end && height-height%c.interval() == start && (!found || height > h) {
+			h, hash, found = height, cp.Hash.String(), true
+		}
+	}
+	return h, hash, found
+}
+
+// anchorAt starts an empty chain. The headers must reach the anchor, the headers up to the anchor
+// only need to link to each other.
+func (c *HeaderChain) anchorAt(start uint32, headers []wire.BlockHeader) error {
+	end := start + uint32(len(headers)) - 1
+	anchor, hash, found := c.periodAnchor(start, end)
+	if !found {
+		latest, _ := c.anchor(end)
+		return fmt.Errorf("headers start at %d, expecting the retarget period of block %d", start, latest)
+	}
+	for i := 1; uint32(i) <= anchor-start; i++ {
+		if headers[i].PrevBlock != headers[i-1].BlockHash() {
+			return &HeaderError{Height: start + uint32(i), Reason: "doesn't link to the previous header"}
+		}
+	}
+	if h := headers[anchor-start].BlockHash(); h.String() != hash {
+		return &HeaderError{Height: anchor, Reason: fmt.Sprintf("hash %s doesn't match checkpoint %s", h, hash)}
+	}
+
+	c.base = start
+	c.headers = append([]wire.BlockHeader{}, headers[:anchor-start+1]...)
+	return c.extend(anchor+1, headers[anchor-start+1:])
+}
+
+// validate checks a header which would be at height, on top of the chain.
+func (c *HeaderChain) validate(height uint32, header *wire.BlockHeader) error {
+	prev := &c.headers[height-1-c.base]
+	if header.PrevBlock != prev.BlockHash() {
+		return &HeaderError{Height: height, Reason: "doesn't link to the previous header"}
+	}
+	if bits := c.nextBits(height, header); header.Bits != bits {
+		return &HeaderError{Height: height, Reason: fmt.Sprintf("bits %08x, expecting %08x", header.Bits, bits)}
+	}
+	if err := checkProofOfWork(header); err != nil {
+		return &HeaderError{Height: height, Reason: err.Error()}
+	}
+	if !header.Timestamp.After(c.medianTime(height)) {
+		return &HeaderError{Height: height, Reason: "timestamp isn't after the median time of the previous blocks"}
+	}
+	for _, cp := range c.params.Checkpoints {
+		if uint32(cp.Height) == height && header.BlockHash() != *cp.Hash {
+			return &HeaderError{Height: height, Reason: fmt.Sprintf("hash doesn't match checkpoint %s", cp.Hash)}
+		}
+	}
+	return nil
+}
+
+// nextBits returns the difficulty the header at height must have.
+func (c *HeaderChain) nextBits(height uint32, header *wire.BlockHeader) uint32 {
+	interval := c.interval()
+	last := &c.headers[height-1-c.base]
+
+	if height%interval != 0 {
+		if !c.params.ReduceMinDifficulty {
+			return last.Bits
+		}
+		// testnet: if no block was found for a while, a block can have the minimum difficulty.
+		// Otherwise, it has the difficulty of the last block which didn't use the exception.
+		if header.Timestamp.After(last.Timestamp.Add(c.params.MinDiffReductionTime)) {
+			return c.params.PowLimitBits
+		}
+		h := height - 1
+		for h%interval != 0 && h > c.base && c.headers[h-c.base].Bits == c.params.PowLimitBits {
+			h--
+		}
+		return c.headers[h-c.base].Bits
+	}
+
+	first := &c.headers[height-interval-c.base]
+	targetTimespan := int64(c.params.TargetTimespan / time.Second)
+	actual := last.Timestamp.Unix() - first.Timestamp.Unix()
+	if min := targetTimespan / c.params.RetargetAdjustmentFactor; actual < min {
+		actual = min
+	}
+	if max := targetTimespan * c.params.RetargetAdjustmentFactor; actual > max {
+		actual = max
+	}
+	target := blockchain.CompactToBig(last.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(targetTimespan))
+	if target.Cmp(c.params.PowLimit) > 0 {
+		target.Set(c.params.PowLimit)
+	}
+	return blockchain.BigToCompact(target)
+}
+
+// medianTime returns the median timestamp of the (up to) 11 blocks below height.
+func (c *HeaderChain) medianTime(height uint32) time.Time {
+	timestamps := []time.Time{}
+	for h := height; h > c.base && len(timestamps) < medianTimeBlocks; h-- {
+		timestamps = append(timestamps, c.headers[h-1-c.base].Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+	return timestamps[len(timestamps)/2]
+}
+
+// Load reads a chain stored by Save and validates it again. The chain is then saved to path
+// whenever Save is called. A missing file isn't an error.
+func (c *HeaderChain) Load(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 || (len(data)-4)%wire.MaxBlockHeaderPayload != 0 {
+		return fmt.Errorf("invalid headers file %s", path)
+	}
+	start := binary.LittleEndian.Uint32(data)
+	headers, err := parseHeaders(data[4:])
+	if err != nil {
+		return fmt.Errorf("invalid headers file %s: %s", path, err)
+	}
+	if len(headers) > maxReorgDepth {
+		headers = headers[:len(headers)-maxReorgDepth]
+	}
+	c.headers, c.lower = nil, nil
+	if err := c.extend(start, headers); err != nil {
+		c.headers = nil
+		return fmt.Errorf("invalid headers file %s: %s", path, err)
+	}
+	return nil
+}
+
+// Save writes the chain to the file given to Load, if any.
+func (c *HeaderChain) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" || len(c.headers) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, c.base)
+	for i := range c.headers {
+		if err := c.headers[i].Serialize(&buf); err != nil {
+			return err
+		}
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// parseHeaders decodes concatenated 80 byte headers.
+func parseHeaders(b []byte) ([]wire.BlockHeader, error) {
+	if len(b)%wire.MaxBlockHeaderPayload != 0 {
+		return nil, fmt.Errorf("headers have %d bytes, not a multiple of %d", len(b), wire.MaxBlockHeaderPayload)
+	}
+	headers := make([]wire.BlockHeader, len(b)/wire.MaxBlockHeaderPayload)
+	r := bytes.NewReader(b)
+	for i := range headers {
+		if err := headers[i].Deserialize(r); err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
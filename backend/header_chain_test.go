@@ -0,0 +1,256 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+// mineHeaders returns n regtest headers on top of prev, which is at height. The blocks are 10
+// minutes apart, except for the last block of each retarget period which comes 20 minutes after
+// the previous one. This way, each period lasts exactly two weeks and the difficulty doesn't change.
+func mineHeaders(prev wire.BlockHeader, height uint32, n int) []wire.BlockHeader {
+	headers := []wire.BlockHeader{}
+	for i := 0; i < n; i++ {
+		height++
+		spacing := 10 * time.Minute
+		if height%2016 == 2015 {
+			spacing = 20 * time.Minute
+		}
+		h := wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(spacing),
+			Bits:      prev.Bits,
+		}
+		for checkProofOfWork(&h) != nil {
+			h.Nonce++
+		}
+		headers = append(headers, h)
+		prev = h
+	}
+	return headers
+}
+
+func TestHeaderChainExtend(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	c := newHeaderChain(&params)
+
+	start, count := c.NextBatch(2100)
+	assert.Equal(t, uint32(0), start)
+	assert.Equal(t, uint32(maxHeadersBatch), count)
+
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 2100)...)
+	assert.NoError(t, c.Extend(0, headers[:count]))
+	start, count = c.NextBatch(2100)
+	assert.Equal(t, uint32(maxHeadersBatch), start)
+	assert.Equal(t, uint32(2100-maxHeadersBatch+1), count)
+
+	// headers which don't link
+	assert.IsType(t, &HeaderError{}, c.Extend(start, headers[start+1:]))
+
+	// wrong difficulty
+	bad := headers[start]
+	bad.Bits = 0x1d00ffff
+	assert.IsType(t, &HeaderError{}, c.Extend(start, []wire.BlockHeader{bad}))
+
+	// the retarget at 2016 keeps the difficulty
+	assert.NoError(t, c.Extend(start, headers[start:]))
+	header, ok := c.Header(2100)
+	assert.True(t, ok)
+	assert.Equal(t, headers[2100].BlockHash(), header.BlockHash())
+	_, ok = c.Header(2101)
+	assert.False(t, ok)
+	_, count = c.NextBatch(2100)
+	assert.Equal(t, uint32(0), count)
+}
+
+func TestHeaderChainCheckpoint(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 2100)...)
+	hash := headers[2050].BlockHash()
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 2050, Hash: &hash}}
+
+	// the chain is anchored at the checkpoint's retarget period
+	c := newHeaderChain(&params)
+	start, count := c.NextBatch(2060)
+	assert.Equal(t, uint32(2016), start)
+	assert.Equal(t, uint32(45), count)
+	assert.NoError(t, c.Extend(start, headers[start:start+count]))
+	_, ok := c.Header(2015)
+	assert.False(t, ok)
+	_, ok = c.Header(2060)
+	assert.True(t, ok)
+
+	// headers which don't lead to the checkpoint
+	c = newHeaderChain(&params)
+	fork := headers[2016]
+	fork.Timestamp = fork.Timestamp.Add(time.Second)
+	for checkProofOfWork(&fork) != nil {
+		fork.Nonce++
+	}
+	other := append([]wire.BlockHeader{fork}, mineHeaders(fork, 2016, 44)...)
+	assert.IsType(t, &HeaderError{}, c.Extend(2016, other))
+
+	// below the checkpoint, the chain starts from the genesis block
+	start, _ = c.NextBatch(1000)
+	assert.Equal(t, uint32(0), start)
+}
+
+func TestHeaderChainStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers")
+
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 300)...)
+
+	c := newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	assert.NoError(t, c.Extend(0, headers))
+	assert.NoError(t, c.Save())
+
+	// the last headers are dropped, in case they were reorganized
+	c = newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	start, _ := c.NextBatch(300)
+	assert.Equal(t, uint32(301-maxReorgDepth), start)
+	header, ok := c.Header(100)
+	assert.True(t, ok)
+	assert.Equal(t, headers[100].BlockHash(), header.BlockHash())
+
+	// corrupted file
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	copy(data[4+100*wire.MaxBlockHeaderPayload+4:], make([]byte, chainhash.HashSize))
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	assert.Error(t, newHeaderChain(&params).Load(path))
+}
+
+func TestHeaderChainStoreCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers")
+
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 4400)...)
+	early, late := headers[100].BlockHash(), headers[4100].BlockHash()
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 100, Hash: &early}, {Height: 4100, Hash: &late}}
+
+	// the chain is anchored at the first checkpoint, then grows past the second one
+	c := newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	for _, height := range []uint32{200, 4400} {
+		for {
+			start, count := c.NextBatch(height)
+			if count == 0 {
+				break
+			}
+			assert.NoError(t, c.Extend(start, headers[start:start+count]))
+		}
+	}
+	assert.NoError(t, c.Save())
+
+	c = newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	header, ok := c.Header(4200)
+	assert.True(t, ok)
+	assert.Equal(t, headers[4200].BlockHash(), header.BlockHash())
+	_, ok = c.Header(0)
+	assert.True(t, ok)
+}
+
+func TestHeaderChainExtendDownwards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers")
+
+	params := chaincfg.RegressionNetParams
+	genesis := params.GenesisBlock.Header
+	headers := append([]wire.BlockHeader{genesis}, mineHeaders(genesis, 0, 4400)...)
+	early, late := headers[100].BlockHash(), headers[4100].BlockHash()
+	params.Checkpoints = []chaincfg.Checkpoint{{Height: 100, Hash: &early}, {Height: 4100, Hash: &late}}
+
+	// sync downloads the headers needed to reach height, and returns the number of batches.
+	sync := func(c *HeaderChain, headers []wire.BlockHeader, height uint32) (int, error) {
+		batches := 0
+		for {
+			start, count := c.NextBatch(height)
+			if count == 0 {
+				return batches, nil
+			}
+			batches++
+			if err := c.Extend(start, headers[start:start+count]); err != nil {
+				return batches, err
+			}
+		}
+	}
+
+	c := newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	_, err = sync(c, headers, 4200)
+	assert.NoError(t, err)
+	_, ok := c.Header(200)
+	assert.False(t, ok)
+
+	// below the base, only the gap between the early checkpoint's period and the base is
+	// downloaded, the headers above are kept
+	batches, err := sync(c, headers, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, batches)
+	for _, height := range []uint32{0, 200, 4031, 4032, 4200} {
+		header, ok := c.Header(height)
+		if assert.True(t, ok, "height %d", height) {
+			assert.Equal(t, headers[height].BlockHash(), header.BlockHash())
+		}
+	}
+
+	// above the chain, it grows from the tip
+	start, count := c.NextBatch(4300)
+	assert.Equal(t, uint32(4201), start)
+	assert.Equal(t, uint32(100), count)
+	_, err = sync(c, headers, 4300)
+	assert.NoError(t, err)
+
+	// the whole chain is stored
+	assert.NoError(t, c.Save())
+	c = newHeaderChain(&params)
+	assert.NoError(t, c.Load(path))
+	_, ok = c.Header(0)
+	assert.True(t, ok)
+	_, ok = c.Header(4300 - maxReorgDepth)
+	assert.True(t, ok)
+
+	// a segment which doesn't link to the chain's base is rejected, and the chain is unchanged
+	params.Checkpoints = params.Checkpoints[1:]
+	c = newHeaderChain(&params)
+	_, err = sync(c, headers, 4200)
+	assert.NoError(t, err)
+	forked := mineHeaders(genesis, 0, 1)[0]
+	forked.Timestamp = forked.Timestamp.Add(time.Second)
+	for checkProofOfWork(&forked) != nil {
+		forked.Nonce++
+	}
+	fork := append([]wire.BlockHeader{genesis, forked}, mineHeaders(forked, 1, 4030)...)
+	_, err = sync(c, fork, 200)
+	assert.IsType(t, &HeaderError{}, err)
+	_, ok = c.Header(200)
+	assert.False(t, ok)
+	header, ok := c.Header(4200)
+	assert.True(t, ok)
+	assert.Equal(t, headers[4200].BlockHash(), header.BlockHash())
+}
@@ -0,0 +1,380 @@
+package backend
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/beancounter/backend/electrum"
+	"github.com/square/beancounter/deriver"
+	"github.com/square/beancounter/reporter"
+)
+
+// By default, each address is sent to whichever Electrum server picks it up first, so every
+// server ends up seeing a large part of the wallet. In privacy mode, the addresses are split into
+// shards and each shard is served by a single host: no host sees much more than maxFraction of the
+// wallet's addresses (shards are assigned in turn, so a shard can get one address more than its
+// share). A host only ever serves one shard, even if it reconnects.
+//
+// The requests are held for a short while and shuffled, so the order in which a server sees the
+// addresses doesn't follow the derivation order. Decoys, addresses derived from a throwaway key
+// with the same shape as the wallet's, can be mixed in: the servers can't tell them apart from the
+// wallet's addresses. The transactions of a shard are fetched from the shard's host too, so they
+// don't leak to the other servers.
+//
+// Like quorum mode, requests are sent to a specific node through its nodeQueue.
+
+const (
+	// number of requests shuffled together.
+	shuffleSize = 20
+	// how long a request waits for shuffleSize requests to be queued.
+	shuffleDelay = 200 * time.Millisecond
+)
+
+// Exposure describes what a server learnt about the wallet in privacy mode.
+type Exposure struct {
+	Server    string  // host
+	Shard     int     // shard the host served
+	Addresses int     // number of the wallet's addresses the host saw
+	Decoys    int     // number of decoys the host saw
+	Fraction  float64 // fraction of the wallet's addresses the host saw
+}
+
+func (e Exposure) String() string {
+	return fmt.Sprintf("%s: %d addresses (%.1f%%), %d decoys, shard %d", e.Server, e.Addresses,
+		100*e.Fraction, e.Decoys, e.Shard)
+}
+
+type privateRequest struct {
+	addr  *deriver.Address
+	decoy bool
+	shard int
+}
+
+// privacyState is the state of privacy mode. The fields below mu are guarded by it.
+type privacyState struct {
+	shards       int
+	decoys       int
+	decoyDeriver *deriver.AddressDeriver
+	nextDecoy    uint32 // index of the next decoy, updated atomically
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	pending    []*privateRequest
+	flushTimer *time.Timer
+	nextShard  [2]int         // next shard for the wallet's addresses and for decoys
+	addrShards map[string]int // address => shard
+	owners     map[int]string // shard => host serving it
+	hostShards map[string]int // host => shard it served
+	txShards   map[string]int // tx hash => shard of the address which has it
+	exposure   map[string]*Exposure
+	addresses  int // number of the wallet's addresses
+	// set once a shard didn't find a host, the remaining requests then fail right away.
+	unavailable error
+}
+
+// SetPrivacy enables privacy mode: no server sees much more than maxFraction of the addresses, and
+// decoys decoy addresses derived from decoyDeriver (see AddressDeriver.Decoy) are mixed with each
+// address. It must be called before the first AddrRequest, and can't be combined with quorum mode.
+func (eb *ElectrumBackend) SetPrivacy(maxFraction float64, decoys int, decoyDeriver *deriver.AddressDeriver) error {
+	if maxFraction <= 0 || maxFraction > 1 {
+		return fmt.Errorf("privacy fraction must be between 0 and 1")
+	}
+	if decoys < 0 {
+		return fmt.Errorf("number of decoys can't be negative")
+	}
+	if decoys > 0 && decoyDeriver == nil {
+		return fmt.Errorf("decoys require a decoy deriver")
+	}
+	if eb.quorum > 1 {
+		return fmt.Errorf("privacy mode can't be combined with a quorum")
+	}
+	// a small epsilon, so that e.g. 1/0.2 doesn't round up to 6 shards.
+	shards := int(math.Ceil(1/maxFraction - 1e-9))
+	if shards > maxPeers {
+		return fmt.Errorf("privacy fraction %g needs %d hosts, more than the %d servers we connect to", maxFraction, shards, maxPeers)
+	}
+	seed := make([]byte, 8)
+	if _, err := crand.Read(seed); err != nil {
+		return err
+	}
+	eb.privacy = &privacyState{
+		shards:       shards,
+		decoys:       decoys,
+		decoyDeriver: decoyDeriver,
+		rand:         rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed)))),
+		addrShards:   make(map[string]int),
+		owners:       make(map[int]string),
+		hostShards:   make(map[string]int),
+		txShards:     make(map[string]int),
+		exposure:     make(map[string]*Exposure),
+	}
+	return nil
+}
+
+// PrivacyExposure returns what each server saw, in privacy mode.
+func (eb *ElectrumBackend) PrivacyExposure() []Exposure {
+	p := eb.privacy
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	exposure := make([]Exposure, 0, len(p.exposure))
+	for _, e := range p.exposure {
+		e := *e
+		if p.addresses > 0 {
+			e.Fraction = float64(e.Addresses) / float64(p.addresses)
+		}
+		exposure = append(exposure, e)
+	}
+	sort.Slice(exposure, func(i, j int) bool { return exposure[i].Server < exposure[j].Server })
+	return exposure
+}
+
+// privateAddrRequest queues the address and its decoys, to be shuffled. The quorum slot is released
+// once the address is processed.
+func (eb *ElectrumBackend) privateAddrRequest(ctx context.Context, addr *deriver.Address) error {
+	select {
+	case eb.quorumSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	reporter.GetInstance().IncAddressesScheduled()
+	reporter.GetInstance().Logf("scheduling address: %s (with %d decoys)", addr, eb.privacy.decoys)
+
+	reqs := []*privateRequest{{addr: addr}}
+	for i := 0; i < eb.privacy.decoys; i++ {
+		index := atomic.AddUint32(&eb.privacy.nextDecoy, 1) - 1
+		decoy, err := eb.privacy.decoyDeriver.Derive(index%2, index/2)
+		if err != nil {
+			log.Printf("failed to derive decoy: %+v", err)
+			continue
+		}
+		reqs = append(reqs, &privateRequest{addr: decoy, decoy: true})
+	}
+	eb.queuePrivate(reqs)
+	return nil
+}
+
+// queuePrivate adds requests to the pending requests, which are flushed once there are
+// shuffleSize of them, or after shuffleDelay.
+func (eb *ElectrumBackend) queuePrivate(reqs []*privateRequest) {
+	p := eb.privacy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, reqs...)
+	if len(p.pending) >= shuffleSize {
+		if p.flushTimer != nil {
+			p.flushTimer.Stop()
+			p.flushTimer = nil
+		}
+		eb.flushPrivate()
+		return
+	}
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(shuffleDelay, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.flushTimer = nil
+			eb.flushPrivate()
+		})
+	}
+}
+
+// flushPrivate shuffles the pending requests, assigns them to shards and processes them. The
+// caller must hold privacy.mu.
+func (eb *ElectrumBackend) flushPrivate() {
+	p := eb.privacy
+	reqs := p.pending
+	p.pending = nil
+	p.rand.Shuffle(len(reqs), func(i, j int) { reqs[i], reqs[j] = reqs[j], reqs[i] })
+
+	// Shards are assigned round robin, in the shuffled order, so they are balanced.
+	for _, req := range reqs {
+		if req.decoy {
+			req.shard = p.nextShard[1] % p.shards
+			p.nextShard[1]++
+			continue
+		}
+		shard, exists := p.addrShards[req.addr.String()]
+		if !exists {
+			shard = p.nextShard[0] % p.shards
+			p.nextShard[0]++
+			p.addrShards[req.addr.String()] = shard
+			p.addresses++
+		}
+		req.shard = shard
+	}
+
+	for _, req := range reqs {
+		go func(req *privateRequest) {
+			if !req.decoy {
+				defer func() { <-eb.quorumSlots }()
+			}
+			eb.processPrivateRequest(req)
+		}(req)
+	}
+}
+
+// processPrivateRequest fetches the address' history from its shard's host, and sends it to the
+// Accounter. Decoys' histories are dropped.
+func (eb *ElectrumBackend) processPrivateRequest(req *privateRequest) {
+	waitingSince := time.Now()
+	for {
+		host, queue, err := eb.shardNode(req.shard, waitingSince)
+		if err != nil {
+			if !req.decoy {
+				reportError(eb.errors, req.addr.String(), err)
+			}
+			return
+		}
+		if queue == nil {
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-eb.doneCh:
+				return
+			}
+		}
+
+		hr := &historyRequest{addr: req.addr, result: make(chan historyResult, 1)}
+		select {
+		case queue.requests <- hr:
+		case <-queue.gone:
+			continue
+		case <-eb.doneCh:
+			return
+		}
+		select {
+		case res := <-hr.result:
+			if res.err != nil {
+				// the node is removed, the shard moves to another node.
+				if req.decoy || !eb.retry(req.addr.String(), res.err) {
+					return
+				}
+				continue
+			}
+			eb.recordExposure(host, req, res.txs)
+			if !req.decoy {
+				eb.sendHistory(req.addr, res.txs)
+			}
+			return
+		case <-queue.gone:
+		case <-eb.doneCh:
+			return
+		}
+	}
+}
+
+// recordExposure records that host saw the request, and which shard the transactions belong to.
+func (eb *ElectrumBackend) recordExposure(host string, req *privateRequest, txs []*electrum.Transaction) {
+	p := eb.privacy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, exists := p.exposure[host]
+	if !exists {
+		e = &Exposure{Server: host, Shard: req.shard}
+		p.exposure[host] = e
+	}
+	if req.decoy {
+		e.Decoys++
+		return
+	}
+	e.Addresses++
+	for _, tx := range txs {
+		if _, exists := p.txShards[tx.Hash]; !exists {
+			p.txShards[tx.Hash] = req.shard
+		}
+	}
+}
+
+// shardNode returns a connected node on the host serving shard. If the host is gone, the shard
+// moves to a host which hasn't served any shard yet. It returns a nil queue while there is no such
+// host, and an error once the request waited since waitingSince for longer than quorumTimeout.
+func (eb *ElectrumBackend) shardNode(shard int, waitingSince time.Time) (string, *nodeQueue, error) {
+	p := eb.privacy
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	eb.nodeMu.RLock()
+	defer eb.nodeMu.RUnlock()
+
+	if p.unavailable != nil {
+		return "", nil, p.unavailable
+	}
+	if owner, exists := p.owners[shard]; exists {
+		for ident, queue := range eb.nodeQueues {
+			if nodeHost(ident) == owner {
+				return owner, queue, nil
+			}
+		}
+	}
+	hosts := make(map[string]bool)
+	for host := range p.hostShards {
+		hosts[host] = true
+	}
+	for ident, queue := range eb.nodeQueues {
+		host := nodeHost(ident)
+		if _, served := p.hostShards[host]; !served {
+			p.owners[shard] = host
+			p.hostShards[host] = shard
+			return host, queue, nil
+		}
+		hosts[host] = true
+	}
+	if time.Since(waitingSince) > quorumTimeout {
+		p.unavailable = fmt.Errorf("no server available for shard %d: privacy mode needs %d hosts, "+
+			"only %d were found, use a larger privacy fraction", shard, p.shards, len(hosts))
+		return "", nil, p.unavailable
+	}
+	return "", nil, nil
+}
+
+// txShard returns the shard of the address which has the transaction, if any.
+func (eb *ElectrumBackend) txShard(txHash string) (int, bool) {
+	if eb.privacy == nil {
+		return 0, false
+	}
+	eb.privacy.mu.Lock()
+	defer eb.privacy.mu.Unlock()
+	shard, exists := eb.privacy.txShards[txHash]
+	return shard, exists
+}
+
+// processPrivateTx hands the transaction request to a node on its shard's host.
+func (eb *ElectrumBackend) processPrivateTx(txHash string, shard int) {
+	waitingSince := time.Now()
+	for {
+		_, queue, err := eb.shardNode(shard, waitingSince)
+		if err != nil {
+			reportError(eb.errors, txHash, err)
+			return
+		}
+		if queue == nil {
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-eb.doneCh:
+				return
+			}
+		}
+		select {
+		case queue.txs <- txHash:
+			return
+		case <-queue.gone:
+		case <-eb.doneCh:
+			return
+		}
+	}
+}
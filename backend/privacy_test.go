@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/beancounter/backend/electrum"
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetPrivacy(t *testing.T) {
+	eb := &ElectrumBackend{quorum: 1}
+	assert.Error(t, eb.SetPrivacy(0, 0, nil))
+	assert.Error(t, eb.SetPrivacy(1.5, 0, nil))
+	assert.Error(t, eb.SetPrivacy(0.5, 2, nil))
+	assert.NoError(t, eb.SetPrivacy(0.2, 0, nil))
+	assert.Equal(t, 5, eb.privacy.shards)
+	assert.NoError(t, eb.SetPrivacy(0.3, 0, nil))
+	assert.Equal(t, 4, eb.privacy.shards)
+	assert.NoError(t, eb.SetPrivacy(0.01, 0, nil))
+	assert.Error(t, eb.SetPrivacy(0.005, 0, nil))
+	assert.Error(t, eb.SetQuorum(2, QuorumUnion))
+
+	eb = &ElectrumBackend{quorum: 2}
+	assert.Error(t, eb.SetPrivacy(0.5, 0, nil))
+}
+
+func TestPrivacyShards(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	decoy, err := d.Decoy()
+	assert.NoError(t, err)
+
+	eb := &ElectrumBackend{
+		quorum:        1,
+		nodeQueues:    make(map[string]*nodeQueue),
+		addrResponses: make(chan *AddrResponse, 2*maxPeers),
+		errors:        make(chan error, maxPeers),
+		transactions:  make(map[string]int64),
+		retries:       make(map[string]int),
+		quorumSlots:   make(chan struct{}, 2*maxPeers),
+		doneCh:        make(chan bool),
+	}
+	defer close(eb.doneCh)
+	assert.NoError(t, eb.SetPrivacy(0.5, 1, decoy))
+
+	// three hosts, one of them with two servers. Each address has a single transaction.
+	var mu sync.Mutex
+	seen := map[string][]string{} // host => addresses
+	txs := map[string]string{}    // tx hash => host which fetched it
+	for _, ident := range []string{"a|t1", "b|t1", "b|t2", "c|t1"} {
+		queue := &nodeQueue{requests: make(chan *historyRequest), txs: make(chan string), gone: make(chan struct{})}
+		eb.nodeQueues[ident] = queue
+		go func(host string, queue *nodeQueue) {
+			for {
+				select {
+				case req := <-queue.requests:
+					mu.Lock()
+					seen[host] = append(seen[host], req.addr.String())
+					mu.Unlock()
+					req.result <- historyResult{txs: []*electrum.Transaction{{Hash: "tx" + req.addr.String(), Height: 100}}}
+				case txHash := <-queue.txs:
+					mu.Lock()
+					txs[txHash] = host
+					mu.Unlock()
+				case <-eb.doneCh:
+					return
+				}
+			}
+		}(nodeHost(ident), queue)
+	}
+
+	addrs := map[string]bool{}
+	for i := uint32(0); i < 10; i++ {
+		addr, err := d.Derive(0, i)
+		assert.NoError(t, err)
+		addrs[addr.String()] = true
+		assert.NoError(t, eb.AddrRequest(context.Background(), addr))
+	}
+	for i := 0; i < 10; i++ {
+		resp := <-eb.addrResponses
+		assert.True(t, addrs[resp.Address.String()])
+		assert.Equal(t, []string{"tx" + resp.Address.String()}, resp.TxHashes)
+	}
+
+	// each address is seen by a single host, and each host sees half of them. The decoys can
+	// still be in flight.
+	assert.Eventually(t, func() bool {
+		decoys := 0
+		for _, e := range eb.PrivacyExposure() {
+			decoys += e.Decoys
+		}
+		return decoys == 10
+	}, quorumTimeout, 10*time.Millisecond)
+	exposure := eb.PrivacyExposure()
+	assert.Len(t, exposure, 2)
+	for _, e := range exposure {
+		assert.Equal(t, 5, e.Addresses, "%s", e)
+		assert.Equal(t, 0.5, e.Fraction)
+	}
+	owner := map[string]string{}
+	mu.Lock()
+	for host, hostAddrs := range seen {
+		for _, addr := range hostAddrs {
+			if addrs[addr] {
+				assert.NotContains(t, owner, addr)
+				owner[addr] = host
+			}
+		}
+	}
+	mu.Unlock()
+	assert.Len(t, owner, 10)
+
+	// the transactions are fetched from the host which saw the address
+	for addr, host := range owner {
+		assert.NoError(t, eb.TxRequest(context.Background(), "tx"+addr))
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return txs["tx"+addr] == host
+		}, quorumTimeout, 10*time.Millisecond, fmt.Sprintf("tx of %s", addr))
+	}
+}
+
+func TestPrivacyNotEnoughHosts(t *testing.T) {
+	eb := &ElectrumBackend{quorum: 1, nodeQueues: make(map[string]*nodeQueue)}
+	assert.NoError(t, eb.SetPrivacy(0.5, 0, nil))
+	eb.nodeQueues["a|t1"] = &nodeQueue{}
+	eb.nodeQueues["a|t2"] = &nodeQueue{}
+
+	host, queue, err := eb.shardNode(0, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "a", host)
+	assert.NotNil(t, queue)
+
+	// the second shard waits for another host
+	_, queue, err = eb.shardNode(1, time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, queue)
+
+	// and gives up eventually. The other requests then fail right away.
+	_, _, err = eb.shardNode(1, time.Now().Add(-2*quorumTimeout))
+	assert.EqualError(t, err, "no server available for shard 1: privacy mode needs 2 hosts, only 1 were found, use a larger privacy fraction")
+	_, _, err = eb.shardNode(0, time.Now())
+	assert.Error(t, err)
+}
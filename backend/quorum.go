@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/square/beancounter/backend/electrum"
+	"github.com/square/beancounter/deriver"
+	"github.com/square/beancounter/reporter"
+)
+
+// By default, each address is sent to whichever Electrum server picks it up first. A server which
+// lies (or lags) can therefore hide transactions. In quorum mode, the history of each address is
+// fetched from k servers running on distinct hosts. Every transaction the servers don't agree on
+// is recorded as a Disagreement, and the answers are combined according to a QuorumPolicy.
+//
+// A history request is sent to a specific node through the node's own queue (see nodeQueue). Each
+// node runs requestsPerNode workers (see processRequests) which read the queue along with the
+// shared request channels, so a node answers several addresses concurrently over its multiplexed
+// connection. A server which doesn't answer within quorumTimeout is skipped and another host is
+// asked instead.
+
+// QuorumPolicy decides how the servers' answers are combined.
+type QuorumPolicy string
+
+const (
+	// QuorumUnion keeps every transaction reported by at least one server.
+	QuorumUnion QuorumPolicy = "union"
+	// QuorumMajority keeps the transactions reported by more than half of the servers.
+	QuorumMajority QuorumPolicy = "majority"
+)
+
+// quorumTimeout is how long an address waits for a server on a host which hasn't answered yet, and
+// for that server's answer. New peers are found every peerFetchInterval.
+const quorumTimeout = 4 * peerFetchInterval
+
+// Disagreement describes a transaction the servers didn't agree on.
+type Disagreement struct {
+	Address string
+	TxHash  string
+	Heights map[string]int64 // height reported by each server which has the transaction
+	Missing []string         // servers which don't have the transaction
+	Kept    bool             // whether the policy kept the transaction
+}
+
+func (d Disagreement) String() string {
+	servers := []string{}
+	for server, height := range d.Heights {
+		servers = append(servers, fmt.Sprintf("%s at %d", server, height))
+	}
+	sort.Strings(servers)
+	kept := "dropped"
+	if d.Kept {
+		kept = "kept"
+	}
+	return fmt.Sprintf("%s: %s reported by %s, missing from [%s] (%s)", d.Address, d.TxHash,
+		strings.Join(servers, ", "), strings.Join(d.Missing, ", "), kept)
+}
+
+// nodeQueue sends requests to a specific node. gone is closed when the node is removed.
+type nodeQueue struct {
+	requests chan *historyRequest
+	txs      chan string // transaction requests, in privacy mode
+	gone     chan struct{}
+}
+
+type historyRequest struct {
+	addr   *deriver.Address
+	result chan historyResult // buffered, so the node never blocks
+}
+
+type historyResult struct {
+	txs []*electrum.Transaction
+	err error
+}
+
+// SetQuorum enables quorum mode: each address is fetched from k servers on distinct hosts. It must
+// be called before the first AddrRequest.
+func (eb *ElectrumBackend) SetQuorum(k int, policy QuorumPolicy) error {
+	if k < 1 {
+		return fmt.Errorf("quorum must be at least 1")
+	}
+	if policy != QuorumUnion && policy != QuorumMajority {
+		return fmt.Errorf("unknown quorum policy: %s", policy)
+	}
+	if k > 1 && eb.privacy != nil {
+		return fmt.Errorf("quorum mode can't be combined with privacy mode")
+	}
+	eb.quorum = k
+	eb.quorumPolicy = policy
+	return nil
+}
+
+// Disagreements returns the transactions the servers didn't agree on, in quorum mode.
+func (eb *ElectrumBackend) Disagreements() []Disagreement {
+	eb.disagreementsMu.Lock()
+	defer eb.disagreementsMu.Unlock()
+
+	return append([]Disagreement{}, eb.disagreements...)
+}
+
+// processQuorumRequest fetches the address' history from eb.quorum servers and sends the combined
+// history to the Accounter. It gives up on a server which takes longer than timeout to answer, and
+// reports an error once no new host answered for longer than timeout.
+func (eb *ElectrumBackend) processQuorumRequest(addr *deriver.Address, timeout time.Duration) {
+	answers := map[string][]*electrum.Transaction{} // host => history
+	servers := map[string]string{}                  // host => node ident
+	tried := map[string]struct{}{}                  // hosts we sent the request to
+	waitingSince := time.Now()
+
+	for len(answers) < eb.quorum {
+		ident, queue := eb.pickNode(tried)
+		if queue == nil {
+			if time.Since(waitingSince) > timeout {
+				reportError(eb.errors, addr.String(), fmt.Errorf("quorum of %d not reached, only %d servers answered", eb.quorum, len(answers)))
+				return
+			}
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-eb.doneCh:
+				return
+			}
+		}
+		host := nodeHost(ident)
+		tried[host] = struct{}{}
+
+		// a server which doesn't answer in time stays in tried, so it isn't asked again.
+		req := &historyRequest{addr: addr, result: make(chan historyResult, 1)}
+		deadline := time.After(timeout)
+		select {
+		case queue.requests <- req:
+		case <-queue.gone:
+			delete(tried, host)
+			continue
+		case <-deadline:
+			log.Printf("%s is too busy for %s, trying another server", ident, addr)
+			continue
+		case <-eb.doneCh:
+			return
+		}
+		select {
+		case res := <-req.result:
+			if res.err != nil {
+				// the node is removed, another node on the same host can try.
+				delete(tried, host)
+				continue
+			}
+			answers[host] = res.txs
+			servers[host] = ident
+			waitingSince = time.Now()
+		case <-queue.gone:
+			delete(tried, host)
+		case <-deadline:
+			log.Printf("%s didn't answer in time for %s, trying another server", ident, addr)
+		case <-eb.doneCh:
+			return
+		}
+	}
+
+	txs, disagreements := combineHistories(addr.String(), answers, servers, eb.quorumPolicy)
+	if len(disagreements) > 0 {
+		eb.disagreementsMu.Lock()
+		eb.disagreements = append(eb.disagreements, disagreements...)
+		eb.disagreementsMu.Unlock()
+		for _, d := range disagreements {
+			reporter.GetInstance().Logf("servers disagree: %s", d)
+		}
+	}
+	eb.sendHistory(addr, txs)
+}
+
+// pickNode returns a connected node whose host isn't in tried.
+func (eb *ElectrumBackend) pickNode(tried map[string]struct{}) (string, *nodeQueue) {
+	eb.nodeMu.RLock()
+	defer eb.nodeMu.RUnlock()
+
+	for ident, queue := range eb.nodeQueues {
+		if _, exists := tried[nodeHost(ident)]; !exists {
+			return ident, queue
+		}
+	}
+	return "", nil
+}
+
+// nodeHost returns the host part of a node's ident. Servers on the same host aren't independent.
+func nodeHost(ident string) string {
+	return strings.SplitN(ident, "|", 2)[0]
+}
+
+// combineHistories merges the histories returned by several servers according to policy.
+func combineHistories(address string, answers map[string][]*electrum.Transaction, servers map[string]string, policy QuorumPolicy) ([]*electrum.Transaction, []Disagreement) {
+	heights := map[string]map[string]int64{} // tx hash => server => height
+	order := []string{}                      // tx hashes, in the order we first saw them
+	hosts := []string{}
+	for host := range answers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		for _, tx := range answers[host] {
+			if _, exists := heights[tx.Hash]; !exists {
+				heights[tx.Hash] = map[string]int64{}
+				order = append(order, tx.Hash)
+			}
+			heights[tx.Hash][servers[host]] = int64(tx.Height)
+		}
+	}
+
+	txs := []*electrum.Transaction{}
+	disagreements := []Disagreement{}
+	for _, hash := range order {
+		reported := heights[hash]
+		height, votes := mostReportedHeight(reported)
+		keep := policy == QuorumUnion || len(reported)*2 > len(answers)
+		if keep {
+			txs = append(txs, &electrum.Transaction{Hash: hash, Height: int32(height)})
+		}
+		if len(reported) == len(answers) && votes == len(answers) {
+			continue
+		}
+		d := Disagreement{Address: address, TxHash: hash, Heights: reported, Missing: []string{}, Kept: keep}
+		for _, host := range hosts {
+			if _, exists := reported[servers[host]]; !exists {
+				d.Missing = append(d.Missing, servers[host])
+			}
+		}
+		disagreements = append(disagreements, d)
+	}
+	return txs, disagreements
+}
+
+// mostReportedHeight returns the height reported by most servers, and the number of servers which
+// reported it. Ties go to the lowest height at which the transaction is mined, or to 0 (in the
+// mempool) over -1 (in the mempool with unconfirmed parents).
+func mostReportedHeight(reported map[string]int64) (int64, int) {
+	counts := map[int64]int{}
+	for _, height := range reported {
+		counts[height]++
+	}
+	best, votes := int64(0), 0
+	for height, count := range counts {
+		better := count > votes
+		if count == votes {
+			if height > 0 {
+				better = best <= 0 || height < best
+			} else {
+				better = best <= 0 && height > best
+			}
+		}
+		if better {
+			best, votes = height, count
+		}
+	}
+	return best, votes
+}
@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/beancounter/backend/electrum"
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCombineHistories(t *testing.T) {
+	servers := map[string]string{"a": "a|t", "b": "b|t", "c": "c|t"}
+	answers := map[string][]*electrum.Transaction{
+		"a": {{Hash: "tx1", Height: 100}, {Hash: "tx2", Height: 200}},
+		"b": {{Hash: "tx1", Height: 100}, {Hash: "tx2", Height: 0}},
+		// c hides tx2 and reports tx3, which nobody else has
+		"c": {{Hash: "tx1", Height: 100}, {Hash: "tx3", Height: 300}},
+	}
+
+	txs, disagreements := combineHistories("addr", answers, servers, QuorumUnion)
+	assert.Equal(t, []*electrum.Transaction{
+		{Hash: "tx1", Height: 100},
+		{Hash: "tx2", Height: 200}, // tie between 200 and 0, the mined height wins
+		{Hash: "tx3", Height: 300},
+	}, txs)
+	assert.Equal(t, []Disagreement{
+		{Address: "addr", TxHash: "tx2", Heights: map[string]int64{"a|t": 200, "b|t": 0}, Missing: []string{"c|t"}, Kept: true},
+		{Address: "addr", TxHash: "tx3", Heights: map[string]int64{"c|t": 300}, Missing: []string{"a|t", "b|t"}, Kept: true},
+	}, disagreements)
+	assert.Equal(t, "addr: tx3 reported by c|t at 300, missing from [a|t, b|t] (kept)", disagreements[1].String())
+
+	txs, disagreements = combineHistories("addr", answers, servers, QuorumMajority)
+	assert.Equal(t, []*electrum.Transaction{
+		{Hash: "tx1", Height: 100},
+		{Hash: "tx2", Height: 200},
+	}, txs)
+	assert.Len(t, disagreements, 2)
+	assert.False(t, disagreements[1].Kept)
+}
+
+func TestMostReportedHeight(t *testing.T) {
+	height, votes := mostReportedHeight(map[string]int64{"a": 5, "b": 5, "c": 6})
+	assert.Equal(t, int64(5), height)
+	assert.Equal(t, 2, votes)
+
+	height, votes = mostReportedHeight(map[string]int64{"a": -1, "b": 7, "c": 6})
+	assert.Equal(t, int64(6), height)
+	assert.Equal(t, 1, votes)
+
+	height, _ = mostReportedHeight(map[string]int64{"a": -1, "b": 0})
+	assert.Equal(t, int64(0), height)
+}
+
+// quorumBackend returns a backend in quorum mode whose nodes answer with the given histories. A
+// nil history means the node never answers.
+func quorumBackend(k int, policy QuorumPolicy, histories map[string][]*electrum.Transaction) *ElectrumBackend {
+	eb := &ElectrumBackend{
+		nodeQueues:    make(map[string]*nodeQueue),
+		addrResponses: make(chan *AddrResponse, 1),
+		errors:        make(chan error, 1),
+		transactions:  make(map[string]int64),
+		doneCh:        make(chan bool),
+	}
+	if err := eb.SetQuorum(k, policy); err != nil {
+		panic(err)
+	}
+	for ident, txs := range histories {
+		queue := &nodeQueue{requests: make(chan *historyRequest), txs: make(chan string), gone: make(chan struct{})}
+		eb.nodeQueues[ident] = queue
+		go func(queue *nodeQueue, txs []*electrum.Transaction) {
+			for {
+				select {
+				case req := <-queue.requests:
+					if txs != nil {
+						req.result <- historyResult{txs: txs}
+					}
+				case <-eb.doneCh:
+					return
+				}
+			}
+		}(queue, txs)
+	}
+	return eb
+}
+
+func TestProcessQuorumRequest(t *testing.T) {
+	d, err := deriver.NewAddressDeriver(Testnet, []string{testTpub}, 1, "")
+	assert.NoError(t, err)
+	addr, err := d.Derive(0, 0)
+	assert.NoError(t, err)
+
+	// c hides tx2 and reports tx3, the majority drops tx3
+	eb := quorumBackend(3, QuorumMajority, map[string][]*electrum.Transaction{
+		"a|t": {{Hash: "tx1", Height: 100}, {Hash: "tx2", Height: 200}},
+		"b|t": {{Hash: "tx1", Height: 100}, {Hash: "tx2", Height: 200}},
+		"c|t": {{Hash: "tx1", Height: 100}, {Hash: "tx3", Height: 300}},
+	})
+	eb.processQuorumRequest(addr, time.Second)
+	resp := <-eb.addrResponses
+	assert.Equal(t, []string{"tx1", "tx2"}, resp.TxHashes)
+	assert.Equal(t, map[string]int64{"tx1": 100, "tx2": 200}, resp.TxHeights)
+	disagreements := eb.Disagreements()
+	assert.Len(t, disagreements, 2)
+	for _, d := range disagreements {
+		assert.Equal(t, d.TxHash == "tx2", d.Kept, "%s", d)
+	}
+	close(eb.doneCh)
+
+	// a tie between a mined height and the mempool goes to the mined height
+	eb = quorumBackend(2, QuorumMajority, map[string][]*electrum.Transaction{
+		"a|t": {{Hash: "tx1", Height: 100}},
+		"b|t": {{Hash: "tx1", Height: 0}},
+	})
+	eb.processQuorumRequest(addr, time.Second)
+	resp = <-eb.addrResponses
+	assert.Equal(t, map[string]int64{"tx1": 100}, resp.TxHeights)
+	assert.Equal(t, []Disagreement{{
+		Address: addr.String(),
+		TxHash:  "tx1",
+		Heights: map[string]int64{"a|t": 100, "b|t": 0},
+		Missing: []string{},
+		Kept:    true,
+	}}, eb.Disagreements())
+	close(eb.doneCh)
+
+	// a server which doesn't answer is skipped, the quorum can't be reached without it
+	eb = quorumBackend(2, QuorumUnion, map[string][]*electrum.Transaction{
+		"a|t":    {{Hash: "tx1", Height: 100}},
+		"slow|t": nil,
+	})
+	eb.processQuorumRequest(addr, 50*time.Millisecond)
+	err = <-eb.errors
+	assert.Contains(t, err.Error(), "quorum of 2 not reached, only 1 servers answered")
+	assert.Empty(t, eb.addrResponses)
+	close(eb.doneCh)
+
+	// with another server, the slow one is skipped
+	eb = quorumBackend(2, QuorumUnion, map[string][]*electrum.Transaction{
+		"a|t":    {{Hash: "tx1", Height: 100}},
+		"b|t":    {{Hash: "tx1", Height: 100}},
+		"slow|t": nil,
+	})
+	eb.processQuorumRequest(addr, 50*time.Millisecond)
+	resp = <-eb.addrResponses
+	assert.Equal(t, []string{"tx1"}, resp.TxHashes)
+	assert.Empty(t, eb.Disagreements())
+	close(eb.doneCh)
+}
+
+func TestRecorderForwardsServerReports(t *testing.T) {
+	eb := &ElectrumBackend{disagreements: []Disagreement{{Address: "addr", TxHash: "tx1"}}}
+	var r ServerReporter = &RecorderBackend{backend: eb}
+	assert.Equal(t, eb.Disagreements(), r.Disagreements())
+	assert.Nil(t, r.PrivacyExposure())
+
+	r = &RecorderBackend{backend: &FixtureBackend{}}
+	assert.Nil(t, r.Disagreements())
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -59,8 +60,8 @@ func NewRecorderBackend(b Backend, filepath string) (*RecorderBackend, error) {
 
 // AddrRequest schedules a request to the backend to lookup information related
 // to the given address.
-func (rb *RecorderBackend) AddrRequest(addr *deriver.Address) {
-	rb.backend.AddrRequest(addr)
+func (rb *RecorderBackend) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	return rb.backend.AddrRequest(ctx, addr)
 }
 
 // AddrResponses exposes a channel that allows to consume backend's responses to
@@ -71,8 +72,8 @@ func (rb *RecorderBackend) AddrResponses() <-chan *AddrResponse {
 
 // TxRequest schedules a request to the backend to lookup information related
 // to the given transaction hash.
-func (rb *RecorderBackend) TxRequest(txHash string) {
-	rb.backend.TxRequest(txHash)
+func (rb *RecorderBackend) TxRequest(ctx context.Context, txHash string) error {
+	return rb.backend.TxRequest(ctx, txHash)
 }
 
 // TxResponses exposes a channel that allows to consume backend's responses to
@@ -83,14 +84,19 @@ func (rb *RecorderBackend) TxResponses() <-chan *TxResponse {
 	return rb.txResponses
 }
 
-func (rb *RecorderBackend) BlockRequest(height uint32) {
-	rb.backend.BlockRequest(height)
+func (rb *RecorderBackend) BlockRequest(ctx context.Context, height uint32) error {
+	return rb.backend.BlockRequest(ctx, height)
 }
 
 func (rb *RecorderBackend) BlockResponses() <-chan *BlockResponse {
 	return rb.blockResponses
 }
 
+// Errors exposes the wrapped backend's errors. Failed requests aren't recorded.
+func (rb *RecorderBackend) Errors() <-chan error {
+	return rb.backend.Errors()
+}
+
 // Finish informs the backend to stop doing its work.
 func (rb *RecorderBackend) Finish() {
 	rb.backend.Finish()
@@ -105,6 +111,31 @@ func (rb *RecorderBackend) ChainHeight() uint32 {
 	return rb.backend.ChainHeight()
 }
 
+// BlockHeight looks up a block with the recorded backend, if it implements BlockFinder.
+func (rb *RecorderBackend) BlockHeight(ctx context.Context, hash string) (uint32, error) {
+	finder, ok := rb.backend.(BlockFinder)
+	if !ok {
+		return 0, fmt.Errorf("the recorded backend can't look up blocks by hash")
+	}
+	return finder.BlockHeight(ctx, hash)
+}
+
+// Disagreements returns the recorded backend's disagreements, if it implements ServerReporter.
+func (rb *RecorderBackend) Disagreements() []Disagreement {
+	if r, ok := rb.backend.(ServerReporter); ok {
+		return r.Disagreements()
+	}
+	return nil
+}
+
+// PrivacyExposure returns the recorded backend's exposure, if it implements ServerReporter.
+func (rb *RecorderBackend) PrivacyExposure() []Exposure {
+	if r, ok := rb.backend.(ServerReporter); ok {
+		return r.PrivacyExposure()
+	}
+	return nil
+}
+
 func (rb *RecorderBackend) processRequests() {
 	backendAddrResponses := rb.backend.AddrResponses()
 	backendTxResponses := rb.backend.TxResponses()
@@ -120,7 +151,11 @@ func (rb *RecorderBackend) processRequests() {
 			rb.addrIndexMu.Lock()
 			rb.addrIndex[addrResp.Address.String()] = *addrResp
 			rb.addrIndexMu.Unlock()
-			rb.addrResponses <- addrResp
+			select {
+			case rb.addrResponses <- addrResp:
+			case <-rb.doneCh:
+				return
+			}
 		case txResp, ok := <-backendTxResponses:
 			if !ok {
 				backendTxResponses = nil
@@ -129,7 +164,11 @@ func (rb *RecorderBackend) processRequests() {
 			rb.txIndexMu.Lock()
 			rb.txIndex[txResp.Hash] = *txResp
 			rb.txIndexMu.Unlock()
-			rb.txResponses <- txResp
+			select {
+			case rb.txResponses <- txResp:
+			case <-rb.doneCh:
+				return
+			}
 		case block, ok := <-backendBlockResponses:
 			if !ok {
 				backendBlockResponses = nil
@@ -138,7 +177,11 @@ func (rb *RecorderBackend) processRequests() {
 			rb.blockIndexMu.Lock()
 			rb.blockIndex[block.Height] = *block
 			rb.blockIndexMu.Unlock()
-			rb.blockResponses <- block
+			select {
+			case rb.blockResponses <- block:
+			case <-rb.doneCh:
+				return
+			}
 		case <-rb.doneCh:
 			return
 		}
@@ -187,6 +230,7 @@ func (rb *RecorderBackend) writeToFile() error {
 	for _, b := range rb.blockIndex {
 		cachedData.Blocks = append(cachedData.Blocks, block{
 			Height:    b.Height,
+			Hash:      b.Hash,
 			Timestamp: b.Timestamp,
 		})
 	}
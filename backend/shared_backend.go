@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/square/beancounter/deriver"
+)
+
+// SharedBackend lets several Accounters use a single Backend at the same time. Each Accounter
+// gets its own client (see NewClient), which implements Backend and only sees the responses to
+// its own requests.
+//
+// Transactions are only fetched once: concurrent requests for the same transaction are merged
+// and responses are cached for the clients which ask for it later. Address and block requests are
+// merged while they are in flight but aren't cached.
+//
+// A failed request is only reported to the clients which made it (see Error), so one wallet's
+// failure doesn't abort the other wallets.
+//
+// Calling Finish() on a client only detaches the client. SharedBackend.Finish() tears down the
+// wrapped backend.
+type SharedBackend struct {
+	backend Backend
+
+	mu        sync.Mutex // protects the maps and clients
+	addrs     map[string][]*sharedRequest
+	txs       map[string][]*sharedClient
+	txCache   map[string]*TxResponse
+	blocks    map[uint32][]*sharedClient
+	clients   map[*sharedClient]struct{}
+	txFetches int // number of transactions requested from the wrapped backend
+
+	doneCh     chan bool
+	finishOnce sync.Once
+}
+
+// sharedRequest is a pending address request. The response is sent back with the address the
+// client requested, since the wrapped backend may return a different (but equal) address.
+type sharedRequest struct {
+	client *sharedClient
+	addr   *deriver.Address
+}
+
+// sharedClient is the view of a SharedBackend given to a single Accounter.
+type sharedClient struct {
+	shared *SharedBackend
+
+	addrResponses  chan *AddrResponse
+	txResponses    chan *TxResponse
+	blockResponses chan *BlockResponse
+	errors         chan error
+
+	doneCh     chan bool
+	finishOnce sync.Once
+}
+
+// NewSharedBackend wraps b. The SharedBackend consumes b's responses, b must not be used
+// directly anymore.
+func NewSharedBackend(b Backend) *SharedBackend {
+	sb := &SharedBackend{
+		backend: b,
+		addrs:   make(map[string][]*sharedRequest),
+		txs:     make(map[string][]*sharedClient),
+		txCache: make(map[string]*TxResponse),
+		blocks:  make(map[uint32][]*sharedClient),
+		clients: make(map[*sharedClient]struct{}),
+		doneCh:  make(chan bool),
+	}
+	go sb.processResponses()
+	return sb
+}
+
+// NewClient returns a Backend which forwards its requests to the shared backend.
+func (sb *SharedBackend) NewClient() Backend {
+	c := &sharedClient{
+		shared:         sb,
+		addrResponses:  make(chan *AddrResponse, addrRequestsChanSize),
+		txResponses:    make(chan *TxResponse, 2*maxTxsPerAddr),
+		blockResponses: make(chan *BlockResponse, blockRequestChanSize),
+		errors:         make(chan error, 1),
+		doneCh:         make(chan bool),
+	}
+	sb.mu.Lock()
+	sb.clients[c] = struct{}{}
+	sb.mu.Unlock()
+	return c
+}
+
+// TxFetches returns the number of transactions which were requested from the wrapped backend.
+func (sb *SharedBackend) TxFetches() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.txFetches
+}
+
+// ChainHeight returns the wrapped backend's chain height.
+func (sb *SharedBackend) ChainHeight() uint32 {
+	return sb.backend.ChainHeight()
+}
+
+// Finish tears down the wrapped backend. The clients stop receiving responses.
+func (sb *SharedBackend) Finish() {
+	sb.finishOnce.Do(func() {
+		close(sb.doneCh)
+		sb.backend.Finish()
+	})
+}
+
+func (sb *SharedBackend) addrRequest(ctx context.Context, c *sharedClient, addr *deriver.Address) error {
+	key := addr.String()
+	sb.mu.Lock()
+	pending, inFlight := sb.addrs[key]
+	sb.addrs[key] = append(pending, &sharedRequest{client: c, addr: addr})
+	sb.mu.Unlock()
+
+	if inFlight {
+		return nil
+	}
+	if err := sb.backend.AddrRequest(ctx, addr); err != nil {
+		sb.mu.Lock()
+		delete(sb.addrs, key)
+		sb.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (sb *SharedBackend) txRequest(ctx context.Context, c *sharedClient, txHash string) error {
+	sb.mu.Lock()
+	if resp, exists := sb.txCache[txHash]; exists {
+		sb.mu.Unlock()
+		return c.sendTxResponse(ctx, resp)
+	}
+	waiting, inFlight := sb.txs[txHash]
+	sb.txs[txHash] = append(waiting, c)
+	if !inFlight {
+		sb.txFetches++
+	}
+	sb.mu.Unlock()
+
+	if inFlight {
+		return nil
+	}
+	if err := sb.backend.TxRequest(ctx, txHash); err != nil {
+		sb.mu.Lock()
+		delete(sb.txs, txHash)
+		sb.txFetches--
+		sb.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (sb *SharedBackend) blockRequest(ctx context.Context, c *sharedClient, height uint32) error {
+	sb.mu.Lock()
+	waiting, inFlight := sb.blocks[height]
+	sb.blocks[height] = append(waiting, c)
+	sb.mu.Unlock()
+
+	if inFlight {
+		return nil
+	}
+	if err := sb.backend.BlockRequest(ctx, height); err != nil {
+		sb.mu.Lock()
+		delete(sb.blocks, height)
+		sb.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// processResponses routes the wrapped backend's responses to the clients which are waiting for
+// them.
+func (sb *SharedBackend) processResponses() {
+	addrResponses := sb.backend.AddrResponses()
+	txResponses := sb.backend.TxResponses()
+	blockResponses := sb.backend.BlockResponses()
+	errs := sb.backend.Errors()
+
+	for {
+		select {
+		case resp, ok := <-addrResponses:
+			if !ok {
+				addrResponses = nil
+				continue
+			}
+			key := resp.Address.String()
+			sb.mu.Lock()
+			pending := sb.addrs[key]
+			delete(sb.addrs, key)
+			sb.mu.Unlock()
+			for _, req := range pending {
+				req.client.forwardAddrResponse(&AddrResponse{Address: req.addr, TxHashes: resp.TxHashes, TxHeights: resp.TxHeights})
+			}
+		case resp, ok := <-txResponses:
+			if !ok {
+				txResponses = nil
+				continue
+			}
+			sb.mu.Lock()
+			sb.txCache[resp.Hash] = resp
+			waiting := sb.txs[resp.Hash]
+			delete(sb.txs, resp.Hash)
+			sb.mu.Unlock()
+			for _, c := range waiting {
+				c.forwardTxResponse(resp)
+			}
+		case resp, ok := <-blockResponses:
+			if !ok {
+				blockResponses = nil
+				continue
+			}
+			sb.mu.Lock()
+			waiting := sb.blocks[resp.Height]
+			delete(sb.blocks, resp.Height)
+			sb.mu.Unlock()
+			for _, c := range waiting {
+				c.forwardBlockResponse(resp)
+			}
+		case err := <-errs:
+			for _, c := range sb.errorClients(err) {
+				select {
+				case c.errors <- err:
+				default:
+				}
+			}
+		case <-sb.doneCh:
+			return
+		}
+	}
+}
+
+// errorClients returns the clients waiting for the request which failed, and forgets the request.
+// Errors which don't name a pending request are sent to every client.
+func (sb *SharedBackend) errorClients(err error) []*sharedClient {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	var berr *Error
+	if errors.As(err, &berr) {
+		if pending, exists := sb.addrs[berr.Request]; exists {
+			delete(sb.addrs, berr.Request)
+			clients := make([]*sharedClient, 0, len(pending))
+			for _, req := range pending {
+				clients = append(clients, req.client)
+			}
+			return clients
+		}
+		if waiting, exists := sb.txs[berr.Request]; exists {
+			delete(sb.txs, berr.Request)
+			return waiting
+		}
+		var height uint32
+		if _, scanErr := fmt.Sscanf(berr.Request, "block %d", &height); scanErr == nil {
+			if waiting, exists := sb.blocks[height]; exists {
+				delete(sb.blocks, height)
+				return waiting
+			}
+		}
+	}
+
+	clients := make([]*sharedClient, 0, len(sb.clients))
+	for c := range sb.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (c *sharedClient) ChainHeight() uint32 {
+	return c.shared.ChainHeight()
+}
+
+func (c *sharedClient) AddrRequest(ctx context.Context, addr *deriver.Address) error {
+	return c.shared.addrRequest(ctx, c, addr)
+}
+
+func (c *sharedClient) AddrResponses() <-chan *AddrResponse {
+	return c.addrResponses
+}
+
+func (c *sharedClient) TxRequest(ctx context.Context, txHash string) error {
+	return c.shared.txRequest(ctx, c, txHash)
+}
+
+func (c *sharedClient) TxResponses() <-chan *TxResponse {
+	return c.txResponses
+}
+
+func (c *sharedClient) BlockRequest(ctx context.Context, height uint32) error {
+	return c.shared.blockRequest(ctx, c, height)
+}
+
+func (c *sharedClient) BlockResponses() <-chan *BlockResponse {
+	return c.blockResponses
+}
+
+func (c *sharedClient) Errors() <-chan error {
+	return c.errors
+}
+
+// Finish detaches the client. Responses to its pending requests are dropped.
+func (c *sharedClient) Finish() {
+	c.finishOnce.Do(func() {
+		c.shared.mu.Lock()
+		delete(c.shared.clients, c)
+		c.shared.mu.Unlock()
+		close(c.doneCh)
+	})
+}
+
+// sendTxResponse is used to answer a request from the cache.
+func (c *sharedClient) sendTxResponse(ctx context.Context, resp *TxResponse) error {
+	select {
+	case c.txResponses <- resp:
+		return nil
+	case <-c.doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *sharedClient) forwardAddrResponse(resp *AddrResponse) {
+	select {
+	case c.addrResponses <- resp:
+	case <-c.doneCh:
+	case <-c.shared.doneCh:
+	}
+}
+
+func (c *sharedClient) forwardTxResponse(resp *TxResponse) {
+	select {
+	case c.txResponses <- resp:
+	case <-c.doneCh:
+	case <-c.shared.doneCh:
+	}
+}
+
+func (c *sharedClient) forwardBlockResponse(resp *BlockResponse) {
+	select {
+	case c.blockResponses <- resp:
+	case <-c.doneCh:
+	case <-c.shared.doneCh:
+	}
+}
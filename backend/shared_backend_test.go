@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/square/beancounter/deriver"
+	. "github.com/square/beancounter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedBackendDedupsTransactions(t *testing.T) {
+	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+	sb := NewSharedBackend(b)
+	defer sb.Finish()
+
+	c1 := sb.NewClient()
+	c2 := sb.NewClient()
+
+	hash := "5554c15d13002786a70a7151aad4eddce76633c60bc7f90e3dc70eb4f9c4b2b0"
+	assert.NoError(t, c1.TxRequest(context.Background(), hash))
+	assert.NoError(t, c2.TxRequest(context.Background(), hash))
+
+	for _, c := range []Backend{c1, c2} {
+		select {
+		case resp := <-c.TxResponses():
+			assert.Equal(t, hash, resp.Hash)
+		case <-time.After(time.Second):
+			t.Fatal("expected a transaction response")
+		}
+	}
+
+	// a later request is answered from the cache
+	assert.NoError(t, c1.TxRequest(context.Background(), hash))
+	resp := <-c1.TxResponses()
+	assert.Equal(t, hash, resp.Hash)
+
+	assert.Equal(t, 1, sb.TxFetches())
+}
+
+func TestSharedBackendRoutesAddresses(t *testing.T) {
+	b, err := NewFixtureBackend("../accounter/testdata/tpub_data.json")
+	assert.NoError(t, err)
+	sb := NewSharedBackend(b)
+	defer sb.Finish()
+
+	c1 := sb.NewClient()
+	c2 := sb.NewClient()
+
+	addr1 := deriver.NewAddress("m/1'/1/0/1", "ADDRESS_1", Testnet, 0, 1)
+	addr2 := deriver.NewAddress("m/1'/1/0/2", "ADDRESS_2", Testnet, 0, 2)
+	assert.NoError(t, c1.AddrRequest(context.Background(), addr1))
+	assert.NoError(t, c2.AddrRequest(context.Background(), addr2))
+
+	resp := <-c1.AddrResponses()
+	assert.Equal(t, addr1, resp.Address)
+	resp = <-c2.AddrResponses()
+	assert.Equal(t, addr2, resp.Address)
+
+	// detached clients don't get anything
+	c1.Finish()
+	assert.NoError(t, c2.AddrRequest(context.Background(), addr1))
+	resp = <-c2.AddrResponses()
+	assert.Equal(t, addr1, resp.Address)
+	assert.Len(t, c1.AddrResponses(), 0)
+}
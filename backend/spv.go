@@ -0,0 +1,218 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Simplified Payment Verification (SPV): instead of trusting the server's claim that a transaction
+// was mined at a given height, we ask for a merkle proof and check that it links the transaction to
+// the merkle root of the block header at that height. The header itself must have a valid proof
+// of work.
+//
+// The proofs come in two shapes:
+// - Electrum returns the transaction's position and the merkle branch (the sibling hashes from the
+//   leaf to the root).
+// - Btcd (or bitcoind) returns a serialized merkleblock message, i.e. a header and a partial merkle
+//   tree.
+
+// ProofError is reported when a transaction's merkle proof doesn't match the block header at the
+// transaction's height.
+type ProofError struct {
+	TxHash string
+	Height int64
+	Reason string
+}
+
+func (e *ProofError) Error() string {
+	return fmt.Sprintf("transaction %s failed SPV verification at height %d: %s", e.TxHash, e.Height, e.Reason)
+}
+
+// checkProofOfWork returns an error if the header's hash is above the target encoded in its bits.
+func checkProofOfWork(header *wire.BlockHeader) error {
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("block %s has an invalid target", header.BlockHash())
+	}
+	hash := header.BlockHash()
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("block %s doesn't satisfy its proof of work", hash)
+	}
+	return nil
+}
+
+// checkPowLimit returns an error if the header's target is easier than the network allows.
+func checkPowLimit(header *wire.BlockHeader, params *chaincfg.Params) error {
+	if blockchain.CompactToBig(header.Bits).Cmp(params.PowLimit) > 0 {
+		return fmt.Errorf("block %s has a target above the proof of work limit", header.BlockHash())
+	}
+	return nil
+}
+
+// merkleBranchRoot computes the merkle root from a transaction hash, its position in the block and
+// the merkle branch. The hashes are hex encoded, in the usual (byte-reversed) order.
+func merkleBranchRoot(txHash string, pos int, branch []string) (*chainhash.Hash, error) {
+	// each level of the branch consumes one bit of the position.
+	if pos < 0 || pos>>uint(len(branch)) != 0 {
+		return nil, fmt.Errorf("position %d doesn't fit a merkle branch of length %d", pos, len(branch))
+	}
+	h, err := chainhash.NewHashFromStr(txHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range branch {
+		sibling, err := chainhash.NewHashFromStr(s)
+		if err != nil {
+			return nil, err
+		}
+		if pos&1 == 1 {
+			h = hashMerkleBranches(sibling, h)
+		} else {
+			h = hashMerkleBranches(h, sibling)
+		}
+		pos >>= 1
+	}
+	return h, nil
+}
+
+func hashMerkleBranches(left, right *chainhash.Hash) *chainhash.Hash {
+	var b [chainhash.HashSize * 2]byte
+	copy(b[:chainhash.HashSize], left[:])
+	copy(b[chainhash.HashSize:], right[:])
+	h := chainhash.DoubleHashH(b[:])
+	return &h
+}
+
+// verifyMerkleBranch checks an Electrum style proof against a header.
+func verifyMerkleBranch(txHash string, height int64, pos int, branch []string, header *wire.BlockHeader) error {
+	if err := checkProofOfWork(header); err != nil {
+		return &ProofError{TxHash: txHash, Height: height, Reason: err.Error()}
+	}
+	root, err := merkleBranchRoot(txHash, pos, branch)
+	if err != nil {
+		return &ProofError{TxHash: txHash, Height: height, Reason: err.Error()}
+	}
+	if !root.IsEqual(&header.MerkleRoot) {
+		return &ProofError{TxHash: txHash, Height: height,
+			Reason: fmt.Sprintf("merkle root %s != %s", root, header.MerkleRoot)}
+	}
+	return nil
+}
+
+// verifyMerkleBlock checks a btcd/bitcoind style proof (i.e. the result of gettxoutproof). The
+// merkleblock's header must be the one at the transaction's height, which the caller passes as
+// blockHash.
+func verifyMerkleBlock(txHash string, height int64, mb *wire.MsgMerkleBlock, blockHash string) error {
+	fail := func(format string, args ...interface{}) error {
+		return &ProofError{TxHash: txHash, Height: height, Reason: fmt.Sprintf(format, args...)}
+	}
+	if hash := mb.Header.BlockHash(); hash.String() != blockHash {
+		return fail("proof is for block %s, expecting %s", hash, blockHash)
+	}
+	if err := checkProofOfWork(&mb.Header); err != nil {
+		return fail("%s", err)
+	}
+
+	root, matches, err := partialMerkleRoot(mb)
+	if err != nil {
+		return fail("%s", err)
+	}
+	if !root.IsEqual(&mb.Header.MerkleRoot) {
+		return fail("merkle root %s != %s", root, mb.Header.MerkleRoot)
+	}
+	for _, m := range matches {
+		if m.String() == txHash {
+			return nil
+		}
+	}
+	return fail("transaction isn't part of the proof")
+}
+
+// decodeTxOutProof decodes the result of gettxoutproof, a hex encoded merkleblock message.
+func decodeTxOutProof(result json.RawMessage, txHash string, height int64) (*wire.MsgMerkleBlock, error) {
+	var proof string
+	if err := json.Unmarshal(result, &proof); err != nil {
+		return nil, fmt.Errorf("invalid merkle proof for %s: %s", txHash, err)
+	}
+	raw, err := hex.DecodeString(proof)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merkle proof for %s: %s", txHash, err)
+	}
+	var mb wire.MsgMerkleBlock
+	if err := mb.BtcDecode(bytes.NewReader(raw), wire.ProtocolVersion, wire.BaseEncoding); err != nil {
+		return nil, &ProofError{TxHash: txHash, Height: height, Reason: err.Error()}
+	}
+	return &mb, nil
+}
+
+// partialMerkleRoot walks a partial merkle tree (BIP 37) depth first and returns its root along
+// with the matched transaction hashes.
+func partialMerkleRoot(mb *wire.MsgMerkleBlock) (*chainhash.Hash, []*chainhash.Hash, error) {
+	n := mb.Transactions
+	if n == 0 {
+		return nil, nil, fmt.Errorf("merkleblock has no transactions")
+	}
+	height := uint(0)
+	for treeWidth(n, height) > 1 {
+		height++
+	}
+
+	var bitsUsed, hashesUsed int
+	var matches []*chainhash.Hash
+	var traverse func(height, pos uint) (*chainhash.Hash, error)
+	traverse = func(height, pos uint) (*chainhash.Hash, error) {
+		if bitsUsed >= len(mb.Flags)*8 {
+			return nil, fmt.Errorf("merkleblock ran out of flag bits")
+		}
+		parentOfMatch := mb.Flags[bitsUsed/8]&(1<<(uint(bitsUsed)%8)) != 0
+		bitsUsed++
+		if height == 0 || !parentOfMatch {
+			if hashesUsed >= len(mb.Hashes) {
+				return nil, fmt.Errorf("merkleblock ran out of hashes")
+			}
+			h := mb.Hashes[hashesUsed]
+			hashesUsed++
+			if height == 0 && parentOfMatch {
+				matches = append(matches, h)
+			}
+			return h, nil
+		}
+		left, err := traverse(height-1, pos*2)
+		if err != nil {
+			return nil, err
+		}
+		right := left
+		if pos*2+1 < treeWidth(n, height-1) {
+			right, err = traverse(height-1, pos*2+1)
+			if err != nil {
+				return nil, err
+			}
+			if right.IsEqual(left) {
+				// CVE-2012-2459
+				return nil, fmt.Errorf("merkleblock has duplicate nodes")
+			}
+		}
+		return hashMerkleBranches(left, right), nil
+	}
+
+	root, err := traverse(height, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hashesUsed != len(mb.Hashes) {
+		return nil, nil, fmt.Errorf("merkleblock has unused hashes")
+	}
+	return root, matches, nil
+}
+
+// treeWidth returns the number of nodes at a given height of a merkle tree with n leaves.
+func treeWidth(n uint32, height uint) uint {
+	return (uint(n) + (1 << height) - 1) >> height
+}
@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/bloom"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlock builds a block with n transactions and a regtest difficulty, so it's cheap to mine.
+func testBlock(n int) *btcutil.Block {
+	msg := &wire.MsgBlock{Header: wire.BlockHeader{Version: 1, Bits: 0x207fffff}}
+	for i := 0; i < n; i++ {
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: uint32(i)}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(i), nil))
+		msg.AddTransaction(tx)
+	}
+	block := btcutil.NewBlock(msg)
+	merkles := blockchain.BuildMerkleTreeStore(block.Transactions(), false)
+	msg.Header.MerkleRoot = *merkles[len(merkles)-1]
+	for checkProofOfWork(&msg.Header) != nil {
+		msg.Header.Nonce++
+	}
+	return btcutil.NewBlock(msg)
+}
+
+// merkleBranch extracts the branch of the i-th transaction, the way Electrum returns it.
+func merkleBranch(block *btcutil.Block, i int) []string {
+	merkles := blockchain.BuildMerkleTreeStore(block.Transactions(), false)
+	branch := []string{}
+	// the store is padded to a power of two, missing nodes are nil.
+	width := 1
+	for width < len(block.Transactions()) {
+		width <<= 1
+	}
+	for offset := 0; width > 1; offset, width, i = offset+width, width/2, i/2 {
+		sibling := merkles[offset+(i^1)]
+		if sibling == nil {
+			sibling = merkles[offset+i]
+		}
+		branch = append(branch, sibling.String())
+	}
+	return branch
+}
+
+func TestVerifyMerkleBranch(t *testing.T) {
+	block := testBlock(5)
+	header := &block.MsgBlock().Header
+	for i, tx := range block.Transactions() {
+		assert.NoError(t, verifyMerkleBranch(tx.Hash().String(), 100, i, merkleBranch(block, i), header))
+	}
+
+	// wrong position
+	tx := block.Transactions()[2]
+	err := verifyMerkleBranch(tx.Hash().String(), 100, 3, merkleBranch(block, 2), header)
+	assert.IsType(t, &ProofError{}, err)
+
+	// position that doesn't fit the branch
+	_, err = merkleBranchRoot(tx.Hash().String(), 1<<uint(len(merkleBranch(block, 2))), merkleBranch(block, 2))
+	assert.Error(t, err)
+	_, err = merkleBranchRoot(tx.Hash().String(), -1, merkleBranch(block, 2))
+	assert.Error(t, err)
+	err = verifyMerkleBranch(tx.Hash().String(), 100, 2, nil, header)
+	assert.IsType(t, &ProofError{}, err)
+
+	// transaction from another block
+	other := testBlock(6).Transactions()[5]
+	err = verifyMerkleBranch(other.Hash().String(), 100, 2, merkleBranch(block, 2), header)
+	assert.IsType(t, &ProofError{}, err)
+
+	// header without proof of work
+	bad := *header
+	bad.Bits = 0x1d00ffff
+	err = verifyMerkleBranch(tx.Hash().String(), 100, 2, merkleBranch(block, 2), &bad)
+	assert.IsType(t, &ProofError{}, err)
+}
+
+func TestVerifyMerkleBlock(t *testing.T) {
+	block := testBlock(7)
+	tx := block.Transactions()[4]
+	blockHash := block.Hash().String()
+
+	filter := bloom.NewFilter(1, 0, 0.0001, wire.BloomUpdateNone)
+	filter.AddHash(tx.Hash())
+	mb, matched := bloom.NewMerkleBlock(block, filter)
+	assert.Equal(t, []uint32{4}, matched)
+	assert.NoError(t, verifyMerkleBlock(tx.Hash().String(), 100, mb, blockHash))
+
+	// the proof doesn't include other transactions
+	err := verifyMerkleBlock(block.Transactions()[3].Hash().String(), 100, mb, blockHash)
+	assert.IsType(t, &ProofError{}, err)
+
+	// the proof is for another block
+	err = verifyMerkleBlock(tx.Hash().String(), 100, mb, chainhash.Hash{}.String())
+	assert.IsType(t, &ProofError{}, err)
+
+	// tampered hashes
+	mb.Hashes[0] = &chainhash.Hash{}
+	err = verifyMerkleBlock(tx.Hash().String(), 100, mb, blockHash)
+	assert.IsType(t, &ProofError{}, err)
+}
+
+func TestCheckPowLimit(t *testing.T) {
+	header := &testBlock(1).MsgBlock().Header
+	assert.NoError(t, checkPowLimit(header, &chaincfg.RegressionNetParams))
+	assert.Error(t, checkPowLimit(header, &chaincfg.TestNet3Params))
+	assert.Error(t, checkPowLimit(header, &chaincfg.MainNetParams))
+	assert.NoError(t, checkPowLimit(&chaincfg.MainNetParams.GenesisBlock.Header, &chaincfg.MainNetParams))
+}
@@ -1,6 +1,8 @@
 package blockfinder
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/square/beancounter/backend"
 	"sort"
@@ -25,25 +27,41 @@ func New(b backend.Backend) *Blockfinder {
 	return bf
 }
 
+// ErrNonMonotonicMedians is returned when the block medians don't increase with the height. This
+// can only happen if the backend returns bogus timestamps.
+var ErrNonMonotonicMedians = errors.New("non-monotonic medians")
+
 // Returns block height, block median, block timestamp
-func (bf *Blockfinder) Search(timestamp time.Time) (uint32, time.Time, time.Time) {
+func (bf *Blockfinder) Search(ctx context.Context, timestamp time.Time) (uint32, time.Time, time.Time, error) {
+	// Give recorder backend a chance to write the data
+	defer bf.backend.Finish()
+
 	target := timestamp.Unix()
 
 	min := uint32(10) // any small number above 5 works
-	minMedian := bf.searchSync(min)
+	minMedian, err := bf.searchSync(ctx, min)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
 
 	// Use chainheight - 6 (because of min confirmations) - 5 (because of the way we compute median)
 	max := bf.backend.ChainHeight() - 11
-	maxMedian := bf.searchSync(max)
+	maxMedian, err := bf.searchSync(ctx, max)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
 
 	for max-min > 1 {
 		avg := (max + min) / 2
-		avgTimestamp := bf.searchSync(avg)
+		avgTimestamp, err := bf.searchSync(ctx, avg)
+		if err != nil {
+			return 0, time.Time{}, time.Time{}, err
+		}
 		fmt.Printf("min: %d %d, avg: %d %d, max: %d %d, target: %d\n",
 			min, minMedian, avg, avgTimestamp, max, maxMedian, target)
 
 		if avgTimestamp < minMedian || avgTimestamp > maxMedian {
-			panic("non-monotonic medians")
+			return 0, time.Time{}, time.Time{}, ErrNonMonotonicMedians
 		}
 
 		if target == avgTimestamp {
@@ -59,13 +77,15 @@ func (bf *Blockfinder) Search(timestamp time.Time) (uint32, time.Time, time.Time
 		}
 	}
 
-	bf.backend.BlockRequest(min)
-	blockHeader := <-bf.blockResponses
-
-	// Give recorder backend a chance to write the data
-	bf.backend.Finish()
+	if err := bf.backend.BlockRequest(ctx, min); err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	blockHeader, err := bf.recv(ctx)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
 
-	return min, time.Unix(minMedian, 0), blockHeader.Timestamp
+	return min, time.Unix(minMedian, 0), blockHeader.Timestamp, nil
 }
 
 // TODO: cache requests
@@ -77,15 +97,32 @@ func (bf *Blockfinder) Search(timestamp time.Time) (uint32, time.Time, time.Time
 // at the previous 5 and next 5, we reduce the delta between the block time displayed on a website
 // such as live.blockcypher.com and the median we compute. It makes things less confusing for people
 // who might not understand why we need to look at the median.
-func (bf *Blockfinder) searchSync(height uint32) int64 {
+func (bf *Blockfinder) searchSync(ctx context.Context, height uint32) (int64, error) {
 	for i := height - 5; i <= (height + 5); i++ {
-		bf.backend.BlockRequest(i)
+		if err := bf.backend.BlockRequest(ctx, i); err != nil {
+			return 0, err
+		}
 	}
 	timestamps := []int64{}
 	for i := 0; i < 11; i++ {
-		blockHeader := <-bf.blockResponses
+		blockHeader, err := bf.recv(ctx)
+		if err != nil {
+			return 0, err
+		}
 		timestamps = append(timestamps, blockHeader.Timestamp.Unix())
 	}
 	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
-	return timestamps[5]
+	return timestamps[5], nil
+}
+
+// recv waits for the next block response, or for the backend to report an error.
+func (bf *Blockfinder) recv(ctx context.Context) (*backend.BlockResponse, error) {
+	select {
+	case blockHeader := <-bf.blockResponses:
+		return blockHeader, nil
+	case err := <-bf.backend.Errors():
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
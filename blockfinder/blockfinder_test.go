@@ -1,6 +1,7 @@
 package blockfinder
 
 import (
+	"context"
 	"github.com/square/beancounter/backend"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -12,7 +13,8 @@ func TestFindBLock(t *testing.T) {
 	assert.NoError(t, err)
 
 	bf := New(b)
-	height, median, timestamp := bf.Search(time.Unix(1533153600, 0))
+	height, median, timestamp, err := bf.Search(context.Background(), time.Unix(1533153600, 0))
+	assert.NoError(t, err)
 
 	assert.Equal(t, height, uint32(534733))
 	assert.Equal(t, median.Unix(), int64(1533152846))
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"log"
 	"sort"
+	"strings"
 
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/pkg/errors"
 
 	. "github.com/square/beancounter/utils"
 )
@@ -21,7 +23,7 @@ import (
 // // https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki#serialization-format
 type AddressDeriver struct {
 	network       Network
-	xpubs         []string
+	keys          []*hdkeychain.ExtendedKey
 	m             int
 	singleAddress string
 }
@@ -67,38 +69,177 @@ func (a *Address) Network() Network {
 	return a.net
 }
 
-func (a *Address) Address() btcutil.Address {
+// Address decodes the address for the address' network.
+func (a *Address) Address() (btcutil.Address, error) {
 	address, err := btcutil.DecodeAddress(a.addr, a.net.ChainConfig())
 	if err != nil {
-		panic("failed to decode address")
+		return nil, errors.Wrapf(err, "failed to decode address %s", a.addr)
 	}
 
-	return address
+	return address, nil
 }
 
+// Script returns the hex encoded output script which pays to the address.
 // TODO: might be more efficient to store the script in the struct.
-func (a *Address) Script() string {
-	address := a.Address()
+func (a *Address) Script() (string, error) {
+	address, err := a.Address()
+	if err != nil {
+		return "", err
+	}
 	script, err := txscript.PayToAddrScript(address)
 	if err != nil {
-		panic("failed to encode script")
+		return "", errors.Wrapf(err, "failed to encode script for %s", a.addr)
 	}
-	return hex.EncodeToString(script)
+	return hex.EncodeToString(script), nil
 }
 
-// NewAddressDeriver returns a new instance of AddressDeriver
-func NewAddressDeriver(network Network, xpubs []string, m int, singleAddress string) *AddressDeriver {
-	return &AddressDeriver{
+// NewAddressDeriver returns a new instance of AddressDeriver. The extended public keys are parsed
+// upfront, so that bad input is rejected before we start deriving addresses.
+func NewAddressDeriver(network Network, xpubs []string, m int, singleAddress string) (*AddressDeriver, error) {
+	d := &AddressDeriver{
 		network:       network,
-		xpubs:         xpubs,
+		keys:          make([]*hdkeychain.ExtendedKey, 0, len(xpubs)),
 		m:             m,
 		singleAddress: singleAddress,
 	}
+	if singleAddress != "" {
+		if _, err := btcutil.DecodeAddress(singleAddress, network.ChainConfig()); err != nil {
+			return nil, errors.Wrapf(err, "invalid address %s", singleAddress)
+		}
+		return d, nil
+	}
+	for _, xpub := range xpubs {
+		key, err := hdkeychain.NewKeyFromString(xpub)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid extended public key %s", xpub)
+		}
+		d.keys = append(d.keys, key)
+	}
+	return d, nil
+}
+
+// Decoy returns a deriver with the same shape (number of keys and signatures) as d, but fresh
+// random keys which are thrown away. Its addresses look like the wallet's, so they can be mixed
+// with the wallet's addresses as decoys. A single address wallet gets a single key deriver for a
+// pay-to-pubkey-hash address, and a multisig deriver for a script hash address: all script hash
+// addresses look the same.
+func (d *AddressDeriver) Decoy() (*AddressDeriver, error) {
+	n, m := len(d.keys), d.m
+	if d.singleAddress != "" {
+		address, err := btcutil.DecodeAddress(d.singleAddress, d.network.ChainConfig())
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address %s", d.singleAddress)
+		}
+		switch address.(type) {
+		case *btcutil.AddressPubKeyHash:
+			n, m = 1, 1
+		case *btcutil.AddressScriptHash:
+			n, m = 2, 2
+		default:
+			return nil, errors.Errorf("decoys aren't supported for %s", d.singleAddress)
+		}
+	}
+	decoy := &AddressDeriver{network: d.network, keys: make([]*hdkeychain.ExtendedKey, 0, n), m: m}
+	for i := 0; i < n; i++ {
+		seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+		if err != nil {
+			return nil, err
+		}
+		master, err := hdkeychain.NewMaster(seed, d.network.ChainConfig())
+		if err != nil {
+			return nil, err
+		}
+		key, err := master.Neuter()
+		if err != nil {
+			return nil, err
+		}
+		decoy.keys = append(decoy.keys, key)
+	}
+	return decoy, nil
+}
+
+// IsSingleAddress returns true if the deriver always returns the same address. Such wallets don't
+// have separate receive and change addresses.
+func (d *AddressDeriver) IsSingleAddress() bool {
+	return d.singleAddress != ""
+}
+
+// Descriptors returns output script descriptors (see BIP 380) for the receive and change
+// addresses, with their checksums. Bitcoin Core uses them to watch the wallet. A single address
+// wallet has only one descriptor.
+func (d *AddressDeriver) Descriptors() []string {
+	if d.singleAddress != "" {
+		return []string{AddChecksum(fmt.Sprintf("addr(%s)", d.singleAddress))}
+	}
+	descriptors := []string{}
+	for change := 0; change <= 1; change++ {
+		keys := make([]string, 0, len(d.keys))
+		for _, key := range d.keys {
+			keys = append(keys, fmt.Sprintf("%s/%d/*", key.String(), change))
+		}
+		var desc string
+		if len(d.keys) == 1 {
+			desc = fmt.Sprintf("pkh(%s)", keys[0])
+		} else {
+			// the deriver sorts the public keys of each address, like sortedmulti.
+			desc = fmt.Sprintf("sh(wsh(sortedmulti(%d,%s)))", d.m, strings.Join(keys, ","))
+		}
+		descriptors = append(descriptors, AddChecksum(desc))
+	}
+	return descriptors
+}
+
+const (
+	descriptorInputCharset    = "0123456789()[],'/*abcdefgh@:$%{}IJKLMNOPQRSTUVWXYZ&+-.;<=>?!^_|~ijklmnopqrstuvwxyzABCDEFGH`#\"\\ "
+	descriptorChecksumCharset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// AddChecksum appends a descriptor's checksum, e.g. "raw(deadbeef)#89f8spxm".
+func AddChecksum(desc string) string {
+	polymod := func(c uint64, val uint64) uint64 {
+		c0 := c >> 35
+		c = ((c & 0x7ffffffff) << 5) ^ val
+		for i, g := range []uint64{0xf5dee51989, 0xa9fdca3312, 0x1bab10e32d, 0x3706b1677a, 0x644d626ffd} {
+			if c0&(1<<uint(i)) != 0 {
+				c ^= g
+			}
+		}
+		return c
+	}
+
+	c, cls, clsCount := uint64(1), uint64(0), 0
+	for _, ch := range desc {
+		pos := strings.IndexRune(descriptorInputCharset, ch)
+		if pos < 0 {
+			// not a valid descriptor, Bitcoin Core will reject it.
+			return desc
+		}
+		c = polymod(c, uint64(pos&31))
+		cls = cls*3 + uint64(pos>>5)
+		clsCount++
+		if clsCount == 3 {
+			c = polymod(c, cls)
+			cls, clsCount = 0, 0
+		}
+	}
+	if clsCount > 0 {
+		c = polymod(c, cls)
+	}
+	for i := 0; i < 8; i++ {
+		c = polymod(c, 0)
+	}
+	c ^= 1
+
+	checksum := make([]byte, 8)
+	for i := range checksum {
+		checksum[i] = descriptorChecksumCharset[(c>>(5*uint(7-i)))&31]
+	}
+	return desc + "#" + string(checksum)
 }
 
 // Derive dervives an address for given change and address index.
 // It supports derivation using single extended public key and multisig + segwit.
-func (d *AddressDeriver) Derive(change uint32, addressIndex uint32) *Address {
+func (d *AddressDeriver) Derive(change uint32, addressIndex uint32) (*Address, error) {
 	if d.singleAddress != "" {
 		return &Address{
 			path:      "n/a",
@@ -106,57 +247,67 @@ func (d *AddressDeriver) Derive(change uint32, addressIndex uint32) *Address {
 			net:       d.network,
 			change:    0,
 			addrIndex: 0,
-		}
+		}, nil
 	}
 
 	path := fmt.Sprintf("m/.../%d/%d", change, addressIndex)
 	addr := &Address{path: path, net: d.network, change: change, addrIndex: addressIndex}
-	if len(d.xpubs) == 1 {
-		addr.addr = d.singleDerive(change, addressIndex)
-		return addr
+	var err error
+	if len(d.keys) == 1 {
+		addr.addr, err = d.singleDerive(change, addressIndex)
+	} else {
+		addr.addr, err = d.multiSigSegwitDerive(change, addressIndex)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to derive %s", path)
 	}
-	addr.addr = d.multiSigSegwitDerive(change, addressIndex)
-	return addr
+	return addr, nil
 }
 
 // singleDerive performs a derivation using a single extended public key
-func (d *AddressDeriver) singleDerive(change uint32, addressIndex uint32) string {
-	key, err := hdkeychain.NewKeyFromString(d.xpubs[0])
-	PanicOnError(err)
-
-	key, err = key.Child(change)
-	PanicOnError(err)
+func (d *AddressDeriver) singleDerive(change uint32, addressIndex uint32) (string, error) {
+	key, err := d.keys[0].Child(change)
+	if err != nil {
+		return "", err
+	}
 
 	key, err = key.Child(addressIndex)
-	PanicOnError(err)
+	if err != nil {
+		return "", err
+	}
 
 	pubKey, err := key.Address(d.network.ChainConfig())
-	PanicOnError(err)
+	if err != nil {
+		return "", err
+	}
 
-	return pubKey.String()
+	return pubKey.String(), nil
 }
 
 // multiSigSegwitDerive performs a multisig + segwit derivation.
-func (d *AddressDeriver) multiSigSegwitDerive(change uint32, addressIndex uint32) string {
-	pubKeysBytes := make([][]byte, 0, len(d.xpubs))
-	pubKeys := make([]*btcutil.AddressPubKey, 0, len(d.xpubs))
-
-	for _, xpub := range d.xpubs {
-		key, err := hdkeychain.NewKeyFromString(xpub)
-		PanicOnError(err)
-
-		key, err = key.Child(change)
-		PanicOnError(err)
+func (d *AddressDeriver) multiSigSegwitDerive(change uint32, addressIndex uint32) (string, error) {
+	pubKeysBytes := make([][]byte, 0, len(d.keys))
+	pubKeys := make([]*btcutil.AddressPubKey, 0, len(d.keys))
+
+	for _, key := range d.keys {
+		key, err := key.Child(change)
+		if err != nil {
+			return "", err
+		}
 
 		key, err = key.Child(addressIndex)
-		PanicOnError(err)
+		if err != nil {
+			return "", err
+		}
 
 		pubKey, err := key.ECPubKey()
-		PanicOnError(err)
+		if err != nil {
+			return "", err
+		}
 
 		pubKeyBytes := pubKey.SerializeCompressed()
 		if len(pubKeyBytes) != 33 {
-			log.Panicf("expected pubkey length 33, got %d", len(pubKeyBytes))
+			return "", errors.Errorf("expected pubkey length 33, got %d", len(pubKeyBytes))
 		}
 
 		pubKeysBytes = append(pubKeysBytes, pubKeyBytes)
@@ -166,12 +317,16 @@ func (d *AddressDeriver) multiSigSegwitDerive(change uint32, addressIndex uint32
 
 	for _, pubKeyBytes := range pubKeysBytes {
 		key, err := btcutil.NewAddressPubKey(pubKeyBytes, d.network.ChainConfig())
-		PanicOnError(err)
+		if err != nil {
+			return "", err
+		}
 		pubKeys = append(pubKeys, key)
 	}
 
 	multiSigScript, err := txscript.MultiSigScript(pubKeys, d.m)
-	PanicOnError(err)
+	if err != nil {
+		return "", err
+	}
 
 	sha := sha256.Sum256(multiSigScript)
 
@@ -179,12 +334,16 @@ func (d *AddressDeriver) multiSigSegwitDerive(change uint32, addressIndex uint32
 	segWitScriptBuilder.AddOp(txscript.OP_0)
 	segWitScriptBuilder.AddData(sha[:])
 	segWitScript, err := segWitScriptBuilder.Script()
-	PanicOnError(err)
+	if err != nil {
+		return "", err
+	}
 
 	addrScriptHash, err := btcutil.NewAddressScriptHash(segWitScript, d.network.ChainConfig())
-	PanicOnError(err)
+	if err != nil {
+		return "", err
+	}
 
-	return addrScriptHash.EncodeAddress()
+	return addrScriptHash.EncodeAddress(), nil
 }
 
 // implement `Interface` in sort package.
@@ -8,14 +8,18 @@ import (
 )
 
 func TestAddress(t *testing.T) {
-	deriver := NewAddressDeriver(Mainnet, []string{"xpub6CjzRxucHWJbmtuNTg6EjPax3V75AhsBRnFKn8MEkc8UFFEhrCoWcQN6oUBhfZWoFKqTyQ21iNVK8KMbC44ifW25uyXaMPWkRtpwcbAWXJx"}, 1, "")
-	addr := deriver.Derive(0, 5)
+	deriver, err := NewAddressDeriver(Mainnet, []string{"xpub6CjzRxucHWJbmtuNTg6EjPax3V75AhsBRnFKn8MEkc8UFFEhrCoWcQN6oUBhfZWoFKqTyQ21iNVK8KMbC44ifW25uyXaMPWkRtpwcbAWXJx"}, 1, "")
+	assert.NoError(t, err)
+	addr, err := deriver.Derive(0, 5)
+	assert.NoError(t, err)
 	assert.Equal(t, addr.Path(), "m/.../0/5")
 	assert.Equal(t, addr.String(), "1N4VBTZqwLkHEKX79kjJ1WaYvX4c3txioz")
 	assert.Equal(t, addr.Change(), uint32(0))
 	assert.Equal(t, addr.Index(), uint32(5))
 	assert.Equal(t, addr.Network(), Mainnet)
-	assert.Equal(t, addr.Script(), "76a914e70369bfda4ba9bdcbb96cfd269a768573d0624c88ac")
+	script, err := addr.Script()
+	assert.NoError(t, err)
+	assert.Equal(t, script, "76a914e70369bfda4ba9bdcbb96cfd269a768573d0624c88ac")
 }
 
 func TestDeriveMultiSigSegwit(t *testing.T) {
@@ -25,15 +29,100 @@ func TestDeriveMultiSigSegwit(t *testing.T) {
 		"tpubDAaTEMnf9SPKJweLaptFdy3Vmyhim5DKQxXRbsCxmAaUp8F84YD5GhdfmABwLddjHTftSVvUPuSru6vJ3b5N2hBveiGmZNE5N5yvB6WZ96c",
 		"tpubDAXKYCetkje8HRRhAvUbAyuC5iF3SgfFWCVXfmrGCw3H9ExCYZVTEoeg7TjtDhgkS7TNHDRZUQNzGACWVzZCAYXy79vqku5z1geYmnsNLaa",
 	}
-	deriver := NewAddressDeriver(Testnet, xpubs, 2, "")
-	assert.Equal(t, "2N4TmnHspa8wqFEUfxfjzHoSUAgwoUwNWhr", deriver.Derive(0, 0).String())
+	deriver, err := NewAddressDeriver(Testnet, xpubs, 2, "")
+	assert.NoError(t, err)
+	addr, err := deriver.Derive(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "2N4TmnHspa8wqFEUfxfjzHoSUAgwoUwNWhr", addr.String())
 }
 
 func TestDeriveGateway(t *testing.T) {
 	xpubs := []string{
 		"tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh",
 	}
-	deriver := NewAddressDeriver(Testnet, xpubs, 1, "")
-	assert.Equal(t, "mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn", deriver.Derive(0, 0).String())
-	assert.Equal(t, "moHN13u4RoMxujdaPxvuaTaawgWZ3LaGyo", deriver.Derive(1, 0).String())
+	deriver, err := NewAddressDeriver(Testnet, xpubs, 1, "")
+	assert.NoError(t, err)
+	addr, err := deriver.Derive(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn", addr.String())
+	addr, err = deriver.Derive(1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "moHN13u4RoMxujdaPxvuaTaawgWZ3LaGyo", addr.String())
+}
+
+func TestInvalidInput(t *testing.T) {
+	_, err := NewAddressDeriver(Testnet, []string{"tpubfoobar"}, 1, "")
+	assert.Error(t, err)
+
+	_, err = NewAddressDeriver(Testnet, nil, 1, "mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn\n")
+	assert.Error(t, err)
+
+	addr := NewAddress("m/1'/1/0/1", "BAD_ADDRESS", Testnet, 0, 1)
+	_, err = addr.Script()
+	assert.Error(t, err)
+}
+
+func TestDescriptors(t *testing.T) {
+	// test vector from BIP 380
+	assert.Equal(t, "raw(deadbeef)#89f8spxm", AddChecksum("raw(deadbeef)"))
+
+	xpub := "tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"
+	deriver, err := NewAddressDeriver(Testnet, []string{xpub}, 1, "")
+	assert.NoError(t, err)
+	descriptors := deriver.Descriptors()
+	assert.Len(t, descriptors, 2)
+	assert.Equal(t, AddChecksum("pkh("+xpub+"/0/*)"), descriptors[0])
+	assert.Equal(t, AddChecksum("pkh("+xpub+"/1/*)"), descriptors[1])
+
+	xpubs := []string{
+		"tpubDAiPiLZeUdwo9oJiE9GZnteXj2E2MEMUb4knc4yCD87bL9siDgYcvrZSHZQZcYTyraL3fxVBRCcMiyfr3oQfH1wNo8J5i8aRAN56dDXaZxC",
+		"tpubDBYBpkSfvt9iVSfdX2ArZq1Q8bVSro3sotbJhdZCG9rgfjdr4aZp7g7AF1P9w95X5fzuJzdZAqYWWU7nb37c594wR22hPY5VpYziXUN2yez",
+	}
+	deriver, err = NewAddressDeriver(Testnet, xpubs, 2, "")
+	assert.NoError(t, err)
+	assert.Equal(t, AddChecksum("sh(wsh(sortedmulti(2,"+xpubs[0]+"/1/*,"+xpubs[1]+"/1/*)))"), deriver.Descriptors()[1])
+
+	deriver, err = NewAddressDeriver(Testnet, nil, 1, "mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{AddChecksum("addr(mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn)")}, deriver.Descriptors())
+}
+
+func TestDecoy(t *testing.T) {
+	xpubs := []string{
+		"tpubDAiPiLZeUdwo9oJiE9GZnteXj2E2MEMUb4knc4yCD87bL9siDgYcvrZSHZQZcYTyraL3fxVBRCcMiyfr3oQfH1wNo8J5i8aRAN56dDXaZxC",
+		"tpubDBYBpkSfvt9iVSfdX2ArZq1Q8bVSro3sotbJhdZCG9rgfjdr4aZp7g7AF1P9w95X5fzuJzdZAqYWWU7nb37c594wR22hPY5VpYziXUN2yez",
+	}
+	deriver, err := NewAddressDeriver(Testnet, xpubs, 2, "")
+	assert.NoError(t, err)
+	decoy, err := deriver.Decoy()
+	assert.NoError(t, err)
+	addr, err := deriver.Derive(0, 0)
+	assert.NoError(t, err)
+	decoyAddr, err := decoy.Derive(0, 0)
+	assert.NoError(t, err)
+	// same kind of address, different keys
+	assert.NotEqual(t, addr.String(), decoyAddr.String())
+	assert.Equal(t, addr.String()[0], decoyAddr.String()[0])
+	assert.Equal(t, 2, decoy.m)
+	assert.Len(t, decoy.keys, 2)
+	assert.Contains(t, decoy.Descriptors()[0], "tpub")
+
+	deriver, err = NewAddressDeriver(Testnet, nil, 1, "mzoeuyGqMudyvKbkNx5dtNBNN59oKEAsPn")
+	assert.NoError(t, err)
+	decoy, err = deriver.Decoy()
+	assert.NoError(t, err)
+	assert.False(t, decoy.IsSingleAddress())
+	decoyAddr, err = decoy.Derive(0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "m/.../0/1", decoyAddr.Path())
+	assert.Contains(t, "mn", decoyAddr.String()[:1])
+
+	// the decoys of a script hash address are script hash addresses too
+	deriver, err = NewAddressDeriver(Testnet, nil, 1, addr.String())
+	assert.NoError(t, err)
+	decoy, err = deriver.Decoy()
+	assert.NoError(t, err)
+	decoyAddr, err = decoy.Derive(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('2'), decoyAddr.String()[0])
 }
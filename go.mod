@@ -1,6 +1,6 @@
 module github.com/square/beancounter
 
-go 1.12
+go 1.13
 
 require (
 	github.com/Masterminds/semver v1.5.0
@@ -11,7 +11,7 @@ require (
 	github.com/btcsuite/btcd v0.0.0-20180924021209-2a560b2036be
 	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f // indirect
 	github.com/btcsuite/btcutil v0.0.0-20180706230648-ab6388e0c60a
-	github.com/btcsuite/go-socks v0.0.0-20170105172521-4720035b7bfd // indirect
+	github.com/btcsuite/go-socks v0.0.0-20170105172521-4720035b7bfd
 	github.com/btcsuite/websocket v0.0.0-20150119174127-31079b680792 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pkg/errors v0.9.1
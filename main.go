@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcutil/hdkeychain"
 	"github.com/square/beancounter/blockfinder"
-	"log"
+	"io/ioutil"
 	"math"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,57 +37,182 @@ var (
 	findAddrM   = findAddr.Flag("m", "number of signatures (quorum)").Short('m').Default("1").Int()
 	findAddrN   = findAddr.Flag("n", "number of public keys").Short('n').Default("1").Int()
 
-	findBlock            = app.Command("find-block", "Finds the block height for a given date/time.")
-	findBlockTimestamp   = findBlock.Arg("timestamp", "Date/time to resolve. E.g. \"2006-01-02 15:04:05 MST\"").Required().String()
-	findBlockBackend     = findBlock.Flag("backend", "electrum | btcd | electrum-recorder | btcd-recorder | fixture").Default("electrum").Enum("electrum", "btcd", "electrum-recorder", "btcd-recorder", "fixture")
-	findBlockAddr        = findBlock.Flag("addr", "Backend to connect to initially. Defaults to a hardcoded node for Electrum and localhost for Btcd.").PlaceHolder("HOST:PORT").String()
-	findBlockRpcUser     = findBlock.Flag("rpcuser", "RPC username").PlaceHolder("USER").String()
-	findBlockRpcPass     = findBlock.Flag("rpcpass", "RPC password").PlaceHolder("PASSWORD").String()
-	findBlockFixtureFile = findBlock.Flag("fixture-file", "Fixture file to use for recording or replaying data.").PlaceHolder("FILEPATH").String()
+	findBlock          = app.Command("find-block", "Finds the block height for a given date/time.")
+	findBlockTimestamp = findBlock.Arg("timestamp", "Date/time to resolve. E.g. \"2006-01-02 15:04:05 MST\"").Required().String()
+	findBlockBackend   = addBackendFlags(findBlock, "")
 
 	computeBalance            = app.Command("compute-balance", "Computes balance for a given watch wallet.")
-	computeBalanceBlockHeight = computeBalance.Flag("block-height", "Compute balance at given block height. Defaults to current chain height - 6.").Default("0").Uint32()
+	computeBalanceBlockHeight = computeBalance.Flag("block-height", "Compute balance at given block height. Defaults to current chain height - confirmations.").Default("0").Uint32()
+	computeBalanceBlockHash   = computeBalance.Flag("block-hash", "Compute balance at the block with this hash, instead of --block-height.").PlaceHolder("HASH").String()
+	computeBalanceConfirms    = computeBalance.Flag("confirmations", "Number of blocks which must have been mined on top of the audit height.").Default("6").Uint32()
 	computeBalanceType        = computeBalance.Flag("type", "multisig | single-address").Required().Enum("multisig", "single-address")
 	computeBalanceM           = computeBalance.Flag("m", "number of signatures (quorum)").Short('m').Default("1").Int()
 	computeBalanceN           = computeBalance.Flag("n", "number of public keys").Short('n').Default("1").Int()
-	computeBalanceBackend     = computeBalance.Flag("backend", "electrum | btcd | electrum-recorder | btcd-recorder | fixture").Default("electrum").Enum("electrum", "btcd", "electrum-recorder", "btcd-recorder", "fixture")
-	computeBalanceAddr        = computeBalance.Flag("addr", "Backend to connect to initially. Defaults to a hardcoded node for Electrum and localhost for Btcd.").PlaceHolder("HOST:PORT").String()
-	computeBalanceRpcUser     = computeBalance.Flag("rpcuser", "RPC username").PlaceHolder("USER").String()
-	computeBalanceRpcPass     = computeBalance.Flag("rpcpass", "RPC password").PlaceHolder("PASSWORD").String()
-	computeBalanceFixtureFile = computeBalance.Flag("fixture-file", "Fixture file to use for recording or replaying data.").PlaceHolder("FILEPATH").String()
+	computeBalanceBackend     = addBackendFlags(computeBalance, "")
 	computeBalanceLookahead   = computeBalance.Flag("lookahead", "lookahead size").Default("100").Uint32()
+	computeBalanceTimeout     = computeBalance.Flag("timeout", "Give up if the balance isn't computed within this duration (e.g. 2h). Defaults to no timeout.").Default("0").Duration()
+	computeBalanceCheckpoint  = computeBalance.Flag("checkpoint-file", "Periodically save progress to this file. The file is removed once all the transactions have been fetched.").PlaceHolder("FILEPATH").String()
+	computeBalanceInterval    = computeBalance.Flag("checkpoint-interval", "How often to save progress.").Default("1m").Duration()
+	computeBalanceResume      = computeBalance.Flag("resume", "Resume from --checkpoint-file. Only the missing addresses and transactions are requested.").Default("false").Bool()
+	computeBalanceSnapshotOut = computeBalance.Flag("snapshot-out", "Write a snapshot of the wallet at --block-height to this file.").PlaceHolder("FILEPATH").String()
+	computeBalanceSnapshotIn  = computeBalance.Flag("from-snapshot", "Start from a snapshot written by --snapshot-out and only apply the transactions above its height.").PlaceHolder("FILEPATH").ExistingFile()
+
+	computeBalances            = app.Command("compute-balances", "Computes balances for a group of watch wallets, using a single backend.")
+	computeBalancesWallets     = computeBalances.Arg("wallets", "JSON file describing the wallets. See README.md for the format.").Required().ExistingFile()
+	computeBalancesBlockHeight = computeBalances.Flag("block-height", "Compute balances at given block height. Defaults to current chain height - confirmations.").Default("0").Uint32()
+	computeBalancesConfirms    = computeBalances.Flag("confirmations", "Number of blocks which must have been mined on top of the audit height.").Default("6").Uint32()
+	computeBalancesBackend     = addBackendFlags(computeBalances, "")
+	computeBalancesLookahead   = computeBalances.Flag("lookahead", "lookahead size").Default("100").Uint32()
+	computeBalancesTimeout     = computeBalances.Flag("timeout", "Give up if the balances aren't computed within this duration (e.g. 2h). Defaults to no timeout.").Default("0").Duration()
+
+	reconcile            = app.Command("reconcile", "Computes balance for a given watch wallet with two backends and compares the data they return.")
+	reconcileBlockHeight = reconcile.Flag("block-height", "Compute balance at given block height. Defaults to the lowest chain height of the two backends - confirmations.").Default("0").Uint32()
+	reconcileConfirms    = reconcile.Flag("confirmations", "Number of blocks which must have been mined on top of the audit height.").Default("6").Uint32()
+	reconcileType        = reconcile.Flag("type", "multisig | single-address").Required().Enum("multisig", "single-address")
+	reconcileM           = reconcile.Flag("m", "number of signatures (quorum)").Short('m').Default("1").Int()
+	reconcileN           = reconcile.Flag("n", "number of public keys").Short('n').Default("1").Int()
+	reconcileLeft        = addBackendFlags(reconcile, "left-")
+	reconcileRight       = addBackendFlags(reconcile, "right-")
+	reconcileLookahead   = reconcile.Flag("lookahead", "lookahead size").Default("100").Uint32()
+	reconcileTimeout     = reconcile.Flag("timeout", "Give up if the balances aren't computed within this duration (e.g. 2h). Defaults to no timeout.").Default("0").Duration()
 )
 
+// Exit codes. They let scripts tell apart a typo from a backend outage or from a wallet whose
+// transactions don't add up.
 const (
-	// number of confirmations required so we don't have to worry about orphaned blocks.
-	minConfirmations = 6
+	exitFailure   = 1 // any error which doesn't fall in the categories below
+	exitUsage     = 2 // invalid flags or input
+	exitBackend   = 3 // the backend is unreachable or failed to answer a request
+	exitIntegrity = 4 // the fetched data is inconsistent (double spends, unparsable transactions, etc.)
+	exitCanceled  = 5 // interrupted or timed out
+	exitMismatch  = 6 // reconcile found differences between the backends
 )
 
+// errBackendsDisagree is returned by reconcile when the backends returned different data.
+var errBackendsDisagree = errors.New("backends disagree")
+
+// usageError is returned when the flags or the input provided by the user are invalid.
+type usageError struct {
+	error
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// auditHeight returns the height to audit at. It defaults to the chain height - confirmations when
+// height is 0. Backends without a chain height (e.g. the fixture backend) report 0, the height is
+// then used as is.
+func auditHeight(height, chainHeight, confirmations uint32) (uint32, error) {
+	if height != 0 && chainHeight == 0 {
+		return height, nil
+	}
+	if chainHeight < confirmations {
+		return 0, usageErrorf("chain height %d is below %d confirmations", chainHeight, confirmations)
+	}
+	if height == 0 {
+		return chainHeight - confirmations, nil
+	}
+	if height > chainHeight-confirmations {
+		return 0, usageErrorf("blockHeight %d is too high (> %d - %d)", height, chainHeight, confirmations)
+	}
+	return height, nil
+}
+
+// anchorable returns true if an audit can be anchored to the block at the audit height without a
+// --block-hash: the backend must be able to look up blocks and know the chain. A fixture without a
+// chain height usually doesn't have any blocks either.
+func anchorable(b backend.Backend) bool {
+	_, ok := b.(backend.BlockFinder)
+	return ok && b.ChainHeight() != 0
+}
+
+// backendError is returned when we can't connect to a backend.
+type backendError struct {
+	error
+}
+
 func main() {
 	app.Version("0.0.3")
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	command, err := app.Parse(os.Args[1:])
+	if err != nil {
+		app.Errorf("%s, try --help", err)
+		os.Exit(exitUsage)
+	}
+
+	// Cancel the context on ^C, so that the backends get a chance to shut down cleanly.
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		cancel()
+	}()
+
+	switch command {
 	case keytree.FullCommand():
-		doKeytree()
+		err = doKeytree()
 	case findAddr.FullCommand():
-		doFindAddr()
+		err = doFindAddr()
 	case findBlock.FullCommand():
-		doFindBlock()
+		err = doFindBlock(ctx)
 	case computeBalance.FullCommand():
-		doComputeBalance()
+		err = doComputeBalance(ctx)
+	case computeBalances.FullCommand():
+		err = doComputeBalances(ctx)
+	case reconcile.FullCommand():
+		err = doReconcile(ctx)
 	default:
 		panic("unreachable")
 	}
+	cancel()
+
+	if err != nil {
+		app.Errorf("%s", err)
+		os.Exit(exitCode(err))
+	}
 }
 
-func doKeytree() {
-	if !*debug {
-		// Disallow piping to prevent leaking addresses in bash history, etc.
-		stat, err := os.Stdin.Stat()
-		PanicOnError(err)
-		if (stat.Mode() & os.ModeCharDevice) == 0 {
-			fmt.Println("Piping stdin forbidden.")
-			return
-		}
+// exitCode maps an error to one of the exit codes above.
+func exitCode(err error) int {
+	var usage usageError
+	var derive *accounter.DeriveError
+	var conn backendError
+	var request *backend.Error
+	switch {
+	case errors.As(err, &usage), errors.As(err, &derive):
+		return exitUsage
+	case errors.As(err, &conn), errors.As(err, &request):
+		return exitBackend
+	case accounter.IsIntegrityError(err), errors.Is(err, blockfinder.ErrNonMonotonicMedians):
+		return exitIntegrity
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return exitCanceled
+	case errors.Is(err, errBackendsDisagree):
+		return exitMismatch
+	default:
+		return exitFailure
+	}
+}
+
+// checkStdin disallows piping to prevent leaking addresses in bash history, etc.
+func checkStdin() error {
+	if *debug {
+		return nil
+	}
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return err
+	}
+	if (stat.Mode() & os.ModeCharDevice) == 0 {
+		return usageErrorf("piping stdin forbidden")
+	}
+	return nil
+}
+
+func doKeytree() error {
+	if err := checkStdin(); err != nil {
+		return err
 	}
 
 	xpubs := make([]string, 0, *keytreeN)
@@ -93,20 +223,20 @@ func doKeytree() {
 		xpubs = append(xpubs, strings.TrimSpace(xpub))
 	}
 
-	// Check that all the addresses have the same prefix
-	for i := 1; i < *keytreeN; i++ {
-		if xpubs[0][0:4] != xpubs[i][0:4] {
-			fmt.Printf("Prefixes must match: %s %s\n", xpubs[0], xpubs[i])
-			return
-		}
+	if err := checkPrefixes(xpubs); err != nil {
+		return err
 	}
 
 	for _, path := range *keytreeArg {
 		for i, xpub := range xpubs {
 			key, err := hdkeychain.NewKeyFromString(xpub)
-			PanicOnError(err)
+			if err != nil {
+				return usageErrorf("invalid pubkey #%d: %s", i+1, err)
+			}
 			key, err = key.Child(path)
-			PanicOnError(err)
+			if err != nil {
+				return err
+			}
 			xpubs[i] = key.String()
 		}
 	}
@@ -114,22 +244,30 @@ func doKeytree() {
 	for i, xpub := range xpubs {
 		fmt.Printf("Child pubkey #%d: %s\n", i+1, xpub)
 	}
+	return nil
 }
 
-func doFindAddr() {
+// checkPrefixes checks that all the xpubs have the same prefix
+func checkPrefixes(xpubs []string) error {
+	for i := range xpubs {
+		if len(xpubs[i]) < 4 {
+			return usageErrorf("invalid pubkey #%d: %s", i+1, xpubs[i])
+		}
+		if xpubs[0][0:4] != xpubs[i][0:4] {
+			return usageErrorf("prefixes must match: %s %s", xpubs[0], xpubs[i])
+		}
+	}
+	return nil
+}
+
+func doFindAddr() error {
 	err := VerifyMandN(*findAddrM, *findAddrN)
 	if err != nil {
-		panic(err)
+		return usageError{err}
 	}
 
-	if !*debug {
-		// Disallow piping to prevent leaking addresses in bash history, etc.
-		stat, err := os.Stdin.Stat()
-		PanicOnError(err)
-		if (stat.Mode() & os.ModeCharDevice) == 0 {
-			fmt.Println("Piping stdin forbidden.")
-			return
-		}
+	if err := checkStdin(); err != nil {
+		return err
 	}
 
 	xpubs := make([]string, 0, *findAddrN)
@@ -140,23 +278,28 @@ func doFindAddr() {
 		xpubs = append(xpubs, strings.TrimSpace(xpub))
 	}
 
-	// Check that all the addresses have the same prefix
-	for i := 1; i < *findAddrN; i++ {
-		if xpubs[0][0:4] != xpubs[i][0:4] {
-			fmt.Printf("Prefixes must match: %s %s\n", xpubs[0], xpubs[i])
-			return
-		}
+	if err := checkPrefixes(xpubs); err != nil {
+		return err
+	}
+	network, err := XpubToNetwork(xpubs[0])
+	if err != nil {
+		return usageError{err}
+	}
+	deriver, err := deriver.NewAddressDeriver(network, xpubs, *findAddrM, "")
+	if err != nil {
+		return usageError{err}
 	}
-	network := XpubToNetwork(xpubs[0])
-	deriver := deriver.NewAddressDeriver(network, xpubs, *findAddrM, "")
 
 	fmt.Printf("Searching for %s\n", *findAddrArg)
 	for i := uint32(0); i < math.MaxUint32; i++ {
 		for _, change := range []uint32{0, 1} {
-			addr := deriver.Derive(change, i)
+			addr, err := deriver.Derive(change, i)
+			if err != nil {
+				return err
+			}
 			if addr.String() == *findAddrArg {
 				fmt.Printf("found: %s %s\n", addr.Path(), addr)
-				return
+				return nil
 			}
 			if i%1000 == 0 {
 				fmt.Printf("reached: %s %s\n", addr.Path(), addr)
@@ -164,130 +307,538 @@ func doFindAddr() {
 		}
 	}
 	fmt.Printf("not found\n")
+	return nil
 }
 
-func doFindBlock() {
+func doFindBlock(ctx context.Context) error {
 	t, err := time.Parse("2006-01-02 15:04:05 MST", *findBlockTimestamp)
-	PanicOnError(err)
+	if err != nil {
+		return usageError{err}
+	}
 
-	backend, err := findBlockBuildBackend(Mainnet)
-	PanicOnError(err)
+	backend, err := findBlockBackend.build(Mainnet)
+	if err != nil {
+		return err
+	}
 	bf := blockfinder.New(backend)
-	block, median, timestamp := bf.Search(t)
+	block, median, timestamp, err := bf.Search(ctx, t)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Closest block to '%s' is block #%d with a median time of '%s'\n",
 		t.String(), block, median.String())
 	if *debug {
 		fmt.Printf("timestamp: '%s'\n", timestamp.String())
 	}
+	return nil
 }
 
-func doComputeBalance() {
+func doComputeBalance(ctx context.Context) error {
 	err := VerifyMandN(*computeBalanceM, *computeBalanceN)
 	if err != nil {
-		panic(err)
+		return usageError{err}
+	}
+
+	var snapshot *accounter.Snapshot
+	if *computeBalanceSnapshotIn != "" {
+		snapshot, err = accounter.LoadSnapshot(*computeBalanceSnapshotIn)
+		if err != nil {
+			return usageError{err}
+		}
+	}
+
+	if *computeBalanceBlockHash != "" && *computeBalanceBlockHeight != 0 {
+		return usageErrorf("--block-hash and --block-height can't be used together")
+	}
+
+	var checkpoint *accounter.Checkpoint
+	if *computeBalanceResume {
+		if *computeBalanceCheckpoint == "" {
+			return usageErrorf("--resume requires --checkpoint-file")
+		}
+		checkpoint, err = accounter.LoadCheckpoint(*computeBalanceCheckpoint)
+		if err != nil {
+			return usageError{err}
+		}
+		// resume at the checkpoint's height, unless the user asks for a specific one.
+		if *computeBalanceBlockHeight == 0 && *computeBalanceBlockHash == "" {
+			*computeBalanceBlockHeight = checkpoint.BlockHeight
+		}
 	}
 
 	if *debug {
 		electrum.DebugMode = true
-	} else {
-		// Disallow piping to prevent leaking addresses in bash history, etc.
-		stat, err := os.Stdin.Stat()
-		PanicOnError(err)
-		if (stat.Mode() & os.ModeCharDevice) == 0 {
-			fmt.Println("Piping stdin forbidden.")
-			return
+	}
+	if err := checkStdin(); err != nil {
+		return err
+	}
+
+	deriver, network, err := readWallet(*computeBalanceType, *computeBalanceM, *computeBalanceN)
+	if err != nil {
+		return err
+	}
+
+	backend, err := computeBalanceBackend.build(network, deriver)
+	if err != nil {
+		return err
+	}
+
+	if *computeBalanceBlockHash != "" {
+		*computeBalanceBlockHeight, err = blockHeight(ctx, backend, *computeBalanceBlockHash)
+		if err != nil {
+			backend.Finish()
+			return err
+		}
+	}
+
+	*computeBalanceBlockHeight, err = auditHeight(*computeBalanceBlockHeight, backend.ChainHeight(), *computeBalanceConfirms)
+	if err != nil {
+		backend.Finish()
+		return err
+	}
+	fmt.Printf("Going to compute balance at %d\n", *computeBalanceBlockHeight)
+
+	tb := accounter.New(backend, deriver, *computeBalanceLookahead, *computeBalanceBlockHeight)
+	if *computeBalanceBlockHash != "" || anchorable(backend) {
+		tb.EnableAnchor(*computeBalanceBlockHash)
+	}
+	if *computeBalanceCheckpoint != "" {
+		tb.EnableCheckpoints(*computeBalanceCheckpoint, *computeBalanceInterval)
+	}
+	if *computeBalanceSnapshotOut != "" {
+		tb.EnableSnapshot()
+	}
+	if snapshot != nil {
+		fmt.Printf("Rolling forward from snapshot at %d\n", snapshot.BlockHeight)
+		if err := tb.RollForward(snapshot); err != nil {
+			backend.Finish()
+			return usageError{err}
+		}
+	}
+	if checkpoint != nil {
+		if err := tb.Resume(checkpoint); err != nil {
+			backend.Finish()
+			return usageError{err}
+		}
+	}
+
+	if *computeBalanceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *computeBalanceTimeout)
+		defer cancel()
+	}
+	balance, err := tb.ComputeBalance(ctx)
+	if err != nil {
+		return err
+	}
+
+	if hash := tb.BlockHash(); hash != "" {
+		fmt.Printf("Block hash: %s\n", hash)
+	}
+	fmt.Printf("Balance: %d\n", balance)
+	fmt.Printf("Immature: %d\n", tb.Immature())
+	unconfirmed := tb.Unconfirmed()
+	fmt.Printf("Unconfirmed incoming: %d\n", unconfirmed.Incoming)
+	fmt.Printf("Unconfirmed outgoing: %d\n", unconfirmed.Outgoing)
+	fmt.Printf("SPV verified: %d/%d transactions\n", tb.Verified(), len(tb.Transactions()))
+
+	if *computeBalanceSnapshotOut != "" {
+		s, err := tb.Snapshot()
+		if err != nil {
+			return err
+		}
+		if err := s.Save(*computeBalanceSnapshotOut); err != nil {
+			return err
+		}
+		fmt.Printf("Snapshot written to %s\n", *computeBalanceSnapshotOut)
+	}
+
+	findings := tb.Findings()
+	fmt.Printf("Findings: %d\n", len(findings))
+	for _, f := range findings {
+		fmt.Printf("  %s\n", f)
+	}
+	computeBalanceBackend.printDisagreements(backend)
+	computeBalanceBackend.printExposure(backend)
+	return nil
+}
+
+// walletConfig describes one wallet in the file passed to compute-balances.
+type walletConfig struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"` // multisig | single-address
+	M       int      `json:"m"`
+	Xpubs   []string `json:"xpubs"`
+	Address string   `json:"address"`
+}
+
+// loadWallets reads the wallets file and returns the network the wallets are on.
+func loadWallets(path string) ([]accounter.Wallet, Network, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", usageError{err}
+	}
+	var configs []walletConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, "", usageErrorf("invalid wallets file: %s", err)
+	}
+	if len(configs) == 0 {
+		return nil, "", usageErrorf("wallets file doesn't contain any wallet")
+	}
+
+	var network Network
+	wallets := make([]accounter.Wallet, 0, len(configs))
+	for i, c := range configs {
+		if c.Name == "" {
+			return nil, "", usageErrorf("wallet #%d doesn't have a name", i+1)
+		}
+		var walletNetwork Network
+		var err error
+		switch c.Type {
+		case "multisig":
+			if c.Address != "" {
+				return nil, "", usageErrorf("wallet %s: a multisig wallet can't have an address", c.Name)
+			}
+			if c.M == 0 {
+				c.M = 1
+			}
+			if err := VerifyMandN(c.M, len(c.Xpubs)); err != nil {
+				return nil, "", usageErrorf("wallet %s: %s", c.Name, err)
+			}
+			if err := checkPrefixes(c.Xpubs); err != nil {
+				return nil, "", usageErrorf("wallet %s: %s", c.Name, err)
+			}
+			walletNetwork, err = XpubToNetwork(c.Xpubs[0])
+		case "single-address":
+			if len(c.Xpubs) > 0 {
+				return nil, "", usageErrorf("wallet %s: a single-address wallet can't have xpubs", c.Name)
+			}
+			if c.Address == "" {
+				return nil, "", usageErrorf("wallet %s doesn't have an address", c.Name)
+			}
+			walletNetwork, err = AddressToNetwork(c.Address)
+		default:
+			return nil, "", usageErrorf("wallet %s: type must be multisig or single-address", c.Name)
+		}
+		if err != nil {
+			return nil, "", usageErrorf("wallet %s: %s", c.Name, err)
+		}
+		if i == 0 {
+			network = walletNetwork
+		} else if walletNetwork != network {
+			return nil, "", usageErrorf("wallet %s is on %s, expecting %s", c.Name, walletNetwork, network)
+		}
+
+		d, err := deriver.NewAddressDeriver(walletNetwork, c.Xpubs, c.M, c.Address)
+		if err != nil {
+			return nil, "", usageErrorf("wallet %s: %s", c.Name, err)
 		}
+		wallets = append(wallets, accounter.Wallet{Name: c.Name, Deriver: d, Lookahead: *computeBalancesLookahead})
+	}
+	return wallets, network, nil
+}
+
+func doComputeBalances(ctx context.Context) error {
+	if *debug {
+		electrum.DebugMode = true
+	}
+
+	wallets, network, err := loadWallets(*computeBalancesWallets)
+	if err != nil {
+		return err
+	}
+
+	derivers := []*deriver.AddressDeriver{}
+	for _, w := range wallets {
+		derivers = append(derivers, w.Deriver)
+	}
+	backend, err := computeBalancesBackend.build(network, derivers...)
+	if err != nil {
+		return err
+	}
+
+	*computeBalancesBlockHeight, err = auditHeight(*computeBalancesBlockHeight, backend.ChainHeight(), *computeBalancesConfirms)
+	if err != nil {
+		backend.Finish()
+		return err
+	}
+	fmt.Printf("Going to compute balances at %d\n", *computeBalancesBlockHeight)
+
+	group := accounter.NewGroup(backend, *computeBalancesBlockHeight)
+	if anchorable(backend) {
+		group.EnableAnchor("")
+	}
+	for _, w := range wallets {
+		if err := group.Add(w); err != nil {
+			backend.Finish()
+			return usageError{err}
+		}
+	}
+
+	if *computeBalancesTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *computeBalancesTimeout)
+		defer cancel()
+	}
+	report, err := group.ComputeBalances(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range report.Wallets {
+		fmt.Printf("Wallet %s: %d\n", w.Name, w.Balance)
+		fmt.Printf("  Immature: %d\n", w.Immature)
+		fmt.Printf("  Unconfirmed incoming: %d\n", w.Unconfirmed.Incoming)
+		fmt.Printf("  Unconfirmed outgoing: %d\n", w.Unconfirmed.Outgoing)
+		fmt.Printf("  SPV verified: %d/%d transactions\n", w.Verified, w.Transactions)
+		fmt.Printf("  Findings: %d\n", len(w.Findings))
+		for _, f := range w.Findings {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+	fmt.Printf("Total: %d\n", report.Total)
+	if report.BlockHash != "" {
+		fmt.Printf("Block hash: %s\n", report.BlockHash)
+	}
+	fmt.Printf("Intra-group transfers: %d\n", len(report.Transfers))
+	for _, t := range report.Transfers {
+		fmt.Printf("  %s\n", t)
+	}
+	computeBalancesBackend.printDisagreements(backend)
+	computeBalancesBackend.printExposure(backend)
+	return nil
+}
+
+func doReconcile(ctx context.Context) error {
+	if *debug {
+		electrum.DebugMode = true
+	}
+	if err := checkStdin(); err != nil {
+		return err
+	}
+
+	deriver, network, err := readWallet(*reconcileType, *reconcileM, *reconcileN)
+	if err != nil {
+		return err
 	}
 
-	xpubs := make([]string, 0, *computeBalanceN)
+	left, err := reconcileLeft.build(network, deriver)
+	if err != nil {
+		return err
+	}
+	right, err := reconcileRight.build(network, deriver)
+	if err != nil {
+		left.Finish()
+		return err
+	}
+
+	// The lowest chain height is used, so both backends have the block.
+	chainHeight := left.ChainHeight()
+	if right.ChainHeight() < chainHeight {
+		chainHeight = right.ChainHeight()
+	}
+	*reconcileBlockHeight, err = auditHeight(*reconcileBlockHeight, chainHeight, *reconcileConfirms)
+	if err != nil {
+		left.Finish()
+		right.Finish()
+		return err
+	}
+	fmt.Printf("Going to reconcile at %d\n", *reconcileBlockHeight)
+
+	if *reconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *reconcileTimeout)
+		defer cancel()
+	}
+	r, err := accounter.Reconcile(ctx, left, right, deriver, *reconcileLookahead, *reconcileBlockHeight)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Left balance: %d\n", r.LeftBalance)
+	fmt.Printf("Right balance: %d\n", r.RightBalance)
+	fmt.Printf("Compared %d addresses and %d transactions\n", r.Addresses, r.Transactions)
+	fmt.Printf("Block hash: %s\n", r.BlockHash)
+	fmt.Printf("Differences: %d\n", len(r.Differences))
+	for _, d := range r.Differences {
+		fmt.Printf("  %s\n", d)
+	}
+	if len(r.Differences) > 0 {
+		return errBackendsDisagree
+	}
+	return nil
+}
+
+// blockHeight looks up the height of a block, for the backends which implement
+// backend.BlockFinder.
+func blockHeight(ctx context.Context, b backend.Backend, hash string) (uint32, error) {
+	finder, ok := b.(backend.BlockFinder)
+	if !ok {
+		return 0, usageErrorf("--block-hash isn't supported by this backend")
+	}
+	height, err := finder.BlockHeight(ctx, hash)
+	if err != nil {
+		return 0, backendError{err}
+	}
+	return height, nil
+}
+
+// readWallet prompts for the wallet's pubkeys (or address).
+func readWallet(kind string, m, n int) (*deriver.AddressDeriver, Network, error) {
+	xpubs := make([]string, 0, n)
 	var network Network
 	reader := bufio.NewReader(os.Stdin)
 	singleAddress := ""
-	if *computeBalanceType == "single-address" {
+	if kind == "single-address" {
 		fmt.Printf("Enter single address:\n")
 		singleAddress, _ = reader.ReadString('\n')
-		network = AddressToNetwork(singleAddress)
+		singleAddress = strings.TrimSpace(singleAddress)
+		var err error
+		network, err = AddressToNetwork(singleAddress)
+		if err != nil {
+			return nil, "", usageError{err}
+		}
 	} else {
-		for i := 0; i < *computeBalanceN; i++ {
-			fmt.Printf("Enter pubkey #%d out of #%d:\n", i+1, *computeBalanceN)
+		for i := 0; i < n; i++ {
+			fmt.Printf("Enter pubkey #%d out of #%d:\n", i+1, n)
 			xpub, _ := reader.ReadString('\n')
 			xpubs = append(xpubs, strings.TrimSpace(xpub))
 		}
 
-		// Check that all the addresses have the same prefix
-		for i := 1; i < *computeBalanceN; i++ {
-			if xpubs[0][0:4] != xpubs[i][0:4] {
-				fmt.Printf("Prefixes must match: %s %s\n", xpubs[0], xpubs[i])
-				return
-			}
+		if err := checkPrefixes(xpubs); err != nil {
+			return nil, "", err
+		}
+		var err error
+		network, err = XpubToNetwork(xpubs[0])
+		if err != nil {
+			return nil, "", usageError{err}
 		}
-		network = XpubToNetwork(xpubs[0])
-	}
-	deriver := deriver.NewAddressDeriver(network, xpubs, *computeBalanceM, singleAddress)
-
-	backend, err := computeBalanceBuildBackend(network)
-	PanicOnError(err)
-
-	// If blockHeight is 0, we default to current height - 6.
-	if *computeBalanceBlockHeight == 0 {
-		*computeBalanceBlockHeight = backend.ChainHeight() - minConfirmations
 	}
-	if *computeBalanceBlockHeight > backend.ChainHeight()-minConfirmations {
-		log.Panicf("blockHeight %d is too high (> %d - %d)", *computeBalanceBlockHeight, backend.ChainHeight(), minConfirmations)
+	d, err := deriver.NewAddressDeriver(network, xpubs, m, singleAddress)
+	if err != nil {
+		return nil, "", usageError{err}
 	}
-	fmt.Printf("Going to compute balance at %d\n", *computeBalanceBlockHeight)
-
-	tb := accounter.New(backend, deriver, *computeBalanceLookahead, *computeBalanceBlockHeight)
+	return d, network, nil
+}
 
-	balance := tb.ComputeBalance()
+// backendFlags are the flags shared by all the commands which need a backend.
+type backendFlags struct {
+	kind        *string
+	addr        *string
+	rpcUser     *string
+	rpcPass     *string
+	fixtureFile *string
+	headersFile *string
+	quorum      *int
+	policy      *string
+	birthday    *uint32
+	esploraURL  *string
+	esploraConc *int
+	rate        *float64
+	burst       *int
+	tls         *string
+	knownFile   *string
+	plaintext   *bool
+	servers     *[]string
+	pin         *string
+	proxy       *string
+	privacy     *float64
+	decoys      *int
+}
 
-	fmt.Printf("Balance: %d\n", balance)
+// addBackendFlags adds the backend flags to cmd. Commands which need several backends prefix
+// each set of flags, e.g. --left-backend and --right-backend.
+func addBackendFlags(cmd *kingpin.CmdClause, prefix string) backendFlags {
+	return backendFlags{
+		kind:        cmd.Flag(prefix+"backend", "electrum | btcd | bitcoind | esplora | electrum-recorder | btcd-recorder | fixture").Default("electrum").Enum("electrum", "btcd", "bitcoind", "esplora", "electrum-recorder", "btcd-recorder", "fixture"),
+		addr:        cmd.Flag(prefix+"addr", "Backend to connect to initially. Defaults to a hardcoded node for Electrum and localhost for Btcd and Bitcoin Core.").PlaceHolder("HOST:PORT").String(),
+		rpcUser:     cmd.Flag(prefix+"rpcuser", "RPC username").PlaceHolder("USER").String(),
+		rpcPass:     cmd.Flag(prefix+"rpcpass", "RPC password").PlaceHolder("PASSWORD").String(),
+		fixtureFile: cmd.Flag(prefix+"fixture-file", "Fixture file to use for recording or replaying data.").PlaceHolder("FILEPATH").String(),
+		headersFile: cmd.Flag(prefix+"headers-file", "File to store validated block headers in (Electrum only). Later runs only download the new headers.").PlaceHolder("FILEPATH").String(),
+		quorum:      cmd.Flag(prefix+"quorum", "Number of Electrum servers, on distinct hosts, each address is fetched from.").Default("1").Int(),
+		policy:      cmd.Flag(prefix+"quorum-policy", "union | majority. Which transactions to keep when the servers disagree.").Default("union").Enum("union", "majority"),
+		birthday:    cmd.Flag(prefix+"birthday", "Height of the wallet's first block (bitcoind only). The node rescans the chain from this height.").Default("0").Uint32(),
+		rate:        cmd.Flag(prefix+"electrum-rate", "Requests per second sent to each Electrum server.").Default(strconv.Itoa(electrum.DefaultRate)).Float64(),
+		burst:       cmd.Flag(prefix+"electrum-burst", "Requests sent at once to an idle Electrum server.").Default(strconv.Itoa(electrum.DefaultBurst)).Int(),
+		tls:         cmd.Flag(prefix+"electrum-tls", "ca | tofu. Which certificates are accepted from Electrum servers: signed by a CA, or also self-signed ones which didn't change since the first connection (requires --known-servers).").Default("ca").Enum("ca", "tofu"),
+		knownFile:   cmd.Flag(prefix+"known-servers", "File to store the certificate fingerprints of the Electrum servers in, for trust on first use.").PlaceHolder("FILEPATH").String(),
+		servers:     cmd.Flag(prefix+"electrum-server", "Another Electrum server to connect to, and to look up peers on. Can be repeated, e.g. so that the --quorum servers aren't all picked by --addr.").PlaceHolder("HOST:PORT").Strings(),
+		plaintext:   cmd.Flag(prefix+"electrum-plaintext", "Also connect to the Electrum servers' plain TCP (t) ports, whose responses can be tampered with.").Bool(),
+		pin:         cmd.Flag(prefix+"electrum-pin", "SHA-256 fingerprint of the certificate of the --addr Electrum server. Connections are refused if it doesn't match.").PlaceHolder("FINGERPRINT").String(),
+		proxy:       cmd.Flag(prefix+"proxy", "SOCKS5 proxy for the Electrum connections, e.g. Tor's socks5://127.0.0.1:9050. Onion servers are then used too.").PlaceHolder("URL").String(),
+		privacy:     cmd.Flag(prefix+"privacy-fraction", "Approximate largest fraction of the addresses an Electrum server may see. The addresses are then spread evenly across servers on distinct hosts, a server can see one address more than its share. 0 disables privacy mode.").Default("0").Float64(),
+		decoys:      cmd.Flag(prefix+"privacy-decoys", "Number of decoy addresses, derived from a throwaway key, sent along with each address in privacy mode.").Default("0").Int(),
+		esploraURL:  cmd.Flag(prefix+"esplora-url", "Root of the Esplora API (esplora only). Defaults to blockstream.info.").PlaceHolder("URL").String(),
+		esploraConc: cmd.Flag(prefix+"esplora-concurrency", "Number of parallel requests sent to the Esplora server.").Default("8").Int(),
+	}
 }
 
-// TODO: copy-pasta
-func findBlockBuildBackend(network Network) (backend.Backend, error) {
+// build connects to the backend. The bitcoind backend imports the wallets' descriptors, so it needs
+// the derivers.
+func (f backendFlags) build(network Network, derivers ...*deriver.AddressDeriver) (backend.Backend, error) {
 	var b backend.Backend
 	var err error
-	switch *findBlockBackend {
+	switch *f.kind {
 	case "electrum":
-		addr, port := GetDefaultServer(network, Electrum, *findBlockAddr)
-		b, err = backend.NewElectrumBackend(addr, port, network)
+		b, err = f.electrum(network, derivers...)
 		if err != nil {
 			return nil, err
 		}
 	case "btcd":
-		addr, port := GetDefaultServer(network, Btcd, *findBlockAddr)
-		b, err = backend.NewBtcdBackend(addr, port, *findBlockRpcUser, *findBlockRpcPass, network)
+		addr, port, err := GetDefaultServer(network, Btcd, *f.addr)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
+		}
+		b, err = backend.NewBtcdBackend(addr, port, *f.rpcUser, *f.rpcPass, network)
+		if err != nil {
+			return nil, backendError{err}
+		}
+	case "bitcoind":
+		addr, port, err := GetDefaultServer(network, Bitcoind, *f.addr)
+		if err != nil {
+			return nil, usageError{err}
+		}
+		b, err = backend.NewBitcoindBackend(addr, port, *f.rpcUser, *f.rpcPass, network, derivers, *f.birthday)
+		if err != nil {
+			return nil, backendError{err}
+		}
+	case "esplora":
+		b, err = backend.NewEsploraBackend(GetDefaultEsploraURL(network, *f.esploraURL), network, *f.esploraConc)
+		if err != nil {
+			return nil, backendError{err}
 		}
 	case "electrum-recorder":
-		if *findBlockFixtureFile == "" {
-			panic("electrum-recorder backend requires output --fixture-file.")
+		if *f.fixtureFile == "" {
+			return nil, usageErrorf("electrum-recorder backend requires output --fixture-file")
 		}
-		addr, port := GetDefaultServer(network, Electrum, *findBlockAddr)
-		b, err = backend.NewElectrumBackend(addr, port, network)
+		b, err = f.electrum(network, derivers...)
 		if err != nil {
 			return nil, err
 		}
-		b, err = backend.NewRecorderBackend(b, *findBlockFixtureFile)
+		b, err = backend.NewRecorderBackend(b, *f.fixtureFile)
 	case "btcd-recorder":
-		if *findBlockFixtureFile == "" {
-			panic("btcd-recorder backend requires output --fixture-file.")
+		if *f.fixtureFile == "" {
+			return nil, usageErrorf("btcd-recorder backend requires output --fixture-file")
 		}
-		addr, port := GetDefaultServer(network, Btcd, *findBlockAddr)
-		b, err = backend.NewBtcdBackend(addr, port, *findBlockRpcUser, *findBlockRpcPass, network)
+		// err isn't shadowed: the recorder's error is returned below.
+		var addr, port string
+		addr, port, err = GetDefaultServer(network, Btcd, *f.addr)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
+		}
+		b, err = backend.NewBtcdBackend(addr, port, *f.rpcUser, *f.rpcPass, network)
+		if err != nil {
+			return nil, backendError{err}
 		}
-		b, err = backend.NewRecorderBackend(b, *findBlockFixtureFile)
+		b, err = backend.NewRecorderBackend(b, *f.fixtureFile)
 	case "fixture":
-		if *findBlockFixtureFile == "" {
-			panic("fixture backend requires input --fixture-file.")
+		if *f.fixtureFile == "" {
+			return nil, usageErrorf("fixture backend requires input --fixture-file")
 		}
-		b, err = backend.NewFixtureBackend(*findBlockFixtureFile)
+		b, err = backend.NewFixtureBackend(*f.fixtureFile)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
 		}
 	default:
 		return nil, fmt.Errorf("unreachable")
@@ -295,53 +846,123 @@ func findBlockBuildBackend(network Network) (backend.Backend, error) {
 	return b, err
 }
 
-// TODO: return *backend.Backend, error instead?
-func computeBalanceBuildBackend(network Network) (backend.Backend, error) {
-	var b backend.Backend
-	var err error
-	switch *computeBalanceBackend {
-	case "electrum":
-		addr, port := GetDefaultServer(network, Electrum, *computeBalanceAddr)
-		b, err = backend.NewElectrumBackend(addr, port, network)
+// electrum connects to the Electrum servers. In privacy mode, the decoys look like the first
+// wallet's addresses.
+func (f backendFlags) electrum(network Network, derivers ...*deriver.AddressDeriver) (*backend.ElectrumBackend, error) {
+	addr, port, err := GetDefaultServer(network, Electrum, *f.addr)
+	if err != nil {
+		return nil, usageError{err}
+	}
+	tlsPolicy := &electrum.TLSPolicy{Pins: map[string]string{}}
+	if *f.pin != "" {
+		tlsPolicy.Pins[addr] = *f.pin
+	}
+	if *f.tls == "tofu" {
+		// without a file, a server could present a new certificate on every run.
+		if *f.knownFile == "" {
+			return nil, usageErrorf("--electrum-tls tofu requires --known-servers")
+		}
+		knownServers, err := electrum.LoadKnownServers(*f.knownFile)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
 		}
-	case "btcd":
-		addr, port := GetDefaultServer(network, Btcd, *computeBalanceAddr)
-		b, err = backend.NewBtcdBackend(addr, port, *computeBalanceRpcUser, *computeBalanceRpcPass, network)
+		tlsPolicy.KnownServers = knownServers
+	}
+	servers := [][2]string{{addr, port}}
+	for _, server := range *f.servers {
+		host, port, err := GetDefaultServer(network, Electrum, server)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
 		}
-	case "electrum-recorder":
-		if *computeBalanceFixtureFile == "" {
-			panic("electrum-recorder backend requires output --fixture-file.")
+		servers = append(servers, [2]string{host, port})
+	}
+	for _, server := range servers {
+		if strings.HasPrefix(server[1], "t") && !*f.plaintext {
+			return nil, usageErrorf("%s is a plain TCP port, which requires --electrum-plaintext", server[1])
 		}
-		addr, port := GetDefaultServer(network, Electrum, *computeBalanceAddr)
-		b, err = backend.NewElectrumBackend(addr, port, network)
+	}
+	connConfig := &electrum.ConnectionConfig{TLS: tlsPolicy, Plaintext: *f.plaintext}
+	if *f.proxy != "" {
+		proxy, err := electrum.ParseProxy(*f.proxy)
 		if err != nil {
-			return nil, err
+			return nil, usageError{err}
 		}
-		b, err = backend.NewRecorderBackend(b, *computeBalanceFixtureFile)
-	case "btcd-recorder":
-		if *computeBalanceFixtureFile == "" {
-			panic("btcd-recorder backend requires output --fixture-file.")
+		connConfig.Proxy = proxy
+	}
+	b, err := backend.NewElectrumBackend(addr, port, network, connConfig)
+	if err != nil {
+		return nil, backendError{err}
+	}
+	for _, server := range servers[1:] {
+		if err := b.AddServer(server[0], server[1]); err != nil {
+			b.Finish()
+			return nil, backendError{err}
 		}
-		addr, port := GetDefaultServer(network, Btcd, *computeBalanceAddr)
-		b, err = backend.NewBtcdBackend(addr, port, *computeBalanceRpcUser, *computeBalanceRpcPass, network)
-		if err != nil {
-			return nil, err
+	}
+	if *f.headersFile != "" {
+		if err := b.UseHeaderStore(*f.headersFile); err != nil {
+			b.Finish()
+			return nil, usageError{err}
 		}
-		b, err = backend.NewRecorderBackend(b, *computeBalanceFixtureFile)
-	case "fixture":
-		if *computeBalanceFixtureFile == "" {
-			panic("fixture backend requires input --fixture-file.")
+	}
+	if err := b.ValidateTip(); err != nil {
+		b.Finish()
+		return nil, backendError{err}
+	}
+	if err := b.SetQuorum(*f.quorum, backend.QuorumPolicy(*f.policy)); err != nil {
+		b.Finish()
+		return nil, usageError{err}
+	}
+	if err := b.SetRateLimit(*f.rate, *f.burst); err != nil {
+		b.Finish()
+		return nil, usageError{err}
+	}
+	if *f.privacy > 0 {
+		var decoy *deriver.AddressDeriver
+		decoys := *f.decoys
+		if len(derivers) == 0 {
+			// the command doesn't look up addresses
+			decoys = 0
+		} else if decoys > 0 {
+			decoy, err = derivers[0].Decoy()
+			if err != nil {
+				b.Finish()
+				return nil, err
+			}
 		}
-		b, err = backend.NewFixtureBackend(*computeBalanceFixtureFile)
-		if err != nil {
-			return nil, err
+		if err := b.SetPrivacy(*f.privacy, decoys, decoy); err != nil {
+			b.Finish()
+			return nil, usageError{err}
+		}
+	}
+	return b, nil
+}
+
+// printDisagreements lists the transactions the Electrum servers didn't agree on, in quorum mode.
+func (f backendFlags) printDisagreements(b backend.Backend) {
+	r, ok := b.(backend.ServerReporter)
+	if !ok || *f.quorum <= 1 {
+		return
+	}
+	disagreements := r.Disagreements()
+	fmt.Printf("Server disagreements: %d\n", len(disagreements))
+	for _, d := range disagreements {
+		fmt.Printf("  %s\n", d)
+	}
+}
+
+// printExposure lists the fraction of the addresses each Electrum server saw, in privacy mode.
+func (f backendFlags) printExposure(b backend.Backend) {
+	r, ok := b.(backend.ServerReporter)
+	if !ok || *f.privacy <= 0 {
+		return
+	}
+	exposure := r.PrivacyExposure()
+	fmt.Printf("Privacy exposure: %d servers\n", len(exposure))
+	for _, e := range exposure {
+		fmt.Printf("  %s\n", e)
+		if e.Fraction > *f.privacy {
+			fmt.Printf("  warning: %s saw more than %.1f%% of the addresses\n", e.Server, 100**f.privacy)
 		}
-	default:
-		return nil, fmt.Errorf("unreachable")
 	}
-	return b, err
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTpub = "tpubDBrCAXucLxvjC9n9nZGGcYS8pk4X1N97YJmUgdDSwG2p36gbSqeRuytHYCHe2dHxLsV2EchX9ePaFdRwp7cNLrSpnr3PsoPLUQqbvLBDWvh"
+
+// run parses args, feeds stdin to the command and returns what it printed.
+func run(t *testing.T, stdin string, args ...string) (string, error) {
+	dir, err := ioutil.TempDir("", "beancounter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "stdin")
+	assert.NoError(t, ioutil.WriteFile(in, []byte(stdin), 0600))
+	inFile, err := os.Open(in)
+	assert.NoError(t, err)
+	defer inFile.Close()
+	outFile, err := os.Create(filepath.Join(dir, "stdout"))
+	assert.NoError(t, err)
+	defer outFile.Close()
+
+	stdinBefore, stdoutBefore := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inFile, outFile
+	defer func() {
+		os.Stdin, os.Stdout = stdinBefore, stdoutBefore
+	}()
+
+	command, err := app.Parse(args)
+	assert.NoError(t, err)
+	switch command {
+	case computeBalance.FullCommand():
+		err = doComputeBalance(context.Background())
+	case computeBalances.FullCommand():
+		err = doComputeBalances(context.Background())
+	default:
+		t.Fatalf("unexpected command %s", command)
+	}
+
+	out, readErr := ioutil.ReadFile(outFile.Name())
+	assert.NoError(t, readErr)
+	return string(out), err
+}
+
+func TestComputeBalanceFixture(t *testing.T) {
+	// the fixture has neither a chain height nor blocks, so the audit isn't anchored.
+	out, err := run(t, testTpub+"\n", "--debug", "compute-balance", "--type", "multisig",
+		"--backend", "fixture", "--fixture-file", "accounter/testdata/tpub_data.json", "--block-height", "1435169")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Balance: 267893477\n")
+	assert.NotContains(t, out, "Block hash")
+}
+
+func TestComputeBalancesFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wallets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	wallets := filepath.Join(dir, "wallets.json")
+	assert.NoError(t, ioutil.WriteFile(wallets, []byte(`[{"name": "cold", "type": "multisig", "m": 1, "xpubs": ["`+testTpub+`"]}]`), 0600))
+
+	out, err := run(t, "", "compute-balances", wallets,
+		"--backend", "fixture", "--fixture-file", "accounter/testdata/tpub_data.json", "--block-height", "1435169")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Wallet cold: 267893477\n")
+}
+
+func TestAuditHeight(t *testing.T) {
+	height, err := auditHeight(0, 1000, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(994), height)
+
+	_, err = auditHeight(995, 1000, 6)
+	assert.Error(t, err)
+
+	_, err = auditHeight(0, 5, 6)
+	assert.Error(t, err)
+
+	// without a chain height, the height is used as is
+	height, err = auditHeight(1435169, 0, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1435169), height)
+	_, err = auditHeight(0, 0, 6)
+	assert.Error(t, err)
+}
@@ -32,6 +32,7 @@ const (
 	Testnet  Network     = "testnet"
 	Electrum BackendName = "electrum"
 	Btcd     BackendName = "btcd"
+	Bitcoind BackendName = "bitcoind"
 )
 
 // ChainConfig returns a given chaincfg.Params for a given Network
@@ -46,34 +47,41 @@ func (n Network) ChainConfig() *chaincfg.Params {
 	}
 }
 
-// prefixes come from BIP32
+// XpubToNetwork returns the network of an extended public key, from its prefix. The prefixes come
+// from BIP32
 // https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki#serialization-format
-func XpubToNetwork(xpub string) Network {
-	prefix := xpub[0:4]
-	switch prefix {
+func XpubToNetwork(xpub string) (Network, error) {
+	if len(xpub) < 4 {
+		return "", fmt.Errorf("invalid extended public key: %q", xpub)
+	}
+	switch xpub[0:4] {
 	case "xpub":
-		return Mainnet
+		return Mainnet, nil
 	case "tpub":
-		return Testnet
+		return Testnet, nil
 	default:
-		panic(fmt.Sprintf("unknown prefix: %s", xpub))
+		return "", fmt.Errorf("unknown prefix: %s", xpub)
 	}
 }
 
-func AddressToNetwork(addr string) Network {
+// AddressToNetwork returns the network of a base58 address, from its prefix.
+func AddressToNetwork(addr string) (Network, error) {
+	if addr == "" {
+		return "", fmt.Errorf("empty address")
+	}
 	switch addr[0] {
 	case 'm':
-		return Testnet // pubkey hash
+		return Testnet, nil // pubkey hash
 	case 'n':
-		return Testnet // pubkey hash
+		return Testnet, nil // pubkey hash
 	case '2':
-		return Testnet //script hash
+		return Testnet, nil //script hash
 	case '1':
-		return Mainnet // pubkey hash
+		return Mainnet, nil // pubkey hash
 	case '3':
-		return Mainnet // script hash
+		return Mainnet, nil // script hash
 	default:
-		panic(fmt.Sprintf("unknown prefix: %s", addr))
+		return "", fmt.Errorf("unknown prefix: %s", addr)
 	}
 }
 
@@ -104,29 +112,41 @@ func VerifyMandN(m int, n int) error {
 }
 
 // Picks a default server for electrum or localhost for btcd
-// Returns a pair of hostname:port (or pseudo-port for electrum)
-func GetDefaultServer(network Network, backend BackendName, addr string) (string, string) {
+// Returns a pair of hostname:port (or pseudo-port for electrum), or an error if addr isn't a valid
+// host:port.
+func GetDefaultServer(network Network, backend BackendName, addr string) (string, string, error) {
 	if addr != "" {
 		host, port, err := net.SplitHostPort(addr)
-		PanicOnError(err)
-		return host, port
+		if err != nil {
+			return "", "", err
+		}
+		return host, port, nil
 	}
 	switch backend {
 	case Electrum:
 		switch network {
 		case "mainnet":
-			return "electrum.petrkr.net", "s50002"
+			return "electrum.petrkr.net", "s50002", nil
 		case "testnet":
-			return "testnet.hsmiths.com", "s53012"
+			return "testnet.hsmiths.com", "s53012", nil
 		default:
 			panic("unreachable")
 		}
 	case Btcd:
 		switch network {
 		case "mainnet":
-			return "localhost", "8334"
+			return "localhost", "8334", nil
+		case "testnet":
+			return "localhost", "18334", nil
+		default:
+			panic("unreachable")
+		}
+	case Bitcoind:
+		switch network {
+		case "mainnet":
+			return "localhost", "8332", nil
 		case "testnet":
-			return "localhost", "18334"
+			return "localhost", "18332", nil
 		default:
 			panic("unreachable")
 		}
@@ -134,3 +154,18 @@ func GetDefaultServer(network Network, backend BackendName, addr string) (string
 		panic("unreachable")
 	}
 }
+
+// GetDefaultEsploraURL returns url, or Blockstream's public Esplora instance if url is empty.
+func GetDefaultEsploraURL(network Network, url string) string {
+	if url != "" {
+		return url
+	}
+	switch network {
+	case "mainnet":
+		return "https://blockstream.info/api"
+	case "testnet":
+		return "https://blockstream.info/testnet/api"
+	default:
+		panic("unreachable")
+	}
+}
@@ -37,22 +37,37 @@ func TestMax(t *testing.T) {
 }
 
 func TestXpubToNetwork(t *testing.T) {
-	assert.Equal(t, XpubToNetwork("xpub6C774QqLVXvX3WBMACHRVdWTyPphFh45cXFvawg9eFuNAK2DNPsWDf1zJcSyZWY59FNspYUCAUJJXhmVzCPcWzLWDm6yEQSN9982pBAsj1k"), Mainnet)
-
-	assert.Equal(t, XpubToNetwork("tpubDC5s7LsM3QFZz8CKNz8ePa2wpvQiq5LsGXrkoaaGsLhNx44wTr13XqoKEMCFPWMK4yen2DsLN7ArrZuqRqQE24Y9kNN51bpcjNdbWpJngdG"), Testnet)
-
-	assert.Panics(t, func() { XpubToNetwork("foobar") })
+	network, err := XpubToNetwork("xpub6C774QqLVXvX3WBMACHRVdWTyPphFh45cXFvawg9eFuNAK2DNPsWDf1zJcSyZWY59FNspYUCAUJJXhmVzCPcWzLWDm6yEQSN9982pBAsj1k")
+	assert.NoError(t, err)
+	assert.Equal(t, Mainnet, network)
+
+	network, err = XpubToNetwork("tpubDC5s7LsM3QFZz8CKNz8ePa2wpvQiq5LsGXrkoaaGsLhNx44wTr13XqoKEMCFPWMK4yen2DsLN7ArrZuqRqQE24Y9kNN51bpcjNdbWpJngdG")
+	assert.NoError(t, err)
+	assert.Equal(t, Testnet, network)
+
+	_, err = XpubToNetwork("foobar")
+	assert.Error(t, err)
+	_, err = XpubToNetwork("")
+	assert.Error(t, err)
 }
 
 func TestAddressToNetwork(t *testing.T) {
-	assert.Equal(t, AddressToNetwork("19YomTTzGd55JM18pmj6Vv2F7ZqkaQDnRF"), Mainnet)
-	assert.Equal(t, AddressToNetwork("3DmcpZprPpPLFsBsuMeGTik11DyQVsadQK"), Mainnet)
-
-	assert.Equal(t, AddressToNetwork("mm8xEm6YS8B7ErLYYqcdF6URWkS1BWnqtY"), Testnet)
-	assert.Equal(t, AddressToNetwork("2MvmkK3F4vT2h3gLjxz66SwQ5zW5XbsdZLu"), Testnet)
-	assert.Equal(t, AddressToNetwork("n3s7pVRvCEuXfF5fyh74JXmYg45q4Wev86"), Testnet)
-
-	assert.Panics(t, func() { AddressToNetwork("foobar") })
+	for addr, expected := range map[string]Network{
+		"19YomTTzGd55JM18pmj6Vv2F7ZqkaQDnRF":  Mainnet,
+		"3DmcpZprPpPLFsBsuMeGTik11DyQVsadQK":  Mainnet,
+		"mm8xEm6YS8B7ErLYYqcdF6URWkS1BWnqtY":  Testnet,
+		"2MvmkK3F4vT2h3gLjxz66SwQ5zW5XbsdZLu": Testnet,
+		"n3s7pVRvCEuXfF5fyh74JXmYg45q4Wev86":  Testnet,
+	} {
+		network, err := AddressToNetwork(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, network, addr)
+	}
+
+	for _, addr := range []string{"foobar", "", "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"} {
+		_, err := AddressToNetwork(addr)
+		assert.Error(t, err, addr)
+	}
 }
 
 func TestChainConfig(t *testing.T) {
@@ -78,27 +93,40 @@ func TestVerifyMandN(t *testing.T) {
 }
 
 func TestGetDefaultServer(t *testing.T) {
-	host, port := GetDefaultServer(Testnet, Electrum, "foobar:s1234")
+	host, port, err := GetDefaultServer(Testnet, Electrum, "foobar:s1234")
+	assert.NoError(t, err)
 	assert.Equal(t, "foobar", host)
 	assert.Equal(t, "s1234", port)
 
-	host, port = GetDefaultServer(Testnet, Electrum, "192.0.2.5:s1234")
+	host, port, _ = GetDefaultServer(Testnet, Electrum, "192.0.2.5:s1234")
 	assert.Equal(t, "192.0.2.5", host)
 	assert.Equal(t, "s1234", port)
 
-	host, port = GetDefaultServer(Testnet, Electrum, "[2001:db8::1]:s1234")
+	host, port, _ = GetDefaultServer(Testnet, Electrum, "[2001:db8::1]:s1234")
 	assert.Equal(t, "2001:db8::1", host)
 	assert.Equal(t, "s1234", port)
 
-	host, port = GetDefaultServer(Testnet, Btcd, "foobar:1234")
+	host, port, _ = GetDefaultServer(Testnet, Btcd, "foobar:1234")
 	assert.Equal(t, "foobar", host)
 	assert.Equal(t, "1234", port)
 
-	host, port = GetDefaultServer(Testnet, Electrum, "")
+	host, port, _ = GetDefaultServer(Testnet, Electrum, "")
 	assert.NotEqual(t, "localhost", host)
 	assert.Equal(t, "s53012", port)
 
-	host, port = GetDefaultServer(Testnet, Btcd, "")
+	host, port, _ = GetDefaultServer(Testnet, Btcd, "")
 	assert.Equal(t, "localhost", host)
 	assert.Equal(t, "18334", port)
+
+	host, port, _ = GetDefaultServer(Mainnet, Bitcoind, "")
+	assert.Equal(t, "localhost", host)
+	assert.Equal(t, "8332", port)
+
+	_, _, err = GetDefaultServer(Testnet, Electrum, "foobar")
+	assert.Error(t, err)
+}
+
+func TestGetDefaultEsploraURL(t *testing.T) {
+	assert.Equal(t, "https://blockstream.info/testnet/api", GetDefaultEsploraURL(Testnet, ""))
+	assert.Equal(t, "http://localhost:3000/api", GetDefaultEsploraURL(Mainnet, "http://localhost:3000/api"))
 }